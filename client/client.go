@@ -6,9 +6,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/stripe/veneur/ssf"
-	"github.com/stripe/veneur/trace"
-
 	"github.com/richo/roving/types"
 )
 
@@ -62,8 +59,17 @@ func RunFuzzerForever(fuzzer *Fuzzer, serverClient *RovingServerClient, syncInte
 // the individual fuzzers, as well as the fleet's monitoring and synchronization
 // machinery.
 func SetupAndRun(conf types.ClientConfig, workdir string, isNewRun bool) {
-	trace.Service = "roving-client"
-	ssf.NamePrefix = "roving-client."
+	metricsSink, err := types.NewMetricsSink(conf.Metrics, "roving-client")
+	if err != nil {
+		log.Fatal(err)
+	}
+	types.SetMetricsSink(metricsSink)
+
+	errorReporter, err := types.NewErrorReporter(conf.Errors, "roving-client")
+	if err != nil {
+		log.Fatal(err)
+	}
+	types.SetErrorReporter(errorReporter)
 
 	parallelism := conf.Parallelism
 
@@ -126,10 +132,20 @@ func SetupAndRun(conf types.ClientConfig, workdir string, isNewRun bool) {
 	log.Printf("TargetCommand:\t%s", targetCommand)
 	log.Printf("Parallelism:\t%d (num cores: %d)", parallelism, runtime.NumCPU())
 
+	// Build the fuzzers up front, so that the QueueDownloader knows
+	// which outputs are ours and not copies of the server's queues.
+	fuzzers := make([]Fuzzer, parallelism)
+	localFuzzerIds := make(map[string]bool)
+	for i := range fuzzers {
+		fuzzers[i] = newAFLFuzzer(targetCommand, workdir, dictPath, fuzzerConfig.TimeoutMs, fuzzerConfig.MemLimitMb)
+		localFuzzerIds[fuzzers[i].Id] = true
+	}
+
 	queueDownloader := QueueDownloader{
-		Interval:    fuzzerConfig.SyncInterval,
-		Server:      serverClient,
-		fileManager: &fleetFileManager,
+		Interval:       fuzzerConfig.SyncInterval,
+		Server:         serverClient,
+		LocalFuzzerIds: localFuzzerIds,
+		fileManager:    &fleetFileManager,
 	}
 
 	// Download the queue immediately and syncronously before starting any
@@ -141,10 +157,10 @@ func SetupAndRun(conf types.ClientConfig, workdir string, isNewRun bool) {
 	for i := 0; i < parallelism; i++ {
 		wg.Add(1)
 		go func(fuzzerN int) {
-			fuzzer := newAFLFuzzer(targetCommand, workdir, dictPath, fuzzerConfig.TimeoutMs, fuzzerConfig.MemLimitMb)
+			fuzzer := &fuzzers[fuzzerN]
 			log.Printf("Initialized fuzzer n=%v id=%v", fuzzerN, fuzzer.Id)
 
-			RunFuzzerForever(&fuzzer, serverClient, fuzzerConfig.SyncInterval)
+			RunFuzzerForever(fuzzer, serverClient, fuzzerConfig.SyncInterval)
 			wg.Done()
 		}(i)
 	}
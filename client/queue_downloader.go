@@ -11,12 +11,31 @@ import (
 // the roving cluster from the server. It writes them to disk using the
 // FleetFileManager. Because all clients on a client machine share the same
 // FleetFileManager, we only need to run 1 QueueDownloader per client machin.
+//
+// It also removes the queues of fuzzers that the server used to send
+// but has stopped sending for staleQueueSyncs syncs in a row, so that
+// clients don't keep the queues of retired fuzzers forever. Output
+// dirs that the server has never sent are left alone, since other
+// clients on the machine may share the workdir, and their fuzzers
+// aren't served until their first upload reaches the server.
+// LocalFuzzerIds are the fuzzers running in this process, whose
+// outputs are never removed.
 type QueueDownloader struct {
-	Interval    time.Duration
-	Server      *RovingServerClient
-	fileManager *types.FleetFileManager
+	Interval       time.Duration
+	Server         *RovingServerClient
+	LocalFuzzerIds map[string]bool
+	fileManager    *types.FleetFileManager
+
+	// The fuzzers whose queues the server has sent, and how many
+	// syncs in a row each of them has been missing for
+	served      map[string]bool
+	missedSyncs map[string]int
 }
 
+// The number of syncs in a row that the server has to stop sending a
+// fuzzer's queue for before the QueueDownloader removes it.
+var staleQueueSyncs int = 3
+
 // run runs the QueueDownloader periodically forever. It should never return.
 func (q *QueueDownloader) run() {
 	ticker := time.NewTicker(q.Interval)
@@ -42,6 +61,7 @@ func (q *QueueDownloader) downloadQueues() {
 		// Fail without panicking so that we can retry in the
 		// next QueueDownloader cycle.
 		log.Printf("Error downloading queue err=%v", err)
+		types.ReportError(err, metricTags)
 
 		types.SubmitMetricCount("queue_downloader.download_queue.fail", 1, metricTags)
 		return
@@ -53,10 +73,57 @@ func (q *QueueDownloader) downloadQueues() {
 		// Fail without panicking so that we can retry in the
 		// next QueueDownloader cycle.
 		log.Printf("Error writing queue to disk err=%v", err)
+		types.ReportError(err, metricTags)
 
 		types.SubmitMetricCount("queue_downloader.download_queue.fail", 1, metricTags)
 		return
 	}
 
 	types.SubmitMetricCount("queue_downloader.download_queue.success", 1, metricTags)
+
+	if err = q.removeStaleQueues(queues); err != nil {
+		// Stale queues only waste disk, so we can try again in the
+		// next QueueDownloader cycle.
+		log.Printf("Error removing stale queues err=%v", err)
+		types.ReportError(err, metricTags)
+	}
+}
+
+// removeStaleQueues removes the outputs of fuzzers that the server
+// sent before, but that have been missing from `queues` for
+// staleQueueSyncs syncs in a row, and that aren't running in this
+// process.
+func (q *QueueDownloader) removeStaleQueues(queues *map[string]*types.InputCorpus) error {
+	if q.served == nil {
+		q.served = make(map[string]bool)
+		q.missedSyncs = make(map[string]int)
+	}
+	for fuzzerId := range *queues {
+		q.served[fuzzerId] = true
+		delete(q.missedSyncs, fuzzerId)
+	}
+
+	fuzzerIds, err := q.fileManager.FuzzerIds()
+	if err != nil {
+		return err
+	}
+
+	for _, fuzzerId := range fuzzerIds {
+		if _, served := (*queues)[fuzzerId]; served || !q.served[fuzzerId] || q.LocalFuzzerIds[fuzzerId] || fuzzerId == types.RetiredCorpusId {
+			continue
+		}
+		q.missedSyncs[fuzzerId]++
+		if q.missedSyncs[fuzzerId] < staleQueueSyncs {
+			continue
+		}
+
+		log.Printf("Removing stale queue fuzzer_id=%s", fuzzerId)
+		if err = q.fileManager.RemoveOutput(fuzzerId); err != nil {
+			return err
+		}
+		delete(q.served, fuzzerId)
+		delete(q.missedSyncs, fuzzerId)
+		types.SubmitMetricCount("queue_downloader.remove_stale_queue", 1, map[string]string{"fuzzer_id": fuzzerId})
+	}
+	return nil
 }
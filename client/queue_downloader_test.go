@@ -0,0 +1,46 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestRemoveStaleQueues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roving-queue-downloader-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fm := types.FleetFileManager{Basedir: dir}
+	for _, fuzzerId := range []string{"local-1", "other-client-2", "served-3"} {
+		if err = fm.MkAllOutputDirs(fuzzerId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := QueueDownloader{
+		LocalFuzzerIds: map[string]bool{"local-1": true},
+		fileManager:    &fm,
+	}
+
+	served := map[string]*types.InputCorpus{"served-3": &types.InputCorpus{}}
+	assert.Nil(t, q.removeStaleQueues(&served))
+
+	// A queue that the server stops sending is only removed once it
+	// has been missing for staleQueueSyncs syncs, and another client's
+	// fuzzer that the server has never sent is never removed
+	none := map[string]*types.InputCorpus{}
+	for i := 0; i < staleQueueSyncs; i++ {
+		fuzzerIds, err := fm.FuzzerIds()
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"local-1", "other-client-2", "served-3"}, fuzzerIds)
+		assert.Nil(t, q.removeStaleQueues(&none))
+	}
+	fuzzerIds, err := fm.FuzzerIds()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"local-1", "other-client-2"}, fuzzerIds)
+}
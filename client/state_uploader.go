@@ -58,6 +58,7 @@ func (s *StateUploader) uploadState() {
 		// Fail without panicking so that we can retry in the
 		// next StateUploader cycle.
 		log.Printf("Error reading state! %s", err)
+		types.ReportError(err, s.metricTags())
 		types.SubmitMetricCount("state_uploader.upload_state.fail", 1, s.metricTags())
 		return
 	}
@@ -65,6 +66,7 @@ func (s *StateUploader) uploadState() {
 	err = s.Server.UploadState(state)
 	if err != nil {
 		log.Printf("Error uploading state! %s", err)
+		types.ReportError(err, s.metricTags())
 		types.SubmitMetricCount("state_uploader.upload_state.fail", 1, s.metricTags())
 		return
 	}
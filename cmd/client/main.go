@@ -42,6 +42,42 @@ func main() {
 		"server-address",
 		"",
 		"The host:port address of the roving server")
+
+	flag.StringVar(
+		&conf.Metrics.Sink,
+		"metrics-sink",
+		"veneur",
+		"Where metrics should be sent: veneur, statsd, log or none")
+
+	flag.StringVar(
+		&conf.Metrics.StatsdAddr,
+		"statsd-addr",
+		"",
+		"The host:port address of the statsd server, if metrics are sent to statsd")
+
+	flag.BoolVar(
+		&conf.Metrics.StatsdTags,
+		"statsd-tags",
+		false,
+		"Whether metrics sent to statsd should include DogStatsD-style tags")
+
+	flag.StringVar(
+		&conf.Errors.Reporter,
+		"error-reporter",
+		"sentry",
+		"Where errors should be reported: sentry, log or none")
+
+	flag.StringVar(
+		&conf.Errors.SentryDSN,
+		"sentry-dsn",
+		"",
+		"The Sentry DSN to report errors to. Defaults to $SENTRY_DSN")
+
+	flag.StringVar(
+		&conf.Errors.Campaign,
+		"campaign",
+		"",
+		"The name of this fuzzing campaign, which reported errors are tagged with")
 	flag.Parse()
 
 	conf.ServerAddress = serverArg
@@ -169,14 +169,18 @@ func runServer(workdir string) {
 	}
 	fileManager.WriteTopLevelInput(&input)
 
-	server.SetupAndServe(
-		port,
-		target,
-		fuzzerConfig,
-		archiveConfig,
-		metricsReportInterval,
-		workdir,
-	)
+	conf := types.ServerConfig{
+		Port:                  port,
+		Workdir:               workdir,
+		DatabasePath:          filepath.Join(workdir, "roving.db"),
+		MetricsReportInterval: metricsReportInterval,
+		Fuzzer:                fuzzerConfig,
+		Archive:               archiveConfig,
+	}
+	if err := conf.ValidateConfig(); err != nil {
+		log.Fatal(err)
+	}
+	server.SetupAndServe(conf, target)
 }
 
 func runClient(workdir string, parallelism int) {
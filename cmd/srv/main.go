@@ -4,6 +4,8 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/richo/roving/server"
@@ -25,6 +27,13 @@ func main() {
 		"",
 		"The afl workdir the roving server should store inputs and outputs in")
 
+	var databasePathArg string
+	flag.StringVar(
+		&databasePathArg,
+		"database-path",
+		"",
+		"The path of the server's database. Defaults to roving.db in the workdir")
+
 	var metricsReportIntervalArg time.Duration
 	flag.DurationVar(
 		&metricsReportIntervalArg,
@@ -32,6 +41,111 @@ func main() {
 		0,
 		"The interval at which metrics should be reported to the external metrics service")
 
+	var metricsSinkArg string
+	flag.StringVar(
+		&metricsSinkArg,
+		"metrics-sink",
+		"veneur",
+		"Where metrics should be sent: veneur, statsd, log or none")
+
+	var statsdAddrArg string
+	flag.StringVar(
+		&statsdAddrArg,
+		"statsd-addr",
+		"",
+		"The host:port address of the statsd server, if metrics are sent to statsd")
+
+	var statsdTagsArg bool
+	flag.BoolVar(
+		&statsdTagsArg,
+		"statsd-tags",
+		false,
+		"Whether metrics sent to statsd should include DogStatsD-style tags")
+
+	var errorReporterArg string
+	flag.StringVar(
+		&errorReporterArg,
+		"error-reporter",
+		"sentry",
+		"Where errors should be reported: sentry, log or none")
+
+	var sentryDSNArg string
+	flag.StringVar(
+		&sentryDSNArg,
+		"sentry-dsn",
+		"",
+		"The Sentry DSN to report errors to. Defaults to $SENTRY_DSN")
+
+	var campaignArg string
+	flag.StringVar(
+		&campaignArg,
+		"campaign",
+		"",
+		"The name of this fuzzing campaign, which reported errors are tagged with")
+
+	var webhookURLsArg string
+	flag.StringVar(
+		&webhookURLsArg,
+		"webhook-urls",
+		"",
+		"A comma-separated list of URLs that events such as new crashes should be POSTed to")
+
+	var webhookEventsArg string
+	flag.StringVar(
+		&webhookEventsArg,
+		"webhook-events",
+		"",
+		"A comma-separated list of the events to send to webhooks. Defaults to all of them")
+
+	var webhookMaxAttemptsArg int
+	flag.IntVar(
+		&webhookMaxAttemptsArg,
+		"webhook-max-attempts",
+		5,
+		"The number of times to try to deliver an event to a webhook before giving up")
+
+	var webhookRetryIntervalArg time.Duration
+	flag.DurationVar(
+		&webhookRetryIntervalArg,
+		"webhook-retry-interval",
+		10*time.Second,
+		"How long to wait before retrying a failed webhook. Doubles after each failure")
+
+	var nodeStaleAfterArg time.Duration
+	flag.DurationVar(
+		&nodeStaleAfterArg,
+		"node-stale-after",
+		15*time.Minute,
+		"How long a fuzzer can go without sending its state before it is considered stale")
+
+	var nodeLostAfterArg time.Duration
+	flag.DurationVar(
+		&nodeLostAfterArg,
+		"node-lost-after",
+		1*time.Hour,
+		"How long a fuzzer can go without sending its state before it is considered lost")
+
+	var nodeRetireAfterArg time.Duration
+	flag.DurationVar(
+		&nodeRetireAfterArg,
+		"node-retire-after",
+		24*time.Hour,
+		"How long a fuzzer can go without sending its state before it is retired and its stats are forgotten")
+
+	var nodeQueueRetentionArg time.Duration
+	flag.DurationVar(
+		&nodeQueueRetentionArg,
+		"node-queue-retention",
+		7*24*time.Hour,
+		"How long the queue of a retired fuzzer is kept before it is folded into the retired corpus and its output is archived and removed")
+
+	var nodeCheckIntervalArg time.Duration
+	flag.DurationVar(
+		&nodeCheckIntervalArg,
+		"node-check-interval",
+		1*time.Minute,
+		"The interval at which the server updates the states of fuzzers")
+
 	var fuzzerSyncIntervalArg time.Duration
 	flag.DurationVar(
 		&fuzzerSyncIntervalArg,
@@ -60,6 +174,13 @@ func main() {
 		"",
 		"The type of work archival to run")
 
+	var archiveModeArg string
+	flag.StringVar(
+		&archiveModeArg,
+		"archive-mode",
+		types.ArchiveModeSnapshot,
+		"How to archive work: snapshot (store each unique file once), copy (copy everything every time) or tarball (store everything as one gzipped tarball every time)")
+
 	var archiveIntervalArg time.Duration
 	flag.DurationVar(
 		&archiveIntervalArg,
@@ -67,6 +188,83 @@ func main() {
 		0,
 		"The interval at which to archive work")
 
+	var archiveKeepLastArg int
+	flag.IntVar(
+		&archiveKeepLastArg,
+		"archive-keep-last",
+		0,
+		"The number of most recent archives to keep. If this and every other -archive-keep flag are 0 then archives are never pruned")
+
+	var archiveKeepHourlyArg int
+	flag.IntVar(
+		&archiveKeepHourlyArg,
+		"archive-keep-hourly",
+		0,
+		"The number of hours to keep the most recent archive of")
+
+	var archiveKeepDailyArg int
+	flag.IntVar(
+		&archiveKeepDailyArg,
+		"archive-keep-daily",
+		0,
+		"The number of days to keep the most recent archive of")
+
+	var archiveKeepWeeklyArg int
+	flag.IntVar(
+		&archiveKeepWeeklyArg,
+		"archive-keep-weekly",
+		0,
+		"The number of weeks to keep the most recent archive of")
+
+	var archivePruneDryRunArg bool
+	flag.BoolVar(
+		&archivePruneDryRunArg,
+		"archive-prune-dry-run",
+		false,
+		"Only report the archives that would be pruned, without pruning them")
+
+	var archiveRestoreArg string
+	flag.StringVar(
+		&archiveRestoreArg,
+		"archive-restore",
+		"",
+		"Restore the workdir from a snapshot before serving: latest, or the timestamp of a snapshot")
+
+	var archiveRestoreForceArg bool
+	flag.BoolVar(
+		&archiveRestoreForceArg,
+		"archive-restore-force",
+		false,
+		"Restore even if the workdir or database already has files in it, overwriting any that differ from the snapshot")
+
+	var archiveTmpDirArg string
+	flag.StringVar(
+		&archiveTmpDirArg,
+		"archive-tmp-dir",
+		"",
+		"Dir to build tarballs and other temporary files in while archiving (default: the system's temp dir)")
+
+	var archiveVerifyArg string
+	flag.StringVar(
+		&archiveVerifyArg,
+		"archive-verify",
+		"",
+		"Instead of serving, check archives against their manifests and exit: latest, all, or the timestamp of an archive")
+
+	var archiveEncryptionKeyFileArg string
+	flag.StringVar(
+		&archiveEncryptionKeyFileArg,
+		"archive-encryption-key-file",
+		"",
+		"A file holding the key to encrypt archived files with, as 64 hex chars. The key can instead be given in $ROVING_ARCHIVE_ENCRYPTION_KEY")
+
+	var archiveEncryptionAllowPlaintextArg bool
+	flag.BoolVar(
+		&archiveEncryptionAllowPlaintextArg,
+		"archive-encryption-allow-plaintext",
+		false,
+		"Read archived files that aren't encrypted, such as those archived before encryption was turned on")
+
 	var archiveDiskRootArg string
 	flag.StringVar(
 		&archiveDiskRootArg,
@@ -95,6 +293,61 @@ func main() {
 		"",
 		"The S3 AWS region to archive to")
 
+	var archiveS3EndpointArg string
+	flag.StringVar(
+		&archiveS3EndpointArg,
+		"archive-s3-endpoint",
+		"",
+		"The URL of an S3-compatible store, such as MinIO or Ceph, to archive to instead of AWS")
+
+	var archiveS3PathStyleArg bool
+	flag.BoolVar(
+		&archiveS3PathStyleArg,
+		"archive-s3-path-style",
+		false,
+		"Whether to address S3 buckets as ENDPOINT/BUCKET rather than BUCKET.ENDPOINT, which most S3-compatible stores need")
+
+	var archiveS3AccessKeyIdArg string
+	flag.StringVar(
+		&archiveS3AccessKeyIdArg,
+		"archive-s3-access-key-id",
+		"",
+		"The access key ID to archive to S3 with. Defaults to the AWS SDK's usual credentials")
+
+	var archiveS3SecretAccessKeyArg string
+	flag.StringVar(
+		&archiveS3SecretAccessKeyArg,
+		"archive-s3-secret-access-key",
+		"",
+		"The secret access key to archive to S3 with. Defaults to $ROVING_S3_SECRET_ACCESS_KEY")
+
+	var archiveS3ProfileArg string
+	flag.StringVar(
+		&archiveS3ProfileArg,
+		"archive-s3-profile",
+		"",
+		"The profile in the shared AWS credentials file to archive to S3 with")
+
+	var archiveS3SSEArg string
+	flag.StringVar(
+		&archiveS3SSEArg,
+		"archive-s3-sse",
+		"",
+		"The server-side encryption that S3 should apply to archived files: AES256 or aws:kms. Defaults to none")
+
+	var archiveS3SSEKMSKeyIdArg string
+	flag.StringVar(
+		&archiveS3SSEKMSKeyIdArg,
+		"archive-s3-sse-kms-key-id",
+		"",
+		"The KMS key that S3 should encrypt archived files with, if -archive-s3-sse is aws:kms. Defaults to the account's default key")
+
+	var archiveDestinationArgs stringsFlag
+	flag.Var(
+		&archiveDestinationArgs,
+		"archive-destination",
+		"Another destination to archive to, as comma-separated key=value settings, such as name=local,type=disk,disk-root=/mnt/roving,interval=10m,keep-last=24. Can be given more than once")
+
 	var binaryPathArg string
 	flag.StringVar(
 		&binaryPathArg,
@@ -109,6 +362,34 @@ func main() {
 		false,
 		"Whether an AFL dictionary should be used. Name it dict.txt and place it alongside the input/ and output/ folders.")
 
+	var confirmHangsArg bool
+	flag.BoolVar(
+		&confirmHangsArg,
+		"confirm-hangs",
+		false,
+		"Whether the server should re-run hangs with an extended timeout to confirm them")
+
+	var hangConfirmIntervalArg time.Duration
+	flag.DurationVar(
+		&hangConfirmIntervalArg,
+		"hang-confirm-interval",
+		60*time.Second,
+		"The interval at which the server should look for new hangs to confirm")
+
+	var hangConfirmRunsArg int
+	flag.IntVar(
+		&hangConfirmRunsArg,
+		"hang-confirm-runs",
+		3,
+		"The number of times each hang should be re-run")
+
+	var hangConfirmTimeoutMultiplierArg int
+	flag.IntVar(
+		&hangConfirmTimeoutMultiplierArg,
+		"hang-confirm-timeout-multiplier",
+		10,
+		"How many times longer than the AFL timeout a hang should be given when it is re-run")
+
 	flag.Parse()
 
 	command := flag.Args()
@@ -124,28 +405,111 @@ func main() {
 		TimeoutMs:    timeoutMsArg,
 	}
 
+	// Secrets on the command line are visible to everyone on the
+	// machine, so allow the secret access key to come from the
+	// environment instead.
+	if archiveS3SecretAccessKeyArg == "" {
+		archiveS3SecretAccessKeyArg = os.Getenv("ROVING_S3_SECRET_ACCESS_KEY")
+	}
 	archiveS3Conf := types.S3ArchiveConfig{
-		RootKey:    archiveS3RootKeyArg,
-		BucketName: archiveS3BucketArg,
-		AwsRegion:  archiveS3AWSRegionArg,
+		RootKey:         archiveS3RootKeyArg,
+		BucketName:      archiveS3BucketArg,
+		AwsRegion:       archiveS3AWSRegionArg,
+		Endpoint:        archiveS3EndpointArg,
+		PathStyle:       archiveS3PathStyleArg,
+		AccessKeyId:     archiveS3AccessKeyIdArg,
+		SecretAccessKey: archiveS3SecretAccessKeyArg,
+		Profile:         archiveS3ProfileArg,
+		SSE:             archiveS3SSEArg,
+		SSEKMSKeyId:     archiveS3SSEKMSKeyIdArg,
+	}
+	var archiveDestinations []types.ArchiveDestinationConfig
+	for _, spec := range archiveDestinationArgs {
+		dst, err := types.ParseArchiveDestination(spec, archiveS3Conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		archiveDestinations = append(archiveDestinations, dst)
 	}
 	archiveDiskConf := types.DiskArchiveConfig{
 		DstRoot: archiveDiskRootArg,
 	}
+	archiveRetentionConf := types.ArchiveRetentionConfig{
+		KeepLast:   archiveKeepLastArg,
+		KeepHourly: archiveKeepHourlyArg,
+		KeepDaily:  archiveKeepDailyArg,
+		KeepWeekly: archiveKeepWeeklyArg,
+		DryRun:     archivePruneDryRunArg,
+	}
+	// Like the S3 secret access key, the encryption key shouldn't be
+	// visible in the process list, so it comes from a file or the
+	// environment rather than a flag.
+	archiveEncryptionConf := types.ArchiveEncryptionConfig{
+		KeyFile:        archiveEncryptionKeyFileArg,
+		Key:            os.Getenv("ROVING_ARCHIVE_ENCRYPTION_KEY"),
+		AllowPlaintext: archiveEncryptionAllowPlaintextArg,
+	}
 	archiveConf := types.ArchiveConfig{
-		Type:     archiveTypeArg,
-		Interval: archiveIntervalArg,
-		Disk:     archiveDiskConf,
-		S3:       archiveS3Conf,
+		Type:         archiveTypeArg,
+		Mode:         archiveModeArg,
+		Interval:     archiveIntervalArg,
+		Retention:    archiveRetentionConf,
+		Restore:      archiveRestoreArg,
+		RestoreForce: archiveRestoreForceArg,
+		Disk:         archiveDiskConf,
+		S3:           archiveS3Conf,
+		Destinations: archiveDestinations,
+		Encryption:   archiveEncryptionConf,
+		TmpDir:       archiveTmpDirArg,
+	}
+
+	hangConfirmConf := types.HangConfirmConfig{
+		Enabled:           confirmHangsArg,
+		Interval:          hangConfirmIntervalArg,
+		Runs:              hangConfirmRunsArg,
+		TimeoutMultiplier: hangConfirmTimeoutMultiplierArg,
+	}
+
+	metricsConf := types.MetricsConfig{
+		Sink:       metricsSinkArg,
+		StatsdAddr: statsdAddrArg,
+		StatsdTags: statsdTagsArg,
+	}
+
+	errorsConf := types.ErrorsConfig{
+		Reporter:  errorReporterArg,
+		SentryDSN: sentryDSNArg,
+		Campaign:  campaignArg,
+	}
+
+	webhookConf := types.WebhookConfig{
+		URLs:          splitList(webhookURLsArg),
+		Events:        splitList(webhookEventsArg),
+		MaxAttempts:   webhookMaxAttemptsArg,
+		RetryInterval: webhookRetryIntervalArg,
+	}
+
+	nodesConf := types.NodesConfig{
+		StaleAfter:     nodeStaleAfterArg,
+		LostAfter:      nodeLostAfterArg,
+		RetireAfter:    nodeRetireAfterArg,
+		QueueRetention: nodeQueueRetentionArg,
+		CheckInterval:  nodeCheckIntervalArg,
 	}
 
 	conf := types.ServerConfig{
 		Port:                  portArg,
 		Workdir:               workdirArg,
 		BinaryPath:            binaryPathArg,
+		DatabasePath:          databasePathArg,
 		MetricsReportInterval: metricsReportIntervalArg,
 		Fuzzer:                fuzzerConf,
 		Archive:               archiveConf,
+		HangConfirm:           hangConfirmConf,
+		Metrics:               metricsConf,
+		Errors:                errorsConf,
+		Webhooks:              webhookConf,
+		Nodes:                 nodesConf,
 	}
 
 	err := conf.ValidateConfig()
@@ -171,9 +535,21 @@ func main() {
 	log.Printf("Target command:\t%s", fuzzerConfig.Command)
 	log.Printf("Sync interval:\t%ds", fuzzerConfig.SyncInterval/time.Second)
 	log.Printf("Workdir:\t%s", conf.Workdir)
+	log.Printf("Database:\t%s", conf.DatabasePath)
 	log.Printf("Dictionary:\t%t", fuzzerConfig.UseDict)
 
 	log.Printf("Archive type:\t%s", archiveConfig.Type)
+	log.Printf("Archive mode:\t%s", archiveConfig.Mode)
+	if archiveConfig.Retention.Enabled() {
+		r := archiveConfig.Retention
+		log.Printf("Archive keep last/hourly/daily/weekly:\t%d/%d/%d/%d (dry run: %t)", r.KeepLast, r.KeepHourly, r.KeepDaily, r.KeepWeekly, r.DryRun)
+	}
+	if archiveConfig.TmpDir != "" {
+		log.Printf("Archive tmp dir:\t%s", archiveConfig.TmpDir)
+	}
+	if archiveConfig.Restore != "" {
+		log.Printf("Restore snapshot:\t%s (force: %t)", archiveConfig.Restore, archiveConfig.RestoreForce)
+	}
 	switch archiveConfig.Type {
 	case "disk":
 		log.Printf("Archive Interval:\t%s", archiveConfig.Interval)
@@ -184,17 +560,67 @@ func main() {
 		log.Printf("Archive Bucket:\t%s", archiveConfig.S3.BucketName)
 		log.Printf("Archive Root Key:\t%s", archiveConfig.S3.RootKey)
 		log.Printf("Archive Is Local?:\t%t", archiveConfig.S3.IsLocal)
+		if archiveConfig.S3.Endpoint != "" {
+			log.Printf("Archive Endpoint:\t%s (path style: %t)", archiveConfig.S3.Endpoint, archiveConfig.S3.PathStyle)
+		}
+		if archiveConfig.S3.SSE != "" {
+			log.Printf("Archive SSE:\t%s", archiveConfig.S3.SSE)
+		}
 	default:
-		log.Printf("Output archiving disabled")
+		if len(archiveConfig.Destinations) == 0 {
+			log.Printf("Output archiving disabled")
+		}
+	}
+	for _, dst := range archiveConfig.Destinations {
+		log.Printf("Archive Destination:\t%s (%s) every %s", dst.Name, dst.Type, dst.Interval)
+	}
+	log.Printf("Archive Encrypted?:\t%t (allow plaintext: %t)", archiveConfig.Encryption.Enabled(), archiveConfig.Encryption.AllowPlaintext)
+
+	log.Printf("Metrics sink:\t%s", conf.Metrics.Sink)
+	log.Printf("Error reporter:\t%s", conf.Errors.Reporter)
+	log.Printf("Webhooks:\t%d", len(conf.Webhooks.URLs))
+	log.Printf("Nodes stale/lost/retired after:\t%s/%s/%s", conf.Nodes.StaleAfter, conf.Nodes.LostAfter, conf.Nodes.RetireAfter)
+	log.Printf("Retired queues kept for:\t%s", conf.Nodes.QueueRetention)
+	if conf.Errors.Campaign != "" {
+		log.Printf("Campaign:\t%s", conf.Errors.Campaign)
+	}
+	log.Printf("Confirm hangs?:\t%t", conf.HangConfirm.Enabled)
+	if conf.HangConfirm.Enabled {
+		log.Printf("Hang Confirm Runs:\t%d", conf.HangConfirm.Runs)
+		log.Printf("Hang Confirm Timeout Multiplier:\t%d", conf.HangConfirm.TimeoutMultiplier)
 	}
 	log.Printf("--------")
 
-	server.SetupAndServe(
-		conf.Port,
-		targetBinary,
-		fuzzerConfig,
-		archiveConfig,
-		conf.MetricsReportInterval,
-		conf.Workdir,
-	)
+	if archiveVerifyArg != "" {
+		if err = server.VerifyArchives(conf.Archive, archiveVerifyArg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	server.SetupAndServe(conf, targetBinary)
+}
+
+// splitList splits a comma-separated flag into its elements, ignoring
+// empty ones.
+func splitList(s string) []string {
+	var elems []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// stringsFlag is a flag that can be given more than once, and
+// collects every value it is given.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
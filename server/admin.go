@@ -5,11 +5,16 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	raven "github.com/getsentry/raven-go"
 	"goji.io/pat"
+
+	"github.com/richo/roving/types"
 )
 
 // admin.go contains the routes and logic for the roving
@@ -17,15 +22,27 @@ import (
 // server.go.
 
 var archiveTemplate *template.Template
-var indexTemplate *template.Template
+var crashesTemplate *template.Template
+var dashboardTemplate *template.Template
+var diffTemplate *template.Template
+var eventsTemplate *template.Template
+var fuzzersTemplate *template.Template
+var historyTemplate *template.Template
 var inputTemplate *template.Template
 var outputTemplate *template.Template
+var snapshotsTemplate *template.Template
 
 func init() {
 	archiveTemplate = parseTemplate("archive")
-	indexTemplate = parseTemplate("index")
+	crashesTemplate = parseTemplate("crashes")
+	dashboardTemplate = parseTemplate("dashboard")
+	diffTemplate = parseTemplate("diff")
+	eventsTemplate = parseTemplate("events")
+	fuzzersTemplate = parseTemplate("fuzzers")
+	historyTemplate = parseTemplate("history")
 	inputTemplate = parseTemplate("input")
 	outputTemplate = parseTemplate("output")
+	snapshotsTemplate = parseTemplate("snapshots")
 }
 
 func buildTemplatePath(name string) string {
@@ -75,95 +92,576 @@ func parseTemplate(name string) *template.Template {
 		"joinStringArray": func(strs []string, delimiter string) string {
 			return strings.Join(strs, delimiter)
 		},
+		"fmtTime": func(t time.Time) string {
+			return t.Format(time.RFC3339)
+		},
+		"svgChart":     svgChart,
+		"fmtStatValue": fmtStatValue,
 	}
 
 	headerPath := buildTemplatePath("_header")
 	headerTmpl, err := template.New(name).
 		Parse(webfaceTemplates[headerPath])
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		types.ReportErrorAndWait(err, nil)
 		log.Fatal(err)
 	}
 	tmpl, err := headerTmpl.
 		Funcs(funcMap).
 		Parse(webfaceTemplates[templatePath])
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		types.ReportErrorAndWait(err, nil)
 		log.Fatal(err)
 	}
 
 	return tmpl
 }
 
-func adminIndex(w http.ResponseWriter, r *http.Request) {
-	nodes.statsLock.RLock()
-	defer nodes.statsLock.RUnlock()
+// fuzzersData is everything shown on the admin fuzzers page.
+type fuzzersData struct {
+	Nodes         []NodeInfo
+	Lifecycles    []NodeLifecycleInfo
+	FuzzerConfig  types.FuzzerConfig
+	ArchiveConfig types.ArchiveConfig
+}
+
+func loadFuzzersData() fuzzersData {
+	return fuzzersData{
+		Nodes:         nodes.snapshot(),
+		Lifecycles:    nodes.lifecycleSnapshot(),
+		FuzzerConfig:  fuzzerConf,
+		ArchiveConfig: archiveConf.Redacted(),
+	}
+}
+
+// loadFleetSummary summarizes the fleet, sorted by the `sort` and
+// `order` query params of `r`.
+func loadFleetSummary(r *http.Request) (fleetSummary, error) {
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = "name"
+	}
+	validSort := false
+	for _, key := range dashboardSortKeys {
+		if sortKey == key {
+			validSort = true
+		}
+	}
+	if !validSort {
+		return fleetSummary{}, fmt.Errorf("Invalid sort: %s", sortKey)
+	}
+
+	var desc bool
+	switch r.URL.Query().Get("order") {
+	case "":
+		// Names read best A-Z, and numbers read best biggest first.
+		desc = sortKey != "name"
+	case "asc":
+	case "desc":
+		desc = true
+	default:
+		return fleetSummary{}, fmt.Errorf("Invalid order: %s", r.URL.Query().Get("order"))
+	}
+
+	return summarizeFleet(nodes.snapshot(), time.Now(), sortKey, desc), nil
+}
+
+// The number of most recent snapshots that the archive page shows.
+var archivePageSnapshots int = 20
+
+// archiveSnapshotInfo summarizes a snapshot for the archive and
+// snapshots pages.
+type archiveSnapshotInfo struct {
+	Timestamp int64
+	Time      time.Time
+	Files     int
+	Size      int64
+	// The destinations that have the snapshot, and where its manifest
+	// is in each of them
+	Destinations []string
+	Location     string
+	// Where the snapshot's tarball is, if it is stored as one
+	Tarball string
+}
+
+// snapshotSummary is the part of an archiveSnapshotInfo that comes
+// from the snapshot's manifest.
+type snapshotSummary struct {
+	Time    time.Time
+	Files   int
+	Size    int64
+	Tarball string
+}
+
+// Snapshot manifests aren't changed once they are archived, so their
+// summaries are cached rather than every manifest being re-read from
+// the archive whenever the archive or snapshots pages are loaded. They
+// are keyed by where the manifest is archived.
+var snapshotSummaryCache = make(map[string]snapshotSummary)
+var snapshotSummaryCacheLock sync.Mutex
+
+// readSnapshotSummary uses an `archiver` to summarize the snapshot
+// taken at `ts`, reading its manifest only if it isn't cached.
+func readSnapshotSummary(a Archiver, ts int64) (snapshotSummary, error) {
+	loc := a.DescribeDstLoc(snapshotManifestPath(ts))
+	snapshotSummaryCacheLock.Lock()
+	summary, present := snapshotSummaryCache[loc]
+	snapshotSummaryCacheLock.Unlock()
+	if present {
+		return summary, nil
+	}
+
+	snapshot, err := readSnapshot(a, ts)
+	if err != nil {
+		return snapshotSummary{}, err
+	}
+	summary = snapshotSummary{
+		Time:    snapshot.Time(),
+		Files:   len(snapshot.Files),
+		Size:    snapshot.Size(),
+		Tarball: snapshot.Tarball,
+	}
+	if loc != "" {
+		snapshotSummaryCacheLock.Lock()
+		snapshotSummaryCache[loc] = summary
+		snapshotSummaryCacheLock.Unlock()
+	}
+	return summary, nil
+}
+
+// loadSnapshotInfos summarizes the snapshots that an `archiver` took
+// at `timestamps`. Each snapshot is looked for in each of
+// `destinations`, since they each take their own.
+func loadSnapshotInfos(a Archiver, destinations []*ArchiveDestination, timestamps []int64) ([]archiveSnapshotInfo, error) {
+	in := make(map[int64][]*ArchiveDestination)
+	for _, d := range destinations {
+		dstTimestamps, err := listSnapshots(d.Archiver)
+		if err != nil {
+			return nil, err
+		}
+		for _, ts := range dstTimestamps {
+			in[ts] = append(in[ts], d)
+		}
+	}
+
+	snapshots := make([]archiveSnapshotInfo, 0, len(timestamps))
+	for _, ts := range timestamps {
+		summary, err := readSnapshotSummary(a, ts)
+		if err != nil {
+			return nil, err
+		}
+		info := archiveSnapshotInfo{
+			Timestamp:    ts,
+			Time:         summary.Time,
+			Files:        summary.Files,
+			Size:         summary.Size,
+			Destinations: []string{},
+		}
+		locations := []string{}
+		tarballs := []string{}
+		for _, d := range in[ts] {
+			info.Destinations = append(info.Destinations, d.Conf.Name)
+			locations = append(locations, d.Archiver.DescribeDstLoc(snapshotManifestPath(ts)))
+			if summary.Tarball != "" {
+				tarballs = append(tarballs, d.Archiver.DescribeDstLoc(summary.Tarball))
+			}
+		}
+		info.Location = strings.Join(locations, ", ")
+		info.Tarball = strings.Join(tarballs, ", ")
+		snapshots = append(snapshots, info)
+	}
+	return snapshots, nil
+}
+
+// archiveData is everything shown on the admin archive page.
+type archiveData struct {
+	RealtimeCrashArchive []string
+	// The metadata archived with the realtime crashes, keyed by name
+	RealtimeCrashMetadata map[string]CrashMetadata
+	ArchiveConfig         types.ArchiveConfig
+	// The most recent snapshots, newest first
+	Snapshots []archiveSnapshotInfo
+	// The total number of snapshots, and of unique files stored for
+	// them
+	SnapshotCount       int
+	SnapshotObjectCount int
+	// How archiving to each destination has been going
+	Destinations []ArchiveDestinationStatus
+}
+
+func loadArchiveData() (archiveData, error) {
+	realtimeCrashNames, err := archiver.lsDstTree(realtimeCrashesPath)
+	if err != nil {
+		return archiveData{}, err
+	}
+	realtimeCrashMetadata, err := loadCrashMetadata(archiver, realtimeCrashNames, archivePageCrashMetadata)
+	if err != nil {
+		return archiveData{}, err
+	}
+
+	timestamps, err := listSnapshots(archiver)
+	if err != nil {
+		return archiveData{}, err
+	}
+	objects, err := archiver.LsDstFiles(snapshotObjectsPath)
+	if err != nil {
+		return archiveData{}, err
+	}
+	recent := timestamps
+	if len(recent) > archivePageSnapshots {
+		recent = recent[:archivePageSnapshots]
+	}
+	snapshots, err := loadSnapshotInfos(archiver, archiveDestinations, recent)
+	if err != nil {
+		return archiveData{}, err
+	}
+
+	return archiveData{
+		RealtimeCrashArchive:  realtimeCrashNames,
+		RealtimeCrashMetadata: realtimeCrashMetadata,
+		ArchiveConfig:         archiveConf.Redacted(),
+		Snapshots:             snapshots,
+		SnapshotCount:         len(timestamps),
+		SnapshotObjectCount:   len(objects),
+		Destinations:          archiveDestinationStatuses(archiveDestinations),
+	}, nil
+}
+
+// snapshotsData is everything shown on the admin snapshots page.
+type snapshotsData struct {
+	// Every snapshot that can be restored, newest first
+	Snapshots []archiveSnapshotInfo
+}
+
+func loadSnapshotsData() (snapshotsData, error) {
+	timestamps, err := listSnapshots(archiver)
+	if err != nil {
+		return snapshotsData{}, err
+	}
+	snapshots, err := loadSnapshotInfos(archiver, archiveDestinations, timestamps)
+	if err != nil {
+		return snapshotsData{}, err
+	}
+	return snapshotsData{Snapshots: snapshots}, nil
+}
+
+// readInput reads an input, as long as it belongs to a fuzzer that
+// the server knows about. Fuzzer IDs come from URLs, so we check them
+// rather than building paths out of them blindly.
+func readInput(fuzzerId, inputType, inputName string) (*types.Input, error) {
+	if !outputIndex.hasFuzzer(fuzzerId) {
+		return nil, fmt.Errorf("Unknown fuzzer: %s", fuzzerId)
+	}
+	return fileManager.ReadInput(fuzzerId, inputType, inputName)
+}
+
+// loadInput reads the input named by the `fuzzerId`, `type` and `name`
+// params of `r`.
+func loadInput(r *http.Request) (*types.Input, error) {
+	return readInput(
+		pat.Param(r, "fuzzerId"),
+		pat.Param(r, "type"),
+		pat.Param(r, "name"),
+	)
+}
+
+// loadInputFromSpec reads the input named by `spec`, which is of the
+// form `fuzzerId/type/name`.
+func loadInputFromSpec(spec string) (*types.Input, []string, error) {
+	parts := strings.SplitN(spec, "/", 3)
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("Input must be of the form FUZZER_ID/TYPE/NAME: %s", spec)
+	}
+	input, err := readInput(parts[0], parts[1], parts[2])
+	return input, parts, err
+}
+
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	summary, err := loadFleetSummary(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sortURLs := make(map[string]string)
+	for _, key := range dashboardSortKeys {
+		sortURLs[key] = dashboardSortURL(summary, key)
+	}
 
 	templateData := map[string]interface{}{
-		"Nodes":         &nodes,
-		"FuzzerConfig":  &fuzzerConf,
-		"ArchiveConfig": &archiveConf,
+		"Summary":  summary,
+		"SortURLs": sortURLs,
+	}
+	err = dashboardTemplate.Execute(w, templateData)
+	if err != nil {
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't execute template: %s", err)
+	}
+}
+
+// dashboardSortURL returns the URL of the dashboard sorted by `key`.
+// If the dashboard is already sorted by `key`, the URL reverses the
+// order.
+func dashboardSortURL(summary fleetSummary, key string) string {
+	params := url.Values{}
+	params.Set("sort", key)
+	if summary.Sort == key {
+		if summary.Desc {
+			params.Set("order", "asc")
+		} else {
+			params.Set("order", "desc")
+		}
 	}
+	return "/admin?" + params.Encode()
+}
 
-	err := indexTemplate.Execute(w, templateData)
+func adminFuzzers(w http.ResponseWriter, r *http.Request) {
+	err := fuzzersTemplate.Execute(w, loadFuzzersData())
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		types.ReportErrorAndWait(err, requestTags(r))
 		log.Fatalf("Couldn't execute template: %s", err)
 	}
 }
 
 func adminInput(w http.ResponseWriter, r *http.Request) {
-	var err error
-
+	input, err := loadInput(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	fuzzerId := pat.Param(r, "fuzzerId")
 	inputType := pat.Param(r, "type")
-	inputName := pat.Param(r, "name")
 
-	input, err := fileManager.ReadInput(fuzzerId, inputType, inputName)
+	rows, truncated := hexdump(input.Body)
+	templateData := map[string]interface{}{
+		"FuzzerId":  fuzzerId,
+		"Type":      inputType,
+		"Input":     input,
+		"Spec":      strings.Join([]string{fuzzerId, inputType, input.Name}, "/"),
+		"Rows":      rows,
+		"Truncated": truncated,
+	}
+	if ancestor, present := queueAncestor(outputIndex, fuzzerId, input.Name); present {
+		templateData["Ancestor"] = ancestor
+	}
+
+	err = inputTemplate.Execute(w, templateData)
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		types.ReportErrorAndWait(err, requestTags(r))
 		log.Fatalf("Couldn't execute template: %s", err)
 	}
+}
+
+// adminInputRaw sends the body of an input as a file download.
+func adminInputRaw(w http.ResponseWriter, r *http.Request) {
+	input, err := loadInput(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	err = inputTemplate.Execute(w, input)
+	filename := downloadFilename(pat.Param(r, "fuzzerId"), pat.Param(r, "type"), input.Name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(input.Body)))
+	w.Write(input.Body)
+}
+
+// adminDiff shows a side-by-side byte diff of the inputs named by the
+// `a` and `b` query params, each of the form `fuzzerId/type/name`.
+func adminDiff(w http.ResponseWriter, r *http.Request) {
+	left, leftParts, err := loadInputFromSpec(r.URL.Query().Get("a"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	right, rightParts, err := loadInputFromSpec(r.URL.Query().Get("b"))
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	rows, nDiffering, truncated := hexdiff(left.Body, right.Body)
+	templateData := map[string]interface{}{
+		"Left":       left,
+		"LeftParts":  leftParts,
+		"Right":      right,
+		"RightParts": rightParts,
+		"Rows":       rows,
+		"NDiffering": nDiffering,
+		"Truncated":  truncated,
+	}
+	err = diffTemplate.Execute(w, templateData)
+	if err != nil {
+		types.ReportErrorAndWait(err, requestTags(r))
 		log.Fatalf("Couldn't execute template: %s", err)
 	}
 }
 
 func adminOutput(w http.ResponseWriter, r *http.Request) {
-	var err error
+	q, err := outputQueryFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page := outputIndex.query(q)
 
-	outputs, err := fileManager.ReadOutputs()
+	hangTriage, err := fileManager.ReadAllHangTriage()
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
-		log.Fatalf("Couldn't load outputs: %s", err)
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't load hang triage: %s", err)
 	}
 
-	err = outputTemplate.Execute(w, outputs)
+	templateData := map[string]interface{}{
+		"Page":       page,
+		"Query":      q,
+		"SortKeys":   outputSortKeys,
+		"InputTypes": []string{types.Queue, types.Crashes, types.Hangs},
+		"HangTriage": hangTriage,
+		"PrevURL":    outputPageURL(r, page.Page-1),
+		"NextURL":    outputPageURL(r, page.Page+1),
+	}
+	if page.Page <= 1 {
+		templateData["PrevURL"] = ""
+	}
+	if page.Page >= page.Pages {
+		templateData["NextURL"] = ""
+	}
+	err = outputTemplate.Execute(w, templateData)
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		types.ReportErrorAndWait(err, requestTags(r))
 		log.Fatalf("Couldn't execute template: %s", err)
 	}
 }
 
+// outputPageURL returns the URL of page `page` of the outputs matching
+// the same query as `r`.
+func outputPageURL(r *http.Request, page int) string {
+	params := r.URL.Query()
+	params.Set("page", strconv.Itoa(page))
+	return "/admin/output?" + params.Encode()
+}
+
 func adminArchive(w http.ResponseWriter, r *http.Request) {
-	var err error
+	data, err := loadArchiveData()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
 
-	realtimeCrashNames, err := archiver.LsDstFiles("realtime-crashes")
+	err = archiveTemplate.Execute(w, data)
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
-		log.Fatal(err)
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't execute template: %s", err)
+	}
+}
+
+func adminSnapshots(w http.ResponseWriter, r *http.Request) {
+	data, err := loadSnapshotsData()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = snapshotsTemplate.Execute(w, data)
+	if err != nil {
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't execute template: %s", err)
+	}
+}
+
+func adminCrashes(w http.ResponseWriter, r *http.Request) {
+	filter, err := crashFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	crashes, err := db.Crashes(filter)
+	if err != nil {
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't load crashes: %s", err)
+	}
+
+	templateData := map[string]interface{}{
+		"Crashes":  crashes,
+		"Filter":   filter,
+		"Statuses": CrashStatuses,
+	}
+	err = crashesTemplate.Execute(w, templateData)
+	if err != nil {
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't execute template: %s", err)
 	}
+}
+
+// adminUpdateCrash handles the triage form on the crashes page, and
+// redirects back to it.
+func adminUpdateCrash(w http.ResponseWriter, r *http.Request) {
+	fuzzerId := pat.Param(r, "fuzzerId")
+	name := pat.Param(r, "name")
+
+	status, err := parseCrashStatus(r.FormValue("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.UpdateCrash(fuzzerId, name, status, r.FormValue("notes"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/crashes", http.StatusSeeOther)
+}
+
+// chartedStats are the stats that are charted on the history page.
+var chartedStats = []string{"execs_per_sec", "paths_total", "unique_crashes", "bitmap_cvg"}
+
+func adminHistory(w http.ResponseWriter, r *http.Request) {
+	fuzzerIds := nodes.history.FuzzerIds()
+	sort.Strings(fuzzerIds)
+
+	fuzzerSamples := make(map[string][]StatsSample)
+	for _, fuzzerId := range fuzzerIds {
+		fuzzerSamples[fuzzerId], _ = nodes.history.FuzzerSamples(fuzzerId)
+	}
+
+	templateData := map[string]interface{}{
+		"Stats":          chartedStats,
+		"ClusterSamples": nodes.history.ClusterSamples(),
+		"FuzzerIds":      fuzzerIds,
+		"FuzzerSamples":  fuzzerSamples,
+	}
+	err := historyTemplate.Execute(w, templateData)
+	if err != nil {
+		types.ReportErrorAndWait(err, requestTags(r))
+		log.Fatalf("Couldn't execute template: %s", err)
+	}
+}
+
+// The types of event that can be picked on the events page.
+var eventTypes = []string{
+	EventStateReceived,
+	EventCrashNew,
+	EventHangNew,
+	EventNodeJoined,
+	EventNodeReaped,
+	EventNodeState,
+	EventQueueRetired,
+	EventArchiveStarted,
+	EventArchiveFinished,
+	EventConfigChanged,
+}
 
+func adminEvents(w http.ResponseWriter, r *http.Request) {
 	templateData := map[string]interface{}{
-		"RealtimeCrashArchive": realtimeCrashNames,
-		"ArchiveConfig":        archiveConf,
+		"EventTypes": eventTypes,
 	}
-	err = archiveTemplate.Execute(w, templateData)
+	err := eventsTemplate.Execute(w, templateData)
 	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
+		types.ReportErrorAndWait(err, requestTags(r))
 		log.Fatalf("Couldn't execute template: %s", err)
 	}
 }
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goji.io/middleware"
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/richo/roving/types"
+)
+
+// api.go contains the routes for the roving server's JSON API.
+// The routes are bound to paths in server.go. Unlike the admin
+// interface, the API is intended to be used by scripts and other
+// automation.
+
+// writeJSON writes `v` to `w` as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Couldn't encode JSON response err=%v", err)
+	}
+}
+
+// writeServerError reports `err` and responds with a 500.
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	types.ReportError(err, requestTags(r))
+	log.Printf("Error handling request path=%s err=%v", r.URL.Path, err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// requestTags returns the tags that errors reported while handling `r`
+// are tagged with: the route that it matched, its path, and the fuzzer
+// it is about, if any.
+func requestTags(r *http.Request) map[string]string {
+	tags := map[string]string{"path": r.URL.Path, "route": "unmatched"}
+	if p, ok := middleware.Pattern(r.Context()).(*pat.Pattern); ok {
+		tags["route"] = p.String()
+		if fuzzerId, present := r.Context().Value(pattern.Variable("fuzzerId")).(string); present {
+			tags["fuzzer_id"] = fuzzerId
+		}
+	}
+	return tags
+}
+
+// crashFilterFromRequest builds a CrashFilter out of the `fuzzer` and
+// `status` query params.
+func crashFilterFromRequest(r *http.Request) (CrashFilter, error) {
+	filter := CrashFilter{FuzzerId: r.URL.Query().Get("fuzzer")}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		crashStatus, err := parseCrashStatus(status)
+		if err != nil {
+			return CrashFilter{}, err
+		}
+		filter.Status = crashStatus
+	}
+	return filter, nil
+}
+
+// The apiCrashes route returns every crash in the database, most
+// recently seen first. It can be filtered using the `fuzzer` and
+// `status` query params.
+func apiCrashes(w http.ResponseWriter, r *http.Request) {
+	filter, err := crashFilterFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	crashes, err := db.Crashes(filter)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, crashes)
+}
+
+// The apiCrash route returns a single crash from the database.
+func apiCrash(w http.ResponseWriter, r *http.Request) {
+	crash, present, err := db.Crash(pat.Param(r, "fuzzerId"), pat.Param(r, "name"))
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if !present {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, crash)
+}
+
+// crashUpdate is the body of a request to the apiUpdateCrash route.
+type crashUpdate struct {
+	Status CrashStatus
+	Notes  string
+}
+
+// The apiUpdateCrash route sets the status and notes of a crash. It
+// expects a JSON body of the form {"Status": "...", "Notes": "..."},
+// and returns the updated crash.
+func apiUpdateCrash(w http.ResponseWriter, r *http.Request) {
+	fuzzerId := pat.Param(r, "fuzzerId")
+	name := pat.Param(r, "name")
+
+	update := crashUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, err := parseCrashStatus(string(update.Status))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, present, err := db.Crash(fuzzerId, name); err != nil {
+		writeServerError(w, r, err)
+		return
+	} else if !present {
+		http.NotFound(w, r)
+		return
+	}
+
+	crash, err := db.UpdateCrash(fuzzerId, name, status, update.Notes, time.Now())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, crash)
+}
+
+// statNamesFromRequest returns the stat names in the comma-separated
+// `stats` query param, if any.
+func statNamesFromRequest(r *http.Request) []string {
+	stats := r.URL.Query().Get("stats")
+	if stats == "" {
+		return nil
+	}
+	return strings.Split(stats, ",")
+}
+
+// The apiClusterHistory route returns the history of the cluster's
+// aggregated stats, oldest first. The `stats` query param restricts
+// the response to a comma-separated list of stats.
+func apiClusterHistory(w http.ResponseWriter, r *http.Request) {
+	samples := nodes.history.ClusterSamples()
+	writeJSON(w, filterSamples(samples, statNamesFromRequest(r)))
+}
+
+// The apiFuzzerHistory route returns the history of a single fuzzer's
+// stats, oldest first. The `stats` query param restricts the response
+// to a comma-separated list of stats.
+func apiFuzzerHistory(w http.ResponseWriter, r *http.Request) {
+	samples, present := nodes.history.FuzzerSamples(pat.Param(r, "fuzzerId"))
+	if !present {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, filterSamples(samples, statNamesFromRequest(r)))
+}
+
+// The apiNodes route returns every node that the server knows about,
+// along with its latest FuzzerStats.
+func apiNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, loadFuzzersData().Nodes)
+}
+
+// The apiFleet route returns the same summary of the fleet as the
+// admin dashboard: totals for the whole fleet and for each host, and
+// which fuzzers are stalled. It can be sorted using the `sort` and
+// `order` query params.
+func apiFleet(w http.ResponseWriter, r *http.Request) {
+	summary, err := loadFleetSummary(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, summary)
+}
+
+// outputQueryFromRequest builds an OutputQuery out of the `fuzzer`,
+// `type`, `name`, `sort`, `order`, `page` and `per_page` query params.
+func outputQueryFromRequest(r *http.Request) (OutputQuery, error) {
+	params := r.URL.Query()
+	q := OutputQuery{
+		FuzzerId: params.Get("fuzzer"),
+		Type:     params.Get("type"),
+		Name:     params.Get("name"),
+		Sort:     params.Get("sort"),
+	}
+
+	// Unless asked otherwise, show the newest inputs first, and
+	// everything else in ascending order.
+	switch params.Get("order") {
+	case "":
+		q.Desc = q.Sort == "" || q.Sort == "time"
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return OutputQuery{}, fmt.Errorf("Invalid order: %s", params.Get("order"))
+	}
+
+	var err error
+	if page := params.Get("page"); page != "" {
+		if q.Page, err = strconv.Atoi(page); err != nil {
+			return OutputQuery{}, fmt.Errorf("Invalid page: %s", page)
+		}
+	}
+	if perPage := params.Get("per_page"); perPage != "" {
+		if q.PerPage, err = strconv.Atoi(perPage); err != nil {
+			return OutputQuery{}, fmt.Errorf("Invalid per_page: %s", perPage)
+		}
+	}
+
+	if err = q.validate(); err != nil {
+		return OutputQuery{}, err
+	}
+	return q, nil
+}
+
+// The apiOutputs route returns a page of metadata about the queue
+// entries, crashes and hangs saved by the fleet, without their bodies.
+// See outputQueryFromRequest for the query params it accepts.
+func apiOutputs(w http.ResponseWriter, r *http.Request) {
+	q, err := outputQueryFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, outputIndex.query(q))
+}
+
+// The apiInput route returns a single input, including its body.
+func apiInput(w http.ResponseWriter, r *http.Request) {
+	input, err := loadInput(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, input)
+}
+
+// The apiConfig route returns the fuzzer and archive config that the
+// server is running with.
+func apiConfig(w http.ResponseWriter, r *http.Request) {
+	data := loadFuzzersData()
+	writeJSON(w, map[string]interface{}{
+		"Fuzzer":  data.FuzzerConfig,
+		"Archive": data.ArchiveConfig,
+	})
+}
+
+// The apiArchive route returns the names of the realtime crashes in
+// the archive, along with the archive config.
+func apiArchive(w http.ResponseWriter, r *http.Request) {
+	data, err := loadArchiveData()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// The apiSnapshots route returns every snapshot that can be restored,
+// newest first.
+func apiSnapshots(w http.ResponseWriter, r *http.Request) {
+	data, err := loadSnapshotsData()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, data)
+}
@@ -1,6 +1,10 @@
 package server
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -8,14 +12,17 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	raven "github.com/getsentry/raven-go"
 
 	"github.com/richo/roving/types"
 )
@@ -29,64 +36,161 @@ func init() {
 	}
 }
 
-// ArchiveToTimestampedDirsForever uses an `archiver` to repeatedly
-// archive `absSrcPath` every `interval`. Each archive preserves
-// the original directory structure, and is saved at
-// `${archiver.DstRoot}/$TIMESTAMP/`.
-//
-// This function never returns.
-func ArchiveToTimestampedDirsForever(archiver Archiver, absSrcPath string, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			log.Printf("Archiving to timestamped dir src=%s dst=%s", absSrcPath, archiver.DescribeDstRoot())
-			err := archiveToTimestampedDir(archiver, absSrcPath)
-			if err != nil {
-				raven.CaptureErrorAndWait(err, nil)
-				log.Print(err)
-			}
-		}
+// readAll reads the whole of the archived file at `relDstPath` from
+// an `archiver` into memory.
+func readAll(a Archiver, relDstPath string) ([]byte, error) {
+	rc, err := a.openOne(relDstPath)
+	if err != nil {
+		return nil, err
 	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// A readCloser reads from one thing and closes another, like a
+// decrypting reader and the file under it.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// The dir that temporary files are made in while archiving, like
+// tarballs before they are uploaded. Empty means the system's temp
+// dir. See types.ArchiveConfig.TmpDir.
+var archiveTmpDir string
+
+// archiveTempFile creates a temporary file in archiveTmpDir, whose
+// name starts with `prefix`. The caller removes it.
+func archiveTempFile(prefix string) (*os.File, error) {
+	return ioutil.TempFile(archiveTmpDir, prefix)
 }
 
 // ArchiveToNamedDir uses an `archiver` to archive `absSrcPath`
-// once. The archive preserves the original directory structure, and
-// is saved at `dstSubRoot`.
-func ArchiveToNamedDir(a Archiver, absSrcPath, dstSubRoot string) error {
-	manifest := newSimpleManifest(absSrcPath, dstSubRoot)
+// once. In types.ArchiveModeTarball the archive is a single tarball
+// saved at `${dstSubRoot}.tar.gz`, with its manifest at
+// `${dstSubRoot}.json`. Otherwise the archive preserves the original
+// directory structure, and is saved at `dstSubRoot`.
+func ArchiveToNamedDir(a Archiver, absSrcPath, dstSubRoot, mode string) (ArchiveResult, error) {
+	if mode == types.ArchiveModeTarball {
+		_, result, err := archiveTarball(a, absSrcPath, dstSubRoot, getTimestamp())
+		return result, err
+	}
+	manifest, err := newSimpleManifest(absSrcPath, dstSubRoot)
+	if err != nil {
+		return ArchiveResult{}, err
+	}
 	return ArchiveManifest(a, manifest)
 }
 
-// ArchiveManifest uses an `archiver` to archive a `manifest` once.
-func ArchiveManifest(a Archiver, manifest Manifest) error {
+// namedArchivePath returns where ArchiveToNamedDir saves an archive
+// of `dstSubRoot` in archive mode `mode`.
+func namedArchivePath(dstSubRoot, mode string) string {
+	if mode == types.ArchiveModeTarball {
+		return dstSubRoot + tarballExt
+	}
+	return dstSubRoot
+}
+
+// ArchiveManifest uses an `archiver` to archive a `manifest` once,
+// several files at a time (see uploads.go). It archives as many files
+// as it can, and returns an error if any of them couldn't be
+// archived. Files are streamed to the archiver, rather than being
+// read into memory to be hashed; use archiveManifestFiles for that.
+func ArchiveManifest(a Archiver, manifest Manifest) (ArchiveResult, error) {
 	types.SubmitMetricCount("archive_manifest", float32(len(manifest.entries)), map[string]string{"root": manifest.srcRoot})
+	jobs := make([]uploadJob, 0, len(manifest.entries))
 	for _, entry := range manifest.entries {
+		jobs = append(jobs, newFileUploadJob(a, filepath.Join(manifest.srcRoot, entry.src), entry.dst))
+	}
+
+	result := uploadAll(manifest.srcRoot, jobs)
+	return result, manifestResultErr(manifest, result)
+}
+
+// archiveManifestFiles is ArchiveManifest, but also returns the path,
+// size and SHA-256 of every file that was archived, sorted by path.
+// Paths are relative to the manifest's srcRoot.
+func archiveManifestFiles(a Archiver, manifest Manifest) (ArchiveResult, []SnapshotFile, error) {
+	types.SubmitMetricCount("archive_manifest", float32(len(manifest.entries)), map[string]string{"root": manifest.srcRoot})
+	files := make([]SnapshotFile, 0, len(manifest.entries))
+	var filesLock sync.Mutex
+
+	jobs := make([]uploadJob, 0, len(manifest.entries))
+	for _, entry := range manifest.entries {
+		relPath := filepath.ToSlash(entry.src)
 		absSrcPath := filepath.Join(manifest.srcRoot, entry.src)
-		relDstPath := entry.dst
-		err := a.archiveOne(absSrcPath, relDstPath)
+		jobs = append(jobs, newHashedUploadJob(a, absSrcPath, entry.dst, func(hash string, size int64) {
+			filesLock.Lock()
+			files = append(files, SnapshotFile{Path: relPath, Sha256: hash, Size: size})
+			filesLock.Unlock()
+		}))
+	}
 
-		if err != nil {
-			types.SubmitMetricCount("archive_one.fail", 1, map[string]string{"srcRoot": manifest.srcRoot})
-			log.Print(err)
-			raven.CaptureError(err, map[string]string{
-				"dst":     entry.dst,
-				"src":     entry.src,
-				"srcRoot": manifest.srcRoot,
-			})
-			continue
-		}
-		types.SubmitMetricCount("archive_one.success", 1, map[string]string{"srcRoot": manifest.srcRoot})
+	result := uploadAll(manifest.srcRoot, jobs)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return result, files, manifestResultErr(manifest, result)
+}
+
+// manifestResultErr returns an error if any of the files in a
+// `manifest` couldn't be archived.
+func manifestResultErr(manifest Manifest, result ArchiveResult) error {
+	if result.Failed > 0 {
+		return fmt.Errorf("Couldn't archive %d of %d files from %s", result.Failed, result.Total(), manifest.srcRoot)
 	}
 	return nil
 }
 
-// archiveToTimestampedDir archives `absSrcPath` to a timestamped dir once.
-func archiveToTimestampedDir(a Archiver, absSrcPath string) error {
+// The extension of the marker that says a timestamped copy is
+// complete.
+var copyCompleteExt string = ".complete"
+
+// copyCompletePath returns where the marker that says the timestamped
+// copy at `dstSubRoot` is complete is stored.
+func copyCompletePath(dstSubRoot string) string {
+	return dstSubRoot + copyCompleteExt
+}
+
+// archiveToTimestampedDir archives `absSrcPath` to a timestamped dir
+// once, in archive mode `mode`.
+//
+// Every archive is only marked complete once all of its files have
+// been archived, so that an archive that was interrupted or that lost
+// files is never mistaken for a good one. A snapshot's manifest is
+// written last (see snapshots.go and tarballs.go), and a copy at
+// `$TIMESTAMP/` is followed by a `$TIMESTAMP.complete` marker. The
+// marker is a manifest like a snapshot's, that lists the path, size
+// and SHA-256 of every file in the copy, so that copies can be
+// verified too (see verify.go).
+func archiveToTimestampedDir(a Archiver, absSrcPath, mode string) (ArchiveResult, error) {
 	ts := getTimestamp()
-	tsStr := strconv.FormatInt(ts, 10)
 
-	return ArchiveToNamedDir(a, absSrcPath, tsStr)
+	switch mode {
+	case types.ArchiveModeSnapshot:
+		_, result, err := archiveSnapshot(a, absSrcPath, ts)
+		return result, err
+	case types.ArchiveModeTarball:
+		// Tarballs are saved alongside their manifests, so that they
+		// are listed like any other snapshot.
+		_, result, err := archiveTarball(a, absSrcPath, snapshotBasePath(ts), ts)
+		return result, err
+	}
+
+	tsStr := strconv.FormatInt(ts, 10)
+	manifest, err := newSimpleManifest(absSrcPath, tsStr)
+	if err != nil {
+		return ArchiveResult{}, err
+	}
+	result, files, err := archiveManifestFiles(a, manifest)
+	if err != nil {
+		return result, err
+	}
+	buf, err := json.Marshal(Snapshot{Timestamp: ts, Src: absSrcPath, Copy: tsStr, Files: files})
+	if err != nil {
+		return result, err
+	}
+	return result, uploadWithRetries(absSrcPath, newBytesUploadJob(a, buf, copyCompletePath(tsStr)))
 }
 
 // Roving servers use `Archiver`s to regularly copy
@@ -99,8 +203,24 @@ func archiveToTimestampedDir(a Archiver, absSrcPath string) error {
 type Archiver interface {
 	// Archive the local dir `absSrcPath` to `relDstPath`
 	archiveOne(absSrcPath, relDstPath string) error
-	// Lists all filenames in `relDstRoot`
+	// Lists all filenames in `relDstRoot`. If `relDstRoot` is in a
+	// snapshot then lists the files in the snapshot.
 	LsDstFiles(relDstRoot string) ([]string, error)
+	// Reads the archived file at `relDstPath`. Returns an error that
+	// isNotExist understands if there is no such file.
+	readOne(relDstPath string) ([]byte, error)
+	// Opens the archived file at `relDstPath` to be streamed, rather
+	// than read into memory like readOne. The caller closes it.
+	// Returns an error that isNotExist understands if there is no
+	// such file.
+	openOne(relDstPath string) (io.ReadCloser, error)
+	// Deletes the archived file at `relDstPath`. It is a no-op if
+	// there is no such file.
+	deleteOne(relDstPath string) error
+	// Lists every file under `relDstRoot`, including in sub-dirs,
+	// relative to it. Unlike LsDstFiles, snapshots are not listed
+	// as though they were dirs.
+	lsDstTree(relDstRoot string) ([]string, error)
 
 	// Describes the dst's root path. For display only.
 	DescribeDstRoot() string
@@ -118,6 +238,18 @@ func (a NullArchiver) archiveOne(absSrcPath, relDstPath string) error {
 func (a NullArchiver) LsDstFiles(relDstRoot string) ([]string, error) {
 	return []string{}, nil
 }
+func (a NullArchiver) readOne(relDstPath string) ([]byte, error) {
+	return nil, &os.PathError{Op: "read", Path: relDstPath, Err: os.ErrNotExist}
+}
+func (a NullArchiver) openOne(relDstPath string) (io.ReadCloser, error) {
+	return nil, &os.PathError{Op: "open", Path: relDstPath, Err: os.ErrNotExist}
+}
+func (a NullArchiver) deleteOne(relDstPath string) error {
+	return nil
+}
+func (a NullArchiver) lsDstTree(relDstRoot string) ([]string, error) {
+	return []string{}, nil
+}
 func (a NullArchiver) DescribeDstRoot() string {
 	return ""
 }
@@ -129,14 +261,32 @@ func (a NullArchiver) DescribeDstLoc(relDstPath string) string {
 // location on local disk. Mostly useful for testing.
 type DiskArchiver struct {
 	DstRoot string
+	// Encrypts archived files, if set (see encryption.go)
+	cipher *archiveCipher
+}
+
+// The extension, before a random suffix, of the temporary files that
+// DiskArchiver writes files to before moving them into place. They are
+// hidden, and aren't listed.
+var diskArchivingExt string = ".archiving"
+
+// isDiskArchivingFile returns whether `name` is one of DiskArchiver's
+// temporary files, for example one left behind by a crash.
+func isDiskArchivingFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, diskArchivingExt)
 }
 
 // archiveOne copies the file at `absSrcPath` to `relDstPath`.
 // `relDstPath` is resolved relative to the current working dir.
+//
+// The copy is written to a temporary file next to `relDstPath`, and
+// only renamed into place once it is complete, so that a crash or a
+// full disk never leaves a truncated file. Snapshots reuse any object
+// that is already archived, so a truncated one would never be fixed.
 func (a DiskArchiver) archiveOne(absSrcPath, relDstPath string) error {
 	var err error
 	var srcFd *os.File
-	var dstFd *os.File
+	var tmpFd *os.File
 
 	absDstPath := filepath.Join(a.DstRoot, relDstPath)
 
@@ -150,12 +300,29 @@ func (a DiskArchiver) archiveOne(absSrcPath, relDstPath string) error {
 	}
 	defer srcFd.Close()
 
-	if dstFd, err = os.Create(absDstPath); err != nil {
+	if tmpFd, err = ioutil.TempFile(dirs, "."+filepath.Base(absDstPath)+diskArchivingExt); err != nil {
 		return err
 	}
-	defer dstFd.Close()
+	tmpPath := tmpFd.Name()
 
-	if _, err = io.Copy(dstFd, srcFd); err != nil {
+	w, err := a.cipher.encryptingWriter(tmpFd, relDstPath)
+	if err == nil {
+		_, err = io.Copy(w, srcFd)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := tmpFd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, absDstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 	return nil
@@ -165,6 +332,10 @@ func (a DiskArchiver) archiveOne(absSrcPath, relDstPath string) error {
 // dir. It does not include directory names, and  does not
 // walk sub-trees.
 func (a DiskArchiver) LsDstFiles(dstSubRoot string) ([]string, error) {
+	if filenames, present, err := lsSnapshotFiles(a, dstSubRoot, false); present {
+		return filenames, err
+	}
+
 	dstFullRoot := filepath.Join(a.DstRoot, dstSubRoot)
 	_, err := os.Stat(dstFullRoot)
 	if err != nil {
@@ -181,13 +352,80 @@ func (a DiskArchiver) LsDstFiles(dstSubRoot string) ([]string, error) {
 
 	filenames := make([]string, 0, 0)
 	for _, fileInfo := range fileInfos {
-		if !fileInfo.IsDir() {
+		if !fileInfo.IsDir() && !isDiskArchivingFile(fileInfo.Name()) {
 			filenames = append(filenames, filepath.Base(fileInfo.Name()))
 		}
 	}
 	return filenames, nil
 }
 
+// readOne reads the file at `relDstPath`.
+func (a DiskArchiver) readOne(relDstPath string) ([]byte, error) {
+	return readAll(a, relDstPath)
+}
+
+// openOne opens the file at `relDstPath`, decrypting it as it is read.
+func (a DiskArchiver) openOne(relDstPath string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(a.DstRoot, relDstPath))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := a.cipher.decryptingReader(f, relDstPath)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{Reader: r, Closer: f}, nil
+}
+
+// deleteOne deletes the file at `relDstPath`, and then any dirs that
+// it leaves empty.
+func (a DiskArchiver) deleteOne(relDstPath string) error {
+	absDstPath := filepath.Join(a.DstRoot, relDstPath)
+	if err := os.Remove(absDstPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	root := filepath.Clean(a.DstRoot)
+	for dir := filepath.Dir(absDstPath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Fails if the dir isn't empty, which is where we stop
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// lsDstTree returns the paths of all files under the given dir,
+// relative to it.
+func (a DiskArchiver) lsDstTree(relDstRoot string) ([]string, error) {
+	dstFullRoot := filepath.Join(a.DstRoot, relDstRoot)
+
+	filenames := make([]string, 0)
+	err := filepath.Walk(dstFullRoot, func(absPath string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+		if info.IsDir() || isDiskArchivingFile(info.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(dstFullRoot, absPath)
+		if err != nil {
+			return err
+		}
+		filenames = append(filenames, filepath.ToSlash(relPath))
+		return nil
+	})
+	if err != nil {
+		return []string{}, err
+	}
+	return filenames, nil
+}
+
 func (a DiskArchiver) DescribeDstRoot() string {
 	return a.DstRoot
 }
@@ -200,7 +438,11 @@ func NewDiskArchiver(config types.ArchiveConfig) (DiskArchiver, error) {
 	if err := os.MkdirAll(dstRoot, 0755); err != nil {
 		return DiskArchiver{}, err
 	}
-	return DiskArchiver{DstRoot: dstRoot}, nil
+	c, err := newArchiveCipher(config.Encryption)
+	if err != nil {
+		return DiskArchiver{}, err
+	}
+	return DiskArchiver{DstRoot: dstRoot, cipher: c}, nil
 }
 
 // S3Archiver archives files to S3.
@@ -208,32 +450,90 @@ type S3Archiver struct {
 	bucketName string
 	rootKey    string
 	s3client   s3iface.S3API
+	// The server-side encryption to ask for, if any
+	sse         string
+	sseKMSKeyId string
+	// Encrypts archived files before they are uploaded, if set (see
+	// encryption.go)
+	cipher *archiveCipher
 }
 
+// archiveOne uploads the file at `absSrcPath` to `relDstPath`. The
+// upload carries the MD5 of what is uploaded, so that S3 rejects it if
+// it is corrupted on the way.
+//
+// PutObject needs a body that it can seek, and the MD5 has to be known
+// before the upload starts, so an encrypted file is streamed into a
+// temporary file first, rather than being encrypted in memory.
 func (a S3Archiver) archiveOne(absSrcPath, relDstPath string) error {
 	srcFd, err := os.Open(absSrcPath)
 	if err != nil {
 		return err
 	}
+	defer srcFd.Close()
+
+	var body io.ReadSeeker = srcFd
+	if a.cipher != nil {
+		encrypted, err := archiveTempFile("roving-archive-encrypted")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(encrypted.Name())
+		defer encrypted.Close()
+
+		w, err := a.cipher.encryptingWriter(encrypted, relDstPath)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, srcFd); err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+		if _, err = encrypted.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		body = encrypted
+	}
+
+	md5Hash := md5.New()
+	if _, err = io.Copy(md5Hash, body); err != nil {
+		return err
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 
 	dstKey := a.dstKey(relDstPath)
 
 	input := &s3.PutObjectInput{
-		Bucket: aws.String(a.bucketName),
-		Key:    aws.String(dstKey),
-		Body:   srcFd,
+		Bucket:     aws.String(a.bucketName),
+		Key:        aws.String(dstKey),
+		Body:       body,
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(md5Hash.Sum(nil))),
+	}
+	if a.sse != "" {
+		input.ServerSideEncryption = aws.String(a.sse)
+	}
+	if a.sseKMSKeyId != "" {
+		input.SSEKMSKeyId = aws.String(a.sseKMSKeyId)
 	}
 	_, err = a.s3client.PutObject(input)
 	if err != nil {
 		return err
 	}
 	log.Printf("Archiving file to S3 bucket=%v key=%v", a.bucketName, dstKey)
-
-	srcFd.Close()
 	return nil
 }
 
+// LsDstFiles returns the keys of all objects under the given
+// prefix, relative to it.
 func (a S3Archiver) LsDstFiles(relDstRoot string) ([]string, error) {
+	if filenames, present, err := lsSnapshotFiles(a, relDstRoot, true); present {
+		return filenames, err
+	}
+
 	fullPrefix := filepath.Join(a.rootKey, relDstRoot)
 	input := s3.ListObjectsInput{
 		Bucket: aws.String(a.bucketName),
@@ -245,7 +545,7 @@ func (a S3Archiver) LsDstFiles(relDstRoot string) ([]string, error) {
 		&input,
 		func(output *s3.ListObjectsOutput, lastPage bool) bool {
 			for _, obj := range output.Contents {
-				filename, err := filepath.Rel(relDstRoot, *obj.Key)
+				filename, err := filepath.Rel(fullPrefix, *obj.Key)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -260,6 +560,64 @@ func (a S3Archiver) LsDstFiles(relDstRoot string) ([]string, error) {
 	return filenames, nil
 }
 
+// readOne reads the object at `relDstPath`.
+func (a S3Archiver) readOne(relDstPath string) ([]byte, error) {
+	return readAll(a, relDstPath)
+}
+
+// openOne opens the object at `relDstPath`, decrypting it as it is
+// downloaded.
+func (a S3Archiver) openOne(relDstPath string) (io.ReadCloser, error) {
+	output, err := a.s3client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(a.dstKey(relDstPath)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := a.cipher.decryptingReader(output.Body, relDstPath)
+	if err != nil {
+		output.Body.Close()
+		return nil, err
+	}
+	return readCloser{Reader: r, Closer: output.Body}, nil
+}
+
+// deleteOne deletes the object at `relDstPath`.
+func (a S3Archiver) deleteOne(relDstPath string) error {
+	_, err := a.s3client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(a.dstKey(relDstPath)),
+	})
+	return err
+}
+
+// lsDstTree returns the keys of all objects under the given dir,
+// relative to it.
+func (a S3Archiver) lsDstTree(relDstRoot string) ([]string, error) {
+	// The trailing slash stops "1000" from matching "10000/..."
+	fullPrefix := a.dstKey(relDstRoot) + "/"
+	input := s3.ListObjectsInput{
+		Bucket: aws.String(a.bucketName),
+		Prefix: aws.String(fullPrefix),
+	}
+
+	filenames := make([]string, 0)
+	err := a.s3client.ListObjectsPages(
+		&input,
+		func(output *s3.ListObjectsOutput, lastPage bool) bool {
+			for _, obj := range output.Contents {
+				filenames = append(filenames, strings.TrimPrefix(*obj.Key, fullPrefix))
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return []string{}, err
+	}
+	return filenames, nil
+}
+
 func (a S3Archiver) DescribeDstRoot() string {
 	u := url.URL{
 		Scheme: "s3",
@@ -279,22 +637,43 @@ func (a S3Archiver) dstKey(dstRelPath string) string {
 }
 
 func NewS3Archiver(config types.ArchiveConfig) (S3Archiver, error) {
-	rootKey := config.S3.RootKey
-	bucketName := config.S3.BucketName
-	awsRegion := config.S3.AwsRegion
-	isLocal := config.S3.IsLocal
+	s3Conf := config.S3
 
-	if isLocal && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+	if s3Conf.IsLocal && s3Conf.AccessKeyId == "" && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
 		log.Fatal("No AWS access key ID found. Configure AWS access with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
 	}
-	s3client := s3.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(awsRegion),
-	})))
+
+	awsConf := aws.Config{
+		Region: aws.String(s3Conf.AwsRegion),
+	}
+	if s3Conf.Endpoint != "" {
+		awsConf.Endpoint = aws.String(s3Conf.Endpoint)
+	}
+	if s3Conf.PathStyle {
+		awsConf.S3ForcePathStyle = aws.Bool(true)
+	}
+	if s3Conf.AccessKeyId != "" {
+		awsConf.Credentials = credentials.NewStaticCredentials(s3Conf.AccessKeyId, s3Conf.SecretAccessKey, "")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:  awsConf,
+		Profile: s3Conf.Profile,
+	})
+	if err != nil {
+		return S3Archiver{}, err
+	}
+	c, err := newArchiveCipher(config.Encryption)
+	if err != nil {
+		return S3Archiver{}, err
+	}
 
 	return S3Archiver{
-		bucketName: bucketName,
-		rootKey:    rootKey,
-		s3client:   s3client,
+		bucketName:  s3Conf.BucketName,
+		rootKey:     s3Conf.RootKey,
+		s3client:    s3.New(sess),
+		sse:         s3Conf.SSE,
+		sseKMSKeyId: s3Conf.SSEKMSKeyId,
+		cipher:      c,
 	}, nil
 }
 
@@ -315,11 +694,19 @@ type ManifestEntry struct {
 // newSimpleManifest constructs a manifest of all files in a dir.
 // This is useful because it allows us to copy something that
 // is as close to a point-in-time snapshot as reasonably possible.
-func newSimpleManifest(srcRoot, dstSubRoot string) Manifest {
+func newSimpleManifest(srcRoot, dstSubRoot string) (Manifest, error) {
 	manifest := Manifest{srcRoot: srcRoot}
 
 	// TODO(rob): use readDir to make this more atomic
-	filepath.Walk(srcRoot, func(absSrcPath string, info os.FileInfo, walkErr error) error {
+	err := filepath.Walk(srcRoot, func(absSrcPath string, info os.FileInfo, walkErr error) error {
+		// Files can be removed while we walk, for example by the
+		// QueueRetirer. They just aren't in the manifest.
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
 		// If current node is a dir then we don't have to add anything to the manifest
 		if !info.IsDir() {
 			relSrcPath, err := filepath.Rel(manifest.srcRoot, absSrcPath)
@@ -341,6 +728,9 @@ func newSimpleManifest(srcRoot, dstSubRoot string) Manifest {
 		}
 		return nil
 	})
+	if err != nil {
+		return Manifest{}, err
+	}
 
-	return manifest
+	return manifest, nil
 }
@@ -2,13 +2,19 @@ package server
 
 import (
 	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/stretchr/testify/assert"
@@ -68,7 +74,7 @@ func TestDiskArchiverNamedDir(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	err = ArchiveToNamedDir(archiver, srcDir, ".")
+	_, err = ArchiveToNamedDir(archiver, srcDir, ".", types.ArchiveModeCopy)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -86,6 +92,9 @@ var putBodies []string
 func resetS3stubs() {
 	putInputs = []*s3.PutObjectInput{}
 	putBodies = []string{}
+	// mockS3Client isn't safe to use from several goroutines, and
+	// tests expect files to be uploaded in order.
+	archiveUploadWorkers = 1
 }
 
 type mockS3Client struct {
@@ -101,22 +110,88 @@ func (m mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput,
 	}
 	putBodies = append(putBodies, string(bodyBytes))
 
+	// Like S3, reject uploads that don't match their MD5
+	if input.ContentMD5 != nil {
+		sum := md5.Sum(bodyBytes)
+		if *input.ContentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, errors.New("BadDigest")
+		}
+	}
 	return nil, nil
 }
 
-// XXX: Doesn't respect the contents of the ListObjectsInput, just returns
-// everything that has been put-ed.
+// XXX: Only respects the Prefix of the ListObjectsInput, and returns
+// everything that has been put-ed under it.
 func (m mockS3Client) ListObjectsPages(input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool) error {
-	for _, input := range putInputs {
-		filename := filepath.Base(*input.Key)
+	for _, putInput := range putInputs {
+		if !strings.HasPrefix(*putInput.Key, *input.Prefix) {
+			continue
+		}
 		output := s3.ListObjectsOutput{Contents: []*s3.Object{
-			&s3.Object{Key: &filename},
+			&s3.Object{Key: putInput.Key},
 		}}
 		fn(&output, false)
 	}
 	return nil
 }
 
+// DeleteObject forgets every object put-ed to the key.
+func (m mockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	keptInputs := []*s3.PutObjectInput{}
+	keptBodies := []string{}
+	for i, putInput := range putInputs {
+		if *putInput.Key != *input.Key {
+			keptInputs = append(keptInputs, putInput)
+			keptBodies = append(keptBodies, putBodies[i])
+		}
+	}
+	putInputs = keptInputs
+	putBodies = keptBodies
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// GetObject returns the body of the last object put-ed to the key.
+func (m mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	for i := len(putInputs) - 1; i >= 0; i-- {
+		if *putInputs[i].Key == *input.Key {
+			body := ioutil.NopCloser(strings.NewReader(putBodies[i]))
+			return &s3.GetObjectOutput{Body: body}, nil
+		}
+	}
+	return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+}
+
+func TestDiskArchiverNeverLeavesPartialFiles(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-archiver-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-archiver-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	// Reading a dir fails part way through the copy
+	assert.NotNil(t, archiver.archiveOne(srcDir, "objects/abc"))
+	infos, err := ioutil.ReadDir(filepath.Join(dstDir, "objects"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(infos))
+
+	// A temporary file left behind by a crash isn't listed
+	writeFile(filepath.Join(srcDir, "abc"), "abc")
+	assert.Nil(t, archiver.archiveOne(filepath.Join(srcDir, "abc"), "objects/abc"))
+	writeFile(filepath.Join(dstDir, "objects", ".def"+diskArchivingExt+"123"), "de")
+	names, err := archiver.LsDstFiles("objects")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"abc"}, names)
+	names, err = archiver.lsDstTree("objects")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"abc"}, names)
+}
+
 func TestS3ArchiverNamedDir(t *testing.T) {
 	var err error
 	resetS3stubs()
@@ -138,7 +213,7 @@ func TestS3ArchiverNamedDir(t *testing.T) {
 		rootKey:    "data/more-data",
 		s3client:   s3client,
 	}
-	err = ArchiveToNamedDir(archiver, srcDir, ".")
+	_, err = ArchiveToNamedDir(archiver, srcDir, ".", types.ArchiveModeCopy)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -153,6 +228,75 @@ func TestS3ArchiverNamedDir(t *testing.T) {
 	assert.Equal(t, "hi there\n", putBodies[1])
 }
 
+func TestS3ArchiverServerSideEncryption(t *testing.T) {
+	resetS3stubs()
+
+	srcDir, err := ioutil.TempDir("", "roving-archiver-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+
+	archiver := S3Archiver{
+		bucketName:  "test-bucket",
+		rootKey:     "data/more-data",
+		s3client:    mockS3Client{},
+		sse:         types.S3SSEKMS,
+		sseKMSKeyId: "roving-key",
+	}
+	if _, err = ArchiveToNamedDir(archiver, srcDir, ".", types.ArchiveModeCopy); err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, 1, len(putInputs))
+	assert.Equal(t, "aws:kms", *putInputs[0].ServerSideEncryption)
+	assert.Equal(t, "roving-key", *putInputs[0].SSEKMSKeyId)
+}
+
+func TestS3ArchiverSendsChecksums(t *testing.T) {
+	resetS3stubs()
+
+	srcDir, err := ioutil.TempDir("", "roving-archiver-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+
+	archiver := S3Archiver{
+		bucketName: "test-bucket",
+		rootKey:    "data/more-data",
+		s3client:   mockS3Client{},
+	}
+	if err = archiver.archiveOne(filepath.Join(srcDir, "goodbye"), "goodbye"); err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, 1, len(putInputs))
+	assert.Equal(t, "MtbBF0fgNxVSEAfYyEta/w==", *putInputs[0].ContentMD5)
+	assert.Equal(t, "goodbye\n", putBodies[0])
+}
+
+func TestNewS3ArchiverWithEndpoint(t *testing.T) {
+	conf := types.ArchiveConfig{
+		Type: "s3",
+		S3: types.S3ArchiveConfig{
+			RootKey:         "roving",
+			BucketName:      "test-bucket",
+			AwsRegion:       "us-east-1",
+			Endpoint:        "http://localhost:9000",
+			PathStyle:       true,
+			AccessKeyId:     "minio",
+			SecretAccessKey: "minio123",
+			SSE:             types.S3SSEAES256,
+		},
+	}
+	archiver, err := NewS3Archiver(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "test-bucket", archiver.bucketName)
+	assert.Equal(t, types.S3SSEAES256, archiver.sse)
+	assert.Equal(t, "s3://test-bucket/roving", archiver.DescribeDstRoot())
+}
+
 func TestS3ArchiverTimestampedDir(t *testing.T) {
 	getTimestamp = func() int64 {
 		return 4815162342
@@ -178,11 +322,11 @@ func TestS3ArchiverTimestampedDir(t *testing.T) {
 		s3client:   s3client,
 	}
 
-	err = archiveToTimestampedDir(archiver, srcDir)
+	_, err = archiveToTimestampedDir(archiver, srcDir, types.ArchiveModeCopy)
 	if err != nil {
 		log.Fatal(err)
 	}
-	assert.Equal(t, 2, len(putBodies))
+	assert.Equal(t, 3, len(putBodies))
 
 	assert.Equal(t, "test-bucket", *putInputs[0].Bucket)
 	assert.Equal(t, "data/more-data/4815162342/goodbye", *putInputs[0].Key)
@@ -191,6 +335,16 @@ func TestS3ArchiverTimestampedDir(t *testing.T) {
 	assert.Equal(t, "test-bucket", *putInputs[1].Bucket)
 	assert.Equal(t, "data/more-data/4815162342/hi/there", *putInputs[1].Key)
 	assert.Equal(t, "hi there\n", putBodies[1])
+
+	// The copy is marked complete once all of its files are archived
+	assert.Equal(t, "data/more-data/4815162342.complete", *putInputs[2].Key)
+	var copy Snapshot
+	assert.Nil(t, json.Unmarshal([]byte(putBodies[2]), &copy))
+	assert.Equal(t, "4815162342", copy.Copy)
+	assert.Equal(t, []SnapshotFile{
+		{Path: "goodbye", Sha256: "71573b922a87abc3fd1a957f2cfa09d9e16998567dd878a85e12166112751806", Size: 8},
+		{Path: "hi/there", Sha256: "c641344867e9806fadfd219f25b62b97c94db0eed04a1d79e93676533cfb782b", Size: 9},
+	}, copy.Files)
 }
 
 func TestS3ArchiverLsDstFiles(t *testing.T) {
@@ -215,7 +369,7 @@ func TestS3ArchiverLsDstFiles(t *testing.T) {
 		s3client:   s3client,
 	}
 
-	if err = ArchiveToNamedDir(archiver, srcDir, ""); err != nil {
+	if _, err = ArchiveToNamedDir(archiver, srcDir, "", types.ArchiveModeCopy); err != nil {
 		log.Fatal(err)
 	}
 	assert.Equal(t, 2, len(putBodies))
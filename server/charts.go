@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+// charts.go renders StatsSamples as simple inline SVG line charts for
+// the admin interface. We render them on the server so that the admin
+// pages don't need any JavaScript.
+
+var chartWidth int = 400
+var chartHeight int = 120
+var chartPadding int = 4
+
+// svgChart renders the history of stat `stat` in `samples` as an
+// SVG line chart, labelled with the stat's latest, min and max values.
+func svgChart(samples []StatsSample, stat string) template.HTML {
+	points := make([]StatsSample, 0, len(samples))
+	for _, sample := range samples {
+		if _, present := sample.Values[stat]; present {
+			points = append(points, sample)
+		}
+	}
+	if len(points) == 0 {
+		return template.HTML(fmt.Sprintf("<p>No history for %s yet</p>", template.HTMLEscapeString(stat)))
+	}
+
+	minV, maxV := points[0].Values[stat], points[0].Values[stat]
+	for _, p := range points {
+		v := p.Values[stat]
+		if v < minV {
+			minV = v
+		}
+		if v > maxV {
+			maxV = v
+		}
+	}
+	start := points[0].Time
+	end := points[len(points)-1].Time
+
+	plotW := float64(chartWidth - 2*chartPadding)
+	plotH := float64(chartHeight - 2*chartPadding)
+	coords := make([]string, 0, len(points))
+	for _, p := range points {
+		var x, y float64
+		if end.After(start) {
+			x = plotW * float64(p.Time.Sub(start)) / float64(end.Sub(start))
+		}
+		if maxV > minV {
+			y = plotH * (p.Values[stat] - minV) / (maxV - minV)
+		}
+		coords = append(coords, fmt.Sprintf(
+			"%.1f,%.1f",
+			float64(chartPadding)+x,
+			float64(chartPadding)+plotH-y,
+		))
+	}
+
+	latest := points[len(points)-1].Values[stat]
+	return template.HTML(fmt.Sprintf(
+		`<figure>`+
+			`<figcaption>%s: %s (min %s, max %s, %s to %s)</figcaption>`+
+			`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" style="border: 1px solid #ccc;">`+
+			`<polyline fill="none" stroke="#36c" stroke-width="1.5" points="%s"/>`+
+			`</svg>`+
+			`</figure>`,
+		template.HTMLEscapeString(stat),
+		fmtStatValue(latest),
+		fmtStatValue(minV),
+		fmtStatValue(maxV),
+		start.Format(time.RFC3339),
+		end.Format(time.RFC3339),
+		chartWidth,
+		chartHeight,
+		strings.Join(coords, " "),
+	))
+}
+
+func fmtStatValue(v float64) string {
+	if v == float64(int64(v)) {
+		return fmt.Sprintf("%d", int64(v))
+	}
+	return fmt.Sprintf("%.2f", v)
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// composite_archiver.go archives the workdir to several destinations
+// at once, for example to local disk for quick restores and to S3 for
+// durability. Each destination archives the workdir on its own
+// schedule and prunes its archives according to its own retention
+// policy. Everything else that the server archives, such as realtime
+// crashes and retired fuzzers, goes through a CompositeArchiver, which
+// fans it out to every destination.
+
+// An ArchiveDestination is one of the places that the server archives
+// its workdir to.
+type ArchiveDestination struct {
+	Conf     types.ArchiveDestinationConfig
+	Archiver Archiver
+
+	statusLock sync.RWMutex
+	status     ArchiveDestinationStatus
+}
+
+// ArchiveDestinationStatus is how an ArchiveDestination's scheduled
+// archives have been going.
+type ArchiveDestinationStatus struct {
+	Name      string
+	Type      string
+	Dst       string
+	Interval  time.Duration
+	Retention types.ArchiveRetentionConfig
+	// When the most recent archive started, and when the most recent
+	// successful one finished. Both are zero if there hasn't been one.
+	LastRun     time.Time
+	LastSuccess time.Time
+	// Why the most recent archive failed, if it did
+	LastError string
+	// How many files the most recent archive uploaded, skipped and
+	// failed to upload, if there has been one
+	LastResult *ArchiveResult
+	// What the most recent prune did, if there has been one
+	LastPrune *PruneReport
+}
+
+// newArchiveDestinations builds an ArchiveDestination for each of
+// the destinations that `config` chooses.
+func newArchiveDestinations(config types.ArchiveConfig) ([]*ArchiveDestination, error) {
+	destinations := make([]*ArchiveDestination, 0)
+	for _, dstConf := range config.AllDestinations() {
+		var a Archiver
+		var err error
+		switch dstConf.Type {
+		case "disk":
+			a, err = NewDiskArchiver(types.ArchiveConfig{Type: dstConf.Type, Disk: dstConf.Disk, Encryption: config.Encryption})
+		case "s3":
+			a, err = NewS3Archiver(types.ArchiveConfig{Type: dstConf.Type, S3: dstConf.S3, Encryption: config.Encryption})
+		default:
+			err = fmt.Errorf("Unknown archiver type: %s", dstConf.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, newArchiveDestination(dstConf, a))
+	}
+	return destinations, nil
+}
+
+func newArchiveDestination(conf types.ArchiveDestinationConfig, a Archiver) *ArchiveDestination {
+	return &ArchiveDestination{
+		Conf:     conf,
+		Archiver: a,
+		status: ArchiveDestinationStatus{
+			Name:      conf.Name,
+			Type:      conf.Type,
+			Dst:       a.DescribeDstRoot(),
+			Interval:  conf.Interval,
+			Retention: conf.Retention,
+		},
+	}
+}
+
+// archiveForever archives `absSrcPath` to the destination every
+// `d.Conf.Interval`, in archive mode `mode`.
+//
+// This function never returns.
+func (d *ArchiveDestination) archiveForever(absSrcPath, mode string) {
+	ticker := time.NewTicker(d.Conf.Interval)
+	for {
+		select {
+		case <-ticker.C:
+			d.archiveOnce(absSrcPath, mode)
+		}
+	}
+}
+
+// archiveOnce archives `absSrcPath` to a timestamped dir in the
+// destination. In types.ArchiveModeCopy, the archive preserves the
+// original directory structure, and is saved at `$TIMESTAMP/`. In
+// types.ArchiveModeSnapshot and types.ArchiveModeTarball, the archive
+// is a snapshot (see snapshots.go and tarballs.go). After a
+// successful archive, old archives are pruned according to the
+// destination's retention policy.
+func (d *ArchiveDestination) archiveOnce(absSrcPath, mode string) error {
+	dst := d.Archiver.DescribeDstRoot()
+	log.Printf("Archiving to timestamped dir src=%s dst=%s destination=%s", absSrcPath, dst, d.Conf.Name)
+	events.publish(EventArchiveStarted, "", map[string]interface{}{
+		"src":         absSrcPath,
+		"dst":         dst,
+		"destination": d.Conf.Name,
+	})
+
+	start := time.Now()
+	d.statusLock.Lock()
+	d.status.LastRun = start
+	d.statusLock.Unlock()
+
+	result, err := archiveToTimestampedDir(d.Archiver, absSrcPath, mode)
+	log.Printf("Archived to timestamped dir destination=%s uploaded=%d skipped=%d failed=%d", d.Conf.Name, result.Uploaded, result.Skipped, result.Failed)
+	finished := map[string]interface{}{
+		"src":              absSrcPath,
+		"dst":              dst,
+		"destination":      d.Conf.Name,
+		"duration_seconds": time.Since(start).Seconds(),
+		"uploaded":         result.Uploaded,
+		"skipped":          result.Skipped,
+		"failed":           result.Failed,
+	}
+	d.statusLock.Lock()
+	d.status.LastResult = &result
+	d.statusLock.Unlock()
+	if err != nil {
+		types.ReportErrorAndWait(err, map[string]string{"src": absSrcPath, "destination": d.Conf.Name})
+		log.Print(err)
+		webhooks.notify(newArchiveFailedEvent(absSrcPath, err, time.Now()))
+		finished["error"] = err.Error()
+
+		d.statusLock.Lock()
+		d.status.LastError = err.Error()
+		d.statusLock.Unlock()
+		events.publish(EventArchiveFinished, "", finished)
+		return err
+	}
+
+	d.statusLock.Lock()
+	d.status.LastSuccess = time.Now()
+	d.status.LastError = ""
+	d.statusLock.Unlock()
+
+	if d.Conf.Retention.Enabled() {
+		report, err := pruneArchive(d.Archiver, mode, d.Conf.Retention)
+		if err != nil {
+			types.ReportError(err, map[string]string{"dst": dst, "destination": d.Conf.Name})
+			log.Printf("Couldn't prune archives destination=%s err=%v", d.Conf.Name, err)
+			report.Error = err.Error()
+		}
+		d.statusLock.Lock()
+		d.status.LastPrune = &report
+		d.statusLock.Unlock()
+		finished["pruned"] = len(report.Pruned)
+	}
+	events.publish(EventArchiveFinished, "", finished)
+	return nil
+}
+
+// Status returns how the destination's archives have been going.
+func (d *ArchiveDestination) Status() ArchiveDestinationStatus {
+	d.statusLock.RLock()
+	defer d.statusLock.RUnlock()
+	return d.status
+}
+
+// archiveDestinationStatuses returns the status of each of
+// `destinations`.
+func archiveDestinationStatuses(destinations []*ArchiveDestination) []ArchiveDestinationStatus {
+	statuses := make([]ArchiveDestinationStatus, 0, len(destinations))
+	for _, d := range destinations {
+		statuses = append(statuses, d.Status())
+	}
+	return statuses
+}
+
+// A CompositeArchiver is an Archiver that archives to every one of
+// its `Destinations`. Listing files lists what any destination has,
+// and reading a file reads it from the first destination that has
+// it, so a snapshot can be restored from whichever destination took
+// it. A destination that can't be listed, for example because S3 is
+// down, is left out of listings, so that the rest can carry on.
+//
+// A file that can't be archived to one destination is still archived
+// to the others. Since it is then listed, it is never archived to the
+// failed destination again. For a realtime crash, that means the
+// failed destination's `realtime-crashes/` never has it, though its
+// scheduled archives of the workdir still do.
+type CompositeArchiver struct {
+	Destinations []*ArchiveDestination
+}
+
+func (a *CompositeArchiver) archiveOne(absSrcPath, relDstPath string) error {
+	failed := make([]string, 0)
+	for _, d := range a.Destinations {
+		if err := d.Archiver.archiveOne(absSrcPath, relDstPath); err != nil {
+			log.Printf("Couldn't archive file src=%s destination=%s err=%v", absSrcPath, d.Conf.Name, err)
+			failed = append(failed, fmt.Sprintf("%s (%v)", d.Conf.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Couldn't archive %s to %s", absSrcPath, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (a *CompositeArchiver) LsDstFiles(relDstRoot string) ([]string, error) {
+	return a.union(func(d Archiver) ([]string, error) {
+		return d.LsDstFiles(relDstRoot)
+	})
+}
+
+func (a *CompositeArchiver) readOne(relDstPath string) ([]byte, error) {
+	var lastErr error
+	for _, d := range a.Destinations {
+		buf, err := d.Archiver.readOne(relDstPath)
+		if err == nil {
+			return buf, nil
+		}
+		// Prefer reporting an error other than the file not existing,
+		// since that is more likely to be why the file couldn't be
+		// read.
+		if lastErr == nil || !isNotExist(err) {
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("There are no archive destinations to read %s from", relDstPath)
+	}
+	return nil, lastErr
+}
+
+func (a *CompositeArchiver) openOne(relDstPath string) (io.ReadCloser, error) {
+	var lastErr error
+	for _, d := range a.Destinations {
+		rc, err := d.Archiver.openOne(relDstPath)
+		if err == nil {
+			return rc, nil
+		}
+		// As in readOne
+		if lastErr == nil || !isNotExist(err) {
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("There are no archive destinations to read %s from", relDstPath)
+	}
+	return nil, lastErr
+}
+
+func (a *CompositeArchiver) deleteOne(relDstPath string) error {
+	var firstErr error
+	for _, d := range a.Destinations {
+		if err := d.Archiver.deleteOne(relDstPath); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *CompositeArchiver) lsDstTree(relDstRoot string) ([]string, error) {
+	return a.union(func(d Archiver) ([]string, error) {
+		return d.lsDstTree(relDstRoot)
+	})
+}
+
+func (a *CompositeArchiver) DescribeDstRoot() string {
+	roots := make([]string, 0, len(a.Destinations))
+	for _, d := range a.Destinations {
+		roots = append(roots, d.Archiver.DescribeDstRoot())
+	}
+	return strings.Join(roots, ", ")
+}
+
+func (a *CompositeArchiver) DescribeDstLoc(relDstPath string) string {
+	locs := make([]string, 0, len(a.Destinations))
+	for _, d := range a.Destinations {
+		locs = append(locs, d.Archiver.DescribeDstLoc(relDstPath))
+	}
+	return strings.Join(locs, ", ")
+}
+
+// union returns the sorted union of the filenames that `ls` returns
+// for each destination. Destinations that `ls` fails for are logged
+// and skipped. It only returns an error if `ls` fails for every
+// destination.
+func (a *CompositeArchiver) union(ls func(Archiver) ([]string, error)) ([]string, error) {
+	seen := make(map[string]bool)
+	filenames := make([]string, 0)
+	var lastErr error
+	listed := 0
+	for _, d := range a.Destinations {
+		names, err := ls(d.Archiver)
+		if err != nil {
+			log.Printf("Couldn't list archived files destination=%s err=%v", d.Conf.Name, err)
+			types.ReportError(err, map[string]string{"destination": d.Conf.Name})
+			lastErr = err
+			continue
+		}
+		listed++
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				filenames = append(filenames, name)
+			}
+		}
+	}
+	if listed == 0 && lastErr != nil {
+		return []string{}, lastErr
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
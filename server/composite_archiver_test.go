@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// setupCompositeTest builds a CompositeArchiver with two disk
+// destinations, and returns it with their roots.
+func setupCompositeTest(t *testing.T) (*CompositeArchiver, []string) {
+	roots := []string{}
+	destinations := []*ArchiveDestination{}
+	for _, name := range []string{"local", "remote"} {
+		dstDir, err := ioutil.TempDir("", "roving-composite-test-"+name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots = append(roots, dstDir)
+		conf := types.ArchiveDestinationConfig{
+			Name:     name,
+			Type:     "disk",
+			Interval: time.Hour,
+			Disk:     types.DiskArchiveConfig{DstRoot: dstDir},
+		}
+		destinations = append(destinations, newArchiveDestination(conf, DiskArchiver{DstRoot: dstDir}))
+	}
+	return &CompositeArchiver{Destinations: destinations}, roots
+}
+
+func TestCompositeArchiverFansOut(t *testing.T) {
+	archiver, roots := setupCompositeTest(t)
+	for _, root := range roots {
+		defer os.RemoveAll(root)
+	}
+
+	srcDir, err := ioutil.TempDir("", "roving-composite-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFile(filepath.Join(srcDir, "crash"), "crash")
+	writeFile(filepath.Join(roots[1], "realtime-crashes", "older"), "older")
+
+	err = archiver.archiveOne(filepath.Join(srcDir, "crash"), "realtime-crashes/crash")
+	assert.Nil(t, err)
+	for _, root := range roots {
+		assert.Equal(t, "crash", readFile(filepath.Join(root, "realtime-crashes", "crash")))
+	}
+
+	// Listing lists what any destination has
+	names, err := archiver.LsDstFiles("realtime-crashes")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"crash", "older"}, names)
+
+	// Reading reads from the first destination that has the file
+	buf, err := archiver.readOne("realtime-crashes/older")
+	assert.Nil(t, err)
+	assert.Equal(t, "older", string(buf))
+	_, err = archiver.readOne("realtime-crashes/missing")
+	assert.True(t, isNotExist(err))
+
+	assert.Nil(t, archiver.deleteOne("realtime-crashes/crash"))
+	for _, root := range roots {
+		_, err = os.Stat(filepath.Join(root, "realtime-crashes", "crash"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+// unlistableArchiver is a DiskArchiver that can't list its files.
+type unlistableArchiver struct {
+	DiskArchiver
+}
+
+func (a unlistableArchiver) LsDstFiles(relDstRoot string) ([]string, error) {
+	return []string{}, errors.New("can't list files")
+}
+
+func (a unlistableArchiver) lsDstTree(relDstRoot string) ([]string, error) {
+	return []string{}, errors.New("can't list files")
+}
+
+func TestCompositeArchiverListsPastBrokenDestinations(t *testing.T) {
+	archiver, roots := setupCompositeTest(t)
+	for _, root := range roots {
+		defer os.RemoveAll(root)
+	}
+	writeFile(filepath.Join(roots[0], "realtime-crashes", "crash"), "crash")
+	archiver.Destinations[1].Archiver = unlistableArchiver{DiskArchiver{DstRoot: roots[1]}}
+
+	names, err := archiver.LsDstFiles("realtime-crashes")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"crash"}, names)
+	names, err = archiver.lsDstTree("realtime-crashes")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"crash"}, names)
+
+	// ...unless every destination is broken
+	archiver.Destinations[0].Archiver = unlistableArchiver{DiskArchiver{DstRoot: roots[0]}}
+	_, err = archiver.LsDstFiles("realtime-crashes")
+	assert.NotNil(t, err)
+}
+
+func TestArchiveDestinationStatus(t *testing.T) {
+	events = newEventBus()
+	archiver, roots := setupCompositeTest(t)
+	for _, root := range roots {
+		defer os.RemoveAll(root)
+	}
+	local := archiver.Destinations[0]
+	remote := archiver.Destinations[1]
+	local.Conf.Retention = types.ArchiveRetentionConfig{KeepLast: 1}
+	// The remote destination can't archive anything
+	remote.Archiver = failingArchiver{DiskArchiver{DstRoot: roots[1]}}
+
+	srcDir, err := ioutil.TempDir("", "roving-composite-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFile(filepath.Join(srcDir, "bad"), "bad")
+
+	status := local.Status()
+	assert.Equal(t, "local", status.Name)
+	assert.True(t, status.LastRun.IsZero())
+
+	for _, ts := range []int64{1000, 2000} {
+		getTimestamp = func() int64 {
+			return ts
+		}
+		assert.Nil(t, local.archiveOnce(srcDir, types.ArchiveModeSnapshot))
+		assert.NotNil(t, remote.archiveOnce(srcDir, types.ArchiveModeSnapshot))
+	}
+
+	statuses := archiveDestinationStatuses(archiver.Destinations)
+	assert.Equal(t, 2, len(statuses))
+	assert.False(t, statuses[0].LastSuccess.IsZero())
+	assert.Equal(t, "", statuses[0].LastError)
+	// Each destination is pruned by its own policy
+	assert.NotNil(t, statuses[0].LastPrune)
+	assert.Equal(t, []int64{1000}, statuses[0].LastPrune.Pruned)
+
+	assert.False(t, statuses[1].LastRun.IsZero())
+	assert.True(t, statuses[1].LastSuccess.IsZero())
+	assert.NotEqual(t, "", statuses[1].LastError)
+	assert.Nil(t, statuses[1].LastPrune)
+
+	_, published := events.subscribe(EventFilter{Types: map[string]bool{EventArchiveFinished: true}}, 0)
+	assert.Equal(t, 4, len(published))
+	assert.Equal(t, "local", published[0].Data["destination"])
+}
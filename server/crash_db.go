@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CrashStatus is where a crash is in the triage workflow.
+type CrashStatus string
+
+const (
+	CrashNew     CrashStatus = "new"
+	CrashTriaged CrashStatus = "triaged"
+	CrashFixed   CrashStatus = "fixed"
+	CrashWontFix CrashStatus = "wont-fix"
+)
+
+// CrashStatuses lists every valid CrashStatus, in workflow order.
+var CrashStatuses = []CrashStatus{CrashNew, CrashTriaged, CrashFixed, CrashWontFix}
+
+func parseCrashStatus(s string) (CrashStatus, error) {
+	for _, status := range CrashStatuses {
+		if string(status) == s {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown crash status: %s", s)
+}
+
+// CrashRecord is everything the server knows about a crash beyond
+// the crash's input itself, which stays on disk in the reporting
+// fuzzer's crashes dir.
+type CrashRecord struct {
+	FuzzerId  string
+	Name      string
+	FirstSeen time.Time
+	// The SHA-256 of the target binary that was being served when
+	// the crash was first seen. Empty if the target is not a binary.
+	TargetHash string
+	Status     CrashStatus
+	Notes      string
+	UpdatedAt  time.Time
+}
+
+// CrashFilter restricts the crashes returned by Database.Crashes.
+// Empty fields match everything.
+type CrashFilter struct {
+	FuzzerId string
+	Status   CrashStatus
+}
+
+func (f CrashFilter) matches(c CrashRecord) bool {
+	if f.FuzzerId != "" && f.FuzzerId != c.FuzzerId {
+		return false
+	}
+	if f.Status != "" && f.Status != c.Status {
+		return false
+	}
+	return true
+}
+
+func crashKey(fuzzerId, name string) []byte {
+	return []byte(fuzzerId + "/" + name)
+}
+
+// RecordCrashes adds a CrashRecord for each of the given crashes that
+// the database hasn't seen before. Crashes that are already recorded
+// are left untouched. It returns the records that were added.
+func (d *Database) RecordCrashes(fuzzerId string, names []string, targetHash string, now time.Time) ([]CrashRecord, error) {
+	added := make([]CrashRecord, 0)
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(crashesBucket)
+		for _, name := range names {
+			key := crashKey(fuzzerId, name)
+			if b.Get(key) != nil {
+				continue
+			}
+
+			record := CrashRecord{
+				FuzzerId:   fuzzerId,
+				Name:       name,
+				FirstSeen:  now,
+				TargetHash: targetHash,
+				Status:     CrashNew,
+				UpdatedAt:  now,
+			}
+			buf, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err = b.Put(key, buf); err != nil {
+				return err
+			}
+			added = append(added, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// Crash returns the record for a single crash, and whether it exists.
+func (d *Database) Crash(fuzzerId, name string) (CrashRecord, bool, error) {
+	var record CrashRecord
+	var present bool
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(crashesBucket).Get(crashKey(fuzzerId, name))
+		if buf == nil {
+			return nil
+		}
+		present = true
+		return json.Unmarshal(buf, &record)
+	})
+	return record, present, err
+}
+
+// Crashes returns every crash that matches `filter`, most recently
+// seen first.
+func (d *Database) Crashes(filter CrashFilter) ([]CrashRecord, error) {
+	records := make([]CrashRecord, 0)
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(crashesBucket).ForEach(func(k, v []byte) error {
+			var record CrashRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if filter.matches(record) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].FirstSeen.Equal(records[j].FirstSeen) {
+			return string(crashKey(records[i].FuzzerId, records[i].Name)) <
+				string(crashKey(records[j].FuzzerId, records[j].Name))
+		}
+		return records[i].FirstSeen.After(records[j].FirstSeen)
+	})
+	return records, nil
+}
+
+// UpdateCrash sets the status and notes of a crash. It returns an
+// error if the crash has never been recorded.
+func (d *Database) UpdateCrash(fuzzerId, name string, status CrashStatus, notes string, now time.Time) (CrashRecord, error) {
+	var record CrashRecord
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(crashesBucket)
+		key := crashKey(fuzzerId, name)
+
+		buf := b.Get(key)
+		if buf == nil {
+			return fmt.Errorf("No such crash: %s", key)
+		}
+		if err := json.Unmarshal(buf, &record); err != nil {
+			return err
+		}
+
+		record.Status = status
+		record.Notes = notes
+		record.UpdatedAt = now
+
+		buf, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, buf)
+	})
+	return record, err
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "roving-database-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := openDatabase(filepath.Join(dir, "roving.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRecordCrashes(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	t1 := time.Unix(1000, 0)
+	added, err := d.RecordCrashes("fuzzer-123", []string{"crash1", "crash2"}, "abc", t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(added))
+
+	// Crashes that have already been recorded keep their first-seen time
+	t2 := time.Unix(2000, 0)
+	added, err = d.RecordCrashes("fuzzer-123", []string{"crash2", "crash3"}, "def", t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, "crash3", added[0].Name)
+
+	crash, present, err := d.Crash("fuzzer-123", "crash2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, present)
+	assert.Equal(t, t1.Unix(), crash.FirstSeen.Unix())
+	assert.Equal(t, "abc", crash.TargetHash)
+	assert.Equal(t, CrashNew, crash.Status)
+
+	_, present, err = d.Crash("fuzzer-123", "crash4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, present)
+}
+
+func TestUpdateAndFilterCrashes(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	if _, err := d.RecordCrashes("fuzzer-123", []string{"crash1"}, "", time.Unix(1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RecordCrashes("fuzzer-456", []string{"crash2"}, "", time.Unix(2000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	crash, err := d.UpdateCrash("fuzzer-123", "crash1", CrashFixed, "fixed in abc123", time.Unix(3000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, CrashFixed, crash.Status)
+	assert.Equal(t, "fixed in abc123", crash.Notes)
+
+	_, err = d.UpdateCrash("fuzzer-123", "crash3", CrashFixed, "", time.Unix(3000, 0))
+	assert.NotNil(t, err)
+
+	all, err := d.Crashes(CrashFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(all))
+	// Most recently seen first
+	assert.Equal(t, "crash2", all[0].Name)
+	assert.Equal(t, "crash1", all[1].Name)
+
+	fixed, err := d.Crashes(CrashFilter{Status: CrashFixed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(fixed))
+	assert.Equal(t, "crash1", fixed[0].Name)
+
+	fuzzer456, err := d.Crashes(CrashFilter{FuzzerId: "fuzzer-456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(fuzzer456))
+	assert.Equal(t, "crash2", fuzzer456[0].Name)
+}
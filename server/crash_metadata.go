@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// crash_metadata.go archives a JSON sidecar alongside every realtime
+// crash, recording what is needed to reproduce it long after the
+// fuzzer that found it has gone: the target, how AFL was run, and
+// what the fuzzer had reported. Sidecars are kept in their own tree,
+// mirroring the realtime crashes:
+//
+// ├── realtime-crashes/
+// │   └── output/fuzzer-1/crashes/id:000000,sig:11,src:000001
+// └── realtime-crash-metadata/
+//     └── output/fuzzer-1/crashes/id:000000,sig:11,src:000001.json
+
+// The dir that realtime crash sidecars are archived to, relative to
+// the archiver's root.
+var realtimeCrashMetadataPath string = "realtime-crash-metadata"
+
+// The maximum number of realtime crashes whose metadata the admin
+// archive page shows, since each one is a separate read.
+var archivePageCrashMetadata int = 100
+
+// Sidecars aren't changed once they are archived, so they are cached
+// rather than being re-read from the archive whenever the archive
+// page is loaded. They are keyed by where they are archived.
+var crashMetadataCache = make(map[string]CrashMetadata)
+var crashMetadataCacheLock sync.Mutex
+
+// CrashMetadata is what the server knew about a crash when it
+// archived it.
+type CrashMetadata struct {
+	FuzzerId string `json:"fuzzer_id"`
+	Name     string `json:"name"`
+	// When the server received the crash from the fuzzer, which is the
+	// earliest that it could know about it
+	FoundAt    time.Time `json:"found_at"`
+	ArchivedAt time.Time `json:"archived_at"`
+	// The SHA-256 of the target binary that the server hands out. It
+	// is empty if fuzzers build their own target.
+	TargetSha256 string             `json:"target_sha256,omitempty"`
+	FuzzerConfig types.FuzzerConfig `json:"fuzzer_config"`
+	// The stats that the fuzzer reported along with the crash. Nil if
+	// it hasn't reported any.
+	FuzzerStats *types.FuzzerStats `json:"fuzzer_stats,omitempty"`
+}
+
+// newCrashMetadata returns the metadata of `crash`, which fuzzer
+// `crash.FuzzerId` reported along with `stats`, if `hasStats`.
+func newCrashMetadata(crash types.InputInfo, stats types.FuzzerStats, hasStats bool, now time.Time) CrashMetadata {
+	metadata := CrashMetadata{
+		FuzzerId:     crash.FuzzerId,
+		Name:         crash.Name,
+		FoundAt:      crash.ModTime,
+		ArchivedAt:   now,
+		TargetSha256: targetHash,
+		FuzzerConfig: fuzzerConf,
+	}
+	if hasStats {
+		metadata.FuzzerStats = &stats
+	}
+	return metadata
+}
+
+// crashMetadataPath returns where the sidecar of the crash at
+// `relCrashPath`, relative to the workdir, is archived.
+func crashMetadataPath(relCrashPath string) string {
+	return path.Join(realtimeCrashMetadataPath, filepath.ToSlash(relCrashPath)) + manifestExt
+}
+
+// newCrashMetadataUploadJob returns an uploadJob that uses an
+// `archiver` to archive `metadata` as the sidecar of the crash at
+// `relCrashPath`.
+func newCrashMetadataUploadJob(a Archiver, relCrashPath string, metadata CrashMetadata) (uploadJob, error) {
+	buf, err := json.Marshal(metadata)
+	if err != nil {
+		return uploadJob{}, err
+	}
+	return newBytesUploadJob(a, buf, crashMetadataPath(relCrashPath)), nil
+}
+
+// newRealtimeCrashUploadJob returns an uploadJob that uses an
+// `archiver` to archive the crash at `relCrashPath`, relative to
+// `srcRoot`, along with its `metadata`. The sidecar is archived first,
+// and the crash isn't archived if it fails, so that the crash is still
+// missing from the archive and both are tried again later.
+func newRealtimeCrashUploadJob(a Archiver, srcRoot, relCrashPath string, metadata CrashMetadata) (uploadJob, error) {
+	sidecar, err := newCrashMetadataUploadJob(a, relCrashPath, metadata)
+	if err != nil {
+		return uploadJob{}, err
+	}
+	crash := newFileUploadJob(a, filepath.Join(srcRoot, relCrashPath), filepath.Join(realtimeCrashesPath, relCrashPath))
+	return uploadJob{
+		src: crash.src,
+		dst: crash.dst,
+		upload: func() error {
+			if err := sidecar.upload(); err != nil {
+				return err
+			}
+			return crash.upload()
+		},
+	}, nil
+}
+
+// loadCrashMetadata uses an `archiver` to read the sidecars of up to
+// `limit` of the realtime crashes at `relCrashPaths`, keyed by path.
+// Crashes that were archived without one are left out.
+func loadCrashMetadata(a Archiver, relCrashPaths []string, limit int) (map[string]CrashMetadata, error) {
+	sidecars, err := a.lsDstTree(realtimeCrashMetadataPath)
+	if err != nil {
+		return nil, err
+	}
+	hasSidecar := make(map[string]bool)
+	for _, name := range sidecars {
+		hasSidecar[path.Join(realtimeCrashMetadataPath, name)] = true
+	}
+
+	metadata := make(map[string]CrashMetadata)
+	for _, relCrashPath := range relCrashPaths {
+		if len(metadata) >= limit {
+			break
+		}
+		sidecarPath := crashMetadataPath(relCrashPath)
+		if !hasSidecar[sidecarPath] {
+			continue
+		}
+		m, err := readCrashMetadata(a, sidecarPath)
+		if err != nil {
+			return nil, err
+		}
+		metadata[relCrashPath] = m
+	}
+	return metadata, nil
+}
+
+// readCrashMetadata uses an `archiver` to read the sidecar at
+// `sidecarPath`, unless it is cached.
+func readCrashMetadata(a Archiver, sidecarPath string) (CrashMetadata, error) {
+	loc := a.DescribeDstLoc(sidecarPath)
+	crashMetadataCacheLock.Lock()
+	m, present := crashMetadataCache[loc]
+	crashMetadataCacheLock.Unlock()
+	if present {
+		return m, nil
+	}
+
+	buf, err := a.readOne(sidecarPath)
+	if err != nil {
+		return CrashMetadata{}, err
+	}
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return CrashMetadata{}, err
+	}
+	if loc != "" {
+		crashMetadataCacheLock.Lock()
+		crashMetadataCache[loc] = m
+		crashMetadataCacheLock.Unlock()
+	}
+	return m, nil
+}
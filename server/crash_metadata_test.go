@@ -0,0 +1,86 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestCrashMetadataPath(t *testing.T) {
+	assert.Equal(t,
+		"realtime-crash-metadata/output/fuzzer-1/crashes/id:000000.json",
+		crashMetadataPath(filepath.Join("output", "fuzzer-1", "crashes", "id:000000")))
+}
+
+func TestNewCrashMetadata(t *testing.T) {
+	oldTargetHash, oldFuzzerConf := targetHash, fuzzerConf
+	defer func() {
+		targetHash, fuzzerConf = oldTargetHash, oldFuzzerConf
+	}()
+	targetHash = "abc123"
+	fuzzerConf = types.FuzzerConfig{Command: []string{"./target", "@@"}, TimeoutMs: 1000}
+
+	found := time.Unix(1000, 0)
+	crash := types.InputInfo{FuzzerId: "fuzzer-1", Name: "id:000000", ModTime: found}
+	metadata := newCrashMetadata(crash, types.FuzzerStats{AflVersion: "2.52b"}, true, time.Unix(2000, 0))
+	assert.Equal(t, "fuzzer-1", metadata.FuzzerId)
+	assert.Equal(t, found, metadata.FoundAt)
+	assert.Equal(t, "abc123", metadata.TargetSha256)
+	assert.Equal(t, []string{"./target", "@@"}, metadata.FuzzerConfig.Command)
+	assert.Equal(t, "2.52b", metadata.FuzzerStats.AflVersion)
+
+	metadata = newCrashMetadata(crash, types.FuzzerStats{}, false, time.Unix(2000, 0))
+	assert.Nil(t, metadata.FuzzerStats)
+}
+
+func TestLoadCrashMetadata(t *testing.T) {
+	dstDir, err := ioutil.TempDir("", "roving-crash-metadata-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	crashes := []string{
+		"output/fuzzer-1/crashes/id:000000",
+		"output/fuzzer-1/crashes/id:000001",
+		"output/fuzzer-2/crashes/id:000000",
+	}
+	for _, relCrashPath := range crashes[:2] {
+		crash := types.InputInfo{FuzzerId: "fuzzer-1", Name: filepath.Base(relCrashPath)}
+		job, err := newCrashMetadataUploadJob(archiver, relCrashPath, newCrashMetadata(crash, types.FuzzerStats{}, false, time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = job.upload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crashes without a sidecar are left out
+	metadata, err := loadCrashMetadata(archiver, crashes, archivePageCrashMetadata)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(metadata))
+	assert.Equal(t, "id:000001", metadata[crashes[1]].Name)
+
+	// and at most `limit` are read
+	metadata, err = loadCrashMetadata(archiver, crashes, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(metadata))
+
+	// Sidecars don't change once they are archived, so they are only
+	// read once
+	if err = ioutil.WriteFile(filepath.Join(dstDir, crashMetadataPath(crashes[1])), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = loadCrashMetadata(archiver, crashes, archivePageCrashMetadata)
+	assert.Nil(t, err)
+	assert.Equal(t, "id:000001", metadata[crashes[1]].Name)
+}
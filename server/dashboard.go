@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dashboard.go summarizes the stats of every fuzzer in the fleet for
+// the admin dashboard, grouped by the host that each fuzzer runs on.
+
+// A fuzzer is stalled if it hasn't uploaded its state for
+// stalledUpdateAge, or if it hasn't found a new path for
+// stalledPathAge.
+var stalledUpdateAge time.Duration = 15 * time.Minute
+var stalledPathAge time.Duration = 6 * time.Hour
+
+// The keys that the dashboard can be sorted by.
+var dashboardSortKeys = []string{
+	"name",
+	"fuzzers",
+	"execs_per_sec",
+	"paths_total",
+	"unique_crashes",
+	"unique_hangs",
+	"stalled",
+}
+
+// Clients name their fuzzers `${hostname}-${hex}`, where hex is at
+// most 4 chars long. See mkFuzzerId in client/fuzzer.go.
+var fuzzerIdSuffix = regexp.MustCompile(`-[0-9a-f]{1,4}$`)
+
+// hostOf returns the host that fuzzer `fuzzerId` runs on.
+func hostOf(fuzzerId string) string {
+	host := fuzzerIdSuffix.ReplaceAllString(fuzzerId, "")
+	if host == "" {
+		return fuzzerId
+	}
+	return host
+}
+
+// fleetTotals are stats summed across a group of fuzzers. Only active
+// fuzzers' stats are summed, since stale and lost fuzzers' stats are
+// out of date, but every fuzzer is counted.
+type fleetTotals struct {
+	Fuzzers       int
+	Stalled       int
+	Stale         int
+	Lost          int
+	ExecsPerSec   float64
+	PathsTotal    uint64
+	UniqueCrashes uint64
+	UniqueHangs   uint64
+}
+
+func (t *fleetTotals) add(f fuzzerSummary) {
+	t.Fuzzers++
+	if f.Stalled {
+		t.Stalled++
+	}
+	switch f.State {
+	case NodeStale:
+		t.Stale++
+	case NodeLost:
+		t.Lost++
+	}
+	if f.State != NodeActive {
+		return
+	}
+	t.ExecsPerSec += f.Stats.ExecsPerSec
+	t.PathsTotal += f.Stats.PathsTotal
+	t.UniqueCrashes += f.Stats.UniqueCrashes
+	t.UniqueHangs += f.Stats.UniqueHangs
+}
+
+// fuzzerSummary is a single fuzzer on the dashboard.
+type fuzzerSummary struct {
+	NodeInfo
+	Stalled bool
+	// StalledReason explains why the fuzzer is stalled, if it is.
+	StalledReason string
+}
+
+// hostSummary is a single host on the dashboard, and its fuzzers.
+type hostSummary struct {
+	Host    string
+	Fuzzers []fuzzerSummary
+	Totals  fleetTotals
+}
+
+// fleetSummary is everything shown on the dashboard.
+type fleetSummary struct {
+	Hosts  []hostSummary
+	Totals fleetTotals
+	Sort   string
+	Desc   bool
+}
+
+// summarizeFuzzer works out whether the fuzzer described by `node` is
+// stalled as of `now`.
+func summarizeFuzzer(node NodeInfo, now time.Time) fuzzerSummary {
+	summary := fuzzerSummary{NodeInfo: node}
+
+	reasons := make([]string, 0)
+	if age := now.Sub(node.LastUpdate); age > stalledUpdateAge {
+		reasons = append(reasons, fmt.Sprintf("no update for %s", age.Truncate(time.Second)))
+	}
+	// AFL sets last_path to 0 until it finds a path, so fall back to
+	// when the fuzzer started.
+	lastPath := node.Stats.LastPath
+	if lastPath == 0 {
+		lastPath = node.Stats.StartTime
+	}
+	if lastPath > 0 {
+		if age := now.Sub(time.Unix(int64(lastPath), 0)); age > stalledPathAge {
+			reasons = append(reasons, fmt.Sprintf("no new paths for %s", age.Truncate(time.Second)))
+		}
+	}
+
+	if len(reasons) > 0 {
+		summary.Stalled = true
+		summary.StalledReason = strings.Join(reasons, ", ")
+	}
+	return summary
+}
+
+// summarizeFleet groups `nodes` by host and totals their stats. Hosts,
+// and the fuzzers on each host, are sorted by `sortKey`, which must be
+// one of dashboardSortKeys.
+func summarizeFleet(nodes []NodeInfo, now time.Time, sortKey string, desc bool) fleetSummary {
+	summary := fleetSummary{Sort: sortKey, Desc: desc}
+
+	hosts := make(map[string]*hostSummary)
+	for _, node := range nodes {
+		fuzzer := summarizeFuzzer(node, now)
+		hostName := hostOf(node.Id)
+		host, present := hosts[hostName]
+		if !present {
+			host = &hostSummary{Host: hostName}
+			hosts[hostName] = host
+		}
+		host.Fuzzers = append(host.Fuzzers, fuzzer)
+		host.Totals.add(fuzzer)
+		summary.Totals.add(fuzzer)
+	}
+
+	for _, host := range hosts {
+		sort.Slice(host.Fuzzers, func(i, j int) bool {
+			a, b := host.Fuzzers[i], host.Fuzzers[j]
+			return lessBy(sortKey, desc, a.Id, b.Id, fuzzerSortValue(a, sortKey), fuzzerSortValue(b, sortKey))
+		})
+		summary.Hosts = append(summary.Hosts, *host)
+	}
+	sort.Slice(summary.Hosts, func(i, j int) bool {
+		a, b := summary.Hosts[i], summary.Hosts[j]
+		return lessBy(sortKey, desc, a.Host, b.Host, totalsSortValue(a.Totals, sortKey), totalsSortValue(b.Totals, sortKey))
+	})
+	return summary
+}
+
+func fuzzerSortValue(f fuzzerSummary, sortKey string) float64 {
+	switch sortKey {
+	case "execs_per_sec":
+		return f.Stats.ExecsPerSec
+	case "paths_total":
+		return float64(f.Stats.PathsTotal)
+	case "unique_crashes":
+		return float64(f.Stats.UniqueCrashes)
+	case "unique_hangs":
+		return float64(f.Stats.UniqueHangs)
+	case "stalled":
+		if f.Stalled {
+			return 1
+		}
+	}
+	return 0
+}
+
+func totalsSortValue(t fleetTotals, sortKey string) float64 {
+	switch sortKey {
+	case "fuzzers":
+		return float64(t.Fuzzers)
+	case "execs_per_sec":
+		return t.ExecsPerSec
+	case "paths_total":
+		return float64(t.PathsTotal)
+	case "unique_crashes":
+		return float64(t.UniqueCrashes)
+	case "unique_hangs":
+		return float64(t.UniqueHangs)
+	case "stalled":
+		return float64(t.Stalled)
+	}
+	return 0
+}
+
+// lessBy orders two rows of the dashboard by `sortKey`. Rows are
+// ordered by name if `sortKey` is "name", or if their values tie.
+func lessBy(sortKey string, desc bool, nameA, nameB string, valueA, valueB float64) bool {
+	if sortKey != "name" && valueA != valueB {
+		if desc {
+			return valueA > valueB
+		}
+		return valueA < valueB
+	}
+	if desc && sortKey == "name" {
+		return nameA > nameB
+	}
+	return nameA < nameB
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestHostOf(t *testing.T) {
+	assert.Equal(t, "host", hostOf("host-a1b2"))
+	assert.Equal(t, "web-01", hostOf("web-01-f"))
+	assert.Equal(t, "web_01_example_com", hostOf("web_01_example_com-1234"))
+	assert.Equal(t, "no_suffix", hostOf("no_suffix"))
+	assert.Equal(t, "-abcd", hostOf("-abcd"))
+}
+
+func TestSummarizeFleet(t *testing.T) {
+	now := time.Unix(100000, 0)
+	recent := uint64(now.Add(-1 * time.Minute).Unix())
+
+	nodeInfos := []NodeInfo{
+		NodeInfo{
+			Id:         "host_a-1",
+			Stats:      types.FuzzerStats{ExecsPerSec: 100, PathsTotal: 10, UniqueCrashes: 1, LastPath: recent},
+			LastUpdate: now,
+			State:      NodeActive,
+		},
+		NodeInfo{
+			Id:         "host_a-2",
+			Stats:      types.FuzzerStats{ExecsPerSec: 50, PathsTotal: 20, UniqueHangs: 2, LastPath: recent},
+			LastUpdate: now.Add(-1 * time.Hour),
+			State:      NodeActive,
+		},
+		NodeInfo{
+			Id:         "host_b-3",
+			Stats:      types.FuzzerStats{ExecsPerSec: 300, PathsTotal: 5, StartTime: 1},
+			LastUpdate: now,
+			State:      NodeActive,
+		},
+		// Lost fuzzers are counted, but their stats are out of date
+		NodeInfo{
+			Id:         "host_b-4",
+			Stats:      types.FuzzerStats{ExecsPerSec: 1000, PathsTotal: 1000, UniqueCrashes: 10},
+			LastUpdate: now.Add(-2 * time.Hour),
+			State:      NodeLost,
+		},
+	}
+
+	summary := summarizeFleet(nodeInfos, now, "name", false)
+	assert.Equal(t, 4, summary.Totals.Fuzzers)
+	assert.Equal(t, 1, summary.Totals.Lost)
+	assert.Equal(t, 3, summary.Totals.Stalled)
+	assert.Equal(t, float64(450), summary.Totals.ExecsPerSec)
+	assert.Equal(t, uint64(35), summary.Totals.PathsTotal)
+	assert.Equal(t, uint64(1), summary.Totals.UniqueCrashes)
+	assert.Equal(t, uint64(2), summary.Totals.UniqueHangs)
+
+	assert.Equal(t, 2, len(summary.Hosts))
+	hostA := summary.Hosts[0]
+	assert.Equal(t, "host_a", hostA.Host)
+	assert.Equal(t, 2, hostA.Totals.Fuzzers)
+	assert.Equal(t, float64(150), hostA.Totals.ExecsPerSec)
+	assert.Equal(t, 1, hostA.Totals.Stalled)
+	assert.False(t, hostA.Fuzzers[0].Stalled)
+	assert.True(t, hostA.Fuzzers[1].Stalled)
+	assert.Contains(t, hostA.Fuzzers[1].StalledReason, "no update")
+
+	// host_b-3 has never found a path, and started long ago
+	hostB := summary.Hosts[1]
+	assert.True(t, hostB.Fuzzers[0].Stalled)
+	assert.Contains(t, hostB.Fuzzers[0].StalledReason, "no new paths")
+
+	summary = summarizeFleet(nodeInfos, now, "execs_per_sec", true)
+	assert.Equal(t, "host_b", summary.Hosts[0].Host)
+	assert.Equal(t, "host_a-1", summary.Hosts[1].Fuzzers[0].Id)
+
+	summary = summarizeFleet(nodeInfos, now, "paths_total", true)
+	assert.Equal(t, "host_a", summary.Hosts[0].Host)
+	assert.Equal(t, "host_a-2", summary.Hosts[0].Fuzzers[0].Id)
+}
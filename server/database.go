@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var crashesBucket = []byte("crashes")
+var nodesBucket = []byte("nodes")
+var webhooksBucket = []byte("webhooks")
+var metaBucket = []byte("meta")
+
+// Database is the roving server's embedded database. It stores the
+// things that the server knows about that can't be reconstructed from
+// the files in its workdir, such as when a crash was first seen and
+// what a human has decided about it.
+//
+// It is a thin wrapper around a bbolt database. Each kind of record
+// lives in its own bucket, and records are stored as JSON.
+type Database struct {
+	db *bolt.DB
+}
+
+// openDatabase opens the database at `path`, creating it and any
+// missing buckets if necessary.
+func openDatabase(path string) (*Database, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{crashesBucket, nodesBucket, webhooksBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Database{db: db}, nil
+}
+
+// Path returns where the database is stored.
+func (d *Database) Path() string {
+	return d.db.Path()
+}
+
+// WriteTo writes a consistent copy of the database to `w`, even while
+// it is being written to.
+func (d *Database) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Close closes the database.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	"github.com/richo/roving/types"
+)
+
+// encryption.go encrypts archived files before they leave the server,
+// since crashes are potential vulnerabilities in the fuzzed target and
+// archives are often kept in shared buckets. DiskArchiver and
+// S3Archiver encrypt every file that they archive, and decrypt every
+// file that they read, so snapshots, restores and the admin interface
+// work the same whether or not archives are encrypted.
+//
+// Files are encrypted with AES-256-GCM as they are streamed to the
+// archive, so that a file never has to fit in memory, however big it
+// is. Each file is split into chunks of encryptedChunkSize bytes, and
+// each chunk is sealed under its own random nonce:
+//
+//   encryptedMagic | nonce | chunk 0 and tag | nonce | chunk 1 and tag | ...
+//
+// The path that the file is archived to is authenticated along with
+// every chunk, so that an encrypted file can't be passed off as
+// another one, for example by swapping two snapshot objects. So are
+// the chunk's index, so that chunks can't be reordered, and whether it
+// is the last chunk, so that a file can't be truncated. The last chunk
+// may be empty.
+
+// The prefix of every encrypted file.
+var encryptedMagic []byte = []byte("roving-aes-gcm-v1\n")
+
+// The number of bytes of plaintext in every chunk but the last.
+var encryptedChunkSize int = 64 * 1024
+
+// An archiveCipher encrypts and decrypts archived files. A nil
+// *archiveCipher leaves them as they are.
+type archiveCipher struct {
+	aead cipher.AEAD
+	// Whether files that aren't encrypted can be read
+	allowPlaintext bool
+}
+
+// newArchiveCipher returns the archiveCipher that `config` chooses,
+// which is nil if archives aren't encrypted.
+func newArchiveCipher(config types.ArchiveEncryptionConfig) (*archiveCipher, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	key, err := config.LoadKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveCipher{aead: aead, allowPlaintext: config.AllowPlaintext}, nil
+}
+
+// encryptingWriter returns a writer that encrypts everything written
+// to it, which is to be archived to `relDstPath`, and writes it to
+// `w`. The last chunk is only written when the writer is closed, which
+// doesn't close `w`.
+func (c *archiveCipher) encryptingWriter(w io.Writer, relDstPath string) (io.WriteCloser, error) {
+	if c == nil {
+		return nopWriteCloser{w}, nil
+	}
+	if _, err := w.Write(encryptedMagic); err != nil {
+		return nil, err
+	}
+	return &chunkWriter{
+		c:   c,
+		w:   w,
+		ad:  encryptionAD(relDstPath),
+		buf: make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+// decryptingReader returns a reader that decrypts `r`, which was read
+// from `relDstPath`. Files that aren't encrypted are refused, unless
+// the archiveCipher allows plaintext or is nil, in which case they are
+// read as they are.
+func (c *archiveCipher) decryptingReader(r io.Reader, relDstPath string) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, len(encryptedMagic))
+	prefix, err := br.Peek(len(encryptedMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(prefix, encryptedMagic) {
+		if c != nil && !c.allowPlaintext {
+			return nil, &corruptedFileError{fmt.Sprintf("Archived file %s isn't encrypted; use -archive-encryption-allow-plaintext to read it anyway", relDstPath)}
+		}
+		return br, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("Archived file %s is encrypted, but no archive encryption key is set", relDstPath)
+	}
+
+	if _, err = br.Discard(len(encryptedMagic)); err != nil {
+		return nil, err
+	}
+	chunkLen := c.aead.NonceSize() + encryptedChunkSize + c.aead.Overhead()
+	return &chunkReader{
+		c:          c,
+		r:          bufio.NewReaderSize(br, chunkLen+1),
+		relDstPath: relDstPath,
+		ad:         encryptionAD(relDstPath),
+		chunk:      make([]byte, chunkLen),
+	}, nil
+}
+
+// encrypt encrypts `plaintext`, which is to be archived to
+// `relDstPath`.
+func (c *archiveCipher) encrypt(plaintext []byte, relDstPath string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.encryptingWriter(&buf, relDstPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decrypt decrypts `buf`, which was read from `relDstPath`.
+func (c *archiveCipher) decrypt(buf []byte, relDstPath string) ([]byte, error) {
+	r, err := c.decryptingReader(bytes.NewReader(buf), relDstPath)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// encryptionAD returns the additional data that the file at
+// `relDstPath` is authenticated with. The path is cleaned, since the
+// same file can be named in more than one way, for example as
+// `./objects/HASH` and as `objects/HASH`.
+func encryptionAD(relDstPath string) []byte {
+	return []byte(path.Clean(filepath.ToSlash(relDstPath)))
+}
+
+// chunkAD returns the additional data that chunk `index` of a file
+// whose additional data is `ad` is authenticated with.
+func chunkAD(ad []byte, index uint64, final bool) []byte {
+	chunkAd := make([]byte, len(ad), len(ad)+9)
+	copy(chunkAd, ad)
+	chunkAd = append(chunkAd, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(chunkAd[len(ad):], index)
+	if final {
+		chunkAd[len(chunkAd)-1] = 1
+	}
+	return chunkAd
+}
+
+// A chunkWriter encrypts a file a chunk at a time. It holds back each
+// full chunk until it knows whether another one follows it.
+type chunkWriter struct {
+	c     *archiveCipher
+	w     io.Writer
+	ad    []byte
+	index uint64
+	buf   []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(cw.buf) == encryptedChunkSize {
+			if err := cw.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := encryptedChunkSize - len(cw.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		cw.buf = append(cw.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close writes the last chunk.
+func (cw *chunkWriter) Close() error {
+	return cw.seal(true)
+}
+
+func (cw *chunkWriter) seal(final bool) error {
+	nonce := make([]byte, cw.c.aead.NonceSize(), cw.c.aead.NonceSize()+len(cw.buf)+cw.c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := cw.c.aead.Seal(nonce, nonce, cw.buf, chunkAD(cw.ad, cw.index, final))
+	if _, err := cw.w.Write(sealed); err != nil {
+		return err
+	}
+	cw.index++
+	cw.buf = cw.buf[:0]
+	return nil
+}
+
+// A chunkReader decrypts a file a chunk at a time.
+type chunkReader struct {
+	c          *archiveCipher
+	r          *bufio.Reader
+	relDstPath string
+	ad         []byte
+	index      uint64
+	chunk      []byte
+	plaintext  []byte
+	done       bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.plaintext) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.plaintext)
+	cr.plaintext = cr.plaintext[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. A chunk is the last one if nothing
+// follows it, and it must have been sealed as the last one.
+func (cr *chunkReader) open() error {
+	n, err := io.ReadFull(cr.r, cr.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	final := n < len(cr.chunk)
+	if !final {
+		if _, err = cr.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonceSize := cr.c.aead.NonceSize()
+	if n < nonceSize+cr.c.aead.Overhead() {
+		return &corruptedFileError{fmt.Sprintf("Archived file %s is truncated", cr.relDstPath)}
+	}
+	nonce, ciphertext := cr.chunk[:nonceSize], cr.chunk[nonceSize:n]
+	plaintext, err := cr.c.aead.Open(ciphertext[:0], nonce, ciphertext, chunkAD(cr.ad, cr.index, final))
+	if err != nil {
+		return &corruptedFileError{fmt.Sprintf("Couldn't decrypt archived file %s: wrong key, or the file is corrupted or truncated", cr.relDstPath)}
+	}
+	cr.plaintext = plaintext
+	cr.index++
+	cr.done = final
+	return nil
+}
+
+// A corruptedFileError is returned when an archived file can't be
+// decrypted because it is corrupted or truncated, or because it isn't
+// encrypted when it should be. Unlike other errors, it is about that
+// file alone, so verifying can report it and carry on.
+type corruptedFileError struct {
+	msg string
+}
+
+func (e *corruptedFileError) Error() string {
+	return e.msg
+}
+
+// isCorruptedFile returns whether `err` is a corruptedFileError.
+func isCorruptedFile(err error) bool {
+	_, ok := err.(*corruptedFileError)
+	return ok
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func newTestArchiveCipher(t *testing.T, keyByte string) *archiveCipher {
+	c, err := newArchiveCipher(types.ArchiveEncryptionConfig{Key: strings.Repeat(keyByte, types.ArchiveEncryptionKeySize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestArchiveCipher(t *testing.T) {
+	c := newTestArchiveCipher(t, "ab")
+
+	buf, err := c.encrypt([]byte("crash"), "realtime-crashes/crash")
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(buf, []byte("crash")))
+
+	plaintext, err := c.decrypt(buf, "./realtime-crashes/crash")
+	assert.Nil(t, err)
+	assert.Equal(t, "crash", string(plaintext))
+
+	// An encrypted file can't be passed off as another one
+	_, err = c.decrypt(buf, "realtime-crashes/other")
+	assert.NotNil(t, err)
+	// or decrypted with the wrong key, or without one
+	_, err = newTestArchiveCipher(t, "cd").decrypt(buf, "realtime-crashes/crash")
+	assert.NotNil(t, err)
+	var noCipher *archiveCipher
+	_, err = noCipher.decrypt(buf, "realtime-crashes/crash")
+	assert.NotNil(t, err)
+
+	// Files that aren't encrypted are refused, so that they can't
+	// replace ones that are
+	_, err = c.decrypt([]byte("old crash"), "realtime-crashes/old")
+	assert.NotNil(t, err)
+	// unless they are allowed, for archives from before encryption
+	// was turned on
+	c.allowPlaintext = true
+	plaintext, err = c.decrypt([]byte("old crash"), "realtime-crashes/old")
+	assert.Nil(t, err)
+	assert.Equal(t, "old crash", string(plaintext))
+}
+
+func TestArchiveCipherChunks(t *testing.T) {
+	oldChunkSize := encryptedChunkSize
+	defer func() {
+		encryptedChunkSize = oldChunkSize
+	}()
+	encryptedChunkSize = 4
+	c := newTestArchiveCipher(t, "ab")
+	chunkLen := c.aead.NonceSize() + encryptedChunkSize + c.aead.Overhead()
+
+	// Files that do and don't fill their last chunk, and empty files
+	for _, plaintext := range []string{"", "abc", "abcd", "abcdefghij", "abcdefgh"} {
+		buf, err := c.encrypt([]byte(plaintext), "crash")
+		assert.Nil(t, err)
+		decrypted, err := c.decrypt(buf, "crash")
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext, string(decrypted))
+	}
+
+	buf, err := c.encrypt([]byte("abcdefghij"), "crash")
+	assert.Nil(t, err)
+	chunks := buf[len(encryptedMagic):]
+	// Chunks can't be dropped from the end
+	_, err = c.decrypt(buf[:len(encryptedMagic)+2*chunkLen], "crash")
+	assert.NotNil(t, err)
+	// or reordered
+	swapped := append([]byte{}, encryptedMagic...)
+	swapped = append(swapped, chunks[chunkLen:2*chunkLen]...)
+	swapped = append(swapped, chunks[:chunkLen]...)
+	swapped = append(swapped, chunks[2*chunkLen:]...)
+	_, err = c.decrypt(swapped, "crash")
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedDiskArchiver(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-encryption-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-encryption-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	workdir, err := ioutil.TempDir("", "roving-encryption-test-workdir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	writeFile(filepath.Join(srcDir, "output", "fuzzer-1", "crashes", "id:000000"), "crash")
+	archiver := DiskArchiver{DstRoot: dstDir, cipher: newTestArchiveCipher(t, "ab")}
+	snapshot, _, err := archiveSnapshot(archiver, srcDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is stored in plaintext
+	assert.NotEqual(t, "crash", readFile(filepath.Join(dstDir, snapshotObjectPath(snapshot.Files[0].Sha256))))
+	assert.False(t, strings.Contains(readFile(filepath.Join(dstDir, snapshotManifestPath(1000))), "id:000000"))
+
+	// but listing, verifying and restoring still work
+	names, err := archiver.LsDstFiles("1000/output/fuzzer-1/crashes")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"id:000000"}, names)
+	report, err := verifyArchive(archiver, 1000)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	_, err = restoreSnapshot(archiver, types.ArchiveRestoreLatest, workdir)
+	assert.Nil(t, err)
+	assert.Equal(t, "crash", readFile(filepath.Join(workdir, "output", "fuzzer-1", "crashes", "id:000000")))
+
+	// Tarballs are decrypted as they are streamed from the archive
+	if _, _, err = archiveTarball(archiver, srcDir, snapshotBasePath(2000), 2000); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(workdir, "output"))
+	_, err = restoreSnapshot(archiver, "2000", workdir)
+	assert.Nil(t, err)
+	assert.Equal(t, "crash", readFile(filepath.Join(workdir, "output", "fuzzer-1", "crashes", "id:000000")))
+}
+
+func TestEncryptedS3Archiver(t *testing.T) {
+	resetS3stubs()
+
+	srcDir, err := ioutil.TempDir("", "roving-encryption-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFile(filepath.Join(srcDir, "crash"), "crash")
+
+	archiver := S3Archiver{
+		bucketName: "test-bucket",
+		rootKey:    "data/more-data",
+		s3client:   mockS3Client{},
+		cipher:     newTestArchiveCipher(t, "ab"),
+	}
+	if err = archiver.archiveOne(filepath.Join(srcDir, "crash"), "realtime-crashes/crash"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(putBodies))
+	assert.False(t, strings.Contains(putBodies[0], "crash"))
+
+	plaintext, err := archiver.cipher.decrypt([]byte(putBodies[0]), "realtime-crashes/crash")
+	assert.Nil(t, err)
+	assert.Equal(t, "crash", string(plaintext))
+}
+
+func TestVerifyReportsUndecryptableFilesAsCorrupted(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-encryption-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-encryption-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	writeFile(filepath.Join(srcDir, "queue", "a"), "first")
+	writeFile(filepath.Join(srcDir, "queue", "b"), "second")
+	writeFile(filepath.Join(srcDir, "queue", "c"), "third")
+	archiver := DiskArchiver{DstRoot: dstDir, cipher: newTestArchiveCipher(t, "ab")}
+	snapshot, _, err := archiveSnapshot(archiver, srcDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = archiveTarball(archiver, srcDir, snapshotBasePath(2000), 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	// One object fails authentication, and another isn't encrypted
+	flipLastByte := func(absPath string) {
+		buf, err := ioutil.ReadFile(absPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf[len(buf)-1] ^= 1
+		if err = ioutil.WriteFile(absPath, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flipLastByte(filepath.Join(dstDir, snapshotObjectPath(snapshot.Files[0].Sha256)))
+	writeFile(filepath.Join(dstDir, snapshotObjectPath(snapshot.Files[1].Sha256)), "plaintext")
+	report, err := verifyArchive(archiver, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{snapshot.Files[0].Path, snapshot.Files[1].Path}, report.Corrupted)
+
+	flipLastByte(filepath.Join(dstDir, snapshotBasePath(2000)+tarballExt))
+	report, err = verifyArchive(archiver, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(report.Corrupted))
+}
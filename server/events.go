@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// events.go streams what the cluster is doing to the admin UI and to
+// external tools. Anything interesting that happens in the server is
+// published to the EventBus, which fans it out to every connection to
+// /events as Server-Sent Events. See
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+
+// The types of event that are published.
+const (
+	EventStateReceived   = "state.received"
+	EventCrashNew        = "crash.new"
+	EventHangNew         = "hang.new"
+	EventNodeJoined      = "node.joined"
+	EventNodeReaped      = "node.reaped"
+	EventNodeState       = "node.state"
+	EventQueueRetired    = "queue.retired"
+	EventArchiveStarted  = "archive.started"
+	EventArchiveFinished = "archive.finished"
+	EventConfigChanged   = "config.changed"
+)
+
+// The number of recent events that the EventBus keeps, so that
+// clients that reconnect can catch up on what they missed.
+var eventHistorySize int = 1000
+
+// The number of events that can be waiting to be sent to a single
+// subscriber. Subscribers that fall further behind than this are
+// disconnected, so that a slow client can't hold up the server.
+var eventSubscriberBufferSize int = 100
+
+// How often a comment is sent to idle subscribers, so that proxies
+// don't close their connections.
+var eventKeepaliveInterval time.Duration = 15 * time.Second
+
+var events = newEventBus()
+
+// Event is something that happened in the cluster.
+type Event struct {
+	// Ids increase by one with every event. They start again at 1
+	// when the server restarts.
+	Id       uint64                 `json:"id"`
+	Type     string                 `json:"type"`
+	Time     time.Time              `json:"time"`
+	FuzzerId string                 `json:"fuzzer_id,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventFilter restricts the events that a subscriber receives. Empty
+// fields match everything.
+type EventFilter struct {
+	Types    map[string]bool
+	FuzzerId string
+}
+
+func (f EventFilter) matches(e Event) bool {
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+	if f.FuzzerId != "" && f.FuzzerId != e.FuzzerId {
+		return false
+	}
+	return true
+}
+
+// eventSubscriber receives the events that match `filter` on `ch`.
+// `ch` is closed if the subscriber falls too far behind.
+type eventSubscriber struct {
+	ch     chan Event
+	filter EventFilter
+}
+
+// EventBus fans events out to subscribers, and remembers the most
+// recent ones.
+type EventBus struct {
+	lastId      uint64
+	history     []Event
+	subscribers map[*eventSubscriber]bool
+
+	lock *sync.Mutex
+}
+
+func newEventBus() *EventBus {
+	var lock sync.Mutex
+	return &EventBus{
+		subscribers: make(map[*eventSubscriber]bool),
+		lock:        &lock,
+	}
+}
+
+// publish sends an event to every subscriber whose filter it matches.
+// It never blocks.
+func (b *EventBus) publish(eventType, fuzzerId string, data map[string]interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastId++
+	e := Event{
+		Id:       b.lastId,
+		Type:     eventType,
+		Time:     time.Now(),
+		FuzzerId: fuzzerId,
+		Data:     data,
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter.matches(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// subscribe returns a subscriber that receives every future event
+// that matches `filter`, and the events it missed since event
+// `since`. If `since` is negative then it hasn't missed anything.
+func (b *EventBus) subscribe(filter EventFilter, since int64) (*eventSubscriber, []Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sub := &eventSubscriber{
+		ch:     make(chan Event, eventSubscriberBufferSize),
+		filter: filter,
+	}
+	b.subscribers[sub] = true
+
+	var missed []Event
+	if since >= 0 {
+		// If `since` is from before the server restarted then
+		// everything we have is new to the subscriber.
+		if uint64(since) > b.lastId {
+			since = 0
+		}
+		for _, e := range b.history {
+			if e.Id > uint64(since) && filter.matches(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	return sub, missed
+}
+
+// unsubscribe stops sending events to `sub`.
+func (b *EventBus) unsubscribe(sub *eventSubscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// publishStateReceived publishes the events about a state that was
+// uploaded by a fuzzer, given the inputs that were new in it.
+func publishStateReceived(state types.State, payloadBytes int64, added []types.InputInfo) {
+	newCounts := map[string]int{types.Queue: 0, types.Crashes: 0, types.Hangs: 0}
+	for _, info := range added {
+		newCounts[info.Type]++
+	}
+	events.publish(EventStateReceived, state.Id, map[string]interface{}{
+		"payload_bytes": payloadBytes,
+		"queue_size":    len(state.AflOutput.Queue.Inputs),
+		"crashes_size":  len(state.AflOutput.Crashes.Inputs),
+		"hangs_size":    len(state.AflOutput.Hangs.Inputs),
+		"new_queue":     newCounts[types.Queue],
+		"new_crashes":   newCounts[types.Crashes],
+		"new_hangs":     newCounts[types.Hangs],
+		"execs_per_sec": state.Stats.ExecsPerSec,
+	})
+
+	// Hangs are only published once the HangConfirmer has confirmed
+	// them; see publishHangConfirmed.
+	for _, info := range added {
+		if info.Type != types.Crashes {
+			continue
+		}
+		events.publish(EventCrashNew, state.Id, map[string]interface{}{
+			"name": info.Name,
+			"size": info.Size,
+		})
+	}
+}
+
+// publishHangConfirmed publishes a hang that the HangConfirmer has
+// classified as confirmed.
+func publishHangConfirmed(fuzzerId string, name string, size int64, t types.HangTriage) {
+	events.publish(EventHangNew, fuzzerId, map[string]interface{}{
+		"name":            name,
+		"size":            size,
+		"runs":            t.Runs,
+		"timed_out":       t.TimedOut,
+		"max_duration_ms": t.MaxDurationMs,
+	})
+}
+
+// publishNodeTransition publishes a node moving from one state to
+// another, and counts it.
+func publishNodeTransition(nodeId string, t NodeTransition) {
+	events.publish(EventNodeState, nodeId, map[string]interface{}{
+		"from": t.From,
+		"to":   t.To,
+	})
+	promMetrics.observeNodeTransition(t)
+	types.SubmitMetricCount("node.transition", 1, map[string]string{
+		"fuzzer_id": nodeId,
+		"to":        string(t.To),
+	})
+}
+
+// eventFilterFromRequest builds an EventFilter out of the `types`
+// (comma-separated) and `fuzzer` query params.
+func eventFilterFromRequest(r *http.Request) EventFilter {
+	filter := EventFilter{
+		Types:    make(map[string]bool),
+		FuzzerId: r.URL.Query().Get("fuzzer"),
+	}
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t != "" {
+			filter.Types[t] = true
+		}
+	}
+	return filter
+}
+
+// eventsSinceFromRequest returns the ID of the last event that the
+// client has seen, from the Last-Event-ID header that browsers send
+// when they reconnect or from the `since` query param. It returns -1
+// if there is neither.
+func eventsSinceFromRequest(r *http.Request) (int64, error) {
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	if since == "" {
+		return -1, nil
+	}
+
+	id, err := strconv.ParseUint(since, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid event ID: %s", since)
+	}
+	return int64(id), nil
+}
+
+// publishConfigChanges publishes an event if `conf` is different to
+// the fuzzer config that the server served when it last ran, and
+// saves it for next time. The config can only change when the server
+// restarts, so the event is in the history that clients can catch up
+// on rather than sent to anyone live.
+func publishConfigChanges(d *Database, conf types.FuzzerConfig) error {
+	previous, present, err := d.FuzzerConfig()
+	if err != nil {
+		return err
+	}
+
+	if present {
+		previousBuf, err := json.Marshal(previous)
+		if err != nil {
+			return err
+		}
+		currentBuf, err := json.Marshal(conf)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(previousBuf, currentBuf) {
+			events.publish(EventConfigChanged, "", map[string]interface{}{
+				"previous": previous,
+				"current":  conf,
+			})
+		}
+	}
+
+	return d.SaveFuzzerConfig(conf)
+}
+
+// writeEvent writes `e` in the Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, e Event) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, buf)
+	return err
+}
+
+// The getEvents route streams events as Server-Sent Events until the
+// client disconnects. Clients that reconnect with a Last-Event-ID
+// header, or that ask for the events `since` an ID, are sent the
+// events they missed first.
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	since, err := eventsSinceFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub, missed := events.subscribe(eventFilterFromRequest(r), since)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				// We fell too far behind. The client will reconnect
+				// and catch up from the history.
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
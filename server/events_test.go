@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+	all, _ := b.subscribe(EventFilter{}, -1)
+	crashes, _ := b.subscribe(EventFilter{Types: map[string]bool{EventCrashNew: true}, FuzzerId: "fuzzer-123"}, -1)
+
+	b.publish(EventStateReceived, "fuzzer-123", nil)
+	b.publish(EventCrashNew, "fuzzer-456", nil)
+	b.publish(EventCrashNew, "fuzzer-123", map[string]interface{}{"name": "crash1"})
+
+	assert.Equal(t, uint64(1), (<-all.ch).Id)
+	assert.Equal(t, uint64(2), (<-all.ch).Id)
+	assert.Equal(t, uint64(3), (<-all.ch).Id)
+	e := <-crashes.ch
+	assert.Equal(t, uint64(3), e.Id)
+	assert.Equal(t, "crash1", e.Data["name"])
+	assert.Equal(t, 0, len(crashes.ch))
+
+	// Subscribers catch up on the events they missed
+	_, missed := b.subscribe(EventFilter{}, 1)
+	assert.Equal(t, 2, len(missed))
+	assert.Equal(t, uint64(2), missed[0].Id)
+	_, missed = b.subscribe(EventFilter{}, 0)
+	assert.Equal(t, 3, len(missed))
+	// An ID from before a restart replays everything
+	_, missed = b.subscribe(EventFilter{}, 1000)
+	assert.Equal(t, 3, len(missed))
+
+	b.unsubscribe(all)
+	_, open := <-all.ch
+	assert.False(t, open)
+}
+
+func TestEventBusDropsSlowSubscribers(t *testing.T) {
+	b := newEventBus()
+	sub, _ := b.subscribe(EventFilter{}, -1)
+	for i := 0; i < eventSubscriberBufferSize+1; i++ {
+		b.publish(EventStateReceived, "fuzzer-123", nil)
+	}
+
+	n := 0
+	for range sub.ch {
+		n++
+	}
+	assert.Equal(t, eventSubscriberBufferSize, n)
+	// Unsubscribing a dropped subscriber is a no-op
+	b.unsubscribe(sub)
+}
+
+func TestGetEvents(t *testing.T) {
+	events = newEventBus()
+	events.publish(EventNodeJoined, "fuzzer-123", nil)
+
+	server := httptest.NewServer(http.HandlerFunc(getEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?since=0&types=node.joined,crash.new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	publishStateReceived(types.State{
+		Id: "fuzzer-123",
+		AflOutput: types.AflOutput{
+			Queue:   &types.InputCorpus{},
+			Crashes: &types.InputCorpus{Inputs: []types.Input{types.Input{Name: "crash1"}}},
+			Hangs:   &types.InputCorpus{},
+		},
+	}, 100, []types.InputInfo{types.InputInfo{FuzzerId: "fuzzer-123", Type: types.Crashes, Name: "crash1", Size: 5}})
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (string, Event) {
+		var eventType string
+		var e Event
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimRight(line, "\n")
+			if line == "" {
+				return eventType, e
+			}
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			}
+			if strings.HasPrefix(line, "data: ") {
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+			}
+		}
+	}
+
+	eventType, e := readEvent()
+	assert.Equal(t, EventNodeJoined, eventType)
+	assert.Equal(t, uint64(1), e.Id)
+	// The state.received event is filtered out
+	eventType, e = readEvent()
+	assert.Equal(t, EventCrashNew, eventType)
+	assert.Equal(t, "crash1", e.Data["name"])
+	assert.Equal(t, float64(5), e.Data["size"])
+}
+
+func TestPublishConfigChanges(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	events = newEventBus()
+
+	conf := types.FuzzerConfig{Command: []string{"./target", "@@"}, TimeoutMs: 100}
+	assert.Nil(t, publishConfigChanges(d, conf))
+	assert.Nil(t, publishConfigChanges(d, conf))
+	_, missed := events.subscribe(EventFilter{}, 0)
+	assert.Equal(t, 0, len(missed))
+
+	conf.TimeoutMs = 200
+	assert.Nil(t, publishConfigChanges(d, conf))
+	_, missed = events.subscribe(EventFilter{}, 0)
+	assert.Equal(t, 1, len(missed))
+	assert.Equal(t, EventConfigChanged, missed[0].Type)
+}
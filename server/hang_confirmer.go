@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+var realtimeHangsPath string = "realtime-hangs"
+
+// AFL uses a 1000ms timeout if it isn't given one explicitly.
+var defaultAflTimeout time.Duration = 1000 * time.Millisecond
+
+// HangConfirmer periodically re-runs the hangs that clients have
+// reported, using a much larger timeout than the fuzzers themselves.
+// Clients report anything that exceeded the fuzzer's timeout once,
+// which is very noisy on busy machines. The HangConfirmer classifies
+// each hang (see types.HangClassification), stores the result
+// alongside the fuzzer's output, and only archives and alerts on
+// confirmed hangs.
+type HangConfirmer struct {
+	Interval time.Duration
+	Runs     int
+	// The timeout that the fuzzers themselves use
+	BaseTimeout time.Duration
+	// The extended timeout that hangs are re-run with
+	Timeout time.Duration
+	// The command used to run the target. As with AFL, "@@" is
+	// replaced by the path of the input. If there is no "@@" then
+	// the input is passed to the target on stdin.
+	TargetCommand []string
+	Workdir       string
+
+	// The temporary copy of the target binary, if the fuzzers use
+	// a binary downloaded from the server. It is removed by close.
+	targetPath  string
+	fileManager *types.FleetFileManager
+	archiver    Archiver
+}
+
+// newHangConfirmer builds a HangConfirmer that runs the same target
+// as the fuzzers. If the fuzzers use a binary downloaded from the
+// server then it is written to a temporary file so that the server
+// can execute it too. The file is not in the workdir because the
+// whole workdir is archived. Callers must call close to remove it.
+func newHangConfirmer(conf types.HangConfirmConfig, fuzzerConf types.FuzzerConfig, targetBinary types.TargetBinary, fm *types.FleetFileManager, a Archiver) (*HangConfirmer, error) {
+	var targetCommand []string
+	var targetPath string
+	if fuzzerConf.UseBinary {
+		var err error
+		targetPath, err = writeHangConfirmerTarget(targetBinary)
+		if err != nil {
+			return nil, err
+		}
+		targetCommand = []string{targetPath}
+	} else {
+		targetCommand = fuzzerConf.Command
+	}
+	if len(targetCommand) == 0 {
+		return nil, errors.New("Can't confirm hangs without a target command")
+	}
+
+	baseTimeout := defaultAflTimeout
+	if fuzzerConf.TimeoutMs > 0 {
+		baseTimeout = time.Duration(fuzzerConf.TimeoutMs) * time.Millisecond
+	}
+
+	return &HangConfirmer{
+		Interval:      conf.Interval,
+		Runs:          conf.Runs,
+		BaseTimeout:   baseTimeout,
+		Timeout:       baseTimeout * time.Duration(conf.TimeoutMultiplier),
+		TargetCommand: targetCommand,
+		Workdir:       fm.Basedir,
+		targetPath:    targetPath,
+		fileManager:   fm,
+		archiver:      a,
+	}, nil
+}
+
+// writeHangConfirmerTarget writes the target binary to an executable
+// temporary file and returns its path. The file is removed if it
+// can't be written.
+func writeHangConfirmerTarget(targetBinary types.TargetBinary) (string, error) {
+	f, err := ioutil.TempFile("", "roving-hang-confirmer-target")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(targetBinary)
+	if err == nil {
+		err = f.Chmod(0755)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// close removes the HangConfirmer's copy of the target binary, if it
+// has one.
+func (h *HangConfirmer) close() error {
+	if h.targetPath == "" {
+		return nil
+	}
+	err := os.Remove(h.targetPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// run runs the HangConfirmer forever. It periodically triages any
+// hangs that it has not seen before.
+func (h *HangConfirmer) run() {
+	log.Printf("HangConfirmer started runs=%d timeout=%v", h.Runs, h.Timeout)
+	ticker := time.NewTicker(h.Interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			h.triageNewHangs()
+		}
+	}
+}
+
+// triageNewHangs triages every hang in the fleet that does not yet
+// have a HangTriage.
+func (h *HangConfirmer) triageNewHangs() {
+	fuzzerIds, err := h.fileManager.FuzzerIds()
+	if err != nil {
+		log.Printf("Couldn't list fuzzers to triage hangs err=%v", err)
+		return
+	}
+
+	for _, fuzzerId := range fuzzerIds {
+		if err = h.triageFuzzerHangs(fuzzerId); err != nil {
+			log.Printf("Couldn't triage hangs fuzzer_id=%s err=%v", fuzzerId, err)
+		}
+	}
+}
+
+// triageFuzzerHangs triages the new hangs of a single fuzzer. It saves
+// the results after every hang so that a slow batch of hangs is not
+// re-run from scratch if the server restarts.
+func (h *HangConfirmer) triageFuzzerHangs(fuzzerId string) error {
+	names, err := h.fileManager.InputNames(fuzzerId, types.Hangs)
+	if err != nil {
+		return err
+	}
+	triage, err := h.fileManager.ReadHangTriage(fuzzerId)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, present := triage[name]; present {
+			continue
+		}
+
+		hangPath, err := h.fileManager.HangPath(fuzzerId, name)
+		if err != nil {
+			return err
+		}
+		t, err := h.triage(hangPath)
+		if err != nil {
+			return err
+		}
+		log.Printf(
+			"Triaged hang fuzzer_id=%s name=%s classification=%s timed_out=%d/%d",
+			fuzzerId, name, t.Classification, t.TimedOut, t.Runs,
+		)
+
+		triage[name] = t
+		if err = h.fileManager.WriteHangTriage(fuzzerId, triage); err != nil {
+			return err
+		}
+
+		tags := map[string]string{
+			"fuzzer_id":      fuzzerId,
+			"classification": string(t.Classification),
+		}
+		types.SubmitMetricCount("hang_confirmer.triaged", 1, tags)
+		if t.Classification == types.HangConfirmed {
+			h.archiveConfirmedHang(fuzzerId, hangPath)
+			h.publishConfirmedHang(fuzzerId, name, hangPath, t)
+		}
+	}
+	return nil
+}
+
+// archiveConfirmedHang archives a confirmed hang to the archiver's
+// "./realtime-hangs" directory, in the same way that archiveNewCrashes
+// archives crashes.
+func (h *HangConfirmer) archiveConfirmedHang(fuzzerId, hangPath string) {
+	relHangPath, err := filepath.Rel(h.fileManager.Basedir, hangPath)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	manifest := Manifest{
+		srcRoot: h.fileManager.Basedir,
+		entries: []ManifestEntry{
+			ManifestEntry{
+				src: relHangPath,
+				dst: filepath.Join(realtimeHangsPath, relHangPath),
+			},
+		},
+	}
+	ArchiveManifest(h.archiver, manifest)
+}
+
+// publishConfirmedHang publishes a hang.new event for a confirmed
+// hang. Unconfirmed hangs are never published.
+func (h *HangConfirmer) publishConfirmedHang(fuzzerId, name, hangPath string, t types.HangTriage) {
+	var size int64
+	if info, err := os.Stat(hangPath); err == nil {
+		size = info.Size()
+	} else {
+		log.Printf("Couldn't stat confirmed hang path=%s err=%v", hangPath, err)
+	}
+	publishHangConfirmed(fuzzerId, name, size, t)
+}
+
+// triage re-runs the input at `inputPath` `Runs` times and classifies
+// it based on how many of the runs timed out.
+func (h *HangConfirmer) triage(inputPath string) (types.HangTriage, error) {
+	durations := make([]time.Duration, 0, h.Runs)
+	timedOut := 0
+
+	for i := 0; i < h.Runs; i++ {
+		duration, didTimeOut, err := h.runOnce(inputPath)
+		if err != nil {
+			return types.HangTriage{}, err
+		}
+		durations = append(durations, duration)
+		if didTimeOut {
+			timedOut++
+		}
+	}
+
+	var maxDuration time.Duration
+	for _, d := range durations {
+		if d > maxDuration {
+			maxDuration = d
+		}
+	}
+
+	return types.HangTriage{
+		Classification: classifyHang(durations, timedOut, h.BaseTimeout),
+		Runs:           h.Runs,
+		TimedOut:       timedOut,
+		MaxDurationMs:  int64(maxDuration / time.Millisecond),
+		TimeoutMs:      int64(h.Timeout / time.Millisecond),
+		TriagedAt:      time.Now(),
+	}, nil
+}
+
+// runOnce runs the target on the input at `inputPath` once. It returns
+// how long the target ran for and whether it was killed for exceeding
+// the extended timeout. The target crashing or exiting non-zero is not
+// an error; only failing to start it is.
+func (h *HangConfirmer) runOnce(inputPath string) (time.Duration, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	args, useStdin := targetArgs(h.TargetCommand, inputPath)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = h.Workdir
+
+	if useStdin {
+		f, err := os.Open(inputPath)
+		if err != nil {
+			return 0, false, err
+		}
+		defer f.Close()
+		cmd.Stdin = f
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, false, err
+	}
+	cmd.Wait()
+	duration := time.Since(start)
+
+	return duration, ctx.Err() == context.DeadlineExceeded, nil
+}
+
+// targetArgs substitutes `inputPath` into `command` the same way that
+// AFL does. It returns whether the input should instead be passed to
+// the target on stdin.
+func targetArgs(command []string, inputPath string) ([]string, bool) {
+	args := make([]string, len(command))
+	useStdin := true
+	for i, arg := range command {
+		if arg == "@@" {
+			args[i] = inputPath
+			useStdin = false
+		} else {
+			args[i] = arg
+		}
+	}
+	return args, useStdin
+}
+
+// classifyHang decides what a hang is, given how long each of its
+// re-runs took and how many of them hit the extended timeout.
+func classifyHang(durations []time.Duration, timedOut int, baseTimeout time.Duration) types.HangClassification {
+	if timedOut == len(durations) {
+		return types.HangConfirmed
+	}
+	if timedOut > 0 {
+		return types.HangFlaky
+	}
+
+	for _, d := range durations {
+		if d <= baseTimeout {
+			return types.HangFlaky
+		}
+	}
+	return types.HangSlow
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestClassifyHang(t *testing.T) {
+	base := 100 * time.Millisecond
+
+	assert.Equal(t, types.HangConfirmed, classifyHang(
+		[]time.Duration{time.Second, time.Second, time.Second}, 3, base))
+	assert.Equal(t, types.HangFlaky, classifyHang(
+		[]time.Duration{time.Second, 10 * time.Millisecond, time.Second}, 2, base))
+	assert.Equal(t, types.HangSlow, classifyHang(
+		[]time.Duration{200 * time.Millisecond, 300 * time.Millisecond}, 0, base))
+	assert.Equal(t, types.HangFlaky, classifyHang(
+		[]time.Duration{200 * time.Millisecond, 10 * time.Millisecond}, 0, base))
+}
+
+func TestTargetArgs(t *testing.T) {
+	args, useStdin := targetArgs([]string{"./target", "-f", "@@"}, "/tmp/input")
+	assert.Equal(t, []string{"./target", "-f", "/tmp/input"}, args)
+	assert.False(t, useStdin)
+
+	args, useStdin = targetArgs([]string{"ruby", "harness.rb"}, "/tmp/input")
+	assert.Equal(t, []string{"ruby", "harness.rb"}, args)
+	assert.True(t, useStdin)
+}
+
+func TestTriageFuzzerHangs(t *testing.T) {
+	var err error
+	srcDir, err := ioutil.TempDir("", "roving-hang-confirmer-test-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	fileManager := types.FleetFileManager{Basedir: srcDir}
+
+	dstDir, err := ioutil.TempDir("", "roving-hang-confirmer-test-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	output := types.AflOutput{
+		Queue:   &types.InputCorpus{},
+		Crashes: &types.InputCorpus{},
+		Hangs: &types.InputCorpus{Inputs: []types.Input{
+			types.Input{Name: "hang1", Body: []byte{1}},
+		}},
+	}
+	if err = fileManager.MkAllOutputDirs("fuzzer-123"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fileManager.WriteOutput("fuzzer-123", &output); err != nil {
+		t.Fatal(err)
+	}
+
+	events = newEventBus()
+	hangConfirmer := HangConfirmer{
+		Runs:          2,
+		BaseTimeout:   10 * time.Millisecond,
+		Timeout:       50 * time.Millisecond,
+		TargetCommand: []string{"sh", "-c", "sleep 5"},
+		Workdir:       srcDir,
+		fileManager:   &fileManager,
+		archiver:      archiver,
+	}
+	if err = hangConfirmer.triageFuzzerHangs("fuzzer-123"); err != nil {
+		t.Fatal(err)
+	}
+
+	triage, err := fileManager.ReadHangTriage("fuzzer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, types.HangConfirmed, triage["hang1"].Classification)
+	assert.Equal(t, 2, triage["hang1"].TimedOut)
+
+	archivedHangs, err := archiver.LsDstFiles("realtime-hangs/output/fuzzer-123/hangs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"hang1"}, archivedHangs)
+
+	_, published := events.subscribe(EventFilter{Types: map[string]bool{EventHangNew: true}}, 0)
+	if assert.Equal(t, 1, len(published)) {
+		assert.Equal(t, "fuzzer-123", published[0].FuzzerId)
+		assert.Equal(t, "hang1", published[0].Data["name"])
+		assert.Equal(t, int64(1), published[0].Data["size"])
+		assert.Equal(t, 2, published[0].Data["timed_out"])
+	}
+}
+
+func TestUnconfirmedHangsAreNotPublished(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-hang-confirmer-test-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	fileManager := types.FleetFileManager{Basedir: srcDir}
+
+	output := types.AflOutput{
+		Queue:   &types.InputCorpus{},
+		Crashes: &types.InputCorpus{},
+		Hangs: &types.InputCorpus{Inputs: []types.Input{
+			types.Input{Name: "hang1", Body: []byte{1}},
+		}},
+	}
+	if err = fileManager.MkAllOutputDirs("fuzzer-123"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fileManager.WriteOutput("fuzzer-123", &output); err != nil {
+		t.Fatal(err)
+	}
+
+	events = newEventBus()
+	hangConfirmer := HangConfirmer{
+		Runs:          2,
+		BaseTimeout:   10 * time.Millisecond,
+		Timeout:       5 * time.Second,
+		TargetCommand: []string{"true"},
+		Workdir:       srcDir,
+		fileManager:   &fileManager,
+		archiver:      NullArchiver{},
+	}
+	if err = hangConfirmer.triageFuzzerHangs("fuzzer-123"); err != nil {
+		t.Fatal(err)
+	}
+
+	triage, err := fileManager.ReadHangTriage("fuzzer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, types.HangConfirmed, triage["hang1"].Classification)
+
+	_, published := events.subscribe(EventFilter{Types: map[string]bool{EventHangNew: true}}, 0)
+	assert.Empty(t, published)
+}
+
+func TestHangConfirmerRemovesItsTargetOnClose(t *testing.T) {
+	fileManager := types.FleetFileManager{Basedir: "/tmp/roving-workdir"}
+	conf := types.HangConfirmConfig{Runs: 1, TimeoutMultiplier: 10}
+	fuzzerConf := types.FuzzerConfig{UseBinary: true}
+
+	hangConfirmer, err := newHangConfirmer(conf, fuzzerConf, []byte("#!/bin/sh\n"), &fileManager, NullArchiver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetPath := hangConfirmer.TargetCommand[0]
+	info, err := os.Stat(targetPath)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	}
+
+	assert.Nil(t, hangConfirmer.close())
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err))
+	// Closing twice is harmless
+	assert.Nil(t, hangConfirmer.close())
+}
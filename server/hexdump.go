@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/richo/roving/types"
+)
+
+// hexdump.go turns input bodies into rows that the admin interface
+// can render as a hexdump, or as a side-by-side diff of two inputs.
+
+// The number of bytes in each row of a hexdump.
+var hexdumpRowWidth int = 16
+
+// The most bytes of an input that we will render. Inputs bigger than
+// this are truncated; the whole input can still be downloaded.
+var hexdumpMaxBytes int = 64 * 1024
+
+// hexByte is a single byte in a hexdump row. Bytes that are past the
+// end of the input have Present set to false, so that the last row
+// lines up with the others.
+type hexByte struct {
+	Hex     string
+	Char    string
+	Present bool
+	// Differs is only used in diffs, and is true if the byte is
+	// different in the other input.
+	Differs bool
+}
+
+// hexdumpRow is a single row of a hexdump: an offset, followed by
+// up to hexdumpRowWidth bytes.
+type hexdumpRow struct {
+	Offset string
+	Bytes  []hexByte
+}
+
+// diffRow is a single row of a side-by-side diff of two inputs.
+type diffRow struct {
+	Offset  string
+	Left    []hexByte
+	Right   []hexByte
+	Differs bool
+}
+
+func newHexByte(body []byte, i int) hexByte {
+	if i >= len(body) {
+		return hexByte{Hex: "  ", Char: " "}
+	}
+
+	b := body[i]
+	char := "."
+	if b >= 0x20 && b < 0x7f {
+		char = string(rune(b))
+	}
+	return hexByte{Hex: fmt.Sprintf("%02x", b), Char: char, Present: true}
+}
+
+func truncateBody(body []byte) ([]byte, bool) {
+	if len(body) > hexdumpMaxBytes {
+		return body[:hexdumpMaxBytes], true
+	}
+	return body, false
+}
+
+// hexdump splits `body` into hexdump rows. It also returns whether
+// `body` was too long to render in full.
+func hexdump(body []byte) ([]hexdumpRow, bool) {
+	body, truncated := truncateBody(body)
+
+	rows := make([]hexdumpRow, 0, len(body)/hexdumpRowWidth+1)
+	for offset := 0; offset < len(body); offset += hexdumpRowWidth {
+		row := hexdumpRow{
+			Offset: fmt.Sprintf("%08x", offset),
+			Bytes:  make([]hexByte, hexdumpRowWidth),
+		}
+		for i := range row.Bytes {
+			row.Bytes[i] = newHexByte(body, offset+i)
+		}
+		rows = append(rows, row)
+	}
+	return rows, truncated
+}
+
+// hexdiff lines up `left` and `right` byte by byte and splits them
+// into rows, marking every byte that differs between them. It also
+// returns the number of differing bytes, and whether either input
+// was too long to render in full.
+//
+// This is a positional diff: an insertion shows up as every following
+// byte differing. That is good enough for comparing AFL inputs, which
+// are mostly mutated in place.
+func hexdiff(left, right []byte) ([]diffRow, int, bool) {
+	left, leftTruncated := truncateBody(left)
+	right, rightTruncated := truncateBody(right)
+
+	length := len(left)
+	if len(right) > length {
+		length = len(right)
+	}
+
+	rows := make([]diffRow, 0, length/hexdumpRowWidth+1)
+	nDiffering := 0
+	for offset := 0; offset < length; offset += hexdumpRowWidth {
+		row := diffRow{
+			Offset: fmt.Sprintf("%08x", offset),
+			Left:   make([]hexByte, hexdumpRowWidth),
+			Right:  make([]hexByte, hexdumpRowWidth),
+		}
+		for i := 0; i < hexdumpRowWidth; i++ {
+			l := newHexByte(left, offset+i)
+			r := newHexByte(right, offset+i)
+			if (l.Present || r.Present) && (l.Present != r.Present || l.Hex != r.Hex) {
+				l.Differs = true
+				r.Differs = true
+				row.Differs = true
+				nDiffering++
+			}
+			row.Left[i] = l
+			row.Right[i] = r
+		}
+		rows = append(rows, row)
+	}
+	return rows, nDiffering, leftTruncated || rightTruncated
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// downloadFilename returns a filename for downloading an input that
+// is safe to put in a Content-Disposition header and to save on any
+// OS. AFL's names contain colons and commas, which are not.
+func downloadFilename(fuzzerId, inputType, inputName string) string {
+	name := strings.Join([]string{fuzzerId, inputType, inputName}, "-")
+	return unsafeFilenameChars.ReplaceAllString(name, "_")
+}
+
+var aflSrcPattern = regexp.MustCompile(`(?:^|,)src:(\d+)`)
+
+// queueAncestor returns the queue entry that AFL says input `name`
+// was derived from, if there is one and it is in `idx`. AFL records
+// this in the input's name, eg. `id:000003,sig:11,src:000001,op:havoc`.
+// Spliced inputs have two sources (`src:000001+000002`); we use the
+// first.
+func queueAncestor(idx *OutputIndex, fuzzerId, name string) (types.InputInfo, bool) {
+	match := aflSrcPattern.FindStringSubmatch(name)
+	if match == nil {
+		return types.InputInfo{}, false
+	}
+
+	prefix := fmt.Sprintf("id:%s,", match[1])
+	q := OutputQuery{FuzzerId: fuzzerId, Type: types.Queue, Name: prefix}
+	if err := q.validate(); err != nil {
+		return types.InputInfo{}, false
+	}
+	for _, info := range idx.query(q).Inputs {
+		if strings.HasPrefix(info.Name, prefix) {
+			return info, true
+		}
+	}
+	return types.InputInfo{}, false
+}
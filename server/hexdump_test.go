@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestHexdump(t *testing.T) {
+	body := []byte("hello, world!\x00\x01\xffAB")
+	rows, truncated := hexdump(body)
+
+	assert.False(t, truncated)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "00000000", rows[0].Offset)
+	assert.Equal(t, "00000010", rows[1].Offset)
+	assert.Equal(t, "68", rows[0].Bytes[0].Hex)
+	assert.Equal(t, "h", rows[0].Bytes[0].Char)
+	assert.Equal(t, "00", rows[0].Bytes[13].Hex)
+	assert.Equal(t, ".", rows[0].Bytes[13].Char)
+	assert.Equal(t, "ff", rows[0].Bytes[15].Hex)
+	assert.Equal(t, ".", rows[0].Bytes[15].Char)
+
+	// The last row is padded out to a full row
+	assert.Equal(t, hexdumpRowWidth, len(rows[1].Bytes))
+	assert.True(t, rows[1].Bytes[1].Present)
+	assert.False(t, rows[1].Bytes[2].Present)
+}
+
+func TestHexdiff(t *testing.T) {
+	left := []byte("0123456789abcdefXY")
+	right := []byte("0123456789abcdeF")
+	rows, nDiffering, truncated := hexdiff(left, right)
+
+	assert.False(t, truncated)
+	assert.Equal(t, 2, len(rows))
+	// One changed byte, and two bytes that are only in `left`
+	assert.Equal(t, 3, nDiffering)
+	assert.True(t, rows[0].Differs)
+	assert.False(t, rows[0].Left[0].Differs)
+	assert.True(t, rows[0].Left[15].Differs)
+	assert.True(t, rows[0].Right[15].Differs)
+	assert.True(t, rows[1].Left[0].Differs)
+	assert.False(t, rows[1].Right[0].Present)
+	assert.False(t, rows[1].Left[2].Differs)
+
+	rows, nDiffering, _ = hexdiff(left, left)
+	assert.Equal(t, 0, nDiffering)
+	assert.False(t, rows[0].Differs)
+}
+
+func TestDownloadFilename(t *testing.T) {
+	assert.Equal(
+		t,
+		"fuzzer-123-crashes-id_000000_sig_11_src_000001_op_havoc_rep_2",
+		downloadFilename("fuzzer-123", "crashes", "id:000000,sig:11,src:000001,op:havoc,rep:2"),
+	)
+	assert.Equal(t, "a-b-c_d_e", downloadFilename("a", "b", "c\"d\ne"))
+}
+
+func TestQueueAncestor(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "roving-hexdump-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := types.FleetFileManager{Basedir: basedir}
+	output := types.AflOutput{
+		Queue: &types.InputCorpus{Inputs: []types.Input{
+			types.Input{Name: "id:000000,orig:seed", Body: []byte("a")},
+			types.Input{Name: "id:000001,src:000000,op:flip1,pos:0,+cov", Body: []byte("b")},
+		}},
+		Crashes: &types.InputCorpus{},
+		Hangs:   &types.InputCorpus{},
+	}
+	if err = fm.MkAllOutputDirs("fuzzer-123"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fm.WriteOutput("fuzzer-123", &output); err != nil {
+		t.Fatal(err)
+	}
+	idx := newOutputIndex()
+	if err = idx.refreshAll(&fm); err != nil {
+		t.Fatal(err)
+	}
+
+	ancestor, present := queueAncestor(idx, "fuzzer-123", "id:000000,sig:11,src:000001,op:havoc,rep:2")
+	assert.True(t, present)
+	assert.Equal(t, "id:000001,src:000000,op:flip1,pos:0,+cov", ancestor.Name)
+
+	ancestor, present = queueAncestor(idx, "fuzzer-123", "id:000002,src:000000+000001,op:splice,rep:4")
+	assert.True(t, present)
+	assert.Equal(t, "id:000000,orig:seed", ancestor.Name)
+
+	_, present = queueAncestor(idx, "fuzzer-123", "id:000000,orig:seed")
+	assert.False(t, present)
+	_, present = queueAncestor(idx, "fuzzer-123", "id:000003,sig:11,src:000009,op:havoc")
+	assert.False(t, present)
+	_, present = queueAncestor(idx, "fuzzer-456", "id:000003,sig:11,src:000001,op:havoc")
+	assert.False(t, present)
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/richo/roving/types"
+)
+
+var fuzzerConfigKey = []byte("fuzzer_config")
+
+// SaveFuzzerConfig saves the fuzzer config that the server is serving
+// to clients, so that it can tell when it changes between runs.
+func (d *Database) SaveFuzzerConfig(conf types.FuzzerConfig) error {
+	buf, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(fuzzerConfigKey, buf)
+	})
+}
+
+// FuzzerConfig returns the fuzzer config that was last saved, and
+// whether there is one.
+func (d *Database) FuzzerConfig() (types.FuzzerConfig, bool, error) {
+	var conf types.FuzzerConfig
+	present := false
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(metaBucket).Get(fuzzerConfigKey)
+		if buf == nil {
+			return nil
+		}
+		present = true
+		return json.Unmarshal(buf, &conf)
+	})
+	return conf, present, err
+}
@@ -32,19 +32,12 @@ func (mp MetricsPoller) logMetrics() {
 
 	timeNow := uint64(time.Now().Unix())
 
-	mp.Nodes.statsLock.RLock()
-	defer mp.Nodes.statsLock.RUnlock()
-
-	for fuzzerID, fuzzerStats := range mp.Nodes.Stats {
-		// Log execs_per_sec
+	nodeInfos := mp.Nodes.snapshot()
+	for _, nodeInfo := range nodeInfos {
+		fuzzerStats := nodeInfo.Stats
 		tags := map[string]string{
-			"fuzzer_id": fuzzerID,
+			"fuzzer_id": nodeInfo.Id,
 		}
-		types.SubmitMetricGauge(
-			"fuzzer.execs_per_sec",
-			float32(fuzzerStats.ExecsPerSec),
-			tags,
-		)
 
 		// Log secs since last update
 		secsSinceLastUpdate := timeNow - fuzzerStats.LastUpdate
@@ -54,6 +47,19 @@ func (mp MetricsPoller) logMetrics() {
 			tags,
 		)
 
+		// The rest of a stale or lost fuzzer's stats are out of date,
+		// so they would throw off sums across the cluster
+		if nodeInfo.State != NodeActive {
+			continue
+		}
+
+		// Log execs_per_sec
+		types.SubmitMetricGauge(
+			"fuzzer.execs_per_sec",
+			float32(fuzzerStats.ExecsPerSec),
+			tags,
+		)
+
 		// Log secs since last path
 		if fuzzerStats.LastPath > 0 {
 			secsSinceLastPath := fuzzerStats.LastUpdate - fuzzerStats.LastPath
@@ -72,5 +78,5 @@ func (mp MetricsPoller) logMetrics() {
 		)
 	}
 
-	log.Printf("Successfully logged metrics in MetricsPoller n_fuzzers=%d", len(mp.Nodes.Stats))
+	log.Printf("Successfully logged metrics in MetricsPoller n_fuzzers=%d", len(nodeInfos))
 }
@@ -1,59 +1,400 @@
 package server
 
 import (
+	"log"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/richo/roving/types"
 )
 
+// NodeState is where a node is in its lifecycle. A node is active
+// while it keeps sending the server its state, and becomes stale,
+// then lost, then retired the longer it goes without doing so. See
+// types.NodesConfig.
+type NodeState string
+
+const (
+	NodeActive  NodeState = "active"
+	NodeStale   NodeState = "stale"
+	NodeLost    NodeState = "lost"
+	NodeRetired NodeState = "retired"
+)
+
+// NodeStates lists every NodeState, in lifecycle order.
+var NodeStates = []NodeState{NodeActive, NodeStale, NodeLost, NodeRetired}
+
+// The number of transitions that are kept for each node. Older
+// transitions are forgotten.
+var maxNodeTransitions int = 20
+
+// nodeStateAfter returns the state of a node that last sent the
+// server its state `age` ago.
+func nodeStateAfter(age time.Duration, conf types.NodesConfig) NodeState {
+	switch {
+	case age >= conf.RetireAfter:
+		return NodeRetired
+	case age >= conf.LostAfter:
+		return NodeLost
+	case age >= conf.StaleAfter:
+		return NodeStale
+	default:
+		return NodeActive
+	}
+}
+
+// NodeTransition is a node moving from one state to another.
+type NodeTransition struct {
+	// From is empty when a node is first seen.
+	From NodeState
+	To   NodeState
+	At   time.Time
+}
+
+// joined returns whether the transition is a node joining the
+// cluster, either for the first time or after it was retired.
+func (t NodeTransition) joined() bool {
+	return t.To == NodeActive && (t.From == "" || t.From == NodeRetired)
+}
+
+// NodeLifecycle is a node's current state, and how it got there.
+type NodeLifecycle struct {
+	State NodeState
+	Since time.Time
+	// Transitions are oldest first.
+	Transitions []NodeTransition
+}
+
+// transition moves the lifecycle to state `to`, and returns the
+// transition.
+func (l *NodeLifecycle) transition(to NodeState, at time.Time) NodeTransition {
+	t := NodeTransition{From: l.State, To: to, At: at}
+	l.State = to
+	l.Since = at
+	l.Transitions = append(l.Transitions, t)
+	if len(l.Transitions) > maxNodeTransitions {
+		l.Transitions = l.Transitions[len(l.Transitions)-maxNodeTransitions:]
+	}
+	return t
+}
+
+// copy returns a deep copy of the lifecycle, that is safe to use
+// without holding the Nodes's locks.
+func (l *NodeLifecycle) copy() NodeLifecycle {
+	c := *l
+	c.Transitions = append([]NodeTransition(nil), l.Transitions...)
+	return c
+}
+
 // Nodes is a struct that gets and sets the stats of Roving clients.
-// Should be used alongside a Reaper in order to cull inactive
-// clients.
+// Should be used alongside a Reaper in order to move nodes through
+// their lifecycles.
+//
+// Stats and updates are only kept for nodes that haven't been
+// retired. Lifecycles are kept for every node, so that we remember
+// when retired nodes left.
+//
+// If it has a Database then every change is also written to it, so
+// that the server's picture of the cluster survives a restart.
 type Nodes struct {
-	Stats   map[string]types.FuzzerStats
-	updates map[string]time.Time
+	Stats      map[string]types.FuzzerStats
+	updates    map[string]time.Time
+	lifecycles map[string]*NodeLifecycle
 
+	// statsLock guards Stats. updatesLock guards updates and
+	// lifecycles. When taking both, take statsLock first.
 	statsLock   *sync.RWMutex
 	updatesLock *sync.RWMutex
+
+	history *StatsHistory
+	db      *Database
+
+	// Records are written to the database without holding statsLock
+	// or updatesLock, so that a slow write doesn't block everything
+	// that reads the Nodes. saveVersion is guarded by updatesLock and
+	// orders the records. saveLock guards savedVersions, which stops
+	// an older record from overwriting a newer one.
+	saveVersion   uint64
+	saveLock      *sync.Mutex
+	savedVersions map[string]uint64
+}
+
+// nodeSave is a nodeRecord that is waiting to be written to the
+// database.
+type nodeSave struct {
+	nodeId  string
+	version uint64
+	record  nodeRecord
 }
 
-// setStats sets the stats for node `nodeId` to `stats`. It takes
-// out the appropriate locks to avoid race conditions.
-func (n *Nodes) setStats(nodeId string, stats types.FuzzerStats) {
+// setStats sets the stats for node `nodeId` to `stats`, and marks it
+// as active. If it wasn't active already then it returns the
+// transition. It takes out the appropriate locks to avoid race
+// conditions.
+func (n *Nodes) setStats(nodeId string, stats types.FuzzerStats) *NodeTransition {
 	n.statsLock.Lock()
-	defer n.statsLock.Unlock()
 	n.Stats[nodeId] = stats
 
 	n.updatesLock.Lock()
-	defer n.updatesLock.Unlock()
-	n.updates[nodeId] = time.Now()
+	now := time.Now()
+	n.updates[nodeId] = now
+	n.history.record(nodeId, stats, n.activeStats(nodeId), now)
+
+	var transition *NodeTransition
+	lifecycle, present := n.lifecycles[nodeId]
+	if !present {
+		lifecycle = &NodeLifecycle{}
+		n.lifecycles[nodeId] = lifecycle
+	}
+	if lifecycle.State != NodeActive {
+		t := lifecycle.transition(NodeActive, now)
+		transition = &t
+	}
+
+	pending := n.pendingSave(nodeId, nodeRecord{Stats: stats, LastUpdate: now, Lifecycle: lifecycle.copy()})
+	n.updatesLock.Unlock()
+	n.statsLock.Unlock()
+
+	n.save(pending)
+	return transition
 }
 
-// deleteNode deletes a node from the Nodes's maps. It takes
-// out the appropriate locks to avoid race conditions.
-func (n *Nodes) deleteNode(nodeId string) {
+// activeStats returns the stats of every active node, and of node
+// `nodeId`, which is about to become active. Stale and lost nodes
+// still have stats, but they are out of date, so they aren't counted
+// towards the cluster's. The caller must hold both locks.
+func (n *Nodes) activeStats(nodeId string) map[string]types.FuzzerStats {
+	active := make(map[string]types.FuzzerStats, len(n.Stats))
+	for id, stats := range n.Stats {
+		if lifecycle, present := n.lifecycles[id]; id == nodeId || !present || lifecycle.State == NodeActive {
+			active[id] = stats
+		}
+	}
+	return active
+}
+
+// nodeStateChange is a transition that updateStates made.
+type nodeStateChange struct {
+	Id         string
+	LastUpdate time.Time
+	NodeTransition
+}
+
+// updateStates moves every node that hasn't been retired into the
+// state it should be in as of `now`. Nodes that are retired are
+// forgotten, apart from their lifecycles. It returns the transitions
+// that were made. It takes out the appropriate locks to avoid race
+// conditions.
+func (n *Nodes) updateStates(now time.Time, conf types.NodesConfig) []nodeStateChange {
+	changes, pending := n.transitionStates(now, conf)
+	for _, p := range pending {
+		n.save(p)
+	}
+	return changes
+}
+
+// transitionStates makes updateStates's transitions in memory, and
+// returns them along with the records that need saving.
+func (n *Nodes) transitionStates(now time.Time, conf types.NodesConfig) ([]nodeStateChange, []nodeSave) {
 	n.statsLock.Lock()
 	defer n.statsLock.Unlock()
+	n.updatesLock.Lock()
+	defer n.updatesLock.Unlock()
+
+	changes := make([]nodeStateChange, 0)
+	pending := make([]nodeSave, 0)
+	for nodeId, lastUpdate := range n.updates {
+		lifecycle, present := n.lifecycles[nodeId]
+		if !present {
+			lifecycle = &NodeLifecycle{State: NodeActive, Since: lastUpdate}
+			n.lifecycles[nodeId] = lifecycle
+		}
+
+		state := nodeStateAfter(now.Sub(lastUpdate), conf)
+		if state == lifecycle.State {
+			continue
+		}
+		changes = append(changes, nodeStateChange{
+			Id:             nodeId,
+			LastUpdate:     lastUpdate,
+			NodeTransition: lifecycle.transition(state, now),
+		})
+
+		// Retired nodes keep their last stats in the database, for
+		// the record, but not in memory.
+		stats := n.Stats[nodeId]
+		if state == NodeRetired {
+			delete(n.Stats, nodeId)
+			delete(n.updates, nodeId)
+			n.history.forget(nodeId)
+			types.SubmitMetricCount("reaped", 1, map[string]string{"id": nodeId})
+		}
+		pending = append(pending, n.pendingSave(nodeId, nodeRecord{Stats: stats, LastUpdate: lastUpdate, Lifecycle: lifecycle.copy()}))
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Id < changes[j].Id
+	})
+	return changes, pending
+}
+
+// pendingSave returns `record` as a nodeSave that is newer than every
+// one before it. The caller must hold updatesLock.
+func (n *Nodes) pendingSave(nodeId string, record nodeRecord) nodeSave {
+	n.saveVersion++
+	return nodeSave{nodeId: nodeId, version: n.saveVersion, record: record}
+}
+
+// save writes a node to the database, if there is one. The caller
+// must not hold statsLock or updatesLock. If a newer record for the
+// node has already been saved then it does nothing.
+func (n *Nodes) save(p nodeSave) {
+	if n.db == nil {
+		return
+	}
+	n.saveLock.Lock()
+	defer n.saveLock.Unlock()
+	if n.savedVersions[p.nodeId] > p.version {
+		return
+	}
+	if err := n.db.SaveNode(p.nodeId, p.record); err != nil {
+		log.Printf("Couldn't save node node_id=%s err=%v", p.nodeId, err)
+		return
+	}
+	n.savedVersions[p.nodeId] = p.version
+}
+
+// NodeInfo is a point-in-time copy of everything a Nodes knows about
+// a single node that hasn't been retired.
+type NodeInfo struct {
+	Id         string
+	Stats      types.FuzzerStats
+	LastUpdate time.Time
+	State      NodeState
+	StateSince time.Time
+}
+
+// snapshot returns a NodeInfo for every node that hasn't been
+// retired, sorted by ID. It takes out the appropriate locks to avoid
+// race conditions.
+func (n *Nodes) snapshot() []NodeInfo {
+	n.statsLock.RLock()
+	defer n.statsLock.RUnlock()
+	n.updatesLock.RLock()
+	defer n.updatesLock.RUnlock()
+
+	infos := make([]NodeInfo, 0, len(n.Stats))
+	for nodeId, stats := range n.Stats {
+		info := NodeInfo{
+			Id:         nodeId,
+			Stats:      stats,
+			LastUpdate: n.updates[nodeId],
+			State:      NodeActive,
+		}
+		if lifecycle, present := n.lifecycles[nodeId]; present {
+			info.State = lifecycle.State
+			info.StateSince = lifecycle.Since
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+// statsOf returns the stats that node `nodeId` last sent, if it has
+// sent any and hasn't been retired. It takes out the appropriate
+// locks to avoid race conditions.
+func (n *Nodes) statsOf(nodeId string) (types.FuzzerStats, bool) {
+	n.statsLock.RLock()
+	defer n.statsLock.RUnlock()
+
+	stats, present := n.Stats[nodeId]
+	return stats, present
+}
+
+// NodeLifecycleInfo is a point-in-time copy of a node's lifecycle.
+type NodeLifecycleInfo struct {
+	Id string
+	NodeLifecycle
+}
+
+// lifecycleSnapshot returns the lifecycle of every node, including
+// retired ones, sorted by ID. It takes out the appropriate locks to
+// avoid race conditions.
+func (n *Nodes) lifecycleSnapshot() []NodeLifecycleInfo {
+	n.updatesLock.RLock()
+	defer n.updatesLock.RUnlock()
+
+	infos := make([]NodeLifecycleInfo, 0, len(n.lifecycles))
+	for nodeId, lifecycle := range n.lifecycles {
+		infos = append(infos, NodeLifecycleInfo{Id: nodeId, NodeLifecycle: lifecycle.copy()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+// lifecycle returns a copy of the lifecycle of node `nodeId`, if the
+// Nodes has one. It takes out the appropriate locks to avoid race
+// conditions.
+func (n *Nodes) lifecycle(nodeId string) (NodeLifecycle, bool) {
 	n.updatesLock.RLock()
 	defer n.updatesLock.RUnlock()
 
-	delete(n.Stats, nodeId)
-	delete(n.updates, nodeId)
-	types.SubmitMetricCount("reaped", 1, map[string]string{"id": nodeId})
+	lifecycle, present := n.lifecycles[nodeId]
+	if !present {
+		return NodeLifecycle{}, false
+	}
+	return lifecycle.copy(), true
 }
 
 func newNodes() Nodes {
 	var stats = make(map[string]types.FuzzerStats)
 	var updates = make(map[string]time.Time)
+	var lifecycles = make(map[string]*NodeLifecycle)
 
 	var statsLock sync.RWMutex
 	var updatesLock sync.RWMutex
+	var saveLock sync.Mutex
 
 	return Nodes{
-		Stats:       stats,
-		updates:     updates,
-		statsLock:   &statsLock,
-		updatesLock: &updatesLock,
+		Stats:         stats,
+		updates:       updates,
+		lifecycles:    lifecycles,
+		statsLock:     &statsLock,
+		updatesLock:   &updatesLock,
+		history:       newStatsHistory(),
+		saveLock:      &saveLock,
+		savedVersions: make(map[string]uint64),
+	}
+}
+
+// loadNodes builds a Nodes that is backed by `d`, and populates it
+// with the nodes that were saved in `d` before the server restarted.
+func loadNodes(d *Database) (Nodes, error) {
+	n := newNodes()
+	n.db = d
+
+	records, err := d.Nodes()
+	if err != nil {
+		return Nodes{}, err
+	}
+	for nodeId, record := range records {
+		lifecycle := record.Lifecycle
+		// Nodes saved before lifecycles existed were active
+		if lifecycle.State == "" {
+			lifecycle = NodeLifecycle{State: NodeActive, Since: record.LastUpdate}
+		}
+		n.lifecycles[nodeId] = &lifecycle
+
+		if lifecycle.State != NodeRetired {
+			n.Stats[nodeId] = record.Stats
+			n.updates[nodeId] = record.LastUpdate
+		}
 	}
+	return n, nil
 }
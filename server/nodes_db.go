@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/richo/roving/types"
+)
+
+// nodeRecord is how a node from a Nodes struct is stored in the
+// database.
+type nodeRecord struct {
+	Stats      types.FuzzerStats
+	LastUpdate time.Time
+	Lifecycle  NodeLifecycle
+}
+
+// SaveNode saves the latest stats of node `nodeId`, the time they
+// were received, and its lifecycle.
+func (d *Database) SaveNode(nodeId string, record nodeRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).Put([]byte(nodeId), buf)
+	})
+}
+
+// Nodes returns every saved node, as a map from nodeId => nodeRecord.
+func (d *Database) Nodes() (map[string]nodeRecord, error) {
+	records := make(map[string]nodeRecord)
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).ForEach(func(k, v []byte) error {
+			var record nodeRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records[string(k)] = record
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
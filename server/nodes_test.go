@@ -0,0 +1,185 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// Check that nodes survive a round-trip from memory => database => memory
+func TestNodesPersistAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roving-nodes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "roving.db")
+
+	d, err := openDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := loadNodes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(n.Stats))
+
+	n.setStats("fuzzer-123", types.FuzzerStats{PathsTotal: 123})
+	lastUpdate := n.updates["fuzzer-123"]
+	d.Close()
+
+	d, err = openDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	n, err = loadNodes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]types.FuzzerStats{
+		"fuzzer-123": types.FuzzerStats{PathsTotal: 123},
+	}, n.Stats)
+	assert.True(t, lastUpdate.Equal(n.updates["fuzzer-123"]))
+}
+
+func TestNodeLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roving-nodes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "roving.db")
+
+	d, err := openDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := loadNodes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.NodesConfig{StaleAfter: 15 * time.Minute, LostAfter: time.Hour, RetireAfter: 24 * time.Hour}
+
+	transition := n.setStats("fuzzer-123", types.FuzzerStats{PathsTotal: 123})
+	assert.NotNil(t, transition)
+	assert.True(t, transition.joined())
+	assert.Nil(t, n.setStats("fuzzer-123", types.FuzzerStats{PathsTotal: 124}))
+	lastUpdate := n.updates["fuzzer-123"]
+
+	assert.Equal(t, 0, len(n.updateStates(lastUpdate.Add(time.Minute), conf)))
+	changes := n.updateStates(lastUpdate.Add(20*time.Minute), conf)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, NodeActive, changes[0].From)
+	assert.Equal(t, NodeStale, changes[0].To)
+	assert.Equal(t, NodeStale, n.snapshot()[0].State)
+
+	changes = n.updateStates(lastUpdate.Add(2*time.Hour), conf)
+	assert.Equal(t, NodeLost, changes[0].To)
+
+	// Retired nodes are forgotten, apart from their lifecycles
+	changes = n.updateStates(lastUpdate.Add(25*time.Hour), conf)
+	assert.Equal(t, NodeRetired, changes[0].To)
+	assert.True(t, lastUpdate.Equal(changes[0].LastUpdate))
+	assert.Equal(t, 0, len(n.Stats))
+	assert.Equal(t, 0, len(n.snapshot()))
+	assert.Equal(t, 0, len(n.updateStates(lastUpdate.Add(48*time.Hour), conf)))
+
+	lifecycles := n.lifecycleSnapshot()
+	assert.Equal(t, 1, len(lifecycles))
+	assert.Equal(t, NodeRetired, lifecycles[0].State)
+	assert.Equal(t, 4, len(lifecycles[0].Transitions))
+	d.Close()
+
+	// ...including across restarts
+	d, err = openDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	n, err = loadNodes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(n.Stats))
+	assert.Equal(t, NodeRetired, n.lifecycleSnapshot()[0].State)
+
+	// A retired node that comes back joins again
+	transition = n.setStats("fuzzer-123", types.FuzzerStats{PathsTotal: 125})
+	assert.Equal(t, NodeRetired, transition.From)
+	assert.True(t, transition.joined())
+	assert.Equal(t, 1, len(n.Stats))
+}
+
+func TestClusterHistoryOnlyCountsActiveNodes(t *testing.T) {
+	n := newNodes()
+	conf := types.NodesConfig{StaleAfter: 15 * time.Minute, LostAfter: time.Hour, RetireAfter: 24 * time.Hour}
+
+	n.setStats("fuzzer-123", types.FuzzerStats{ExecsPerSec: 100})
+	n.updateStates(n.updates["fuzzer-123"].Add(2*time.Hour), conf)
+	assert.Equal(t, NodeLost, n.snapshot()[0].State)
+
+	n.setStats("fuzzer-456", types.FuzzerStats{ExecsPerSec: 50})
+	cluster := n.history.ClusterSamples()
+	newest := cluster[len(cluster)-1]
+	assert.Equal(t, float64(50), newest.Values["execs_per_sec"])
+	assert.Equal(t, float64(1), newest.Values["fuzzers"])
+
+	// A lost node that comes back counts again
+	n.setStats("fuzzer-123", types.FuzzerStats{ExecsPerSec: 100})
+	cluster = n.history.ClusterSamples()
+	newest = cluster[len(cluster)-1]
+	assert.Equal(t, float64(150), newest.Values["execs_per_sec"])
+	assert.Equal(t, float64(2), newest.Values["fuzzers"])
+}
+
+func TestReaperPublishesTransitions(t *testing.T) {
+	events = newEventBus()
+	promMetrics = newServerMetrics()
+	n := newNodes()
+	n.setStats("fuzzer-123", types.FuzzerStats{})
+	lastUpdate := n.updates["fuzzer-123"]
+
+	r := newReaper(&n, types.NodesConfig{StaleAfter: time.Minute, LostAfter: time.Hour, RetireAfter: 2 * time.Hour})
+	r.updateNodeStates(lastUpdate.Add(3 * time.Hour))
+
+	_, published := events.subscribe(EventFilter{}, 0)
+	assert.Equal(t, 2, len(published))
+	assert.Equal(t, EventNodeState, published[0].Type)
+	assert.Equal(t, NodeRetired, published[0].Data["to"])
+	assert.Equal(t, EventNodeReaped, published[1].Type)
+	assert.Equal(t, uint64(1), promMetrics.nodeTransitions[NodeRetired])
+}
+
+// Nodes are saved without holding the Nodes's locks, so saves can
+// finish out of order. An older record must never overwrite a newer
+// one.
+func TestNodesNeverSaveOlderRecordsOverNewerOnes(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	n, err := loadNodes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.updatesLock.Lock()
+	older := n.pendingSave("fuzzer-123", nodeRecord{Stats: types.FuzzerStats{PathsTotal: 1}})
+	newer := n.pendingSave("fuzzer-123", nodeRecord{Stats: types.FuzzerStats{PathsTotal: 2}})
+	n.updatesLock.Unlock()
+	n.save(newer)
+	n.save(older)
+
+	records, err := d.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(2), records["fuzzer-123"].Stats.PathsTotal)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/richo/roving/types"
+)
+
+// The number of inputs on a page of outputs if the request doesn't
+// ask for a particular number, and the most it can ask for.
+var defaultOutputsPerPage int = 100
+var maxOutputsPerPage int = 1000
+
+// The keys that a page of outputs can be sorted by.
+var outputSortKeys = []string{"time", "fuzzer", "type", "name", "size"}
+
+// OutputIndex is an in-memory index of the metadata of every queue
+// entry, crash and hang that the fleet has saved to disk. It lets us
+// list, filter and sort outputs without reading their bodies, which on
+// a real campaign can add up to hundreds of MB.
+//
+// The index is rebuilt for a fuzzer whenever the fuzzer uploads its
+// state, so it is never more than one upload behind the disk.
+type OutputIndex struct {
+	inputs map[string][]types.InputInfo
+	lock   *sync.RWMutex
+}
+
+func newOutputIndex() *OutputIndex {
+	var lock sync.RWMutex
+	return &OutputIndex{
+		inputs: make(map[string][]types.InputInfo),
+		lock:   &lock,
+	}
+}
+
+// refreshAll rebuilds the index for every fuzzer on disk.
+func (i *OutputIndex) refreshAll(fm *types.FleetFileManager) error {
+	fuzzerIds, err := fm.FuzzerIds()
+	if err != nil {
+		return err
+	}
+	for _, fuzzerId := range fuzzerIds {
+		if _, err = i.refreshFuzzer(fm, fuzzerId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshFuzzer rebuilds the index for fuzzer `fuzzerId`. It returns
+// the inputs that weren't in the index before.
+func (i *OutputIndex) refreshFuzzer(fm *types.FleetFileManager, fuzzerId string) ([]types.InputInfo, error) {
+	infos, err := fm.ListFuzzerOutputs(fuzzerId)
+	if err != nil {
+		return nil, err
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	known := make(map[string]bool)
+	for _, info := range i.inputs[fuzzerId] {
+		known[info.Type+"/"+info.Name] = true
+	}
+	added := make([]types.InputInfo, 0)
+	for _, info := range infos {
+		if !known[info.Type+"/"+info.Name] {
+			added = append(added, info)
+		}
+	}
+
+	i.inputs[fuzzerId] = infos
+	return added, nil
+}
+
+// forgetFuzzer removes fuzzer `fuzzerId` from the index.
+func (i *OutputIndex) forgetFuzzer(fuzzerId string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	delete(i.inputs, fuzzerId)
+}
+
+// hasFuzzer returns whether fuzzer `fuzzerId` has been indexed.
+func (i *OutputIndex) hasFuzzer(fuzzerId string) bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	_, present := i.inputs[fuzzerId]
+	return present
+}
+
+// inputsOfType returns every indexed input of type `inputType`, in no
+// particular order.
+func (i *OutputIndex) inputsOfType(inputType string) []types.InputInfo {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	matches := make([]types.InputInfo, 0)
+	for _, infos := range i.inputs {
+		for _, info := range infos {
+			if info.Type == inputType {
+				matches = append(matches, info)
+			}
+		}
+	}
+	return matches
+}
+
+// OutputQuery selects a page of inputs from an OutputIndex. Empty
+// filters match everything.
+type OutputQuery struct {
+	FuzzerId string
+	Type     string
+	// Name matches any input whose name contains it.
+	Name string
+
+	Sort    string
+	Desc    bool
+	Page    int
+	PerPage int
+}
+
+// validate checks that `q` can be run, and fills in defaults for any
+// fields that weren't set.
+func (q *OutputQuery) validate() error {
+	if q.Type != "" && q.Type != types.Queue && q.Type != types.Crashes && q.Type != types.Hangs {
+		return fmt.Errorf("Invalid type: %s", q.Type)
+	}
+
+	if q.Sort == "" {
+		q.Sort = "time"
+	}
+	validSort := false
+	for _, key := range outputSortKeys {
+		if q.Sort == key {
+			validSort = true
+		}
+	}
+	if !validSort {
+		return fmt.Errorf("Invalid sort: %s", q.Sort)
+	}
+
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PerPage < 1 {
+		q.PerPage = defaultOutputsPerPage
+	}
+	if q.PerPage > maxOutputsPerPage {
+		q.PerPage = maxOutputsPerPage
+	}
+	return nil
+}
+
+func (q OutputQuery) matches(info types.InputInfo) bool {
+	return (q.FuzzerId == "" || info.FuzzerId == q.FuzzerId) &&
+		(q.Type == "" || info.Type == q.Type) &&
+		(q.Name == "" || strings.Contains(info.Name, q.Name))
+}
+
+// less orders inputs by the query's sort key. Ties are broken by
+// fuzzer, type and name so that pages are stable.
+func (q OutputQuery) less(a, b types.InputInfo) bool {
+	var cmp int
+	switch q.Sort {
+	case "time":
+		cmp = compareInts(a.ModTime.UnixNano(), b.ModTime.UnixNano())
+	case "size":
+		cmp = compareInts(a.Size, b.Size)
+	case "fuzzer":
+		cmp = strings.Compare(a.FuzzerId, b.FuzzerId)
+	case "type":
+		cmp = strings.Compare(a.Type, b.Type)
+	case "name":
+		cmp = strings.Compare(a.Name, b.Name)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.FuzzerId, b.FuzzerId)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Type, b.Type)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Name, b.Name)
+	}
+
+	if q.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// OutputPage is a single page of the results of an OutputQuery.
+type OutputPage struct {
+	Inputs []types.InputInfo
+	// Total is the number of inputs that matched the query, across
+	// every page.
+	Total   int
+	Page    int
+	PerPage int
+	Pages   int
+}
+
+// query runs `q` against the index. `q` must already have been
+// validated.
+func (i *OutputIndex) query(q OutputQuery) OutputPage {
+	i.lock.RLock()
+	matches := make([]types.InputInfo, 0)
+	for _, infos := range i.inputs {
+		for _, info := range infos {
+			if q.matches(info) {
+				matches = append(matches, info)
+			}
+		}
+	}
+	i.lock.RUnlock()
+
+	sort.Slice(matches, func(a, b int) bool {
+		return q.less(matches[a], matches[b])
+	})
+
+	page := OutputPage{
+		Total:   len(matches),
+		Page:    q.Page,
+		PerPage: q.PerPage,
+		Pages:   (len(matches) + q.PerPage - 1) / q.PerPage,
+	}
+	// Pages past the last one are empty. The page number isn't
+	// bounded, so it is checked before it is multiplied, which could
+	// overflow.
+	start := len(matches)
+	if q.Page <= page.Pages {
+		start = (q.Page - 1) * q.PerPage
+	}
+	end := start + q.PerPage
+	if end > len(matches) {
+		end = len(matches)
+	}
+	page.Inputs = matches[start:end]
+	return page
+}
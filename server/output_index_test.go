@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestOutputIndexQuery(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "roving-output-index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := types.FleetFileManager{Basedir: basedir}
+
+	outputs := map[string]*types.AflOutput{
+		"fuzzer-123": &types.AflOutput{
+			Queue: &types.InputCorpus{Inputs: []types.Input{
+				types.Input{Name: "id:000000,orig:a", Body: []byte("aaaa")},
+				types.Input{Name: "id:000001,src:000000", Body: []byte("a")},
+			}},
+			Crashes: &types.InputCorpus{Inputs: []types.Input{
+				types.Input{Name: "id:000000,sig:11,src:000001", Body: []byte("crash")},
+			}},
+			Hangs: &types.InputCorpus{},
+		},
+		"fuzzer-456": &types.AflOutput{
+			Queue: &types.InputCorpus{},
+			Crashes: &types.InputCorpus{Inputs: []types.Input{
+				types.Input{Name: "id:000000,sig:06,src:000002", Body: []byte("crash!")},
+			}},
+			Hangs: &types.InputCorpus{Inputs: []types.Input{
+				types.Input{Name: "id:000000,src:000003", Body: []byte("hang")},
+			}},
+		},
+	}
+	for fuzzerId, output := range outputs {
+		if err = fm.MkAllOutputDirs(fuzzerId); err != nil {
+			t.Fatal(err)
+		}
+		if err = fm.WriteOutput(fuzzerId, output); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx := newOutputIndex()
+	if err = idx.refreshAll(&fm); err != nil {
+		t.Fatal(err)
+	}
+
+	q := OutputQuery{Type: types.Crashes, Sort: "size", Desc: true}
+	assert.Nil(t, q.validate())
+	page := idx.query(q)
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, "fuzzer-456", page.Inputs[0].FuzzerId)
+	assert.Equal(t, int64(6), page.Inputs[0].Size)
+	assert.Equal(t, "fuzzer-123", page.Inputs[1].FuzzerId)
+
+	q = OutputQuery{Name: "src:", Sort: "name", PerPage: 2}
+	assert.Nil(t, q.validate())
+	page = idx.query(q)
+	assert.Equal(t, 4, page.Total)
+	assert.Equal(t, 2, page.Pages)
+	assert.Equal(t, 2, len(page.Inputs))
+	assert.Equal(t, "id:000000,sig:06,src:000002", page.Inputs[0].Name)
+
+	q.Page = 2
+	page = idx.query(q)
+	assert.Equal(t, 2, len(page.Inputs))
+	assert.Equal(t, "id:000001,src:000000", page.Inputs[1].Name)
+
+	q.Page = 3
+	page = idx.query(q)
+	assert.Equal(t, 0, len(page.Inputs))
+
+	// Huge page numbers don't overflow
+	q.Page = math.MaxInt64
+	assert.Nil(t, q.validate())
+	page = idx.query(q)
+	assert.Equal(t, 0, len(page.Inputs))
+
+	q = OutputQuery{FuzzerId: "fuzzer-456"}
+	assert.Nil(t, q.validate())
+	assert.Equal(t, 2, idx.query(q).Total)
+
+	q = OutputQuery{Type: "nope"}
+	assert.NotNil(t, q.validate())
+	q = OutputQuery{Sort: "nope"}
+	assert.NotNil(t, q.validate())
+
+	assert.Equal(t, 2, len(idx.inputsOfType(types.Crashes)))
+
+	// Refreshing a fuzzer returns only the inputs it didn't have before
+	outputs["fuzzer-123"].Crashes.Inputs = append(outputs["fuzzer-123"].Crashes.Inputs,
+		types.Input{Name: "id:000001,sig:11,src:000000", Body: []byte("crash2")})
+	if err = fm.WriteOutput("fuzzer-123", outputs["fuzzer-123"]); err != nil {
+		t.Fatal(err)
+	}
+	added, err := idx.refreshFuzzer(&fm, "fuzzer-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, "id:000001,sig:11,src:000000", added[0].Name)
+	assert.Equal(t, types.Crashes, added[0].Type)
+}
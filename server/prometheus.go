@@ -0,0 +1,371 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goji.io/middleware"
+	"goji.io/pat"
+)
+
+// prometheus.go exposes the server's metrics at /metrics, in the
+// Prometheus text exposition format. See
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// Fuzzer and cluster metrics are computed from the Nodes when they
+// are scraped. The server's own metrics are collected as it runs in
+// promMetrics.
+
+// Upper bounds of the buckets of the request latency histogram, in
+// seconds.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Upper bounds of the buckets of the state payload size histogram, in
+// bytes.
+var stateSizeBuckets = []float64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20}
+
+var promMetrics = newServerMetrics()
+
+// histogram is a Prometheus histogram. It is not safe for concurrent
+// use; serverMetrics guards its histograms with its lock.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// requestKey identifies a group of requests. `route` is the pattern
+// that the request matched, rather than its path, so that there is
+// one series per route and not one per fuzzer or input.
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+// serverMetrics are the roving server's metrics about itself.
+type serverMetrics struct {
+	requests         map[requestKey]uint64
+	requestDurations map[requestKey]*histogram
+	stateSizes       *histogram
+	archiveResults   map[string]uint64
+	// nodeTransitions maps the state that nodes moved to => count
+	nodeTransitions map[NodeState]uint64
+
+	lock *sync.Mutex
+}
+
+func newServerMetrics() *serverMetrics {
+	var lock sync.Mutex
+	return &serverMetrics{
+		requests:         make(map[requestKey]uint64),
+		requestDurations: make(map[requestKey]*histogram),
+		stateSizes:       newHistogram(stateSizeBuckets),
+		archiveResults:   map[string]uint64{"success": 0, "failure": 0},
+		nodeTransitions:  make(map[NodeState]uint64),
+		lock:             &lock,
+	}
+}
+
+func (m *serverMetrics) observeRequest(route, method string, code int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[requestKey{route: route, method: method, code: code}]++
+
+	// Durations aren't broken down by status code, to keep the number
+	// of series down.
+	durationKey := requestKey{route: route, method: method}
+	h, present := m.requestDurations[durationKey]
+	if !present {
+		h = newHistogram(requestDurationBuckets)
+		m.requestDurations[durationKey] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *serverMetrics) observeStateSize(bytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stateSizes.observe(float64(bytes))
+}
+
+// observeArchive records the result of archiving a single file.
+func (m *serverMetrics) observeArchive(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err != nil {
+		m.archiveResults["failure"]++
+	} else {
+		m.archiveResults["success"]++
+	}
+}
+
+// observeNodeTransition records a node moving from one state to
+// another.
+func (m *serverMetrics) observeNodeTransition(t NodeTransition) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nodeTransitions[t.To]++
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the status
+// code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets handlers that stream their responses, such as getEvents,
+// flush through a statusRecorder.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentRequests is goji middleware that records the count and
+// latency of requests to each route.
+func instrumentRequests(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		inner.ServeHTTP(recorder, r)
+
+		route := "unmatched"
+		if p, ok := middleware.Pattern(r.Context()).(*pat.Pattern); ok {
+			route = p.String()
+		}
+		promMetrics.observeRequest(route, r.Method, recorder.code, time.Since(start))
+	})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// promWriter writes metrics in the Prometheus text format.
+type promWriter struct {
+	w io.Writer
+}
+
+func (p promWriter) header(name, metricType, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (p promWriter) sample(name string, labels []string, value float64) {
+	fmt.Fprintf(p.w, "%s%s %v\n", name, formatLabels(labels), value)
+}
+
+func (p promWriter) histogram(name string, labels []string, h *histogram) {
+	for i, bound := range h.bounds {
+		p.sample(name+"_bucket", append(labels, "le", fmt.Sprintf("%v", bound)), float64(h.counts[i]))
+	}
+	p.sample(name+"_bucket", append(labels, "le", "+Inf"), float64(h.count))
+	p.sample(name+"_sum", labels, h.sum)
+	p.sample(name+"_count", labels, float64(h.count))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats `labels`, a list of alternating names and
+// values, as a Prometheus label set.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeFuzzerMetrics writes a gauge per fuzzer for some of the stats
+// in `nodeInfos`, and gauges of their totals across the cluster.
+// Stale and lost fuzzers only get roving_fuzzer_seconds_since_last_update,
+// since the rest of their stats are out of date.
+func writeFuzzerMetrics(p promWriter, nodeInfos []NodeInfo, now time.Time) {
+	gauges := []struct {
+		name  string
+		help  string
+		value func(NodeInfo) (float64, bool)
+		// Whether fuzzers that aren't active get the gauge
+		allStates bool
+	}{
+		{"roving_fuzzer_execs_per_sec", "Executions per second.", func(n NodeInfo) (float64, bool) {
+			return n.Stats.ExecsPerSec, true
+		}, false},
+		{"roving_fuzzer_paths_total", "Paths in the fuzzer's queue.", func(n NodeInfo) (float64, bool) {
+			return float64(n.Stats.PathsTotal), true
+		}, false},
+		{"roving_fuzzer_unique_crashes", "Unique crashes found.", func(n NodeInfo) (float64, bool) {
+			return float64(n.Stats.UniqueCrashes), true
+		}, false},
+		{"roving_fuzzer_unique_hangs", "Unique hangs found.", func(n NodeInfo) (float64, bool) {
+			return float64(n.Stats.UniqueHangs), true
+		}, false},
+		{"roving_fuzzer_bitmap_coverage_percent", "Percentage of the coverage bitmap that is set.", func(n NodeInfo) (float64, bool) {
+			return n.Stats.BitmapCvg, true
+		}, false},
+		{"roving_fuzzer_seconds_since_last_path", "Seconds since the fuzzer last found a new path.", func(n NodeInfo) (float64, bool) {
+			if n.Stats.LastPath == 0 {
+				return 0, false
+			}
+			return now.Sub(time.Unix(int64(n.Stats.LastPath), 0)).Seconds(), true
+		}, false},
+		{"roving_fuzzer_seconds_since_last_update", "Seconds since the fuzzer last sent the server its state.", func(n NodeInfo) (float64, bool) {
+			return now.Sub(n.LastUpdate).Seconds(), true
+		}, true},
+	}
+
+	for _, gauge := range gauges {
+		p.header(gauge.name, "gauge", gauge.help)
+		for _, n := range nodeInfos {
+			if n.State != NodeActive && !gauge.allStates {
+				continue
+			}
+			if v, ok := gauge.value(n); ok {
+				p.sample(gauge.name, []string{"fuzzer_id", n.Id, "host", hostOf(n.Id)}, v)
+			}
+		}
+	}
+
+	totals := summarizeFleet(nodeInfos, now, "name", false).Totals
+	clusterGauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"roving_cluster_fuzzers", "Fuzzers known to the server.", float64(totals.Fuzzers)},
+		{"roving_cluster_stalled_fuzzers", "Fuzzers that are stalled.", float64(totals.Stalled)},
+		{"roving_cluster_execs_per_sec", "Executions per second across the cluster.", totals.ExecsPerSec},
+		{"roving_cluster_paths_total", "Paths across the cluster.", float64(totals.PathsTotal)},
+		{"roving_cluster_unique_crashes", "Unique crashes across the cluster.", float64(totals.UniqueCrashes)},
+		{"roving_cluster_unique_hangs", "Unique hangs across the cluster.", float64(totals.UniqueHangs)},
+	}
+	for _, gauge := range clusterGauges {
+		p.header(gauge.name, "gauge", gauge.help)
+		p.sample(gauge.name, nil, gauge.value)
+	}
+}
+
+// writeServerMetrics writes the server's metrics about itself.
+func writeServerMetrics(p promWriter, m *serverMetrics) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sortRequestKeys(requestKeys)
+	p.header("roving_http_requests_total", "counter", "HTTP requests, by route, method and status code.")
+	for _, key := range requestKeys {
+		labels := []string{"route", key.route, "method", key.method, "code", fmt.Sprintf("%d", key.code)}
+		p.sample("roving_http_requests_total", labels, float64(m.requests[key]))
+	}
+
+	durationKeys := make([]requestKey, 0, len(m.requestDurations))
+	for key := range m.requestDurations {
+		durationKeys = append(durationKeys, key)
+	}
+	sortRequestKeys(durationKeys)
+	p.header("roving_http_request_duration_seconds", "histogram", "HTTP request latencies, by route and method.")
+	for _, key := range durationKeys {
+		labels := []string{"route", key.route, "method", key.method}
+		p.histogram("roving_http_request_duration_seconds", labels, m.requestDurations[key])
+	}
+
+	p.header("roving_state_payload_bytes", "histogram", "Sizes of the states uploaded by fuzzers.")
+	p.histogram("roving_state_payload_bytes", nil, m.stateSizes)
+
+	p.header("roving_archive_files_total", "counter", "Files archived, by result.")
+	for _, result := range []string{"failure", "success"} {
+		p.sample("roving_archive_files_total", []string{"result", result}, float64(m.archiveResults[result]))
+	}
+
+	p.header("roving_node_transitions_total", "counter", "Nodes moving between lifecycle states, by the state they moved to.")
+	for _, state := range NodeStates {
+		p.sample("roving_node_transitions_total", []string{"to", string(state)}, float64(m.nodeTransitions[state]))
+	}
+}
+
+// writeNodeStateMetrics writes the number of nodes in each lifecycle
+// state.
+func writeNodeStateMetrics(p promWriter, lifecycles []NodeLifecycleInfo) {
+	counts := make(map[NodeState]int)
+	for _, l := range lifecycles {
+		counts[l.State]++
+	}
+
+	p.header("roving_cluster_nodes", "gauge", "Nodes known to the server, by lifecycle state.")
+	for _, state := range NodeStates {
+		p.sample("roving_cluster_nodes", []string{"state", string(state)}, float64(counts[state]))
+	}
+}
+
+func sortRequestKeys(keys []requestKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+}
+
+// The getMetrics route returns the server's metrics in the Prometheus
+// text format.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	p := promWriter{w: w}
+	writeFuzzerMetrics(p, nodes.snapshot(), time.Now())
+	writeNodeStateMetrics(p, nodes.lifecycleSnapshot())
+	writeServerMetrics(p, promMetrics)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	goji "goji.io"
+	"goji.io/pat"
+
+	"github.com/richo/roving/types"
+)
+
+func TestWriteFuzzerMetrics(t *testing.T) {
+	now := time.Unix(1000, 0)
+	nodeInfos := []NodeInfo{
+		NodeInfo{
+			Id:         "host_a-1",
+			Stats:      types.FuzzerStats{ExecsPerSec: 100, PathsTotal: 10, LastPath: 900},
+			LastUpdate: now.Add(-5 * time.Second),
+			State:      NodeActive,
+		},
+		NodeInfo{
+			Id:         "host_b-2",
+			Stats:      types.FuzzerStats{ExecsPerSec: 50.5, UniqueCrashes: 3},
+			LastUpdate: now,
+			State:      NodeActive,
+		},
+		NodeInfo{
+			Id:         "host_c-3",
+			Stats:      types.FuzzerStats{ExecsPerSec: 1000, UniqueCrashes: 10},
+			LastUpdate: now.Add(-20 * time.Minute),
+			State:      NodeStale,
+		},
+	}
+
+	var buf bytes.Buffer
+	writeFuzzerMetrics(promWriter{w: &buf}, nodeInfos, now)
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE roving_fuzzer_execs_per_sec gauge\n")
+	assert.Contains(t, out, `roving_fuzzer_execs_per_sec{fuzzer_id="host_a-1",host="host_a"} 100`+"\n")
+	assert.Contains(t, out, `roving_fuzzer_execs_per_sec{fuzzer_id="host_b-2",host="host_b"} 50.5`+"\n")
+	assert.Contains(t, out, `roving_fuzzer_seconds_since_last_path{fuzzer_id="host_a-1",host="host_a"} 100`+"\n")
+	// host_b-2 has never found a path, so it has no such gauge
+	assert.NotContains(t, out, `roving_fuzzer_seconds_since_last_path{fuzzer_id="host_b-2"`)
+	assert.Contains(t, out, `roving_fuzzer_seconds_since_last_update{fuzzer_id="host_a-1",host="host_a"} 5`+"\n")
+	// host_c-3 is stale, so only how long ago it last updated counts
+	assert.NotContains(t, out, `roving_fuzzer_execs_per_sec{fuzzer_id="host_c-3"`)
+	assert.Contains(t, out, `roving_fuzzer_seconds_since_last_update{fuzzer_id="host_c-3",host="host_c"} 1200`+"\n")
+	assert.Contains(t, out, "roving_cluster_fuzzers 3\n")
+	assert.Contains(t, out, "roving_cluster_execs_per_sec 150.5\n")
+	assert.Contains(t, out, "roving_cluster_unique_crashes 3\n")
+}
+
+func TestWriteServerMetrics(t *testing.T) {
+	m := newServerMetrics()
+	m.observeRequest("/state", "POST", 200, 20*time.Millisecond)
+	m.observeRequest("/state", "POST", 200, 2*time.Second)
+	m.observeRequest("/state", "POST", 500, 1*time.Millisecond)
+	m.observeStateSize(2048)
+	m.observeArchive(nil)
+	m.observeArchive(errors.New("oops"))
+	m.observeArchive(nil)
+
+	var buf bytes.Buffer
+	writeServerMetrics(promWriter{w: &buf}, m)
+	out := buf.String()
+
+	assert.Contains(t, out, `roving_http_requests_total{route="/state",method="POST",code="200"} 2`+"\n")
+	assert.Contains(t, out, `roving_http_requests_total{route="/state",method="POST",code="500"} 1`+"\n")
+	assert.Contains(t, out, `roving_http_request_duration_seconds_bucket{route="/state",method="POST",le="0.025"} 2`+"\n")
+	assert.Contains(t, out, `roving_http_request_duration_seconds_bucket{route="/state",method="POST",le="+Inf"} 3`+"\n")
+	assert.Contains(t, out, `roving_http_request_duration_seconds_count{route="/state",method="POST"} 3`+"\n")
+	assert.Contains(t, out, `roving_state_payload_bytes_bucket{le="1024"} 0`+"\n")
+	assert.Contains(t, out, `roving_state_payload_bytes_bucket{le="16384"} 1`+"\n")
+	assert.Contains(t, out, "roving_state_payload_bytes_sum 2048\n")
+	assert.Contains(t, out, `roving_archive_files_total{result="failure"} 1`+"\n")
+	assert.Contains(t, out, `roving_archive_files_total{result="success"} 2`+"\n")
+}
+
+func TestWriteNodeStateMetrics(t *testing.T) {
+	lifecycles := []NodeLifecycleInfo{
+		NodeLifecycleInfo{Id: "a", NodeLifecycle: NodeLifecycle{State: NodeActive}},
+		NodeLifecycleInfo{Id: "b", NodeLifecycle: NodeLifecycle{State: NodeActive}},
+		NodeLifecycleInfo{Id: "c", NodeLifecycle: NodeLifecycle{State: NodeRetired}},
+	}
+
+	var buf bytes.Buffer
+	writeNodeStateMetrics(promWriter{w: &buf}, lifecycles)
+	out := buf.String()
+
+	assert.Contains(t, out, `roving_cluster_nodes{state="active"} 2`+"\n")
+	assert.Contains(t, out, `roving_cluster_nodes{state="lost"} 0`+"\n")
+	assert.Contains(t, out, `roving_cluster_nodes{state="retired"} 1`+"\n")
+}
+
+func TestInstrumentRequests(t *testing.T) {
+	promMetrics = newServerMetrics()
+
+	mux := goji.NewMux()
+	mux.Use(instrumentRequests)
+	mux.HandleFunc(pat.Get("/api/crashes/:fuzzerId/:name"), func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	for _, path := range []string{"/api/crashes/a/b", "/api/crashes/c/d", "/nope"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	assert.Equal(t, uint64(2), promMetrics.requests[requestKey{"/api/crashes/:fuzzerId/:name", "GET", 404}])
+	assert.Equal(t, uint64(1), promMetrics.requests[requestKey{"unmatched", "GET", 404}])
+}
+
+func TestFormatLabels(t *testing.T) {
+	assert.Equal(t, "", formatLabels(nil))
+	assert.Equal(t, `{a="1",b="x\"y\\z\n"}`, formatLabels([]string{"a", "1", "b", "x\"y\\z\n"}))
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// PruneReport is what pruneArchive did, or would have done in a dry
+// run.
+type PruneReport struct {
+	Time   time.Time
+	DryRun bool
+	// The timestamps of the archives that were kept and pruned,
+	// newest first
+	Kept   []int64
+	Pruned []int64
+	// The number of snapshot objects that no kept snapshot refers to,
+	// and so were pruned too
+	ObjectsPruned int
+	// Why pruning stopped early, if it did
+	Error string
+}
+
+// archivesToKeep returns which of `timestamps` a retention `policy`
+// keeps, as a set.
+func archivesToKeep(timestamps []int64, policy types.ArchiveRetentionConfig) map[int64]bool {
+	sorted := append([]int64(nil), timestamps...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] > sorted[j]
+	})
+
+	keep := make(map[int64]bool)
+	for i, ts := range sorted {
+		if i < policy.KeepLast {
+			keep[ts] = true
+		}
+	}
+
+	// keepPerPeriod keeps the most recent archive in each of the `n`
+	// most recent periods that have one.
+	keepPerPeriod := func(n int, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, ts := range sorted {
+			if len(seen) >= n {
+				return
+			}
+			p := period(time.Unix(ts, 0).UTC())
+			if !seen[p] {
+				seen[p] = true
+				keep[ts] = true
+			}
+		}
+	}
+	keepPerPeriod(policy.KeepHourly, func(t time.Time) string {
+		return t.Format("2006-01-02T15")
+	})
+	keepPerPeriod(policy.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPerPeriod(policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	return keep
+}
+
+// pruneArchive uses an `archiver` to delete the archives that a
+// retention `policy` doesn't keep. Snapshots and tarballs are always
+// pruned, along with any snapshot objects that only pruned snapshots
+// referred to. Timestamped copies are only pruned in
+// types.ArchiveModeCopy, because finding them means listing
+// everything that has been archived.
+//
+// Only complete copies count towards the policy, so that a
+// half-written copy is never kept in place of a good one. Incomplete
+// copies are pruned once there is a newer complete one, since they
+// will never be finished; newer ones may still be being written.
+func pruneArchive(a Archiver, mode string, policy types.ArchiveRetentionConfig) (PruneReport, error) {
+	report := PruneReport{
+		Time:   time.Now(),
+		DryRun: policy.DryRun,
+		Kept:   []int64{},
+		Pruned: []int64{},
+	}
+
+	snapshots, err := listSnapshots(a)
+	if err != nil {
+		return report, err
+	}
+	copies := []int64{}
+	incomplete := []int64{}
+	if mode == types.ArchiveModeCopy {
+		if copies, incomplete, err = listCopies(a); err != nil {
+			return report, err
+		}
+	}
+	timestamps := append(append([]int64{}, snapshots...), copies...)
+	isCopy := make(map[int64]bool)
+	var newestCopy int64
+	for _, ts := range copies {
+		isCopy[ts] = true
+		if ts > newestCopy {
+			newestCopy = ts
+		}
+	}
+
+	keep := archivesToKeep(timestamps, policy)
+	for _, ts := range incomplete {
+		isCopy[ts] = true
+		timestamps = append(timestamps, ts)
+		keep[ts] = ts > newestCopy
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] > timestamps[j]
+	})
+	for _, ts := range timestamps {
+		if keep[ts] {
+			report.Kept = append(report.Kept, ts)
+		} else {
+			report.Pruned = append(report.Pruned, ts)
+		}
+	}
+
+	// Work out which objects the kept snapshots need before deleting
+	// anything, so that a failure part way through can't leave a kept
+	// snapshot without its objects.
+	referenced := make(map[string]bool)
+	for _, ts := range report.Kept {
+		if isCopy[ts] {
+			continue
+		}
+		snapshot, err := readSnapshot(a, ts)
+		if err != nil {
+			return report, err
+		}
+		for _, f := range snapshot.Files {
+			referenced[f.Sha256] = true
+		}
+	}
+	objects, err := a.LsDstFiles(snapshotObjectsPath)
+	if err != nil {
+		return report, err
+	}
+	unreferenced := make([]string, 0)
+	for _, hash := range objects {
+		if !referenced[hash] {
+			unreferenced = append(unreferenced, hash)
+		}
+	}
+	report.ObjectsPruned = len(unreferenced)
+
+	if policy.DryRun {
+		log.Printf("Would prune archives dst=%s pruned=%v objects=%d", a.DescribeDstRoot(), report.Pruned, report.ObjectsPruned)
+		return report, nil
+	}
+
+	for _, ts := range report.Pruned {
+		if isCopy[ts] {
+			err = deleteCopy(a, ts)
+		} else {
+			err = deleteSnapshot(a, ts)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, hash := range unreferenced {
+		if err = a.deleteOne(snapshotObjectPath(hash)); err != nil {
+			return report, err
+		}
+	}
+
+	log.Printf("Pruned archives dst=%s pruned=%v objects=%d", a.DescribeDstRoot(), report.Pruned, report.ObjectsPruned)
+	types.SubmitMetricCount("archive_prune.pruned", float32(len(report.Pruned)), map[string]string{})
+	return report, nil
+}
+
+// listCopies returns the timestamps of every timestamped copy that an
+// `archiver` has, split into those that have a completion marker and
+// those that don't.
+func listCopies(a Archiver) ([]int64, []int64, error) {
+	filenames, err := a.lsDstTree("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[int64]bool)
+	complete := make(map[int64]bool)
+	for _, filename := range filenames {
+		if !strings.Contains(filename, "/") {
+			if !strings.HasSuffix(filename, copyCompleteExt) {
+				continue
+			}
+			ts, err := strconv.ParseInt(strings.TrimSuffix(filename, copyCompleteExt), 10, 64)
+			if err == nil {
+				seen[ts] = true
+				complete[ts] = true
+			}
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.SplitN(filename, "/", 2)[0], 10, 64)
+		if err == nil {
+			seen[ts] = true
+		}
+	}
+
+	completeTimestamps := make([]int64, 0)
+	incompleteTimestamps := make([]int64, 0)
+	for ts := range seen {
+		if complete[ts] {
+			completeTimestamps = append(completeTimestamps, ts)
+		} else {
+			incompleteTimestamps = append(incompleteTimestamps, ts)
+		}
+	}
+	return completeTimestamps, incompleteTimestamps, nil
+}
+
+// deleteCopy deletes the timestamped copy taken at `ts`. Its
+// completion marker is deleted first, so that a copy that is only
+// partly deleted is never taken for a complete one.
+func deleteCopy(a Archiver, ts int64) error {
+	dir := strconv.FormatInt(ts, 10)
+	if err := a.deleteOne(copyCompletePath(dir)); err != nil {
+		return err
+	}
+	filenames, err := a.lsDstTree(dir)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if err = a.deleteOne(path.Join(dir, filename)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSnapshot deletes the snapshot taken at `ts`, and its tarball
+// if it has one. Its manifest is deleted first, so that a snapshot is
+// never listed without its tarball.
+func deleteSnapshot(a Archiver, ts int64) error {
+	snapshot, err := readSnapshot(a, ts)
+	if err != nil {
+		return err
+	}
+	if err = a.deleteOne(snapshotManifestPath(ts)); err != nil {
+		return err
+	}
+	if snapshot.Tarball != "" {
+		return a.deleteOne(snapshot.Tarball)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestArchivesToKeep(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// An archive every 30 minutes for 3 days
+	timestamps := []int64{}
+	for i := 0; i < 3*48; i++ {
+		timestamps = append(timestamps, start.Add(time.Duration(i)*30*time.Minute).Unix())
+	}
+	newest := timestamps[len(timestamps)-1]
+
+	keep := archivesToKeep(timestamps, types.ArchiveRetentionConfig{KeepLast: 3})
+	assert.Equal(t, 3, len(keep))
+	assert.True(t, keep[newest])
+
+	// The newest archive in each of the last 4 hours
+	keep = archivesToKeep(timestamps, types.ArchiveRetentionConfig{KeepHourly: 4})
+	assert.Equal(t, 4, len(keep))
+	assert.True(t, keep[newest])
+	assert.True(t, keep[newest-3600])
+	assert.False(t, keep[newest-1800])
+
+	// The newest archive in each day, which overlaps with the hourly
+	// archives on the last day
+	keep = archivesToKeep(timestamps, types.ArchiveRetentionConfig{KeepHourly: 2, KeepDaily: 7})
+	assert.Equal(t, 4, len(keep))
+	assert.True(t, keep[start.Add(24*time.Hour-30*time.Minute).Unix()])
+	assert.True(t, keep[start.Add(48*time.Hour-30*time.Minute).Unix()])
+
+	keep = archivesToKeep(timestamps, types.ArchiveRetentionConfig{KeepWeekly: 2})
+	assert.Equal(t, 1, len(keep))
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-pruning-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-pruning-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	writeFile(filepath.Join(srcDir, "kept"), "kept")
+	writeFile(filepath.Join(srcDir, "changes"), "first")
+	if _, _, err = archiveSnapshot(archiver, srcDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = archiveTarball(archiver, srcDir, snapshotBasePath(2000), 2000); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(filepath.Join(srcDir, "changes"), "second")
+	if _, _, err = archiveSnapshot(archiver, srcDir, 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dry runs don't delete anything
+	policy := types.ArchiveRetentionConfig{KeepLast: 1, DryRun: true}
+	report, err := pruneArchive(archiver, types.ArchiveModeSnapshot, policy)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{3000}, report.Kept)
+	assert.Equal(t, []int64{2000, 1000}, report.Pruned)
+	assert.Equal(t, 1, report.ObjectsPruned)
+	timestamps, err := listSnapshots(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(timestamps))
+
+	policy.DryRun = false
+	report, err = pruneArchive(archiver, types.ArchiveModeSnapshot, policy)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2000, 1000}, report.Pruned)
+
+	timestamps, err = listSnapshots(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{3000}, timestamps)
+	snapshotFiles, err := archiver.LsDstFiles(snapshotsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3000.json"}, snapshotFiles)
+	// Only the object that the kept snapshot doesn't use is pruned
+	objects, err := archiver.LsDstFiles(snapshotObjectsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+}
+
+func TestPruneCopies(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-pruning-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-pruning-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	writeFile(filepath.Join(srcDir, "hi", "there"), "hi there\n")
+	for _, ts := range []int64{1000, 2000} {
+		getTimestamp = func() int64 {
+			return ts
+		}
+		if _, err = archiveToTimestampedDir(archiver, srcDir, types.ArchiveModeCopy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copies without a completion marker don't count towards the
+	// policy. They are pruned once there is a newer complete copy, and
+	// are otherwise left to be finished.
+	for _, dst := range []string{"1500", "3000", "realtime-crashes"} {
+		if _, err = ArchiveToNamedDir(archiver, srcDir, dst, types.ArchiveModeCopy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := types.ArchiveRetentionConfig{KeepLast: 1}
+	report, err := pruneArchive(archiver, types.ArchiveModeCopy, policy)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{3000, 2000}, report.Kept)
+	assert.Equal(t, []int64{1500, 1000}, report.Pruned)
+
+	dirs, err := ioutil.ReadDir(dstDir)
+	assert.Nil(t, err)
+	names := []string{}
+	for _, dir := range dirs {
+		names = append(names, dir.Name())
+	}
+	assert.Equal(t, []string{"2000", "2000.complete", "3000", "realtime-crashes"}, names)
+}
+
+func TestS3ArchiverPruneTarballs(t *testing.T) {
+	resetS3stubs()
+
+	srcDir, err := ioutil.TempDir("", "roving-pruning-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+
+	archiver := S3Archiver{
+		bucketName: "test-bucket",
+		rootKey:    "data/more-data",
+		s3client:   mockS3Client{},
+	}
+	for _, ts := range []int64{1000, 2000} {
+		if _, _, err = archiveTarball(archiver, srcDir, snapshotBasePath(ts), ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := pruneArchive(archiver, types.ArchiveModeTarball, types.ArchiveRetentionConfig{KeepLast: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1000}, report.Pruned)
+
+	keys := []string{}
+	for _, input := range putInputs {
+		keys = append(keys, *input.Key)
+	}
+	assert.Equal(t, []string{
+		"data/more-data/snapshots/2000.tar.gz",
+		"data/more-data/snapshots/2000.json",
+	}, keys)
+}
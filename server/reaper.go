@@ -3,44 +3,49 @@ package server
 import (
 	"log"
 	"time"
+
+	"github.com/richo/roving/types"
 )
 
-// Reaper removes old nodes from a Nodes struct after
-// they have been inactive for > Interval.
+// Reaper periodically moves the nodes in a Nodes struct through their
+// lifecycles, marking them stale, then lost, then retiring them the
+// longer they go without sending the server their state.
 type Reaper struct {
-	Nodes    Nodes
-	Interval time.Duration
+	Nodes *Nodes
+	Conf  types.NodesConfig
 }
 
-func newReaper(n Nodes, i time.Duration) *Reaper {
+func newReaper(n *Nodes, conf types.NodesConfig) *Reaper {
 	return &Reaper{
-		Nodes:    n,
-		Interval: i,
+		Nodes: n,
+		Conf:  conf,
 	}
 }
 
-// cleanUpOldNodes removes nodes that have been inactive for longer
-// than `Interval` from the Nodes.
-func (r *Reaper) cleanUpOldNodes() {
-	now := time.Now()
+// updateNodeStates moves every node into the state it should be in as
+// of `now`, and announces the transitions.
+func (r *Reaper) updateNodeStates(now time.Time) {
+	for _, change := range r.Nodes.updateStates(now, r.Conf) {
+		log.Printf("Node changed state node_id=%s from=%s to=%s", change.Id, change.From, change.To)
+		publishNodeTransition(change.Id, change.NodeTransition)
 
-	for id := range nodes.Stats {
-		if r.Nodes.updates[id].Add(r.Interval).Before(now) {
-			r.Nodes.deleteNode(id)
+		if change.To == NodeRetired {
+			events.publish(EventNodeReaped, change.Id, nil)
+			webhooks.notify(newNodeEvent(types.WebhookNodeReaped, change.Id, change.LastUpdate, now))
 		}
 	}
 }
 
 // run runs the Reaper forever. It will periodically check for inactive
-// nodes, and reap them.
+// nodes, and update their states.
 func (r *Reaper) run() {
 	log.Printf("Reaper started")
-	ticker := time.NewTicker(r.Interval)
+	ticker := time.NewTicker(r.Conf.CheckInterval)
 
 	for {
 		select {
 		case <-ticker.C:
-			r.cleanUpOldNodes()
+			r.updateNodeStates(time.Now())
 		}
 	}
 }
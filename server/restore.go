@@ -0,0 +1,254 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/richo/roving/types"
+)
+
+// restore.go restores a workdir from a snapshot, so that a server
+// whose disk has died can pick up where it left off. Only snapshots
+// can be restored, whether their files are stored as objects or in a
+// tarball. Timestamped copies don't say what should be in them, so
+// there is no way to check that one was restored correctly.
+
+// The maximum number of bad files that a failed verification lists.
+var restoreMaxReportedFiles int = 10
+
+// resolveSnapshot returns the timestamp of the snapshot that `spec`
+// names, which is either types.ArchiveRestoreLatest or a timestamp.
+func resolveSnapshot(a Archiver, spec string) (int64, error) {
+	timestamps, err := listSnapshots(a)
+	if err != nil {
+		return 0, err
+	}
+
+	if spec == types.ArchiveRestoreLatest {
+		if len(timestamps) == 0 {
+			return 0, fmt.Errorf("There are no snapshots to restore in %s", a.DescribeDstRoot())
+		}
+		return timestamps[0], nil
+	}
+
+	ts, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unrecognized snapshot to restore: %s", spec)
+	}
+	for _, t := range timestamps {
+		if t == ts {
+			return ts, nil
+		}
+	}
+	return 0, fmt.Errorf("There is no snapshot %d in %s", ts, a.DescribeDstRoot())
+}
+
+// checkRestoreDst returns an error if the workdir at `absDstPath`
+// already has files in it, or if there is already a database at
+// `dbPath`, since restoring would overwrite them with older ones.
+// Missing and empty dirs can be restored into.
+func checkRestoreDst(absDstPath, dbPath string) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("Refusing to restore over the existing database %s; use -archive-restore-force to restore anyway", dbPath)
+	}
+
+	var existing string
+	err := filepath.Walk(absDstPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			existing = path
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return fmt.Errorf("Refusing to restore into %s, which already has files in it (%s); use -archive-restore-force to restore anyway", absDstPath, existing)
+	}
+	return nil
+}
+
+// restoreSnapshot uses an `archiver` to restore the snapshot that
+// `spec` names to `absDstPath`, then checks every file in the
+// snapshot's manifest against what was restored. Files that are
+// already in `absDstPath` are overwritten, unless they already match
+// the manifest, so an interrupted restore can be re-run. Files that
+// aren't in the snapshot are left alone.
+func restoreSnapshot(a Archiver, spec, absDstPath string) (Snapshot, error) {
+	ts, err := resolveSnapshot(a, spec)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snapshot, err := readSnapshot(a, ts)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	log.Printf("Restoring snapshot ts=%d files=%d src=%s dst=%s", ts, len(snapshot.Files), a.DescribeDstRoot(), absDstPath)
+	if snapshot.Tarball != "" {
+		err = restoreTarball(a, snapshot, absDstPath)
+	} else {
+		err = restoreObjects(a, snapshot, absDstPath)
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err = verifyRestore(snapshot, absDstPath); err != nil {
+		return Snapshot{}, err
+	}
+
+	log.Printf("Restored snapshot ts=%d files=%d bytes=%d", ts, len(snapshot.Files), snapshot.Size())
+	types.SubmitMetricCount("archive_restore.files", float32(len(snapshot.Files)), map[string]string{})
+	return snapshot, nil
+}
+
+// restoreObjects restores the files of a `snapshot` whose files are
+// stored as objects, one object at a time.
+func restoreObjects(a Archiver, snapshot Snapshot, absDstPath string) error {
+	for _, f := range snapshot.Files {
+		absPath, err := restoredPath(absDstPath, f.Path)
+		if err != nil {
+			return err
+		}
+		if hash, err := hashFile(absPath); err == nil && hash == f.Sha256 {
+			continue
+		}
+
+		buf, err := a.readOne(snapshotObjectPath(f.Sha256))
+		if err != nil {
+			return err
+		}
+		// Catch corrupted objects now, rather than when the whole
+		// restore is verified, so that the error says which object
+		// is bad.
+		sum := sha256.Sum256(buf)
+		if hex.EncodeToString(sum[:]) != f.Sha256 {
+			return fmt.Errorf("Archived file %s is corrupted", a.DescribeDstLoc(snapshotObjectPath(f.Sha256)))
+		}
+		if err = writeRestoredFile(absPath, bytes.NewReader(buf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreTarball restores the files of a `snapshot` whose files are
+// stored in a tarball. The tarball can be as big as the workdir, so it
+// is streamed from the archive, a file at a time.
+func restoreTarball(a Archiver, snapshot Snapshot, absDstPath string) error {
+	rc, err := a.openOne(snapshot.Tarball)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		absPath, err := restoredPath(absDstPath, header.Name)
+		if err != nil {
+			return err
+		}
+		if err = writeRestoredFile(absPath, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// verifyRestore checks that every file in a `snapshot`'s manifest is
+// in `absDstPath` with the right contents.
+func verifyRestore(snapshot Snapshot, absDstPath string) error {
+	bad := make([]string, 0)
+	for _, f := range snapshot.Files {
+		absPath, err := restoredPath(absDstPath, f.Path)
+		if err != nil {
+			return err
+		}
+		if hash, err := hashFile(absPath); err != nil || hash != f.Sha256 {
+			bad = append(bad, f.Path)
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+
+	reported := bad
+	if len(reported) > restoreMaxReportedFiles {
+		reported = reported[:restoreMaxReportedFiles]
+	}
+	return fmt.Errorf("%d of %d restored files in %s don't match snapshot %d: %s", len(bad), len(snapshot.Files), absDstPath, snapshot.Timestamp, strings.Join(reported, ", "))
+}
+
+// restoredPath returns where the file at `relPath` in a snapshot is
+// restored to. Manifests and tarballs come from the archive, so we
+// check that the file stays inside `absDstPath` rather than trusting
+// them.
+func restoredPath(absDstPath, relPath string) (string, error) {
+	absPath := filepath.Join(absDstPath, filepath.FromSlash(relPath))
+	rel, err := filepath.Rel(absDstPath, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Snapshot file is outside of the workdir: %s", relPath)
+	}
+	return absPath, nil
+}
+
+// writeRestoredFile writes everything in `r` to `absPath`, making any
+// dirs that it needs. It writes to a temporary file first, so that a
+// restore that is interrupted never leaves a half-written file.
+func writeRestoredFile(absPath string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := absPath + ".restoring"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, absPath)
+}
+
+// hashFile returns the hex SHA-256 of the file at `absPath`.
+func hashFile(absPath string) (string, error) {
+	hash, _, err := hashFileWithSize(absPath)
+	return hash, err
+}
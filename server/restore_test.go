@@ -0,0 +1,195 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// setupRestoreTest archives two snapshots of a workdir, the first as
+// objects and the second as a tarball.
+func setupRestoreTest(t *testing.T) (DiskArchiver, string) {
+	srcDir, err := ioutil.TempDir("", "roving-restore-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-restore-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	writeFile(filepath.Join(srcDir, "output", "fuzzer-1", "queue", "id:000000"), "first")
+	writeFile(filepath.Join(srcDir, "roving.db"), "db")
+	if _, _, err = archiveSnapshot(archiver, srcDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(filepath.Join(srcDir, "output", "fuzzer-1", "queue", "id:000001"), "second")
+	if _, _, err = archiveTarball(archiver, srcDir, snapshotBasePath(2000), 2000); err != nil {
+		t.Fatal(err)
+	}
+	return archiver, dstDir
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	archiver, dstDir := setupRestoreTest(t)
+	defer os.RemoveAll(dstDir)
+
+	workdir, err := ioutil.TempDir("", "roving-restore-test-workdir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	snapshot, err := restoreSnapshot(archiver, "1000", workdir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), snapshot.Timestamp)
+	assert.Equal(t, "first", readFile(filepath.Join(workdir, "output", "fuzzer-1", "queue", "id:000000")))
+	assert.Equal(t, "db", readFile(filepath.Join(workdir, "roving.db")))
+	_, err = os.Stat(filepath.Join(workdir, "output", "fuzzer-1", "queue", "id:000001"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The latest snapshot is a tarball
+	snapshot, err = restoreSnapshot(archiver, types.ArchiveRestoreLatest, workdir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), snapshot.Timestamp)
+	assert.Equal(t, "second", readFile(filepath.Join(workdir, "output", "fuzzer-1", "queue", "id:000001")))
+
+	_, err = restoreSnapshot(archiver, "3000", workdir)
+	assert.NotNil(t, err)
+}
+
+func TestRestoreSnapshotWithCorruptedObject(t *testing.T) {
+	archiver, dstDir := setupRestoreTest(t)
+	defer os.RemoveAll(dstDir)
+
+	workdir, err := ioutil.TempDir("", "roving-restore-test-workdir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	snapshot, err := readSnapshot(archiver, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(filepath.Join(dstDir, snapshotObjectPath(snapshot.Files[0].Sha256)), "corrupted")
+
+	_, err = restoreSnapshot(archiver, "1000", workdir)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyRestore(t *testing.T) {
+	archiver, dstDir := setupRestoreTest(t)
+	defer os.RemoveAll(dstDir)
+
+	workdir, err := ioutil.TempDir("", "roving-restore-test-workdir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	snapshot, err := restoreSnapshot(archiver, "2000", workdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, verifyRestore(snapshot, workdir))
+
+	writeFile(filepath.Join(workdir, "roving.db"), "changed")
+	err = verifyRestore(snapshot, workdir)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "roving.db")
+
+	// Restoring again replaces the changed file
+	_, err = restoreSnapshot(archiver, "2000", workdir)
+	assert.Nil(t, err)
+	assert.Equal(t, "db", readFile(filepath.Join(workdir, "roving.db")))
+}
+
+func TestCheckRestoreDst(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "roving-restore-test-workdir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	dbPath := filepath.Join(workdir, "roving.db")
+
+	assert.Nil(t, checkRestoreDst(filepath.Join(workdir, "missing"), dbPath))
+	if err = os.MkdirAll(filepath.Join(workdir, "output", "fuzzer-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, checkRestoreDst(workdir, dbPath))
+
+	writeFile(filepath.Join(workdir, "output", "fuzzer-1", "fuzzer_stats"), "stats")
+	assert.NotNil(t, checkRestoreDst(workdir, dbPath))
+
+	writeFile(dbPath, "db")
+	assert.NotNil(t, checkRestoreDst(filepath.Join(workdir, "missing"), dbPath))
+}
+
+func TestRestoredPath(t *testing.T) {
+	absPath, err := restoredPath("/tmp/workdir", "output/fuzzer-1/queue/id:000000")
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/workdir/output/fuzzer-1/queue/id:000000", absPath)
+
+	_, err = restoredPath("/tmp/workdir", "../etc/passwd")
+	assert.NotNil(t, err)
+}
+
+func TestArchivesHoldAConsistentCopyOfTheDatabase(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	oldDb := db
+	defer func() {
+		db = oldDb
+	}()
+	db = d
+	srcDir := filepath.Dir(d.Path())
+	dstDir, err := ioutil.TempDir("", "roving-restore-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	if _, err = d.RecordCrashes("fuzzer-1", []string{"crash1"}, "", time.Unix(1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(filepath.Join(srcDir, "output", "fuzzer-1", "crashes", "crash1"), "crash")
+	if _, _, err = archiveSnapshot(archiver, srcDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = archiveTarball(archiver, srcDir, snapshotBasePath(2000), 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{"1000", "2000"} {
+		workdir, err := ioutil.TempDir("", "roving-restore-test-workdir")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(workdir)
+
+		snapshot, err := restoreSnapshot(archiver, spec, workdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, len(snapshot.Files))
+		restored, err := openDatabase(filepath.Join(workdir, "roving.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, present, err := restored.Crash("fuzzer-1", "crash1")
+		assert.Nil(t, err)
+		assert.True(t, present)
+		restored.Close()
+	}
+}
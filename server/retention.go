@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// The ID that the queue entries of retired fuzzers are folded into.
+// It is served to clients like any other fuzzer's queue, so the
+// fleet keeps the coverage that retired fuzzers found. No fuzzer can
+// send its state under it.
+var retiredCorpusId string = types.RetiredCorpusId
+
+// The dir that the output of retired fuzzers is archived to. It is
+// relative to the archiver's root, or to the workdir if the server
+// isn't archiving.
+var retiredFuzzersPath string = "retired-fuzzers"
+
+// outputLock stops the QueueRetirer from removing a fuzzer's output
+// while it is being written or read. Anything that writes or reads
+// output takes the read lock. The QueueRetirer takes the write lock,
+// but only to change output dirs, never to read them.
+var outputLock sync.RWMutex
+
+// QueueRetirer periodically cleans up after fuzzers that have been
+// retired for longer than `Conf.QueueRetention`. It folds their
+// unique queue entries into the retired corpus, archives their
+// output dir, and removes it, so that the queues the server sends to
+// clients track the live fleet.
+//
+// Fuzzers that the server has no lifecycle for, like ones that
+// stopped before it had a database, are left alone.
+type QueueRetirer struct {
+	Nodes *Nodes
+	Conf  types.NodesConfig
+	// The archive mode that retired output is archived in. See
+	// ArchiveToNamedDir.
+	ArchiveMode string
+
+	fileManager *types.FleetFileManager
+	archiver    Archiver
+}
+
+func newQueueRetirer(n *Nodes, conf types.NodesConfig, archiveMode string, fm *types.FleetFileManager, a Archiver) *QueueRetirer {
+	return &QueueRetirer{
+		Nodes:       n,
+		Conf:        conf,
+		ArchiveMode: archiveMode,
+		fileManager: fm,
+		archiver:    a,
+	}
+}
+
+// run runs the QueueRetirer forever. It should never return.
+func (q *QueueRetirer) run() {
+	ticker := time.NewTicker(q.Conf.CheckInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+			q.retireQueues(time.Now())
+		}
+	}
+}
+
+// retireQueues retires the queue of every fuzzer that has been
+// retired for longer than `Conf.QueueRetention` as of `now`.
+func (q *QueueRetirer) retireQueues(now time.Time) {
+	fuzzerIds, err := q.fileManager.FuzzerIds()
+	if err != nil {
+		types.ReportError(err, map[string]string{})
+		log.Printf("Couldn't list fuzzers to retire err=%v", err)
+		return
+	}
+
+	for _, fuzzerId := range fuzzerIds {
+		if fuzzerId == retiredCorpusId {
+			continue
+		}
+		lifecycle, present := q.Nodes.lifecycle(fuzzerId)
+		if !present || !q.expired(lifecycle, now) {
+			continue
+		}
+
+		if err := q.retireQueue(fuzzerId, lifecycle, now); err != nil {
+			types.ReportError(err, map[string]string{"fuzzer_id": fuzzerId})
+			log.Printf("Couldn't retire queue fuzzer_id=%s err=%v", fuzzerId, err)
+			types.SubmitMetricCount("queue_retirer.retire.fail", 1, map[string]string{"fuzzer_id": fuzzerId})
+			continue
+		}
+		types.SubmitMetricCount("queue_retirer.retire.success", 1, map[string]string{"fuzzer_id": fuzzerId})
+	}
+}
+
+// expired returns whether a fuzzer with lifecycle `lifecycle` has
+// been retired for longer than `Conf.QueueRetention` as of `now`.
+func (q *QueueRetirer) expired(lifecycle NodeLifecycle, now time.Time) bool {
+	return lifecycle.State == NodeRetired && now.Sub(lifecycle.Since) >= q.Conf.QueueRetention
+}
+
+// retireQueue retires the queue of fuzzer `fuzzerId`, which was
+// retired in `lifecycle`.
+func (q *QueueRetirer) retireQueue(fuzzerId string, lifecycle NodeLifecycle, now time.Time) error {
+	// Archiving and reading every queue can be slow, so they are done
+	// before taking the lock. If the fuzzer comes back in the
+	// meantime then we don't remove anything, and the archive is just
+	// a spare copy.
+	_, null := q.archiver.(NullArchiver)
+	archiving := !null
+	dstSubRoot := filepath.Join(retiredFuzzersPath, fuzzerId, strconv.FormatInt(now.Unix(), 10))
+	if archiving {
+		if _, err := ArchiveToNamedDir(q.archiver, q.fileManager.OutputDir(fuzzerId), dstSubRoot, q.ArchiveMode); err != nil {
+			return err
+		}
+	}
+	unique, err := uniqueRetiredInputs(q.fileManager, fuzzerId)
+	if err != nil {
+		return err
+	}
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	current, present := q.Nodes.lifecycle(fuzzerId)
+	if !present || !current.Since.Equal(lifecycle.Since) || !q.expired(current, now) {
+		log.Printf("Fuzzer came back while its queue was being retired fuzzer_id=%s", fuzzerId)
+		return nil
+	}
+
+	if err = writeRetiredInputs(q.fileManager, unique); err != nil {
+		return err
+	}
+	folded := len(unique.Inputs)
+
+	// Without an archiver, keep the output on local disk but out of
+	// the dirs that are served to clients.
+	var archivedTo string
+	if archiving {
+		if err = q.fileManager.RemoveOutput(fuzzerId); err != nil {
+			return err
+		}
+		archivedTo = q.archiver.DescribeDstLoc(namedArchivePath(dstSubRoot, q.ArchiveMode))
+	} else {
+		archivedTo = filepath.Join(q.fileManager.Basedir, dstSubRoot)
+		if err = os.MkdirAll(filepath.Dir(archivedTo), 0755); err != nil {
+			return err
+		}
+		if err = os.Rename(q.fileManager.OutputDir(fuzzerId), archivedTo); err != nil {
+			return err
+		}
+	}
+
+	outputIndex.forgetFuzzer(fuzzerId)
+	if _, err = outputIndex.refreshFuzzer(q.fileManager, retiredCorpusId); err != nil {
+		return err
+	}
+
+	log.Printf("Retired queue fuzzer_id=%s folded=%d archived_to=%s", fuzzerId, folded, archivedTo)
+	events.publish(EventQueueRetired, fuzzerId, map[string]interface{}{
+		"folded":      folded,
+		"archived_to": archivedTo,
+	})
+	return nil
+}
+
+// uniqueRetiredInputs returns the queue entries of fuzzer `fuzzerId`
+// that no other fuzzer has, and that aren't in the retired corpus
+// already, named to carry on the retired corpus's own AFL IDs, so that
+// fuzzers that have already synced from it pick them up.
+//
+// Queues are read an entry at a time, under outputLock's read lock, so
+// that fuzzers can keep sending their states while they are read.
+// Only the QueueRetirer changes the retired corpus, so the IDs stay
+// free until writeRetiredInputs writes the entries.
+func uniqueRetiredInputs(fm *types.FleetFileManager, fuzzerId string) (types.InputCorpus, error) {
+	outputLock.RLock()
+	defer outputLock.RUnlock()
+
+	unique := types.InputCorpus{}
+	fuzzerIds, err := fm.FuzzerIds()
+	if err != nil {
+		return unique, err
+	}
+
+	seen := make(map[[sha256.Size]byte]bool)
+	nextId := 0
+	for _, id := range fuzzerIds {
+		if id == fuzzerId {
+			continue
+		}
+		names, err := fm.InputNames(id, types.Queue)
+		if err != nil {
+			return unique, err
+		}
+		for _, name := range names {
+			var n int
+			if _, err := fmt.Sscanf(name, "id:%06d", &n); err == nil && id == retiredCorpusId && n >= nextId {
+				nextId = n + 1
+			}
+			input, err := fm.ReadInput(id, types.Queue, name)
+			if err != nil {
+				return unique, err
+			}
+			seen[sha256.Sum256(input.Body)] = true
+		}
+	}
+
+	names, err := fm.InputNames(fuzzerId, types.Queue)
+	if err != nil {
+		return unique, err
+	}
+	for _, name := range names {
+		input, err := fm.ReadInput(fuzzerId, types.Queue, name)
+		if err != nil {
+			return unique, err
+		}
+		sum := sha256.Sum256(input.Body)
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+
+		unique.Add(types.Input{
+			Name: retiredInputName(nextId, fuzzerId, name),
+			Body: input.Body,
+		})
+		nextId++
+	}
+	return unique, nil
+}
+
+// writeRetiredInputs copies `inputs`, from uniqueRetiredInputs, into
+// the retired corpus. The caller holds outputLock.
+func writeRetiredInputs(fm *types.FleetFileManager, inputs types.InputCorpus) error {
+	if len(inputs.Inputs) == 0 {
+		return nil
+	}
+
+	// The retired corpus gets every output dir, like a real fuzzer, so
+	// that everything that reads outputs can read it.
+	if err := fm.MkAllOutputDirs(retiredCorpusId); err != nil {
+		return err
+	}
+	queues := map[string]*types.InputCorpus{retiredCorpusId: &inputs}
+	return fm.WriteQueues(&queues)
+}
+
+// retiredInputName names the `n`th entry in the retired corpus, which
+// came from the queue entry `name` of fuzzer `fuzzerId`.
+func retiredInputName(n int, fuzzerId, name string) string {
+	return fmt.Sprintf("id:%06d,from:%s,%s", n, fuzzerId, name)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// setupRetirementTest builds a workdir with a retired fuzzer, a live
+// fuzzer and an existing retired corpus, and a QueueRetirer for it.
+func setupRetirementTest(t *testing.T, a Archiver, retiredSince time.Time) (*QueueRetirer, *types.FleetFileManager) {
+	workdir, err := ioutil.TempDir("", "roving-retention-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &types.FleetFileManager{Basedir: workdir}
+
+	outputs := map[string][]types.Input{
+		"fuzzer-old": []types.Input{
+			types.Input{Name: "id:000000,orig:seed", Body: []byte("shared")},
+			types.Input{Name: "id:000001,src:000000", Body: []byte("unique")},
+			types.Input{Name: "id:000002,src:000000", Body: []byte("already retired")},
+		},
+		"fuzzer-live": []types.Input{
+			types.Input{Name: "id:000000,orig:seed", Body: []byte("shared")},
+		},
+		retiredCorpusId: []types.Input{
+			types.Input{Name: "id:000004,from:fuzzer-older,id:000000", Body: []byte("already retired")},
+		},
+	}
+	for fuzzerId, inputs := range outputs {
+		if err = fm.MkAllOutputDirs(fuzzerId); err != nil {
+			t.Fatal(err)
+		}
+		output := types.AflOutput{
+			Queue:   &types.InputCorpus{Inputs: inputs},
+			Crashes: &types.InputCorpus{},
+			Hangs:   &types.InputCorpus{},
+		}
+		if err = fm.WriteOutput(fuzzerId, &output); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events = newEventBus()
+	outputIndex = newOutputIndex()
+	if err = outputIndex.refreshAll(fm); err != nil {
+		t.Fatal(err)
+	}
+
+	n := newNodes()
+	n.setStats("fuzzer-live", types.FuzzerStats{})
+	n.lifecycles["fuzzer-old"] = &NodeLifecycle{State: NodeRetired, Since: retiredSince}
+
+	conf := types.NodesConfig{QueueRetention: 24 * time.Hour}
+	return newQueueRetirer(&n, conf, types.ArchiveModeCopy, fm, a), fm
+}
+
+func TestRetireQueuesArchives(t *testing.T) {
+	dstDir, err := ioutil.TempDir("", "roving-retention-test-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	a, err := NewDiskArchiver(types.ArchiveConfig{Disk: types.DiskArchiveConfig{DstRoot: dstDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	q, fm := setupRetirementTest(t, a, now.Add(-25*time.Hour))
+	defer os.RemoveAll(fm.Basedir)
+
+	q.retireQueues(now)
+
+	fuzzerIds, err := fm.FuzzerIds()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"fuzzer-live", retiredCorpusId}, fuzzerIds)
+	assert.False(t, outputIndex.hasFuzzer("fuzzer-old"))
+
+	// Only the entry that nobody else had is folded in, after the
+	// retired corpus's existing entries
+	retired, err := fm.InputNames(retiredCorpusId, types.Queue)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"id:000004,from:fuzzer-older,id:000000",
+		"id:000005,from:fuzzer-old,id:000001,src:000000",
+	}, retired)
+
+	archived := filepath.Join(dstDir, retiredFuzzersPath, "fuzzer-old", strconv.FormatInt(now.Unix(), 10), "queue", "id:000001,src:000000")
+	assert.Equal(t, "unique", readFile(archived))
+
+	_, published := events.subscribe(EventFilter{}, 0)
+	assert.Equal(t, 1, len(published))
+	assert.Equal(t, EventQueueRetired, published[0].Type)
+	assert.Equal(t, 1, published[0].Data["folded"])
+}
+
+func TestRetireQueuesWithoutArchiver(t *testing.T) {
+	now := time.Now()
+	q, fm := setupRetirementTest(t, NullArchiver{}, now.Add(-25*time.Hour))
+	defer os.RemoveAll(fm.Basedir)
+
+	q.retireQueues(now)
+
+	assert.False(t, outputIndex.hasFuzzer("fuzzer-old"))
+	moved := filepath.Join(fm.Basedir, retiredFuzzersPath, "fuzzer-old", strconv.FormatInt(now.Unix(), 10), "queue", "id:000001,src:000000")
+	assert.Equal(t, "unique", readFile(moved))
+}
+
+func TestRetireQueuesKeepsRecentlyRetired(t *testing.T) {
+	now := time.Now()
+	q, fm := setupRetirementTest(t, NullArchiver{}, now.Add(-23*time.Hour))
+	defer os.RemoveAll(fm.Basedir)
+
+	q.retireQueues(now)
+
+	fuzzerIds, err := fm.FuzzerIds()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"fuzzer-live", "fuzzer-old", retiredCorpusId}, fuzzerIds)
+	assert.True(t, outputIndex.hasFuzzer("fuzzer-old"))
+}
+
+func TestFuzzersCantSendStatesAsTheRetiredCorpus(t *testing.T) {
+	promMetrics = newServerMetrics()
+	body := strings.NewReader(`{"Id": "retired"}`)
+	w := httptest.NewRecorder()
+	postState(w, httptest.NewRequest("POST", "/state", body))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -1,16 +1,18 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
-	"github.com/stripe/veneur/ssf"
-	"github.com/stripe/veneur/trace"
-
 	goji "goji.io"
 	"goji.io/pat"
 
@@ -18,11 +20,16 @@ import (
 )
 
 var nodes Nodes
+var db *Database
 var target types.TargetBinary
+var targetHash string
 var fuzzerConf types.FuzzerConfig
 var archiver Archiver
 var archiveConf types.ArchiveConfig
+var archiveDestinations []*ArchiveDestination
 var fileManager *types.FleetFileManager
+var outputIndex *OutputIndex
+var webhooks *Webhooks
 var realtimeCrashesPath string = "realtime-crashes"
 var dict []byte
 
@@ -32,8 +39,18 @@ var dict []byte
 func postState(w http.ResponseWriter, r *http.Request) {
 	state := types.State{}
 
-	encoder := json.NewDecoder(r.Body)
+	body := &countingReader{Reader: r.Body}
+	encoder := json.NewDecoder(body)
 	encoder.Decode(&state)
+	promMetrics.observeStateSize(body.n)
+
+	// The retired corpus isn't a fuzzer, and a client that claimed to
+	// be it would overwrite it
+	if state.Id == retiredCorpusId {
+		log.Printf("Rejected fuzzer state with a reserved ID fuzzer_id=%q", state.Id)
+		http.Error(w, fmt.Sprintf("Fuzzer ID %q is reserved", state.Id), http.StatusBadRequest)
+		return
+	}
 
 	aflOutput := state.AflOutput
 	log.Printf(
@@ -50,6 +67,11 @@ func postState(w http.ResponseWriter, r *http.Request) {
 		map[string]string{"fuzzer_id": state.Id},
 	)
 
+	// Hold the lock until the node is active again, so that the
+	// QueueRetirer can't remove the output we are about to write.
+	outputLock.RLock()
+	defer outputLock.RUnlock()
+
 	if err := fileManager.MkAllOutputDirs(state.Id); err != nil {
 		log.Fatal(err)
 	}
@@ -57,15 +79,80 @@ func postState(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	archiveNewCrashes(fileManager, archiver)
+	added, err := outputIndex.refreshFuzzer(fileManager, state.Id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	publishStateReceived(state, body.n, added)
+
+	// The fuzzer's stats aren't saved until after its crashes are
+	// archived, so give its crashes the stats that came with them.
+	archiveNewCrashes(fileManager, outputIndex, archiver, func(fuzzerId string) (types.FuzzerStats, bool) {
+		if fuzzerId == state.Id {
+			return state.Stats, true
+		}
+		return nodes.statsOf(fuzzerId)
+	})
+	recordNewCrashes(db, state.Id, aflOutput.Crashes)
+
+	if transition := nodes.setStats(state.Id, state.Stats); transition != nil {
+		publishNodeTransition(state.Id, *transition)
+		if transition.joined() {
+			events.publish(EventNodeJoined, state.Id, nil)
+			webhooks.notify(newNodeEvent(types.WebhookNodeJoined, state.Id, transition.At, transition.At))
+		}
+	}
+}
+
+// recordNewCrashes adds any crashes in `crashes` that the database
+// has not seen before to the database.
+func recordNewCrashes(d *Database, fuzzerId string, crashes *types.InputCorpus) {
+	names := make([]string, 0, len(crashes.Inputs))
+	for _, crash := range crashes.Inputs {
+		names = append(names, crash.Name)
+	}
 
-	nodes.setStats(state.Id, state.Stats)
+	added, err := d.RecordCrashes(fuzzerId, names, targetHash, time.Now())
+	if err != nil {
+		types.ReportError(err, map[string]string{"fuzzer_id": fuzzerId})
+		log.Printf("Couldn't record crashes fuzzer_id=%s err=%v", fuzzerId, err)
+		return
+	}
+	for _, record := range added {
+		log.Printf("Recorded new crash fuzzer_id=%s name=%s", record.FuzzerId, record.Name)
+	}
+}
+
+// recordExistingCrashes adds every crash already on disk to the
+// database. This lets the server pick up crashes that were found
+// before it had a database.
+func recordExistingCrashes(d *Database, fm *types.FleetFileManager) error {
+	fuzzerIds, err := fm.FuzzerIds()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, fuzzerId := range fuzzerIds {
+		names, err := fm.InputNames(fuzzerId, types.Crashes)
+		if err != nil {
+			return err
+		}
+		if _, err = d.RecordCrashes(fuzzerId, names, "", now); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // The getQueues route returns the Queue of each fuzzer that the server
-// knows about.
+// knows about, and the retired corpus. The queues of fuzzers that
+// have been retired for a while are folded into the retired corpus by
+// the QueueRetirer, so this tracks the live fleet.
 func getQueues(w http.ResponseWriter, r *http.Request) {
+	outputLock.RLock()
 	queues, err := fileManager.ReadQueues()
+	outputLock.RUnlock()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -113,17 +200,21 @@ func getDict(w http.ResponseWriter, r *http.Request) {
 	w.Write(dict)
 }
 
-// archiveNewCrashes reads the crashes from a `FleetFileManager` and compares
+// archiveNewCrashes looks up the crashes in an `OutputIndex` and compares
 // them to the crashes in an `Archiver`'s "./realtime-crashes"
-// directory. It copies over any that are missing.
+// directory. It copies over any that are missing, each with a
+// CrashMetadata sidecar (see crash_metadata.go). `statsOf` returns the
+// stats of the fuzzer that found a crash.
 //
 // We do this so that we archive crashes as soon as we find them. This
 // way we should never lose a crash, even if the server dies before
 // the next regularly scheduled run of the archiver.
-func archiveNewCrashes(fm *types.FleetFileManager, a Archiver) {
+func archiveNewCrashes(fm *types.FleetFileManager, idx *OutputIndex, a Archiver, statsOf func(fuzzerId string) (types.FuzzerStats, bool)) {
 	var err error
 
-	archivedRealtimeCrashPaths, err := a.LsDstFiles(realtimeCrashesPath)
+	// Crashes are archived in sub-dirs, and only some archivers list
+	// them with LsDstFiles, so list the whole tree.
+	archivedRealtimeCrashPaths, err := a.lsDstTree(realtimeCrashesPath)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -133,86 +224,186 @@ func archiveNewCrashes(fm *types.FleetFileManager, a Archiver) {
 	for _, name := range archivedRealtimeCrashPaths {
 		archivedRealtimeCrashPathsMap[name] = true
 	}
+	// A NullArchiver keeps nothing, so every crash looks new every
+	// time. Don't read them all only for them to be thrown away.
+	_, discard := a.(NullArchiver)
+
+	// Construct a job for each of the missing crashes, copying it to
+	// the same path under "./realtime-crashes".
+	var jobs []uploadJob
+	var newCrashes []types.InputInfo
+	now := time.Now()
+	// Iterate through the crashes of every fuzzer in the fleet. We
+	// only need their names, so use the index rather than reading
+	// them from disk.
+	for _, crash := range idx.inputsOfType(types.Crashes) {
+		fullLocalCrashPath, err := fm.CrashPath(crash.FuzzerId, crash.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		relCrashPath, err := filepath.Rel(fm.Basedir, fullLocalCrashPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// If the current crash has not yet been archived, add a job
+		// for it
+		if _, present := archivedRealtimeCrashPathsMap[filepath.ToSlash(relCrashPath)]; !present {
+			newCrashes = append(newCrashes, crash)
+			if discard {
+				continue
+			}
+
+			stats, hasStats := statsOf(crash.FuzzerId)
+			job, err := newRealtimeCrashUploadJob(a, fm.Basedir, relCrashPath, newCrashMetadata(crash, stats, hasStats, now))
+			if err != nil {
+				log.Printf("Couldn't archive crash fuzzer_id=%s name=%s err=%v", crash.FuzzerId, crash.Name, err)
+				types.ReportError(err, map[string]string{"fuzzer_id": crash.FuzzerId})
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	// This runs while the fuzzer waits for its request to finish, so
+	// don't wait to retry anything: crashes that couldn't be archived
+	// are still missing next time, and are tried again then.
+	uploadAllAttempts(fm.Basedir, jobs, 1)
+
+	// Webhooks deduplicate crashes themselves, so it doesn't matter
+	// that an archiver that doesn't keep the crashes it is given
+	// reports the same crashes every time.
+	for _, crash := range newCrashes {
+		webhooks.notify(newCrashEvent(crash.FuzzerId, crash.Name, now))
+	}
+}
 
-	localOutputs, err := fm.ReadOutputs()
+// SetupAndServe is the main entry-point for the roving server.
+// onShutdown runs `cleanup` and exits when the server is interrupted
+// or terminated.
+func onShutdown(cleanup func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Shutting down signal=%v", sig)
+		cleanup()
+		os.Exit(1)
+	}()
+}
+
+func SetupAndServe(conf types.ServerConfig, targetBinary types.TargetBinary) {
+	metricsSink, err := types.NewMetricsSink(conf.Metrics, "roving-srv")
 	if err != nil {
 		log.Fatal(err)
 	}
+	types.SetMetricsSink(metricsSink)
 
-	// Construct a manifest of the missing crashes and where they
-	// should be copied to.
-	manifest := Manifest{srcRoot: fm.Basedir}
-	// Iterate through fuzzers in the fleet
-	for fuzzerId, output := range localOutputs {
-		// Iterate through crashes in the current fuzzer's output
-		for _, crash := range output.Crashes.Inputs {
-			fullLocalCrashPath, err := fm.CrashPath(fuzzerId, crash.Name)
-			if err != nil {
-				log.Fatal(err)
-			}
-			relCrashPath, err := filepath.Rel(fm.Basedir, fullLocalCrashPath)
-			if err != nil {
+	errorReporter, err := types.NewErrorReporter(conf.Errors, "roving-srv")
+	if err != nil {
+		log.Fatal(err)
+	}
+	types.SetErrorReporter(errorReporter)
+
+	target = targetBinary
+	if len(target) > 0 {
+		sum := sha256.Sum256(target)
+		targetHash = hex.EncodeToString(sum[:])
+	}
+
+	fuzzerConf = conf.Fuzzer
+	archiveConf = conf.Archive
+	archiveTmpDir = archiveConf.TmpDir
+	fileManager = &types.FleetFileManager{Basedir: conf.Workdir}
+
+	archiveDestinations, err = newArchiveDestinations(archiveConf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(archiveDestinations) > 0 {
+		archiver = &CompositeArchiver{Destinations: archiveDestinations}
+	} else {
+		archiver = NullArchiver{}
+	}
+	// Restore before anything reads the workdir, including the
+	// database, which is in the workdir by default. A restore flag
+	// that is left set must not roll the server back on every
+	// restart, so only restore into an empty workdir unless forced.
+	if archiveConf.Restore != "" {
+		if !archiveConf.RestoreForce {
+			if err = checkRestoreDst(fileManager.Basedir, conf.DatabasePath); err != nil {
 				log.Fatal(err)
 			}
-			// If the current crash has not yet been archived, add it
-			// to the manifest
-			if _, present := archivedRealtimeCrashPathsMap[relCrashPath]; !present {
-				entry := ManifestEntry{
-					src: relCrashPath,
-					dst: filepath.Join(realtimeCrashesPath, relCrashPath),
-				}
-				manifest.entries = append(manifest.entries, entry)
-			}
+		}
+		if _, err = restoreSnapshot(archiver, archiveConf.Restore, fileManager.Basedir); err != nil {
+			types.ReportErrorAndWait(err, map[string]string{"restore": archiveConf.Restore})
+			log.Fatalf("Couldn't restore workdir err=%v", err)
 		}
 	}
-	// Once the manifest has been built, archive everything
-	ArchiveManifest(a, manifest)
-}
 
-// SetupAndServe is the main entry-point for the roving server.
-func SetupAndServe(port int, targetBinary types.TargetBinary, fuzzerConfig types.FuzzerConfig, archiveConfig types.ArchiveConfig, metricsReportInterval time.Duration, workdir string) {
-	var err error
-	target = targetBinary
+	if err = fileManager.MkTopLevelOutputDir(); err != nil {
+		log.Fatal(err)
+	}
+	db, err = openDatabase(conf.DatabasePath)
+	if err != nil {
+		log.Fatalf("Couldn't open database path=%s err=%v", conf.DatabasePath, err)
+	}
+	if err = recordExistingCrashes(db, fileManager); err != nil {
+		log.Fatal(err)
+	}
+	if err = publishConfigChanges(db, fuzzerConf); err != nil {
+		log.Fatal(err)
+	}
+
+	outputIndex = newOutputIndex()
+	if err = outputIndex.refreshAll(fileManager); err != nil {
+		log.Fatalf("Couldn't index outputs err=%v", err)
+	}
+
+	nodes, err = loadNodes(db)
+	if err != nil {
+		log.Fatalf("Couldn't load nodes from database err=%v", err)
+	}
+	log.Printf("Loaded nodes from database n_nodes=%d", len(nodes.Stats))
 
-	fuzzerConf = fuzzerConfig
-	archiveConf = archiveConfig
-	fileManager = &types.FleetFileManager{Basedir: workdir}
-	nodes = newNodes()
+	if len(conf.Webhooks.URLs) > 0 {
+		webhooks = newWebhooks(conf.Webhooks, db)
+		go webhooks.run()
+	}
 
-	reaper := newReaper(nodes, 1*time.Hour)
+	reaper := newReaper(&nodes, conf.Nodes)
 	go reaper.run()
 
-	if metricsReportInterval > 0 {
+	if conf.MetricsReportInterval > 0 {
 		metricsPoller := MetricsPoller{
 			Nodes:    &nodes,
-			Interval: metricsReportInterval,
+			Interval: conf.MetricsReportInterval,
 		}
 		go metricsPoller.run()
 	}
 
-	if archiveConf.Type != "" {
-		switch archiveConf.Type {
-		case "disk":
-			archiver, err = NewDiskArchiver(archiveConf)
-		case "s3":
-			archiver, err = NewS3Archiver(archiveConf)
-		default:
-			log.Fatalf("Unknown archiver type: %s", archiveConf.Type)
-		}
+	for _, d := range archiveDestinations {
+		go d.archiveForever(fileManager.Basedir, archiveConf.Mode)
+	}
+
+	queueRetirer := newQueueRetirer(&nodes, conf.Nodes, archiveConf.Mode, fileManager, archiver)
+	go queueRetirer.run()
+
+	if conf.HangConfirm.Enabled {
+		hangConfirmer, err := newHangConfirmer(conf.HangConfirm, fuzzerConf, target, fileManager, archiver)
 		if err != nil {
 			log.Fatal(err)
 		}
-		go ArchiveToTimestampedDirsForever(archiver, fileManager.Basedir, archiveConf.Interval)
-	} else {
-		archiver = NullArchiver{}
+		go hangConfirmer.run()
+		onShutdown(func() {
+			if err := hangConfirmer.close(); err != nil {
+				log.Printf("Couldn't remove the hang confirmer's target err=%v", err)
+			}
+		})
 	}
 
-	trace.Service = "roving-srv"
-	ssf.NamePrefix = "roving-srv."
-
 	mux := goji.NewMux()
+	mux.Use(instrumentRequests)
 
-	if fuzzerConfig.UseDict {
+	if fuzzerConf.UseDict {
 		log.Printf("Reading dict...")
 
 		dict, err = fileManager.ReadDict()
@@ -227,11 +418,32 @@ func SetupAndServe(port int, targetBinary types.TargetBinary, fuzzerConfig types
 	}
 
 	// Admin browser endpoints
-	mux.HandleFunc(pat.Get("/"), adminIndex)
-	mux.HandleFunc(pat.Get("/admin"), adminIndex)
+	mux.HandleFunc(pat.Get("/"), adminDashboard)
+	mux.HandleFunc(pat.Get("/admin"), adminDashboard)
+	mux.HandleFunc(pat.Get("/admin/fuzzers"), adminFuzzers)
 	mux.HandleFunc(pat.Get("/admin/archive"), adminArchive)
+	mux.HandleFunc(pat.Get("/admin/snapshots"), adminSnapshots)
 	mux.HandleFunc(pat.Get("/admin/fuzzer/:fuzzerId/input/:type/:name"), adminInput)
+	mux.HandleFunc(pat.Get("/admin/fuzzer/:fuzzerId/input/:type/:name/raw"), adminInputRaw)
+	mux.HandleFunc(pat.Get("/admin/diff"), adminDiff)
 	mux.HandleFunc(pat.Get("/admin/output"), adminOutput)
+	mux.HandleFunc(pat.Get("/admin/crashes"), adminCrashes)
+	mux.HandleFunc(pat.Get("/admin/history"), adminHistory)
+	mux.HandleFunc(pat.Get("/admin/events"), adminEvents)
+	mux.HandleFunc(pat.Post("/admin/crashes/:fuzzerId/:name"), adminUpdateCrash)
+	// JSON API endpoints
+	mux.HandleFunc(pat.Get("/api/nodes"), apiNodes)
+	mux.HandleFunc(pat.Get("/api/fleet"), apiFleet)
+	mux.HandleFunc(pat.Get("/api/outputs"), apiOutputs)
+	mux.HandleFunc(pat.Get("/api/fuzzers/:fuzzerId/inputs/:type/:name"), apiInput)
+	mux.HandleFunc(pat.Get("/api/config"), apiConfig)
+	mux.HandleFunc(pat.Get("/api/archive"), apiArchive)
+	mux.HandleFunc(pat.Get("/api/snapshots"), apiSnapshots)
+	mux.HandleFunc(pat.Get("/api/crashes"), apiCrashes)
+	mux.HandleFunc(pat.Get("/api/crashes/:fuzzerId/:name"), apiCrash)
+	mux.HandleFunc(pat.Post("/api/crashes/:fuzzerId/:name"), apiUpdateCrash)
+	mux.HandleFunc(pat.Get("/api/history/cluster"), apiClusterHistory)
+	mux.HandleFunc(pat.Get("/api/history/fuzzers/:fuzzerId"), apiFuzzerHistory)
 	// Client endpoints
 	mux.HandleFunc(pat.Post("/state"), postState)
 	mux.HandleFunc(pat.Get("/queue"), getQueues)
@@ -239,8 +451,11 @@ func SetupAndServe(port int, targetBinary types.TargetBinary, fuzzerConfig types
 	mux.HandleFunc(pat.Get("/target/binary"), getTargetBinary)
 	mux.HandleFunc(pat.Get("/inputs"), getInputs)
 	mux.HandleFunc(pat.Get("/dict"), getDict)
+	// Prometheus endpoint
+	mux.HandleFunc(pat.Get("/metrics"), getMetrics)
+	mux.HandleFunc(pat.Get("/events"), getEvents)
 
-	log.Printf("Starting Roving server on port %d...", port)
+	log.Printf("Starting Roving server on port %d...", conf.Port)
 
-	http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), mux)
 }
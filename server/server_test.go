@@ -3,10 +3,15 @@ package server
 import (
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	goji "goji.io"
+	"goji.io/pat"
 
 	"github.com/richo/roving/types"
 )
@@ -57,7 +62,17 @@ func TestArchivingNewCrashes(t *testing.T) {
 	}
 	assert.Equal(t, []string{}, names)
 
-	archiveNewCrashes(&fileManager, archiver)
+	idx := newOutputIndex()
+	if err = idx.refreshAll(&fileManager); err != nil {
+		t.Fatal(err)
+	}
+	statsOf := func(fuzzerId string) (types.FuzzerStats, bool) {
+		if fuzzerId == "fuzzer-123" {
+			return types.FuzzerStats{AflVersion: "2.52b"}, true
+		}
+		return types.FuzzerStats{}, false
+	}
+	archiveNewCrashes(&fileManager, idx, archiver, statsOf)
 
 	archiveFileManager := types.NewAflFileManagerWithFuzzerId(
 		filepath.Join(dstDir, "./realtime-crashes"),
@@ -105,7 +120,10 @@ func TestArchivingNewCrashes(t *testing.T) {
 	}
 	fileManager.WriteOutput("fuzzer-456", &output2)
 
-	archiveNewCrashes(&fileManager, archiver)
+	if _, err = idx.refreshFuzzer(&fileManager, "fuzzer-456"); err != nil {
+		t.Fatal(err)
+	}
+	archiveNewCrashes(&fileManager, idx, archiver, statsOf)
 
 	archiveFileManager2 := types.NewAflFileManagerWithFuzzerId(
 		filepath.Join(dstDir, "./realtime-crashes"),
@@ -125,4 +143,114 @@ func TestArchivingNewCrashes(t *testing.T) {
 		"crash5",
 		"crash6",
 	}, archivedCrashNames2)
+
+	// Every crash is archived with a sidecar, with the stats of the
+	// fuzzer that found it if it has sent any
+	metadata, err := loadCrashMetadata(archiver, []string{
+		"output/fuzzer-123/crashes/crash1",
+		"output/fuzzer-456/crashes/crash4",
+	}, archivePageCrashMetadata)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(metadata))
+	assert.Equal(t, "crash1", metadata["output/fuzzer-123/crashes/crash1"].Name)
+	assert.Equal(t, "2.52b", metadata["output/fuzzer-123/crashes/crash1"].FuzzerStats.AflVersion)
+	assert.Equal(t, "fuzzer-456", metadata["output/fuzzer-456/crashes/crash4"].FuzzerId)
+	assert.Nil(t, metadata["output/fuzzer-456/crashes/crash4"].FuzzerStats)
+}
+
+// setupRealtimeCrashTest writes a crash for fuzzer-123 to a new
+// workdir, and returns it with an index of it and a new dst dir.
+func setupRealtimeCrashTest(t *testing.T) (types.FleetFileManager, *OutputIndex, string) {
+	srcDir, err := ioutil.TempDir("", "roving-server-test-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstDir, err := ioutil.TempDir("", "roving-server-test-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileManager := types.FleetFileManager{Basedir: srcDir}
+
+	output := types.AflOutput{
+		Queue:   &types.InputCorpus{},
+		Crashes: &types.InputCorpus{Inputs: []types.Input{{Name: "crash1", Body: []byte{1}}}},
+		Hangs:   &types.InputCorpus{},
+	}
+	if err = fileManager.MkAllOutputDirs("fuzzer-123"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fileManager.WriteOutput("fuzzer-123", &output); err != nil {
+		t.Fatal(err)
+	}
+	idx := newOutputIndex()
+	if err = idx.refreshAll(&fileManager); err != nil {
+		t.Fatal(err)
+	}
+	return fileManager, idx, dstDir
+}
+
+func noStats(fuzzerId string) (types.FuzzerStats, bool) {
+	return types.FuzzerStats{}, false
+}
+
+func TestArchivingNewCrashesDoesntRetry(t *testing.T) {
+	fileManager, idx, dstDir := setupRealtimeCrashTest(t)
+	defer os.RemoveAll(fileManager.Basedir)
+	defer os.RemoveAll(dstDir)
+
+	// Each crash is only tried once per update, without waiting, and
+	// is tried again on the next update. A crash isn't archived if its
+	// sidecar couldn't be.
+	archiver := newFlakyArchiver(dstDir, 1)
+	relCrashPath := filepath.Join("output", "fuzzer-123", "crashes", "crash1")
+	crashPath := filepath.Join(realtimeCrashesPath, relCrashPath)
+	archiveNewCrashes(&fileManager, idx, archiver, noStats)
+	assert.Equal(t, 1, archiver.attempts[crashMetadataPath(relCrashPath)])
+	assert.Equal(t, 0, archiver.attempts[crashPath])
+
+	archiveNewCrashes(&fileManager, idx, archiver, noStats)
+	assert.Equal(t, 2, archiver.attempts[crashMetadataPath(relCrashPath)])
+	assert.Equal(t, 1, archiver.attempts[crashPath])
+
+	archiveNewCrashes(&fileManager, idx, archiver, noStats)
+	assert.Equal(t, 2, archiver.attempts[crashPath])
+	assert.Equal(t, string([]byte{1}), readFile(filepath.Join(dstDir, crashPath)))
+	metadata, err := loadCrashMetadata(archiver, []string{relCrashPath}, archivePageCrashMetadata)
+	assert.Nil(t, err)
+	assert.Equal(t, "crash1", metadata[relCrashPath].Name)
+}
+
+func TestArchivedCrashesArentArchivedAgain(t *testing.T) {
+	fileManager, idx, dstDir := setupRealtimeCrashTest(t)
+	defer os.RemoveAll(fileManager.Basedir)
+	defer os.RemoveAll(dstDir)
+
+	// DiskArchiver.LsDstFiles doesn't look in sub-dirs, so this
+	// checks that crashes are looked for in the whole tree
+	archiver := newFlakyArchiver(dstDir, 0)
+	crashPath := filepath.Join(realtimeCrashesPath, "output", "fuzzer-123", "crashes", "crash1")
+	archiveNewCrashes(&fileManager, idx, archiver, noStats)
+	archiveNewCrashes(&fileManager, idx, archiver, noStats)
+	assert.Equal(t, 1, archiver.attempts[crashPath])
+}
+
+func TestRequestTags(t *testing.T) {
+	var tags map[string]string
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Get("/api/crashes/:fuzzerId/:name"), func(w http.ResponseWriter, r *http.Request) {
+		tags = requestTags(r)
+	})
+	mux.HandleFunc(pat.Get("/api/nodes"), func(w http.ResponseWriter, r *http.Request) {
+		tags = requestTags(r)
+	})
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/crashes/host-1234/id:000001", nil))
+	assert.Equal(t, map[string]string{
+		"route":     "/api/crashes/:fuzzerId/:name",
+		"path":      "/api/crashes/host-1234/id:000001",
+		"fuzzer_id": "host-1234",
+	}, tags)
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/nodes", nil))
+	assert.Equal(t, map[string]string{"route": "/api/nodes", "path": "/api/nodes"}, tags)
 }
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/richo/roving/types"
+)
+
+// snapshots.go archives the workdir incrementally. Rather than copying
+// every file on every run, each unique file is stored once, named by
+// its SHA-256, and each run writes a small manifest that lists the
+// files in the workdir and which stored file each one is:
+//
+// ├── objects/
+// │   ├── 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+// │   └── fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9
+// └── snapshots/
+//     ├── 1500000000.json
+//     └── 1500003600.json
+//
+// Since AFL never changes a queue entry, crash or hang once it has
+// written it, each run only stores the files that are new.
+
+// The dirs that snapshots keep their files and manifests in, relative
+// to the archiver's root.
+var snapshotObjectsPath string = "objects"
+var snapshotsPath string = "snapshots"
+
+// The extension of snapshot manifests.
+var manifestExt string = ".json"
+
+// SnapshotFile is a file in a Snapshot.
+type SnapshotFile struct {
+	// Path is relative to the Snapshot's Src, and always uses
+	// forward slashes.
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Snapshot is the manifest of a single snapshot of a dir, or of a
+// timestamped copy of one.
+type Snapshot struct {
+	Timestamp int64  `json:"timestamp"`
+	Src       string `json:"src"`
+	// Tarball is where the tarball that holds the snapshot's files is
+	// stored, relative to the archiver's root. It is empty if the
+	// files are stored as objects.
+	Tarball string `json:"tarball,omitempty"`
+	// Copy is the timestamped dir that holds the files of a copy made
+	// in types.ArchiveModeCopy, relative to the archiver's root. It
+	// is empty for snapshots.
+	Copy  string         `json:"copy,omitempty"`
+	Files []SnapshotFile `json:"files"`
+}
+
+// Time returns when the snapshot was taken.
+func (s Snapshot) Time() time.Time {
+	return time.Unix(s.Timestamp, 0)
+}
+
+// Size returns the total size of the files in the snapshot.
+func (s Snapshot) Size() int64 {
+	var size int64
+	for _, f := range s.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// snapshotObjectPath returns where the file with SHA-256 `hash` is
+// stored, relative to the archiver's root.
+func snapshotObjectPath(hash string) string {
+	return path.Join(snapshotObjectsPath, hash)
+}
+
+// snapshotBasePath returns the path, without an extension, that the
+// snapshot taken at `ts` is stored at, relative to the archiver's
+// root.
+func snapshotBasePath(ts int64) string {
+	return path.Join(snapshotsPath, strconv.FormatInt(ts, 10))
+}
+
+// snapshotManifestPath returns where the manifest of the snapshot
+// taken at `ts` is stored, relative to the archiver's root.
+func snapshotManifestPath(ts int64) string {
+	return snapshotBasePath(ts) + manifestExt
+}
+
+// archiveSnapshot uses an `archiver` to take a snapshot of
+// `absSrcPath`, at timestamp `ts`. It stores any files that the
+// archiver doesn't already have, several at a time, then the
+// snapshot's manifest. If any file can't be stored then the manifest
+// isn't written, so that every snapshot that exists is complete.
+func archiveSnapshot(a Archiver, absSrcPath string, ts int64) (Snapshot, ArchiveResult, error) {
+	var result ArchiveResult
+	hashes, err := a.LsDstFiles(snapshotObjectsPath)
+	if err != nil {
+		return Snapshot{}, result, err
+	}
+	stored := make(map[string]bool)
+	for _, hash := range hashes {
+		stored[hash] = true
+	}
+
+	snapshot := Snapshot{Timestamp: ts, Src: absSrcPath, Files: []SnapshotFile{}}
+	// The files that have each hash that isn't stored yet, by their
+	// index in snapshot.Files, in the order that they were found
+	unstored := make(map[string][]int)
+	var unstoredHashes []string
+	dbRelPath, hasDb := databaseRelPath(absSrcPath)
+	err = filepath.Walk(absSrcPath, func(absPath string, info os.FileInfo, walkErr error) error {
+		// Files can be removed while we walk, for example by the
+		// QueueRetirer. They just aren't in the snapshot.
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(absSrcPath, absPath)
+		if err != nil {
+			return err
+		}
+		if hasDb && relPath == dbRelPath {
+			return nil
+		}
+
+		hash, size, err := hashFileWithSize(absPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if stored[hash] {
+			result.Skipped++
+		} else {
+			if _, present := unstored[hash]; !present {
+				unstoredHashes = append(unstoredHashes, hash)
+			}
+			unstored[hash] = append(unstored[hash], len(snapshot.Files))
+		}
+		snapshot.Files = append(snapshot.Files, SnapshotFile{
+			Path:   filepath.ToSlash(relPath),
+			Sha256: hash,
+			Size:   size,
+		})
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, result, err
+	}
+
+	// Each job only touches the snapshot.Files that it was given, so
+	// the jobs don't need to lock them.
+	removed := make([]bool, len(snapshot.Files))
+	jobs := make([]uploadJob, 0, len(unstoredHashes)+1)
+	for _, hash := range unstoredHashes {
+		jobs = append(jobs, newObjectUploadJob(a, absSrcPath, hash, snapshot.Files, unstored[hash], removed))
+	}
+
+	// The database is written to all the time, so copying its file
+	// could tear it. Store a consistent copy of it instead.
+	if hasDb {
+		dbCopyPath, err := copyDatabase()
+		if err != nil {
+			return Snapshot{}, result, err
+		}
+		defer os.Remove(dbCopyPath)
+		hash, size, err := hashFileWithSize(dbCopyPath)
+		if err != nil {
+			return Snapshot{}, result, err
+		}
+		if stored[hash] {
+			result.Skipped++
+		} else {
+			jobs = append(jobs, newFileUploadJob(a, dbCopyPath, snapshotObjectPath(hash)))
+		}
+		snapshot.Files = append(snapshot.Files, SnapshotFile{
+			Path:   filepath.ToSlash(dbRelPath),
+			Sha256: hash,
+			Size:   size,
+		})
+		removed = append(removed, false)
+	}
+	uploaded := uploadAll(absSrcPath, jobs)
+	result.Uploaded = uploaded.Uploaded
+	result.Skipped += uploaded.Skipped
+	result.Failed = uploaded.Failed
+	if result.Failed > 0 {
+		return Snapshot{}, result, fmt.Errorf("Couldn't archive %d files from %s, so snapshot %d wasn't saved", result.Failed, absSrcPath, ts)
+	}
+	files := make([]SnapshotFile, 0, len(snapshot.Files))
+	for i, f := range snapshot.Files {
+		if !removed[i] {
+			files = append(files, f)
+		}
+	}
+	snapshot.Files = files
+
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return Snapshot{}, result, err
+	}
+	if err = uploadWithRetries(absSrcPath, newBytesUploadJob(a, buf, snapshotManifestPath(ts))); err != nil {
+		return Snapshot{}, result, err
+	}
+
+	log.Printf("Archived snapshot ts=%d files=%d new_files=%d", ts, len(snapshot.Files), result.Uploaded)
+	types.SubmitMetricCount("archive_snapshot.new_files", float32(result.Uploaded), map[string]string{"srcRoot": absSrcPath})
+	return snapshot, result, nil
+}
+
+// newObjectUploadJob returns an uploadJob that uses an `archiver` to
+// store the object with SHA-256 `hash`, which each of `files[indices]`
+// had when it was hashed. Files are read again when they are stored,
+// rather than being held in memory since they were hashed, and are
+// hashed again from the same read, so the object always matches its
+// name even if the file has changed in the meantime.
+//
+// The first file that still has `hash` is stored, and the rest are
+// left as they are. Files that have changed are stored under their new
+// hash, which is recorded in `files`, and files that have been removed
+// are marked in `removed` so that they can be left out of the
+// snapshot. The job is skipped if every file was removed.
+func newObjectUploadJob(a Archiver, absSrcPath, hash string, files []SnapshotFile, indices []int, removed []bool) uploadJob {
+	return uploadJob{
+		src: filepath.Join(absSrcPath, filepath.FromSlash(files[indices[0]].Path)),
+		dst: snapshotObjectPath(hash),
+		upload: func() error {
+			nUploaded := 0
+			for _, i := range indices {
+				absPath := filepath.Join(absSrcPath, filepath.FromSlash(files[i].Path))
+				buf, err := ioutil.ReadFile(absPath)
+				if err != nil {
+					if os.IsNotExist(err) {
+						removed[i] = true
+						continue
+					}
+					return err
+				}
+				sum := sha256.Sum256(buf)
+				newHash := hex.EncodeToString(sum[:])
+				if err = archiveBytes(a, buf, snapshotObjectPath(newHash)); err != nil {
+					return err
+				}
+				nUploaded++
+				removed[i] = false
+				files[i].Sha256 = newHash
+				files[i].Size = int64(len(buf))
+				if newHash == hash {
+					// The rest of the files are stored by this object
+					break
+				}
+			}
+			if nUploaded == 0 {
+				return errUploadSkipped
+			}
+			return nil
+		},
+	}
+}
+
+// databaseRelPath returns where the server's database is, relative to
+// `absSrcPath`, if the server has a database and it is in
+// `absSrcPath`.
+func databaseRelPath(absSrcPath string) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+	absDbPath, err := filepath.Abs(db.Path())
+	if err != nil {
+		return "", false
+	}
+	absSrcPath, err = filepath.Abs(absSrcPath)
+	if err != nil {
+		return "", false
+	}
+	relPath, err := filepath.Rel(absSrcPath, absDbPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return relPath, true
+}
+
+// copyDatabase writes a consistent copy of the server's database to a
+// temporary file, and returns its path. The caller removes it.
+func copyDatabase() (string, error) {
+	f, err := archiveTempFile("roving-archive-db")
+	if err != nil {
+		return "", err
+	}
+	_, err = db.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// hashFileWithSize returns the hex SHA-256 and the size of the file at
+// `absPath`.
+func hashFileWithSize(absPath string) (string, int64, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// hashReader returns the hex SHA-256 of everything in `r`, and its
+// size.
+func hashReader(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// archiveBytes uses an `archiver` to archive `buf` to `relDstPath`.
+func archiveBytes(a Archiver, buf []byte, relDstPath string) error {
+	f, err := archiveTempFile("roving-archive")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return a.archiveOne(f.Name(), relDstPath)
+}
+
+// readSnapshot uses an `archiver` to read the manifest of the snapshot
+// taken at `ts`.
+func readSnapshot(a Archiver, ts int64) (Snapshot, error) {
+	buf, err := a.readOne(snapshotManifestPath(ts))
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var snapshot Snapshot
+	if err = json.Unmarshal(buf, &snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// listSnapshots returns the timestamps of every snapshot that an
+// `archiver` has, newest first.
+func listSnapshots(a Archiver) ([]int64, error) {
+	names, err := a.LsDstFiles(snapshotsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps := make([]int64, 0, len(names))
+	for _, name := range names {
+		ts, err := strconv.ParseInt(strings.TrimSuffix(name, manifestExt), 10, 64)
+		if err != nil || !strings.HasSuffix(name, manifestExt) {
+			continue
+		}
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] > timestamps[j]
+	})
+	return timestamps, nil
+}
+
+// lsSnapshotFiles lists the files in `relDstRoot` when it is the
+// timestamped dir of a snapshot, or a dir inside one, so that
+// snapshots can be listed as though they were plain copies. If
+// `recursive` then files in sub-dirs are included, relative to
+// `relDstRoot`. The bool is false if `relDstRoot` isn't in a
+// snapshot.
+func lsSnapshotFiles(a Archiver, relDstRoot string, recursive bool) ([]string, bool, error) {
+	parts := strings.SplitN(path.Clean(filepath.ToSlash(relDstRoot)), "/", 2)
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, false, nil
+	}
+	snapshot, err := readSnapshot(a, ts)
+	if err != nil {
+		if isNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = parts[1] + "/"
+	}
+	filenames := make([]string, 0)
+	for _, f := range snapshot.Files {
+		if !strings.HasPrefix(f.Path, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(f.Path, prefix)
+		if !recursive && strings.Contains(name, "/") {
+			continue
+		}
+		filenames = append(filenames, name)
+	}
+	return filenames, true, nil
+}
+
+// isNotExist returns whether `err` means that an archived file
+// doesn't exist, for any Archiver.
+func isNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
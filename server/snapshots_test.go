@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskArchiverSnapshots(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-snapshots-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-snapshots-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	writeFile(filepath.Join(srcDir, "hi", "there"), "hi there\n")
+	writeFile(filepath.Join(srcDir, "hi", "again"), "hi there\n")
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	snapshot, _, err := archiveSnapshot(archiver, srcDir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(snapshot.Files))
+	assert.Equal(t, int64(26), snapshot.Size())
+	// Identical files are only stored once
+	objects, err := archiver.LsDstFiles(snapshotObjectsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+
+	// Only new files are stored by later snapshots
+	writeFile(filepath.Join(srcDir, "hi", "new"), "new\n")
+	if _, _, err = archiveSnapshot(archiver, srcDir, 2000); err != nil {
+		t.Fatal(err)
+	}
+	objects, err = archiver.LsDstFiles(snapshotObjectsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(objects))
+
+	timestamps, err := listSnapshots(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2000, 1000}, timestamps)
+
+	read, err := readSnapshot(archiver, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot, read)
+
+	// Snapshots can be listed like copies
+	names, err := archiver.LsDstFiles("2000")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"goodbye"}, names)
+	names, err = archiver.LsDstFiles("2000/hi")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"again", "new", "there"}, names)
+	names, err = archiver.LsDstFiles("1000/hi")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"again", "there"}, names)
+}
+
+func TestS3ArchiverSnapshots(t *testing.T) {
+	resetS3stubs()
+
+	srcDir, err := ioutil.TempDir("", "roving-snapshots-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	writeFile(filepath.Join(srcDir, "hi", "there"), "hi there\n")
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+	archiver := S3Archiver{
+		bucketName: "test-bucket",
+		rootKey:    "data/more-data",
+		s3client:   mockS3Client{},
+	}
+
+	if _, _, err = archiveSnapshot(archiver, srcDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = archiveSnapshot(archiver, srcDir, 2000); err != nil {
+		t.Fatal(err)
+	}
+	// 2 files, then 2 manifests
+	assert.Equal(t, 4, len(putBodies))
+	assert.True(t, strings.HasPrefix(*putInputs[0].Key, "data/more-data/objects/"))
+	assert.Equal(t, "data/more-data/snapshots/2000.json", *putInputs[3].Key)
+
+	names, err := archiver.LsDstFiles("2000")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"goodbye", "hi/there"}, names)
+
+	timestamps, err := listSnapshots(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2000, 1000}, timestamps)
+}
+
+// failingArchiver fails to archive the file with body "bad".
+type failingArchiver struct {
+	DiskArchiver
+}
+
+func (a failingArchiver) archiveOne(absSrcPath, relDstPath string) error {
+	if readFile(absSrcPath) == "bad" {
+		return errors.New("Couldn't archive")
+	}
+	return a.DiskArchiver.archiveOne(absSrcPath, relDstPath)
+}
+
+func TestIncompleteSnapshotsAreNotSaved(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-snapshots-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-snapshots-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	writeFile(filepath.Join(srcDir, "good"), "good")
+	writeFile(filepath.Join(srcDir, "bad"), "bad")
+	archiver := failingArchiver{DiskArchiver{DstRoot: dstDir}}
+
+	_, _, err = archiveSnapshot(archiver, srcDir, 1000)
+	assert.NotNil(t, err)
+
+	timestamps, err := listSnapshots(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(timestamps))
+}
+
+func TestFilesThatChangeWhileArchivingAreStoredAsTheyAre(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-snapshots-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-snapshots-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	// Both files had the same contents when they were hashed, but the
+	// first has since been rewritten and the second removed
+	sum := sha256.Sum256([]byte("before"))
+	hash, size := hex.EncodeToString(sum[:]), int64(len("before"))
+	writeFile(filepath.Join(srcDir, "roving.db"), "after")
+	files := []SnapshotFile{
+		{Path: "roving.db", Sha256: hash, Size: size},
+		{Path: "gone", Sha256: hash, Size: size},
+	}
+	removed := make([]bool, len(files))
+	job := newObjectUploadJob(archiver, srcDir, hash, files, []int{0, 1}, removed)
+	assert.Nil(t, job.upload())
+
+	assert.NotEqual(t, hash, files[0].Sha256)
+	assert.Equal(t, int64(len("after")), files[0].Size)
+	assert.Equal(t, "after", readFile(filepath.Join(dstDir, snapshotObjectPath(files[0].Sha256))))
+	assert.Equal(t, []bool{false, true}, removed)
+
+	// A job whose files have all been removed is skipped
+	job = newObjectUploadJob(archiver, srcDir, hash, files[1:], []int{0}, removed[1:])
+	assert.Equal(t, errUploadSkipped, job.upload())
+}
+
+// Manifests don't change once they are archived, so the admin pages
+// only read each one once.
+func TestSnapshotSummariesAreCached(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-snapshots-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-snapshots-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	writeFile(filepath.Join(srcDir, "hi"), "hi there\n")
+	archiver := DiskArchiver{DstRoot: dstDir}
+	if _, _, err = archiveSnapshot(archiver, srcDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := readSnapshotSummary(archiver, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, summary.Files)
+	assert.Equal(t, int64(9), summary.Size)
+
+	if err = archiver.deleteOne(snapshotManifestPath(1000)); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := readSnapshotSummary(archiver, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, summary, cached)
+}
+
+func TestAdminSnapshotsReportsArchiveErrors(t *testing.T) {
+	dstDir, err := ioutil.TempDir("", "roving-snapshots-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	defer func(a Archiver) { archiver = a }(archiver)
+	archiver = unlistableArchiver{DiskArchiver{DstRoot: dstDir}}
+
+	w := httptest.NewRecorder()
+	adminSnapshots(w, httptest.NewRequest("GET", "/admin/snapshots", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = httptest.NewRecorder()
+	adminArchive(w, httptest.NewRequest("GET", "/admin/archive", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
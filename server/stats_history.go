@@ -0,0 +1,243 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// The number of samples kept at each resolution, and the number of
+// resolutions. Each resolution has half as many samples per unit of
+// time as the one before it, so with clients syncing every 5 minutes
+// this covers several weeks of history in at most 720 samples per
+// fuzzer.
+var historyLevelCapacity int = 120
+var historyLevels int = 6
+
+// Cluster samples closer together than this are coalesced into one.
+// Without this the cluster's history would gain a sample every time
+// any fuzzer uploaded its state.
+var clusterSampleInterval time.Duration = 1 * time.Minute
+
+// Stats that are summed across fuzzers in the cluster's history.
+// Stats that aren't listed here or in clusterMaxStats are specific
+// to a single fuzzer and are left out.
+var clusterSumStats = []string{
+	"cycles_done",
+	"execs_done",
+	"execs_per_sec",
+	"paths_total",
+	"paths_favored",
+	"paths_found",
+	"paths_imported",
+	"pending_favs",
+	"pending_total",
+	"variable_paths",
+	"unique_crashes",
+	"unique_hangs",
+}
+
+// Stats that are maxed across fuzzers in the cluster's history.
+var clusterMaxStats = []string{
+	"bitmap_cvg",
+	"max_depth",
+}
+
+// StatsSample is the value of every numeric stat at a point in time.
+// Older samples are averages of several consecutive samples.
+type StatsSample struct {
+	Time   time.Time
+	Values map[string]float64
+}
+
+// timeSeries is a bounded series of StatsSamples. New samples are
+// kept at full resolution. Once there are too many of them, the two
+// oldest are averaged into a single sample at the next resolution
+// down, and so on. The oldest samples at the lowest resolution are
+// eventually dropped.
+type timeSeries struct {
+	// levels[0] holds the newest samples at full resolution. Every
+	// sample in levels[i+1] is older than every sample in levels[i].
+	// Within a level, samples are oldest first.
+	levels [][]StatsSample
+}
+
+func newTimeSeries() *timeSeries {
+	return &timeSeries{levels: make([][]StatsSample, historyLevels)}
+}
+
+func (ts *timeSeries) add(sample StatsSample) {
+	ts.levels[0] = append(ts.levels[0], sample)
+
+	for i := range ts.levels {
+		if len(ts.levels[i]) <= historyLevelCapacity {
+			break
+		}
+		if i == len(ts.levels)-1 {
+			ts.levels[i] = ts.levels[i][1:]
+			break
+		}
+		merged := mergeSamples(ts.levels[i][0], ts.levels[i][1])
+		ts.levels[i] = ts.levels[i][2:]
+		ts.levels[i+1] = append(ts.levels[i+1], merged)
+	}
+}
+
+// replaceNewest replaces the newest sample in the series, or adds
+// `sample` if the series is empty.
+func (ts *timeSeries) replaceNewest(sample StatsSample) {
+	if len(ts.levels[0]) == 0 {
+		ts.add(sample)
+		return
+	}
+	ts.levels[0][len(ts.levels[0])-1] = sample
+}
+
+func (ts *timeSeries) newest() (StatsSample, bool) {
+	if len(ts.levels[0]) == 0 {
+		return StatsSample{}, false
+	}
+	return ts.levels[0][len(ts.levels[0])-1], true
+}
+
+// samples returns every sample in the series, oldest first.
+func (ts *timeSeries) samples() []StatsSample {
+	all := make([]StatsSample, 0)
+	for i := len(ts.levels) - 1; i >= 0; i-- {
+		all = append(all, ts.levels[i]...)
+	}
+	return all
+}
+
+// mergeSamples averages two samples.
+func mergeSamples(a, b StatsSample) StatsSample {
+	values := make(map[string]float64, len(a.Values))
+	for k, v := range a.Values {
+		values[k] = (v + b.Values[k]) / 2
+	}
+	return StatsSample{
+		Time:   a.Time.Add(b.Time.Sub(a.Time) / 2),
+		Values: values,
+	}
+}
+
+// StatsHistory keeps a bounded history of the stats of each fuzzer,
+// and of the cluster as a whole.
+type StatsHistory struct {
+	fuzzers map[string]*timeSeries
+	cluster *timeSeries
+	lock    *sync.RWMutex
+}
+
+func newStatsHistory() *StatsHistory {
+	var lock sync.RWMutex
+	return &StatsHistory{
+		fuzzers: make(map[string]*timeSeries),
+		cluster: newTimeSeries(),
+		lock:    &lock,
+	}
+}
+
+// record adds a sample of `stats` to the history of fuzzer `nodeId`,
+// and a sample of `allStats`, the stats of every active fuzzer, to the
+// cluster's history.
+func (h *StatsHistory) record(nodeId string, stats types.FuzzerStats, allStats map[string]types.FuzzerStats, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	series, present := h.fuzzers[nodeId]
+	if !present {
+		series = newTimeSeries()
+		h.fuzzers[nodeId] = series
+	}
+	series.add(StatsSample{Time: now, Values: stats.NumericStats()})
+
+	clusterSample := StatsSample{Time: now, Values: aggregateStats(allStats)}
+	newest, present := h.cluster.newest()
+	if present && now.Sub(newest.Time) < clusterSampleInterval {
+		clusterSample.Time = newest.Time
+		h.cluster.replaceNewest(clusterSample)
+	} else {
+		h.cluster.add(clusterSample)
+	}
+}
+
+// forget drops the history of fuzzer `nodeId`.
+func (h *StatsHistory) forget(nodeId string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.fuzzers, nodeId)
+}
+
+// FuzzerSamples returns the history of fuzzer `nodeId`, oldest first,
+// and whether the fuzzer has any history.
+func (h *StatsHistory) FuzzerSamples(nodeId string) ([]StatsSample, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	series, present := h.fuzzers[nodeId]
+	if !present {
+		return nil, false
+	}
+	return series.samples(), true
+}
+
+// ClusterSamples returns the history of the cluster, oldest first.
+func (h *StatsHistory) ClusterSamples() []StatsSample {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.cluster.samples()
+}
+
+// FuzzerIds returns the IDs of every fuzzer with any history.
+func (h *StatsHistory) FuzzerIds() []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	ids := make([]string, 0, len(h.fuzzers))
+	for id := range h.fuzzers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// aggregateStats combines the stats of every fuzzer in the cluster.
+func aggregateStats(allStats map[string]types.FuzzerStats) map[string]float64 {
+	values := make(map[string]float64)
+	for _, stats := range allStats {
+		fuzzerValues := stats.NumericStats()
+		for _, k := range clusterSumStats {
+			values[k] += fuzzerValues[k]
+		}
+		for _, k := range clusterMaxStats {
+			if fuzzerValues[k] > values[k] {
+				values[k] = fuzzerValues[k]
+			}
+		}
+	}
+	values["fuzzers"] = float64(len(allStats))
+	return values
+}
+
+// filterSamples returns copies of `samples` that only contain the
+// given stats. If `names` is empty, `samples` is returned unchanged.
+func filterSamples(samples []StatsSample, names []string) []StatsSample {
+	if len(names) == 0 {
+		return samples
+	}
+
+	filtered := make([]StatsSample, 0, len(samples))
+	for _, sample := range samples {
+		values := make(map[string]float64, len(names))
+		for _, name := range names {
+			if v, present := sample.Values[name]; present {
+				values[name] = v
+			}
+		}
+		filtered = append(filtered, StatsSample{Time: sample.Time, Values: values})
+	}
+	return filtered
+}
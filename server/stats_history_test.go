@@ -0,0 +1,67 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func TestTimeSeriesIsBoundedAndOrdered(t *testing.T) {
+	ts := newTimeSeries()
+	start := time.Unix(0, 0)
+
+	n := historyLevelCapacity * historyLevels * 8
+	for i := 0; i < n; i++ {
+		ts.add(StatsSample{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Values: map[string]float64{"paths_total": float64(i)},
+		})
+	}
+
+	samples := ts.samples()
+	assert.True(t, len(samples) <= historyLevelCapacity*historyLevels)
+
+	// The newest sample is kept at full resolution
+	newest := samples[len(samples)-1]
+	assert.Equal(t, float64(n-1), newest.Values["paths_total"])
+
+	for i := 1; i < len(samples); i++ {
+		assert.True(t, samples[i-1].Time.Before(samples[i].Time))
+		assert.True(t, samples[i-1].Values["paths_total"] < samples[i].Values["paths_total"])
+	}
+}
+
+func TestStatsHistoryAggregatesCluster(t *testing.T) {
+	h := newStatsHistory()
+	now := time.Unix(1000, 0)
+
+	allStats := map[string]types.FuzzerStats{
+		"fuzzer-123": types.FuzzerStats{ExecsPerSec: 100, PathsTotal: 10, BitmapCvg: 1.5},
+		"fuzzer-456": types.FuzzerStats{ExecsPerSec: 50, PathsTotal: 20, BitmapCvg: 2.5},
+	}
+	h.record("fuzzer-123", allStats["fuzzer-123"], allStats, now)
+	h.record("fuzzer-456", allStats["fuzzer-456"], allStats, now.Add(time.Second))
+
+	// Samples closer together than clusterSampleInterval are coalesced
+	cluster := h.ClusterSamples()
+	assert.Equal(t, 1, len(cluster))
+	assert.Equal(t, float64(150), cluster[0].Values["execs_per_sec"])
+	assert.Equal(t, float64(30), cluster[0].Values["paths_total"])
+	assert.Equal(t, 2.5, cluster[0].Values["bitmap_cvg"])
+	assert.Equal(t, float64(2), cluster[0].Values["fuzzers"])
+
+	h.record("fuzzer-123", allStats["fuzzer-123"], allStats, now.Add(clusterSampleInterval))
+	assert.Equal(t, 2, len(h.ClusterSamples()))
+
+	samples, present := h.FuzzerSamples("fuzzer-123")
+	assert.True(t, present)
+	assert.Equal(t, 2, len(samples))
+	assert.Equal(t, float64(100), samples[0].Values["execs_per_sec"])
+
+	h.forget("fuzzer-123")
+	_, present = h.FuzzerSamples("fuzzer-123")
+	assert.False(t, present)
+}
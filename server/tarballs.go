@@ -0,0 +1,176 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// tarballs.go archives a dir as a single gzipped tarball, plus a
+// manifest in the same format as a snapshot's that lists what is in
+// it. Storing thousands of tiny AFL inputs one at a time is slow, and
+// on S3 every one of them is a separate request, whereas a tarball is
+// a single upload however many files are in it:
+//
+// └── snapshots/
+//     ├── 1500000000.json
+//     ├── 1500000000.tar.gz
+//     ├── 1500003600.json
+//     └── 1500003600.tar.gz
+
+// The extension of tarballs.
+var tarballExt string = ".tar.gz"
+
+// archiveTarball uses an `archiver` to archive `absSrcPath` as a
+// tarball at `${relDstPath}.tar.gz`, with its manifest at
+// `${relDstPath}.json`. The tarball is built in a temporary file and
+// then archived in one go, so the ArchiveResult counts every file in
+// it as uploaded or as failed together. The manifest is written last,
+// so that every manifest that exists has a complete tarball.
+//
+// The tarball can't be streamed straight to the archiver, because S3
+// needs a body that it can seek and the MD5 of the whole upload before
+// it starts, and an upload that fails is retried from the beginning.
+// The temporary file can be as big as the workdir, so it is made in
+// archiveTmpDir, which can be pointed at a disk with room for it.
+func archiveTarball(a Archiver, absSrcPath, relDstPath string, ts int64) (Snapshot, ArchiveResult, error) {
+	var result ArchiveResult
+	f, err := archiveTempFile("roving-archive-tarball")
+	if err != nil {
+		return Snapshot{}, result, err
+	}
+	defer os.Remove(f.Name())
+
+	snapshot, err := writeTarball(f, absSrcPath)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Snapshot{}, result, err
+	}
+	snapshot.Timestamp = ts
+	snapshot.Tarball = relDstPath + tarballExt
+
+	err = uploadWithRetries(absSrcPath, newFileUploadJob(a, f.Name(), snapshot.Tarball))
+	if err == nil {
+		var buf []byte
+		if buf, err = json.Marshal(snapshot); err == nil {
+			err = uploadWithRetries(absSrcPath, newBytesUploadJob(a, buf, relDstPath+manifestExt))
+		}
+	}
+	if err != nil {
+		result.Failed = len(snapshot.Files)
+		return Snapshot{}, result, err
+	}
+	result.Uploaded = len(snapshot.Files)
+
+	log.Printf("Archived tarball dst=%s files=%d", a.DescribeDstLoc(snapshot.Tarball), len(snapshot.Files))
+	return snapshot, result, nil
+}
+
+// writeTarball writes every file in `absSrcPath` to `f` as a gzipped
+// tarball. It returns a Snapshot that lists them, without a Timestamp
+// or Tarball. If the server's database is in `absSrcPath` then a
+// consistent copy of it is written instead of its file.
+func writeTarball(f *os.File, absSrcPath string) (Snapshot, error) {
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	snapshot := Snapshot{Src: absSrcPath, Files: []SnapshotFile{}}
+	dbRelPath, hasDb := databaseRelPath(absSrcPath)
+	err := filepath.Walk(absSrcPath, func(absPath string, info os.FileInfo, walkErr error) error {
+		// Files can be removed while we walk, for example by the
+		// QueueRetirer. They just aren't in the tarball.
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(absSrcPath, absPath)
+		if err != nil {
+			return err
+		}
+		if hasDb && relPath == dbRelPath {
+			return nil
+		}
+
+		file, err := writeTarballFile(tw, absPath, relPath, info)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if hasDb {
+		dbCopyPath, err := copyDatabase()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		defer os.Remove(dbCopyPath)
+		info, err := os.Stat(dbCopyPath)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		file, err := writeTarballFile(tw, dbCopyPath, dbRelPath, info)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.Files = append(snapshot.Files, file)
+	}
+
+	if err = tw.Close(); err != nil {
+		return Snapshot{}, err
+	}
+	if err = gz.Close(); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// writeTarballFile writes the file at `absPath` to `tw`, named
+// `relPath`, and returns how it should be listed in a manifest.
+func writeTarballFile(tw *tar.Writer, absPath, relPath string, info os.FileInfo) (SnapshotFile, error) {
+	// Read the whole file so that the header's size matches what we
+	// write, even if the file is being rewritten.
+	buf, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	header.Name = filepath.ToSlash(relPath)
+	header.Size = int64(len(buf))
+	if err = tw.WriteHeader(header); err != nil {
+		return SnapshotFile{}, err
+	}
+	if _, err = tw.Write(buf); err != nil {
+		return SnapshotFile{}, err
+	}
+
+	sum := sha256.Sum256(buf)
+	return SnapshotFile{
+		Path:   header.Name,
+		Sha256: hex.EncodeToString(sum[:]),
+		Size:   header.Size,
+	}, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// readTarball returns the contents of every file in the gzipped
+// tarball at `path`, as a map from name => contents.
+func readTarball(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = string(buf)
+	}
+	return contents
+}
+
+func TestDiskArchiverTarballs(t *testing.T) {
+	getTimestamp = func() int64 {
+		return 4815162342
+	}
+	srcDir, err := ioutil.TempDir("", "roving-tarballs-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-tarballs-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	writeFile(filepath.Join(srcDir, "hi", "there"), "hi there\n")
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	if _, err = archiveToTimestampedDir(archiver, srcDir, types.ArchiveModeTarball); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"goodbye":  "goodbye\n",
+		"hi/there": "hi there\n",
+	}, readTarball(t, filepath.Join(dstDir, "snapshots", "4815162342.tar.gz")))
+
+	// Tarballs are listed like any other snapshot
+	timestamps, err := listSnapshots(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{4815162342}, timestamps)
+	snapshot, err := readSnapshot(archiver, 4815162342)
+	assert.Nil(t, err)
+	assert.Equal(t, "snapshots/4815162342.tar.gz", snapshot.Tarball)
+	assert.Equal(t, int64(17), snapshot.Size())
+	names, err := archiver.LsDstFiles("4815162342/hi")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"there"}, names)
+
+	// As can named dirs
+	if _, err = ArchiveToNamedDir(archiver, filepath.Join(srcDir, "hi"), "named", types.ArchiveModeTarball); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"there": "hi there\n",
+	}, readTarball(t, filepath.Join(dstDir, "named.tar.gz")))
+	assert.Contains(t, readFile(filepath.Join(dstDir, "named.json")), `"path":"there"`)
+}
+
+// srcDirArchiver is a DiskArchiver that remembers which dir each file
+// it archived was in.
+type srcDirArchiver struct {
+	DiskArchiver
+	srcDirs *[]string
+}
+
+func (a srcDirArchiver) archiveOne(absSrcPath, relDstPath string) error {
+	*a.srcDirs = append(*a.srcDirs, filepath.Dir(absSrcPath))
+	return a.DiskArchiver.archiveOne(absSrcPath, relDstPath)
+}
+
+func TestTarballsAreBuiltInTheArchiveTmpDir(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "roving-tarballs-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-tarballs-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	tmpDir, err := ioutil.TempDir("", "roving-tarballs-test-tmp")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	archiveTmpDir = tmpDir
+	defer func() { archiveTmpDir = "" }()
+
+	writeFile(filepath.Join(srcDir, "goodbye"), "goodbye\n")
+	srcDirs := []string{}
+	archiver := srcDirArchiver{DiskArchiver: DiskArchiver{DstRoot: dstDir}, srcDirs: &srcDirs}
+	if _, err = ArchiveToNamedDir(archiver, srcDir, "named", types.ArchiveModeTarball); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{tmpDir, tmpDir}, srcDirs)
+
+	// ...and are cleaned up afterwards
+	names, err := ioutil.ReadDir(tmpDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+}
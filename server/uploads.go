@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// uploads.go archives many files at once. Each file is uploaded by one
+// of a fixed number of workers, and an upload that fails is retried
+// with exponential backoff, so that a brief S3 outage doesn't drop
+// files from an archive.
+
+// How many files are uploaded at once.
+var archiveUploadWorkers int = 8
+
+// How many times an upload is tried before giving up on it, and how
+// long to wait before the first retry. The wait doubles after every
+// failed retry.
+var archiveUploadAttempts int = 4
+var archiveUploadBackoff time.Duration = time.Second
+
+// ArchiveResult summarizes an archive of many files.
+type ArchiveResult struct {
+	// Files that were uploaded
+	Uploaded int `json:"uploaded"`
+	// Files that didn't need uploading, because the archiver already
+	// had them, or because they were removed before they could be
+	// uploaded
+	Skipped int `json:"skipped"`
+	// Files that couldn't be uploaded, even after retrying
+	Failed int `json:"failed"`
+}
+
+// Total returns how many files the archive covered.
+func (r ArchiveResult) Total() int {
+	return r.Uploaded + r.Skipped + r.Failed
+}
+
+// errUploadSkipped is returned by an uploadJob's upload func when
+// there turns out to be nothing to upload.
+var errUploadSkipped = errors.New("Nothing to upload")
+
+// An uploadJob is a single file to upload. `src` and `dst` are only
+// used to describe it.
+type uploadJob struct {
+	src    string
+	dst    string
+	upload func() error
+}
+
+// newFileUploadJob returns an uploadJob that uses an `archiver` to
+// archive the local file `absSrcPath` to `relDstPath`. The job is
+// skipped if the file is removed before it can be archived, for
+// example by the QueueRetirer.
+func newFileUploadJob(a Archiver, absSrcPath, relDstPath string) uploadJob {
+	return uploadJob{
+		src: absSrcPath,
+		dst: relDstPath,
+		upload: func() error {
+			err := a.archiveOne(absSrcPath, relDstPath)
+			if err != nil {
+				if _, statErr := os.Stat(absSrcPath); os.IsNotExist(statErr) {
+					return errUploadSkipped
+				}
+			}
+			return err
+		},
+	}
+}
+
+// newHashedUploadJob is newFileUploadJob, but reads the whole file
+// first, so that it can call `uploaded` with the SHA-256 and size of
+// exactly what was archived.
+func newHashedUploadJob(a Archiver, absSrcPath, relDstPath string, uploaded func(hash string, size int64)) uploadJob {
+	return uploadJob{
+		src: absSrcPath,
+		dst: relDstPath,
+		upload: func() error {
+			buf, err := ioutil.ReadFile(absSrcPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return errUploadSkipped
+				}
+				return err
+			}
+			if err = archiveBytes(a, buf, relDstPath); err != nil {
+				return err
+			}
+			sum := sha256.Sum256(buf)
+			uploaded(hex.EncodeToString(sum[:]), int64(len(buf)))
+			return nil
+		},
+	}
+}
+
+// newBytesUploadJob returns an uploadJob that uses an `archiver` to
+// archive `buf` to `relDstPath`.
+func newBytesUploadJob(a Archiver, buf []byte, relDstPath string) uploadJob {
+	return uploadJob{
+		src: fmt.Sprintf("%d bytes", len(buf)),
+		dst: relDstPath,
+		upload: func() error {
+			return archiveBytes(a, buf, relDstPath)
+		},
+	}
+}
+
+// uploadAll runs every one of `jobs`, archiveUploadWorkers at a time,
+// and returns once they have all finished. `srcRoot` is only used to
+// tag metrics and errors.
+func uploadAll(srcRoot string, jobs []uploadJob) ArchiveResult {
+	return uploadAllAttempts(srcRoot, jobs, archiveUploadAttempts)
+}
+
+// uploadAllAttempts is uploadAll, but only tries each job `attempts`
+// times. With one attempt it never waits to retry, so it can be used
+// where waiting would hold up a request.
+func uploadAllAttempts(srcRoot string, jobs []uploadJob, attempts int) ArchiveResult {
+	var result ArchiveResult
+	var resultLock sync.Mutex
+	var wg sync.WaitGroup
+
+	nWorkers := archiveUploadWorkers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	queue := make(chan uploadJob)
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				err := uploadWithAttempts(srcRoot, job, attempts)
+
+				resultLock.Lock()
+				switch {
+				case err == errUploadSkipped:
+					result.Skipped++
+				case err != nil:
+					result.Failed++
+				default:
+					result.Uploaded++
+				}
+				resultLock.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	return result
+}
+
+// uploadWithRetries runs `job`, retrying it with exponential backoff
+// until it succeeds, it is skipped, or it has been tried
+// archiveUploadAttempts times.
+func uploadWithRetries(srcRoot string, job uploadJob) error {
+	return uploadWithAttempts(srcRoot, job, archiveUploadAttempts)
+}
+
+// uploadWithAttempts is uploadWithRetries, but only tries `job`
+// `attempts` times.
+func uploadWithAttempts(srcRoot string, job uploadJob, attempts int) error {
+	backoff := archiveUploadBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = job.upload()
+		if err == errUploadSkipped {
+			return err
+		}
+		promMetrics.observeArchive(err)
+		if err == nil {
+			types.SubmitMetricCount("archive_one.success", 1, map[string]string{"srcRoot": srcRoot})
+			return nil
+		}
+		types.SubmitMetricCount("archive_one.fail", 1, map[string]string{"srcRoot": srcRoot})
+		if attempt >= attempts {
+			break
+		}
+
+		log.Printf("Couldn't archive file, retrying src=%s dst=%s attempt=%d backoff=%v err=%v", job.src, job.dst, attempt, backoff, err)
+		types.SubmitMetricCount("archive_one.retry", 1, map[string]string{"srcRoot": srcRoot})
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	err = fmt.Errorf("Couldn't archive %s to %s after %d attempts: %v", job.src, job.dst, attempts, err)
+	log.Print(err)
+	types.ReportError(err, map[string]string{
+		"dst":     job.dst,
+		"src":     job.src,
+		"srcRoot": srcRoot,
+	})
+	return err
+}
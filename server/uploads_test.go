@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+func init() {
+	// Don't keep tests of failing archivers waiting to retry
+	archiveUploadBackoff = time.Millisecond
+}
+
+// flakyArchiver fails to archive each file the first `failures` times
+// that it is asked to.
+type flakyArchiver struct {
+	DiskArchiver
+	failures int
+
+	lock     *sync.Mutex
+	attempts map[string]int
+}
+
+func newFlakyArchiver(dstRoot string, failures int) flakyArchiver {
+	return flakyArchiver{
+		DiskArchiver: DiskArchiver{DstRoot: dstRoot},
+		failures:     failures,
+		lock:         &sync.Mutex{},
+		attempts:     make(map[string]int),
+	}
+}
+
+func (a flakyArchiver) archiveOne(absSrcPath, relDstPath string) error {
+	a.lock.Lock()
+	a.attempts[relDstPath]++
+	attempts := a.attempts[relDstPath]
+	a.lock.Unlock()
+
+	if attempts <= a.failures {
+		return errors.New("Couldn't archive")
+	}
+	return a.DiskArchiver.archiveOne(absSrcPath, relDstPath)
+}
+
+// setupUploadsTest writes `n` files to a new src dir, and returns it
+// with a new dst dir.
+func setupUploadsTest(n int) (string, string) {
+	srcDir, err := ioutil.TempDir("", "roving-uploads-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dstDir, err := ioutil.TempDir("", "roving-uploads-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		writeFile(filepath.Join(srcDir, "queue", string(rune('a'+i))), string(rune('a'+i)))
+	}
+	return srcDir, dstDir
+}
+
+func TestArchiveManifestRetries(t *testing.T) {
+	srcDir, dstDir := setupUploadsTest(10)
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(dstDir)
+
+	archiver := newFlakyArchiver(dstDir, archiveUploadAttempts-1)
+	manifest, err := newSimpleManifest(srcDir, "named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ArchiveManifest(archiver, manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveResult{Uploaded: 10}, result)
+	assert.Equal(t, "j", readFile(filepath.Join(dstDir, "named", "queue", "j")))
+}
+
+func TestArchiveManifestGivesUp(t *testing.T) {
+	srcDir, dstDir := setupUploadsTest(3)
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(dstDir)
+
+	archiver := newFlakyArchiver(dstDir, archiveUploadAttempts)
+	manifest, err := newSimpleManifest(srcDir, "named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ArchiveManifest(archiver, manifest)
+	assert.NotNil(t, err)
+	assert.Equal(t, ArchiveResult{Failed: 3}, result)
+	for _, attempts := range archiver.attempts {
+		assert.Equal(t, archiveUploadAttempts, attempts)
+	}
+}
+
+func TestArchiveManifestSkipsRemovedFiles(t *testing.T) {
+	srcDir, dstDir := setupUploadsTest(2)
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(dstDir)
+
+	manifest, err := newSimpleManifest(srcDir, "named")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(srcDir, "queue", "a"))
+
+	result, err := ArchiveManifest(DiskArchiver{DstRoot: dstDir}, manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveResult{Uploaded: 1, Skipped: 1}, result)
+}
+
+func TestSimpleManifestsSkipRemovedDirs(t *testing.T) {
+	manifest, err := newSimpleManifest(filepath.Join(os.TempDir(), "roving-uploads-test-missing"), "named")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(manifest.entries))
+}
+
+func TestCopiesAreMarkedComplete(t *testing.T) {
+	srcDir, dstDir := setupUploadsTest(2)
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(dstDir)
+	getTimestamp = func() int64 {
+		return 1000
+	}
+
+	result, err := archiveToTimestampedDir(DiskArchiver{DstRoot: dstDir}, srcDir, types.ArchiveModeCopy)
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveResult{Uploaded: 2}, result)
+	_, err = os.Stat(filepath.Join(dstDir, "1000.complete"))
+	assert.Nil(t, err)
+
+	// A copy that loses files isn't marked complete
+	getTimestamp = func() int64 {
+		return 2000
+	}
+	_, err = archiveToTimestampedDir(newFlakyArchiver(dstDir, archiveUploadAttempts), srcDir, types.ArchiveModeCopy)
+	assert.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(dstDir, "2000.complete"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Pruning a copy deletes its marker
+	assert.Nil(t, deleteCopy(DiskArchiver{DstRoot: dstDir}, 1000))
+	_, err = os.Stat(filepath.Join(dstDir, "1000.complete"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSnapshotUploadResult(t *testing.T) {
+	srcDir, dstDir := setupUploadsTest(3)
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(dstDir)
+	archiver := newFlakyArchiver(dstDir, 1)
+
+	snapshot, result, err := archiveSnapshot(archiver, srcDir, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(snapshot.Files))
+	assert.Equal(t, ArchiveResult{Uploaded: 3}, result)
+
+	// Files that are already stored are skipped
+	writeFile(filepath.Join(srcDir, "queue", "z"), "z")
+	_, result, err = archiveSnapshot(archiver, srcDir, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveResult{Uploaded: 1, Skipped: 3}, result)
+}
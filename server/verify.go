@@ -0,0 +1,379 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/richo/roving/types"
+)
+
+// verify.go checks archives against their manifests, to find files
+// that have gone missing or been corrupted since they were archived.
+// Snapshots, tarballs and timestamped copies can all be verified,
+// since each of them has a manifest that lists the path, size and
+// SHA-256 of every file in it.
+
+// The spec that VerifyArchives takes to verify every archive.
+var verifyAllArchives string = "all"
+
+// VerifyReport is what verifying a single archive found.
+type VerifyReport struct {
+	Timestamp int64
+	Dst       string
+	// How many files the archive's manifest lists
+	Files int
+	// Files that the manifest lists but that aren't in the archive
+	Missing []string
+	// Files whose size or SHA-256 don't match the manifest
+	Corrupted []string
+	// Why the archive couldn't be verified, if it couldn't
+	Err error
+}
+
+// OK returns whether every file in the archive matches its manifest.
+func (r VerifyReport) OK() bool {
+	return r.Err == nil && len(r.Missing) == 0 && len(r.Corrupted) == 0
+}
+
+// String describes the report, listing at most
+// restoreMaxReportedFiles bad files of each kind.
+func (r VerifyReport) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("Archive %d in %s couldn't be verified: %v", r.Timestamp, r.Dst, r.Err)
+	}
+	if r.OK() {
+		return fmt.Sprintf("Archive %d in %s is OK: %d files", r.Timestamp, r.Dst, r.Files)
+	}
+	return fmt.Sprintf("Archive %d in %s is bad: %d files, %d missing (%s), %d corrupted (%s)",
+		r.Timestamp, r.Dst, r.Files,
+		len(r.Missing), strings.Join(truncateFiles(r.Missing), ", "),
+		len(r.Corrupted), strings.Join(truncateFiles(r.Corrupted), ", "))
+}
+
+func truncateFiles(files []string) []string {
+	if len(files) > restoreMaxReportedFiles {
+		return files[:restoreMaxReportedFiles]
+	}
+	return files
+}
+
+// VerifyArchives re-reads the archives that `spec` names from every
+// destination that `config` chooses, and checks every file in them
+// against their manifests. `spec` is types.ArchiveRestoreLatest,
+// "all", or the timestamp of an archive. It returns an error if any
+// archive can't be read or doesn't match its manifest.
+func VerifyArchives(config types.ArchiveConfig, spec string) error {
+	destinations, err := newArchiveDestinations(config)
+	if err != nil {
+		return err
+	}
+	if len(destinations) == 0 {
+		return fmt.Errorf("There are no archive destinations to verify")
+	}
+
+	nBad := 0
+	for _, d := range destinations {
+		reports, err := verifyArchives(d.Archiver, spec)
+		if err != nil {
+			log.Printf("Couldn't verify archives destination=%s err=%v", d.Conf.Name, err)
+			nBad++
+			continue
+		}
+		for _, report := range reports {
+			log.Printf("%s (destination %s)", report, d.Conf.Name)
+			if !report.OK() {
+				nBad++
+			}
+		}
+	}
+	if nBad > 0 {
+		return fmt.Errorf("%d archives couldn't be verified", nBad)
+	}
+	return nil
+}
+
+// verifyArchives verifies the archives that `spec` names in an
+// `archiver`, newest first. An archive that can't be read doesn't stop
+// the rest from being verified; it gets a report with its error.
+func verifyArchives(a Archiver, spec string) ([]VerifyReport, error) {
+	timestamps, err := resolveVerifiable(a, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]VerifyReport, 0, len(timestamps))
+	for _, ts := range timestamps {
+		report, err := verifyArchive(a, ts)
+		if err != nil {
+			report = VerifyReport{Timestamp: ts, Dst: a.DescribeDstRoot(), Err: err}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// resolveVerifiable returns the timestamps of the archives that
+// `spec` names, newest first.
+func resolveVerifiable(a Archiver, spec string) ([]int64, error) {
+	timestamps, err := listVerifiable(a)
+	if err != nil {
+		return nil, err
+	}
+
+	switch spec {
+	case verifyAllArchives:
+		return timestamps, nil
+	case types.ArchiveRestoreLatest:
+		if len(timestamps) == 0 {
+			return nil, fmt.Errorf("There are no archives to verify in %s", a.DescribeDstRoot())
+		}
+		return timestamps[:1], nil
+	}
+
+	ts, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unrecognized archive to verify: %s", spec)
+	}
+	for _, t := range timestamps {
+		if t == ts {
+			return []int64{ts}, nil
+		}
+	}
+	return nil, fmt.Errorf("There is no complete archive %d in %s", ts, a.DescribeDstRoot())
+}
+
+// listVerifiable returns the timestamps of every snapshot and every
+// complete timestamped copy that an `archiver` has, newest first.
+func listVerifiable(a Archiver) ([]int64, error) {
+	timestamps, err := listSnapshots(a)
+	if err != nil {
+		return nil, err
+	}
+	copies, err := listCompleteCopies(a)
+	if err != nil {
+		return nil, err
+	}
+	timestamps = append(timestamps, copies...)
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] > timestamps[j]
+	})
+	return timestamps, nil
+}
+
+// listCompleteCopies returns the timestamps of every timestamped copy
+// that an `archiver` has a completion marker for.
+func listCompleteCopies(a Archiver) ([]int64, error) {
+	complete, _, err := listCopies(a)
+	return complete, err
+}
+
+// readArchiveManifest reads the manifest of the snapshot or
+// timestamped copy taken at `ts`.
+func readArchiveManifest(a Archiver, ts int64) (Snapshot, error) {
+	snapshot, err := readSnapshot(a, ts)
+	if err == nil || !isNotExist(err) {
+		return snapshot, err
+	}
+
+	buf, err := a.readOne(copyCompletePath(strconv.FormatInt(ts, 10)))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err = json.Unmarshal(buf, &snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// verifyArchive re-reads the snapshot or timestamped copy taken at
+// `ts` from an `archiver`, and checks every file in it against its
+// manifest. Missing and corrupted files are reported rather than
+// returned as errors.
+func verifyArchive(a Archiver, ts int64) (VerifyReport, error) {
+	snapshot, err := readArchiveManifest(a, ts)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{
+		Timestamp: ts,
+		Dst:       a.DescribeDstRoot(),
+		Files:     len(snapshot.Files),
+		Missing:   []string{},
+		Corrupted: []string{},
+	}
+	switch {
+	case snapshot.Tarball != "":
+		err = verifyTarball(a, snapshot, &report)
+	case snapshot.Copy != "":
+		err = verifyFiles(a, snapshot, &report, func(f SnapshotFile) string {
+			return path.Join(snapshot.Copy, f.Path)
+		})
+	default:
+		err = verifyFiles(a, snapshot, &report, func(f SnapshotFile) string {
+			return snapshotObjectPath(f.Sha256)
+		})
+	}
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	types.SubmitMetricCount("archive_verify.missing", float32(len(report.Missing)), map[string]string{})
+	types.SubmitMetricCount("archive_verify.corrupted", float32(len(report.Corrupted)), map[string]string{})
+	return report, nil
+}
+
+// verifyFiles checks each file in a `snapshot` by reading it from
+// wherever `locate` says that it is stored. Files that are stored
+// together, like identical files in a snapshot, are only read once.
+// Files that can't be decrypted are reported as corrupted.
+func verifyFiles(a Archiver, snapshot Snapshot, report *VerifyReport, locate func(SnapshotFile) string) error {
+	// Whether each stored file is missing, or doesn't match
+	missing := make(map[string]bool)
+	corrupted := make(map[string]bool)
+	checked := make(map[string]bool)
+
+	for _, f := range snapshot.Files {
+		relDstPath := locate(f)
+		if !checked[relDstPath] {
+			checked[relDstPath] = true
+			matches, err := archivedFileMatches(a, relDstPath, f)
+			switch {
+			case err == nil:
+				corrupted[relDstPath] = !matches
+			case isNotExist(err):
+				missing[relDstPath] = true
+			case isCorruptedFile(err):
+				corrupted[relDstPath] = true
+			default:
+				return err
+			}
+		}
+
+		if missing[relDstPath] {
+			report.Missing = append(report.Missing, f.Path)
+		} else if corrupted[relDstPath] {
+			report.Corrupted = append(report.Corrupted, f.Path)
+		}
+	}
+	return nil
+}
+
+// archivedFileMatches returns whether the archived file at
+// `relDstPath` has the size and SHA-256 that `f` says it should. The
+// file is streamed rather than read into memory.
+func archivedFileMatches(a Archiver, relDstPath string, f SnapshotFile) (bool, error) {
+	rc, err := a.openOne(relDstPath)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	hash, size, err := hashReader(rc)
+	if err != nil {
+		return false, err
+	}
+	return size == f.Size && hash == f.Sha256, nil
+}
+
+// verifyTarball checks each file in a `snapshot` against the tarball
+// that holds them. The tarball is streamed from the archive, since it
+// can be as big as the workdir. If the tarball can't be read to the
+// end, because it is corrupted, then the files that weren't reached
+// are reported as corrupted.
+func verifyTarball(a Archiver, snapshot Snapshot, report *VerifyReport) error {
+	expected := make(map[string]SnapshotFile)
+	for _, f := range snapshot.Files {
+		expected[f.Path] = f
+	}
+	seen := make(map[string]bool)
+	unreached := func() []string {
+		names := make([]string, 0)
+		for _, f := range snapshot.Files {
+			if !seen[f.Path] {
+				names = append(names, f.Path)
+			}
+		}
+		return names
+	}
+
+	rc, err := a.openOne(snapshot.Tarball)
+	if err != nil {
+		switch {
+		case isNotExist(err):
+			report.Missing = unreached()
+			return nil
+		case isCorruptedFile(err):
+			report.Corrupted = unreached()
+			return nil
+		}
+		return err
+	}
+	defer rc.Close()
+
+	// A tarball that can't be read because the archive can't be read
+	// couldn't be verified, rather than being corrupted
+	src := &errRecorder{Reader: rc}
+	corrupted := func() error {
+		if src.err != nil && !isCorruptedFile(src.err) {
+			return src.err
+		}
+		report.Corrupted = append(report.Corrupted, unreached()...)
+		return nil
+	}
+
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return corrupted()
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return corrupted()
+		}
+
+		f, present := expected[header.Name]
+		if !present || seen[header.Name] {
+			continue
+		}
+		hash, size, err := hashReader(tr)
+		if err != nil {
+			return corrupted()
+		}
+		seen[header.Name] = true
+		if size != f.Size || hash != f.Sha256 {
+			report.Corrupted = append(report.Corrupted, f.Path)
+		}
+	}
+	report.Missing = unreached()
+	return nil
+}
+
+// An errRecorder remembers the first error, other than io.EOF, that
+// reading from its Reader returned.
+type errRecorder struct {
+	io.Reader
+	err error
+}
+
+func (r *errRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// setupVerifyTest archives a workdir three times: as a snapshot, as a
+// tarball and as a timestamped copy.
+func setupVerifyTest(t *testing.T) (DiskArchiver, string) {
+	srcDir, err := ioutil.TempDir("", "roving-verify-test-src")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "roving-verify-test-dst")
+	if err != nil {
+		log.Fatal(err)
+	}
+	archiver := DiskArchiver{DstRoot: dstDir}
+
+	writeFile(filepath.Join(srcDir, "output", "fuzzer-1", "queue", "id:000000"), "first")
+	writeFile(filepath.Join(srcDir, "output", "fuzzer-1", "queue", "id:000001"), "second")
+	for ts, mode := range map[int64]string{
+		1000: types.ArchiveModeSnapshot,
+		2000: types.ArchiveModeTarball,
+		3000: types.ArchiveModeCopy,
+	} {
+		getTimestamp = func() int64 {
+			return ts
+		}
+		if _, err = archiveToTimestampedDir(archiver, srcDir, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return archiver, dstDir
+}
+
+func TestVerifyArchives(t *testing.T) {
+	archiver, dstDir := setupVerifyTest(t)
+	defer os.RemoveAll(dstDir)
+
+	reports, err := verifyArchives(archiver, verifyAllArchives)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(reports))
+	for i, ts := range []int64{3000, 2000, 1000} {
+		assert.Equal(t, ts, reports[i].Timestamp)
+		assert.Equal(t, 2, reports[i].Files)
+		assert.True(t, reports[i].OK(), reports[i].String())
+	}
+
+	reports, err = verifyArchives(archiver, types.ArchiveRestoreLatest)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reports))
+	assert.Equal(t, int64(3000), reports[0].Timestamp)
+
+	_, err = verifyArchives(archiver, "4000")
+	assert.NotNil(t, err)
+}
+
+func TestVerifyFindsMissingAndCorruptedFiles(t *testing.T) {
+	archiver, dstDir := setupVerifyTest(t)
+	defer os.RemoveAll(dstDir)
+
+	snapshot, err := readSnapshot(archiver, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dstDir, snapshotObjectPath(snapshot.Files[0].Sha256)))
+	writeFile(filepath.Join(dstDir, snapshotObjectPath(snapshot.Files[1].Sha256)), "corrupted")
+	report, err := verifyArchive(archiver, 1000)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, []string{snapshot.Files[0].Path}, report.Missing)
+	assert.Equal(t, []string{snapshot.Files[1].Path}, report.Corrupted)
+
+	writeFile(filepath.Join(dstDir, "3000", "output", "fuzzer-1", "queue", "id:000001"), "corrupted")
+	report, err = verifyArchive(archiver, 3000)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, report.Missing)
+	assert.Equal(t, []string{"output/fuzzer-1/queue/id:000001"}, report.Corrupted)
+
+	writeFile(filepath.Join(dstDir, "snapshots", "2000.tar.gz"), "corrupted")
+	report, err = verifyArchive(archiver, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(report.Corrupted))
+
+	os.Remove(filepath.Join(dstDir, "snapshots", "2000.tar.gz"))
+	report, err = verifyArchive(archiver, 2000)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(report.Missing))
+}
+
+func TestVerifyCarriesOnPastUnreadableManifests(t *testing.T) {
+	archiver, dstDir := setupVerifyTest(t)
+	defer os.RemoveAll(dstDir)
+
+	writeFile(filepath.Join(dstDir, snapshotManifestPath(2000)), "not json")
+	reports, err := verifyArchives(archiver, verifyAllArchives)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(reports))
+	assert.True(t, reports[0].OK(), reports[0].String())
+	assert.Equal(t, int64(2000), reports[1].Timestamp)
+	assert.False(t, reports[1].OK())
+	assert.NotNil(t, reports[1].Err)
+	assert.Contains(t, reports[1].String(), "couldn't be verified")
+	assert.True(t, reports[2].OK(), reports[2].String())
+}
+
+func TestIncompleteCopiesAreNotVerifiable(t *testing.T) {
+	archiver, dstDir := setupVerifyTest(t)
+	defer os.RemoveAll(dstDir)
+
+	os.Remove(filepath.Join(dstDir, "3000.complete"))
+	timestamps, err := listVerifiable(archiver)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2000, 1000}, timestamps)
+}
+
+func TestVerifyArchivesForEveryDestination(t *testing.T) {
+	archiver, dstDir := setupVerifyTest(t)
+	defer os.RemoveAll(dstDir)
+
+	conf := types.ArchiveConfig{
+		Type: "disk",
+		Disk: types.DiskArchiveConfig{DstRoot: archiver.DstRoot},
+	}
+	assert.Nil(t, VerifyArchives(conf, verifyAllArchives))
+
+	writeFile(filepath.Join(dstDir, "3000", "output", "fuzzer-1", "queue", "id:000000"), "corrupted")
+	assert.NotNil(t, VerifyArchives(conf, verifyAllArchives))
+	assert.NotNil(t, VerifyArchives(types.ArchiveConfig{}, verifyAllArchives))
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/richo/roving/types"
+)
+
+// webhooks.go POSTs events, such as new crashes and fuzzers joining
+// or leaving the cluster, to the URLs in the server's WebhookConfig.
+//
+// Every event is saved to the database before it is sent. Events
+// that haven't been delivered yet are resumed when the server
+// restarts, and events with an ID that has been seen before are
+// dropped. Crash events have an ID derived from the crash, so a
+// crash is only ever notified once.
+
+// The number of events that can be waiting to be delivered. Events
+// that don't fit are still saved, and are delivered when the server
+// next starts.
+var webhookQueueSize int = 1000
+
+// WebhookEvent is the JSON payload that is POSTed to webhooks.
+type WebhookEvent struct {
+	Id       string            `json:"id"`
+	Type     string            `json:"type"`
+	Time     time.Time         `json:"time"`
+	FuzzerId string            `json:"fuzzer_id,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+func newCrashEvent(fuzzerId, name string, now time.Time) WebhookEvent {
+	return WebhookEvent{
+		Id:       types.WebhookCrashNew + "/" + fuzzerId + "/" + name,
+		Type:     types.WebhookCrashNew,
+		Time:     now,
+		FuzzerId: fuzzerId,
+		Data: map[string]string{
+			"name":        name,
+			"target_hash": targetHash,
+			"admin_path":  fmt.Sprintf("/admin/fuzzer/%s/input/%s/%s", fuzzerId, types.Crashes, name),
+		},
+	}
+}
+
+func newNodeEvent(eventType, fuzzerId string, lastUpdate, now time.Time) WebhookEvent {
+	return WebhookEvent{
+		Id:       fmt.Sprintf("%s/%s/%d", eventType, fuzzerId, now.UnixNano()),
+		Type:     eventType,
+		Time:     now,
+		FuzzerId: fuzzerId,
+		Data: map[string]string{
+			"last_update": lastUpdate.UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+func newArchiveFailedEvent(src string, archiveErr error, now time.Time) WebhookEvent {
+	return WebhookEvent{
+		Id:   fmt.Sprintf("%s/%d", types.WebhookArchiveFailed, now.UnixNano()),
+		Type: types.WebhookArchiveFailed,
+		Time: now,
+		Data: map[string]string{
+			"src":   src,
+			"error": archiveErr.Error(),
+		},
+	}
+}
+
+// Webhooks sends events to webhook URLs. A nil *Webhooks drops
+// every event, so that callers don't need to check whether any
+// webhooks are configured.
+type Webhooks struct {
+	URLs          []string
+	Events        map[string]bool
+	MaxAttempts   int
+	RetryInterval time.Duration
+
+	client *http.Client
+	db     *Database
+	// IDs of events that are ready to be delivered
+	queue chan string
+}
+
+// newWebhooks builds a Webhooks that sends the events in `conf` to
+// its URLs, and that records them in `d`.
+func newWebhooks(conf types.WebhookConfig, d *Database) *Webhooks {
+	events := make(map[string]bool)
+	for _, event := range conf.Events {
+		events[event] = true
+	}
+	if len(events) == 0 {
+		for _, event := range types.WebhookEvents {
+			events[event] = true
+		}
+	}
+
+	return &Webhooks{
+		URLs:          conf.URLs,
+		Events:        events,
+		MaxAttempts:   conf.MaxAttempts,
+		RetryInterval: conf.RetryInterval,
+		client:        &http.Client{Timeout: conf.Timeout},
+		db:            d,
+		queue:         make(chan string, webhookQueueSize),
+	}
+}
+
+// notify sends `event` to every URL, unless its type isn't wanted or
+// it has been sent before. It doesn't wait for it to be delivered, or
+// for there to be room in the queue.
+func (w *Webhooks) notify(event WebhookEvent) {
+	if w == nil || !w.Events[event.Type] {
+		return
+	}
+	// Most crash events have been seen before, so check with a
+	// read-only transaction before taking out a write one.
+	seen, err := w.db.HasWebhookEvent(event.Id)
+	if err != nil {
+		log.Printf("Couldn't look up webhook event id=%s err=%v", event.Id, err)
+		types.ReportError(err, map[string]string{"event": event.Type})
+		return
+	}
+	if seen {
+		return
+	}
+
+	deliveries := make(map[string]webhookDelivery)
+	for _, u := range w.URLs {
+		deliveries[u] = webhookDelivery{}
+	}
+	added, err := w.db.AddWebhookEvent(webhookRecord{Event: event, Deliveries: deliveries})
+	if err != nil {
+		log.Printf("Couldn't save webhook event id=%s err=%v", event.Id, err)
+		types.ReportError(err, map[string]string{"event": event.Type})
+		return
+	}
+	if !added {
+		return
+	}
+
+	select {
+	case w.queue <- event.Id:
+	default:
+		log.Printf("Webhook queue is full, delivering event when the server next starts id=%s queued=%d", event.Id, len(w.queue))
+		types.SubmitMetricCount("webhook.queue_full", 1, map[string]string{"event": event.Type})
+	}
+}
+
+// run delivers events forever. It starts by resuming any events that
+// hadn't been delivered when the server last stopped.
+func (w *Webhooks) run() {
+	records, err := w.db.WebhookEvents()
+	if err != nil {
+		log.Printf("Couldn't load webhook events err=%v", err)
+	}
+	for _, record := range records {
+		if !record.finished(w.MaxAttempts) {
+			go w.enqueue(record.Event.Id)
+		}
+	}
+
+	for id := range w.queue {
+		w.deliver(id)
+	}
+}
+
+func (w *Webhooks) enqueue(id string) {
+	w.queue <- id
+}
+
+// deliver attempts to deliver event `id` to every URL that it hasn't
+// been delivered to yet, and schedules a retry if any of them fail.
+func (w *Webhooks) deliver(id string) {
+	record, present, err := w.db.WebhookEvent(id)
+	if err != nil {
+		log.Printf("Couldn't load webhook event id=%s err=%v", id, err)
+		return
+	}
+	if !present {
+		return
+	}
+
+	body, err := json.Marshal(record.Event)
+	if err != nil {
+		log.Printf("Couldn't encode webhook event id=%s err=%v", id, err)
+		return
+	}
+
+	maxAttempts := 0
+	for u, delivery := range record.Deliveries {
+		if delivery.Delivered || delivery.Attempts >= w.MaxAttempts {
+			continue
+		}
+
+		delivery.Attempts++
+		if err := w.post(u, record.Event, body); err != nil {
+			delivery.LastError = err.Error()
+			log.Printf("Couldn't deliver webhook event id=%s url=%s attempts=%d err=%v", id, u, delivery.Attempts, err)
+			types.SubmitMetricCount("webhook.delivery.fail", 1, map[string]string{"event": record.Event.Type})
+			if delivery.Attempts >= w.MaxAttempts {
+				types.ReportError(err, map[string]string{"event": record.Event.Type, "url": u})
+			}
+		} else {
+			delivery.Delivered = true
+			types.SubmitMetricCount("webhook.delivery.success", 1, map[string]string{"event": record.Event.Type})
+		}
+		record.Deliveries[u] = delivery
+
+		if !delivery.Delivered && delivery.Attempts > maxAttempts {
+			maxAttempts = delivery.Attempts
+		}
+	}
+
+	// Crash events are kept once they are finished, so that we can
+	// tell that they have already been sent. Other events have unique
+	// IDs and can't be sent twice, so there's no need to keep them.
+	if record.finished(w.MaxAttempts) && record.Event.Type != types.WebhookCrashNew {
+		err = w.db.DeleteWebhookEvent(id)
+	} else {
+		err = w.db.SaveWebhookEvent(record)
+	}
+	if err != nil {
+		log.Printf("Couldn't save webhook event id=%s err=%v", id, err)
+	}
+
+	if !record.finished(w.MaxAttempts) {
+		time.AfterFunc(w.retryDelay(maxAttempts), func() { w.enqueue(id) })
+	}
+}
+
+// retryDelay returns how long to wait before retrying an event that
+// has failed `attempts` times.
+func (w *Webhooks) retryDelay(attempts int) time.Duration {
+	delay := w.RetryInterval
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+func (w *Webhooks) post(u string, event WebhookEvent, body []byte) error {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Roving-Event", event.Type)
+	req.Header.Set("X-Roving-Delivery", event.Id)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// webhookDelivery is the state of the delivery of an event to a
+// single webhook URL.
+type webhookDelivery struct {
+	Attempts  int
+	Delivered bool
+	LastError string
+}
+
+// webhookRecord is how an event that is being sent to webhooks is
+// stored in the database.
+type webhookRecord struct {
+	Event WebhookEvent
+	// Deliveries maps URL => webhookDelivery
+	Deliveries map[string]webhookDelivery
+}
+
+// finished returns whether the event has been delivered to every URL,
+// or we have given up trying.
+func (r webhookRecord) finished(maxAttempts int) bool {
+	for _, delivery := range r.Deliveries {
+		if !delivery.Delivered && delivery.Attempts < maxAttempts {
+			return false
+		}
+	}
+	return true
+}
+
+// AddWebhookEvent saves `record`, unless an event with the same ID
+// has already been saved. It returns whether it was saved, so that
+// each event is only ever sent once, even across restarts.
+func (d *Database) AddWebhookEvent(record webhookRecord) (bool, error) {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+
+	added := false
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhooksBucket)
+		key := []byte(record.Event.Id)
+		if b.Get(key) != nil {
+			return nil
+		}
+		added = true
+		return b.Put(key, buf)
+	})
+	return added, err
+}
+
+// SaveWebhookEvent saves `record`, overwriting any existing record of
+// the same event.
+func (d *Database) SaveWebhookEvent(record webhookRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Put([]byte(record.Event.Id), buf)
+	})
+}
+
+// HasWebhookEvent returns whether event `id` has been saved. Unlike
+// AddWebhookEvent it only reads the database, so it is cheap to call
+// for events that have probably been seen before.
+func (d *Database) HasWebhookEvent(id string) (bool, error) {
+	present := false
+	err := d.db.View(func(tx *bolt.Tx) error {
+		present = tx.Bucket(webhooksBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return present, err
+}
+
+// WebhookEvent returns the record of event `id`, and whether there
+// is one.
+func (d *Database) WebhookEvent(id string) (webhookRecord, bool, error) {
+	var record webhookRecord
+	present := false
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(webhooksBucket).Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		present = true
+		return json.Unmarshal(buf, &record)
+	})
+	return record, present, err
+}
+
+// DeleteWebhookEvent deletes the record of event `id`. It is a no-op
+// if there is no such record.
+func (d *Database) DeleteWebhookEvent(id string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Delete([]byte(id))
+	})
+}
+
+// WebhookEvents returns every saved event.
+func (d *Database) WebhookEvents() ([]webhookRecord, error) {
+	var records []webhookRecord
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(k, v []byte) error {
+			var record webhookRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
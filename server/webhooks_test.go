@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/richo/roving/types"
+)
+
+// webhookReceiver is an HTTP server that records the events that are
+// POSTed to it. It fails the first `failures` requests.
+type webhookReceiver struct {
+	server   *httptest.Server
+	events   chan WebhookEvent
+	failures int
+}
+
+func newWebhookReceiver(failures int) *webhookReceiver {
+	receiver := &webhookReceiver{
+		events:   make(chan WebhookEvent, 10),
+		failures: failures,
+	}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if receiver.failures > 0 {
+			receiver.failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var event WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		receiver.events <- event
+	}))
+	return receiver
+}
+
+// next waits for the next event that is delivered.
+func (r *webhookReceiver) next(t *testing.T) WebhookEvent {
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+		return WebhookEvent{}
+	}
+}
+
+// assertNoEvents checks that no more events are delivered.
+func (r *webhookReceiver) assertNoEvents(t *testing.T) {
+	select {
+	case event := <-r.events:
+		t.Fatalf("Unexpected webhook event id=%s", event.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testWebhookConfig(u string) types.WebhookConfig {
+	return types.WebhookConfig{
+		URLs:          []string{u},
+		MaxAttempts:   3,
+		RetryInterval: 10 * time.Millisecond,
+		Timeout:       time.Second,
+	}
+}
+
+func TestWebhooksDeduplicateCrashes(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	receiver := newWebhookReceiver(0)
+	defer receiver.server.Close()
+
+	w := newWebhooks(testWebhookConfig(receiver.server.URL), d)
+	go w.run()
+
+	now := time.Unix(1000, 0)
+	w.notify(newCrashEvent("fuzzer-123", "crash1", now))
+	w.notify(newCrashEvent("fuzzer-123", "crash1", now))
+	w.notify(newCrashEvent("fuzzer-123", "crash2", now))
+
+	event := receiver.next(t)
+	assert.Equal(t, "crash.new/fuzzer-123/crash1", event.Id)
+	assert.Equal(t, types.WebhookCrashNew, event.Type)
+	assert.Equal(t, "fuzzer-123", event.FuzzerId)
+	assert.Equal(t, "crash1", event.Data["name"])
+	assert.Equal(t, "crash.new/fuzzer-123/crash2", receiver.next(t).Id)
+	receiver.assertNoEvents(t)
+
+	// A restarted server doesn't notify crashes it has already
+	// notified
+	w = newWebhooks(testWebhookConfig(receiver.server.URL), d)
+	go w.run()
+	w.notify(newCrashEvent("fuzzer-123", "crash1", now))
+	receiver.assertNoEvents(t)
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	receiver := newWebhookReceiver(2)
+	defer receiver.server.Close()
+
+	w := newWebhooks(testWebhookConfig(receiver.server.URL), d)
+	go w.run()
+
+	w.notify(newNodeEvent(types.WebhookNodeJoined, "fuzzer-123", time.Unix(1000, 0), time.Unix(1000, 0)))
+	event := receiver.next(t)
+	assert.Equal(t, types.WebhookNodeJoined, event.Type)
+	assert.Equal(t, "fuzzer-123", event.FuzzerId)
+
+	// Delivered events that can't be repeated aren't kept
+	time.Sleep(50 * time.Millisecond)
+	records, err := d.WebhookEvents()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	receiver := newWebhookReceiver(100)
+	defer receiver.server.Close()
+
+	w := newWebhooks(testWebhookConfig(receiver.server.URL), d)
+	go w.run()
+
+	w.notify(newCrashEvent("fuzzer-123", "crash1", time.Unix(1000, 0)))
+	receiver.assertNoEvents(t)
+
+	record, present, err := d.WebhookEvent("crash.new/fuzzer-123/crash1")
+	assert.Nil(t, err)
+	assert.True(t, present)
+	delivery := record.Deliveries[receiver.server.URL]
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.False(t, delivery.Delivered)
+	assert.Equal(t, "Webhook responded with status 503", delivery.LastError)
+}
+
+func TestWebhooksDontBlockWhenTheQueueIsFull(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	oldQueueSize := webhookQueueSize
+	defer func() {
+		webhookQueueSize = oldQueueSize
+	}()
+	webhookQueueSize = 1
+	// Nothing delivers the events, so the queue fills up
+	w := newWebhooks(testWebhookConfig("http://127.0.0.1:1"), d)
+
+	now := time.Unix(1000, 0)
+	w.notify(newCrashEvent("fuzzer-123", "crash1", now))
+	w.notify(newCrashEvent("fuzzer-123", "crash2", now))
+	assert.Equal(t, 1, len(w.queue))
+
+	// but events that don't fit are still saved, to be resumed later
+	present, err := d.HasWebhookEvent("crash.new/fuzzer-123/crash2")
+	assert.Nil(t, err)
+	assert.True(t, present)
+}
+
+func TestWebhooksFilterEvents(t *testing.T) {
+	d, cleanup := openTestDatabase(t)
+	defer cleanup()
+	receiver := newWebhookReceiver(0)
+	defer receiver.server.Close()
+
+	conf := testWebhookConfig(receiver.server.URL)
+	conf.Events = []string{types.WebhookNodeReaped}
+	w := newWebhooks(conf, d)
+	go w.run()
+
+	now := time.Unix(1000, 0)
+	w.notify(newCrashEvent("fuzzer-123", "crash1", now))
+	w.notify(newNodeEvent(types.WebhookNodeReaped, "fuzzer-123", now, now))
+	assert.Equal(t, types.WebhookNodeReaped, receiver.next(t).Type)
+	receiver.assertNoEvents(t)
+
+	// A nil Webhooks drops everything
+	var none *Webhooks
+	none.notify(newCrashEvent("fuzzer-123", "crash2", now))
+}
@@ -1,10 +1,15 @@
 package types
 
 import (
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,10 +18,16 @@ type ServerConfig struct {
 	Port                  int           `yaml:"port"`
 	Workdir               string        `yaml:"workdir"`
 	BinaryPath            string        `yaml:"binary_path"`
+	DatabasePath          string        `yaml:"database_path"`
 	MetricsReportInterval time.Duration `yaml:"metrics_report_interval"`
 
-	Fuzzer  FuzzerConfig  `yaml:"fuzzer"`
-	Archive ArchiveConfig `yaml:"archive"`
+	Fuzzer      FuzzerConfig      `yaml:"fuzzer"`
+	Archive     ArchiveConfig     `yaml:"archive"`
+	HangConfirm HangConfirmConfig `yaml:"hang_confirm"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Errors      ErrorsConfig      `yaml:"errors"`
+	Webhooks    WebhookConfig     `yaml:"webhooks"`
+	Nodes       NodesConfig       `yaml:"nodes"`
 }
 
 // A FuzzerConfig is initially constructed from a config file by
@@ -31,22 +42,527 @@ type FuzzerConfig struct {
 	TimeoutMs  int      `yaml:"timeout_ms"`
 }
 
+// The ways that roving-srv can archive its workdir.
+const (
+	// Store each unique file once, under its SHA-256, and write a
+	// small manifest for each archive run that refers to them
+	ArchiveModeSnapshot = "snapshot"
+	// Copy the whole workdir to a new timestamped dir every time
+	ArchiveModeCopy = "copy"
+	// Store the whole workdir as a single gzipped tarball every time,
+	// with a manifest that lists what is in it
+	ArchiveModeTarball = "tarball"
+)
+
+// ArchiveRestoreLatest restores the most recent snapshot.
+const ArchiveRestoreLatest = "latest"
+
+// An ArchiveConfig chooses where roving-srv archives its workdir,
+// how often, how, and for how long. `Mode` is one of
+// ArchiveModeSnapshot (the default), ArchiveModeCopy or
+// ArchiveModeTarball. If `Restore` is set then roving-srv restores
+// its workdir from a snapshot before it starts serving. It is either
+// ArchiveRestoreLatest or the timestamp of a snapshot. Restoring into
+// a workdir that already has files in it is refused, unless
+// `RestoreForce` is set.
+//
+// `Type`, `Interval`, `Retention`, `Disk` and `S3` describe the main
+// destination, if there is one. `Destinations` are archived to as
+// well, each on its own schedule. `Encryption` applies to every
+// destination.
 type ArchiveConfig struct {
-	Type     string            `yaml:"type"`
-	Interval time.Duration     `yaml:"interval"`
-	Disk     DiskArchiveConfig `yaml:"disk"`
-	S3       S3ArchiveConfig   `yaml:"s3"`
+	Type         string                     `yaml:"type"`
+	Mode         string                     `yaml:"mode"`
+	Interval     time.Duration              `yaml:"interval"`
+	Retention    ArchiveRetentionConfig     `yaml:"retention"`
+	Restore      string                     `yaml:"restore"`
+	RestoreForce bool                       `yaml:"restore_force"`
+	Disk         DiskArchiveConfig          `yaml:"disk"`
+	S3           S3ArchiveConfig            `yaml:"s3"`
+	Destinations []ArchiveDestinationConfig `yaml:"destinations"`
+	Encryption   ArchiveEncryptionConfig    `yaml:"encryption"`
+	TmpDir       string                     `yaml:"tmp_dir"`
+}
+
+// AllDestinations returns every destination that roving-srv archives
+// to: the main destination, named after its type, and then
+// `Destinations`.
+func (r ArchiveConfig) AllDestinations() []ArchiveDestinationConfig {
+	destinations := make([]ArchiveDestinationConfig, 0, len(r.Destinations)+1)
+	if r.Type != "" {
+		destinations = append(destinations, ArchiveDestinationConfig{
+			Name:      r.Type,
+			Type:      r.Type,
+			Interval:  r.Interval,
+			Retention: r.Retention,
+			Disk:      r.Disk,
+			S3:        r.S3,
+		})
+	}
+	return append(destinations, r.Destinations...)
+}
+
+// Redacted returns a copy of the config with its secrets replaced, so
+// that it can be shown in the admin interface and API.
+func (r ArchiveConfig) Redacted() ArchiveConfig {
+	r.S3 = r.S3.Redacted()
+	r.Encryption = r.Encryption.Redacted()
+	r.Destinations = append([]ArchiveDestinationConfig(nil), r.Destinations...)
+	for i := range r.Destinations {
+		r.Destinations[i].S3 = r.Destinations[i].S3.Redacted()
+	}
+	return r
+}
+
+// An ArchiveDestinationConfig is one of the places that roving-srv
+// archives its workdir to. `Name` identifies it in logs, events and
+// the admin interface. `Type` is "disk" or "s3". The destination is
+// archived to every `Interval`, and pruned according to its own
+// `Retention`.
+type ArchiveDestinationConfig struct {
+	Name      string                 `yaml:"name"`
+	Type      string                 `yaml:"type"`
+	Interval  time.Duration          `yaml:"interval"`
+	Retention ArchiveRetentionConfig `yaml:"retention"`
+	Disk      DiskArchiveConfig      `yaml:"disk"`
+	S3        S3ArchiveConfig        `yaml:"s3"`
+}
+
+func (r *ArchiveDestinationConfig) validate() error {
+	if r.Name == "" {
+		return errors.New("Must specify a name for every archive destination!")
+	}
+	if r.Type == "" {
+		return fmt.Errorf("Must specify a type for archive destination %s!", r.Name)
+	}
+	if r.Interval <= 0 {
+		return fmt.Errorf("Must specify an interval for archive destination %s!", r.Name)
+	}
+	if err := validateArchiveType(r.Type, &r.Disk, &r.S3); err != nil {
+		return err
+	}
+	return r.Retention.validate()
+}
+
+// validateArchiveType checks the settings that an archive of type
+// `archiveType` needs.
+func validateArchiveType(archiveType string, disk *DiskArchiveConfig, s3 *S3ArchiveConfig) error {
+	switch archiveType {
+	case "disk":
+		if disk.DstRoot == "" {
+			return errors.New("Must specify dst_root if archiving to disk!")
+		}
+	case "s3":
+		return s3.validate()
+	case "":
+	default:
+		return fmt.Errorf("Unrecognized archive type: %s", archiveType)
+	}
+	return nil
+}
+
+// ParseArchiveDestination parses an archive destination from a
+// comma-separated list of key=value settings, such as
+// "name=local,type=disk,disk-root=/mnt/roving,interval=10m,keep-last=24".
+// An S3 destination's settings start out as `s3Defaults`, so that it
+// can share credentials and the like with the main destination.
+func ParseArchiveDestination(spec string, s3Defaults S3ArchiveConfig) (ArchiveDestinationConfig, error) {
+	dst := ArchiveDestinationConfig{S3: s3Defaults}
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return ArchiveDestinationConfig{}, fmt.Errorf("Invalid archive destination setting: %s", setting)
+		}
+		key, value := parts[0], parts[1]
+
+		var err error
+		switch key {
+		case "name":
+			dst.Name = value
+		case "type":
+			dst.Type = value
+		case "interval":
+			dst.Interval, err = time.ParseDuration(value)
+		case "keep-last":
+			dst.Retention.KeepLast, err = strconv.Atoi(value)
+		case "keep-hourly":
+			dst.Retention.KeepHourly, err = strconv.Atoi(value)
+		case "keep-daily":
+			dst.Retention.KeepDaily, err = strconv.Atoi(value)
+		case "keep-weekly":
+			dst.Retention.KeepWeekly, err = strconv.Atoi(value)
+		case "prune-dry-run":
+			dst.Retention.DryRun, err = strconv.ParseBool(value)
+		case "disk-root":
+			dst.Disk.DstRoot = value
+		case "s3-bucket":
+			dst.S3.BucketName = value
+		case "s3-root-key":
+			dst.S3.RootKey = value
+		case "s3-region":
+			dst.S3.AwsRegion = value
+		case "s3-endpoint":
+			dst.S3.Endpoint = value
+		case "s3-path-style":
+			dst.S3.PathStyle, err = strconv.ParseBool(value)
+		case "s3-profile":
+			dst.S3.Profile = value
+		case "s3-sse":
+			dst.S3.SSE = value
+		case "s3-sse-kms-key-id":
+			dst.S3.SSEKMSKeyId = value
+		default:
+			return ArchiveDestinationConfig{}, fmt.Errorf("Unrecognized archive destination setting: %s", key)
+		}
+		if err != nil {
+			return ArchiveDestinationConfig{}, fmt.Errorf("Invalid archive destination setting %s: %v", setting, err)
+		}
+	}
+	return dst, nil
+}
+
+// An ArchiveRetentionConfig chooses which archives roving-srv keeps.
+// It keeps the `KeepLast` most recent archives, plus the most recent
+// archive in each of the last `KeepHourly` hours, `KeepDaily` days
+// and `KeepWeekly` weeks that have one. Everything else is pruned
+// after each archive run. If every field is 0 then nothing is ever
+// pruned. If `DryRun` then roving-srv only reports what it would
+// prune.
+type ArchiveRetentionConfig struct {
+	KeepLast   int  `yaml:"keep_last"`
+	KeepHourly int  `yaml:"keep_hourly"`
+	KeepDaily  int  `yaml:"keep_daily"`
+	KeepWeekly int  `yaml:"keep_weekly"`
+	DryRun     bool `yaml:"dry_run"`
+}
+
+// Enabled returns whether archives are ever pruned.
+func (r ArchiveRetentionConfig) Enabled() bool {
+	return r.KeepLast > 0 || r.KeepHourly > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0
+}
+
+func (r *ArchiveRetentionConfig) validate() error {
+	if r.KeepLast < 0 || r.KeepHourly < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 {
+		return errors.New("Must specify keep_last, keep_hourly, keep_daily and keep_weekly >= 0!")
+	}
+	return nil
+}
+
+// The size of the keys that archives are encrypted with, in bytes.
+const ArchiveEncryptionKeySize = 32
+
+// An ArchiveEncryptionConfig chooses the key that roving-srv encrypts
+// archived files with before they leave the server. The key is 32
+// bytes, written as 64 hex chars, and is read from `KeyFile` or given
+// as `Key`. Archives aren't encrypted if neither is set.
+//
+// Once archives are encrypted, files that aren't are refused when they
+// are read, since anyone who can write to the archive could otherwise
+// replace an encrypted file with a plaintext one. `AllowPlaintext`
+// reads them anyway, for archives that were started before they were
+// encrypted.
+type ArchiveEncryptionConfig struct {
+	KeyFile        string `yaml:"key_file"`
+	Key            string `yaml:"key"`
+	AllowPlaintext bool   `yaml:"allow_plaintext"`
+}
+
+// Enabled returns whether archives are encrypted.
+func (r ArchiveEncryptionConfig) Enabled() bool {
+	return r.KeyFile != "" || r.Key != ""
+}
+
+// Redacted returns a copy of the config with its key replaced.
+func (r ArchiveEncryptionConfig) Redacted() ArchiveEncryptionConfig {
+	if r.Key != "" {
+		r.Key = redactedValue
+	}
+	return r
+}
+
+// LoadKey returns the key that the config chooses, reading it from
+// `KeyFile` if it is set.
+func (r ArchiveEncryptionConfig) LoadKey() ([]byte, error) {
+	encoded := r.Key
+	if r.KeyFile != "" {
+		buf, err := ioutil.ReadFile(r.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(buf)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ArchiveEncryptionKeySize {
+		return nil, fmt.Errorf("The archive encryption key must be %d bytes, written as %d hex chars", ArchiveEncryptionKeySize, 2*ArchiveEncryptionKeySize)
+	}
+	return key, nil
+}
+
+func (r *ArchiveEncryptionConfig) validate() error {
+	if r.KeyFile != "" && r.Key != "" {
+		return errors.New("Can only specify one of an archive encryption key_file and key")
+	}
+	if r.Enabled() {
+		if _, err := r.LoadKey(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type DiskArchiveConfig struct {
 	DstRoot string `yaml:"dst_root"`
 }
 
+// The server-side encryption that S3 can apply to archived files.
+const (
+	S3SSEAES256 = "AES256"
+	S3SSEKMS    = "aws:kms"
+)
+
+// An S3ArchiveConfig chooses where in S3, or in an S3-compatible store
+// such as MinIO or Ceph, roving-srv archives its workdir.
+//
+// `Endpoint` is the URL of the store, if it isn't AWS. Most
+// S3-compatible stores also need `PathStyle`, which addresses buckets
+// as ENDPOINT/BUCKET rather than BUCKET.ENDPOINT. If `AccessKeyId` and
+// `SecretAccessKey` aren't set then credentials come from the AWS
+// SDK's usual places: the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// env vars, then `Profile` (or the default profile) in the shared
+// credentials file, then the instance's role. `SSE` is the
+// server-side encryption to ask for, if any: S3SSEAES256 or S3SSEKMS,
+// with `SSEKMSKeyId` choosing a KMS key other than the default.
 type S3ArchiveConfig struct {
 	RootKey    string `yaml:"root_key"`
 	BucketName string `yaml:"bucket_name"`
 	AwsRegion  string `yaml:"aws_region"`
 	IsLocal    bool   `yaml:"is_local"`
+
+	Endpoint        string `yaml:"endpoint"`
+	PathStyle       bool   `yaml:"path_style"`
+	AccessKeyId     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	Profile         string `yaml:"profile"`
+	SSE             string `yaml:"sse"`
+	SSEKMSKeyId     string `yaml:"sse_kms_key_id"`
+}
+
+// The value that Redacted replaces secrets with.
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of the config with its secret access key
+// replaced.
+func (r S3ArchiveConfig) Redacted() S3ArchiveConfig {
+	if r.SecretAccessKey != "" {
+		r.SecretAccessKey = redactedValue
+	}
+	return r
+}
+
+func (r *S3ArchiveConfig) validate() error {
+	if r.RootKey == "" {
+		return errors.New("Must specify root_key if archiving to S3!")
+	}
+	if r.BucketName == "" {
+		return errors.New("Must specify bucket_name if archiving to S3!")
+	}
+	if r.AwsRegion == "" {
+		// S3-compatible stores generally don't care about the
+		// region, but the AWS SDK won't sign requests without one.
+		if r.Endpoint == "" {
+			return errors.New("Must specify aws_region if archiving to S3!")
+		}
+		r.AwsRegion = "us-east-1"
+	}
+	if r.Endpoint != "" {
+		u, err := url.Parse(r.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Invalid S3 endpoint: %s", r.Endpoint)
+		}
+	}
+	if (r.AccessKeyId == "") != (r.SecretAccessKey == "") {
+		return errors.New("Must specify both or neither of access_key_id and secret_access_key!")
+	}
+	if r.AccessKeyId != "" && r.Profile != "" {
+		return errors.New("Can only specify profile if access_key_id is not set")
+	}
+	switch r.SSE {
+	case "", S3SSEAES256:
+		if r.SSEKMSKeyId != "" {
+			return fmt.Errorf("Can only specify sse_kms_key_id if sse is %s", S3SSEKMS)
+		}
+	case S3SSEKMS:
+	default:
+		return fmt.Errorf("Unrecognized S3 server-side encryption: %s", r.SSE)
+	}
+	return nil
+}
+
+// A HangConfirmConfig controls how roving-srv re-runs the hangs that
+// clients report. Hangs are re-run `Runs` times with a timeout of
+// `TimeoutMultiplier` times the fuzzer's own timeout, and only hangs
+// that time out every time are treated as confirmed.
+type HangConfirmConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	Interval          time.Duration `yaml:"interval"`
+	Runs              int           `yaml:"runs"`
+	TimeoutMultiplier int           `yaml:"timeout_multiplier"`
+}
+
+// A MetricsConfig chooses where roving-srv or roving-client sends its
+// metrics. `Sink` is one of "veneur" (the default), "statsd", "log" or
+// "none".
+type MetricsConfig struct {
+	Sink       string `yaml:"sink"`
+	StatsdAddr string `yaml:"statsd_addr"`
+	// StatsdTags sends tags to statsd using the DogStatsD extension.
+	StatsdTags bool `yaml:"statsd_tags"`
+}
+
+func (r *MetricsConfig) validate() error {
+	switch r.Sink {
+	case "":
+		r.Sink = "veneur"
+	case "veneur", "log", "none":
+	case "statsd":
+		if r.StatsdAddr == "" {
+			return errors.New("Must specify statsd_addr if sending metrics to statsd!")
+		}
+	default:
+		return fmt.Errorf("Unrecognized metrics sink: %s", r.Sink)
+	}
+	return nil
+}
+
+// An ErrorsConfig chooses where roving-srv or roving-client reports
+// errors. `Reporter` is one of "sentry" (the default), "log" or "none".
+// If `SentryDSN` is empty, Sentry's DSN is read from the SENTRY_DSN
+// environment variable. Every error is tagged with `Campaign`, if it is
+// set, so that errors from different fuzzing campaigns can be told
+// apart.
+type ErrorsConfig struct {
+	Reporter  string `yaml:"reporter"`
+	SentryDSN string `yaml:"sentry_dsn"`
+	Campaign  string `yaml:"campaign"`
+}
+
+func (r *ErrorsConfig) validate() error {
+	switch r.Reporter {
+	case "":
+		r.Reporter = "sentry"
+	case "sentry", "log", "none":
+	default:
+		return fmt.Errorf("Unrecognized error reporter: %s", r.Reporter)
+	}
+	return nil
+}
+
+// A NodesConfig sets how long a fuzzer can go without sending its
+// state before roving-srv considers it stale, then lost, then
+// retired. Retired fuzzers are forgotten, except for a record of
+// their lifecycle. The server checks every `CheckInterval`.
+//
+// `QueueRetention` is how long the queue of a retired fuzzer is kept
+// and served to clients. After that its unique queue entries are
+// folded into the shared retired corpus, and its output dir is
+// archived and removed.
+type NodesConfig struct {
+	StaleAfter     time.Duration `yaml:"stale_after"`
+	LostAfter      time.Duration `yaml:"lost_after"`
+	RetireAfter    time.Duration `yaml:"retire_after"`
+	QueueRetention time.Duration `yaml:"queue_retention"`
+	CheckInterval  time.Duration `yaml:"check_interval"`
+}
+
+func (r *NodesConfig) validate() error {
+	if r.StaleAfter <= 0 {
+		r.StaleAfter = 15 * time.Minute
+	}
+	if r.LostAfter <= 0 {
+		r.LostAfter = 1 * time.Hour
+	}
+	if r.RetireAfter <= 0 {
+		r.RetireAfter = 24 * time.Hour
+	}
+	if r.QueueRetention <= 0 {
+		r.QueueRetention = 7 * 24 * time.Hour
+	}
+	if r.CheckInterval <= 0 {
+		r.CheckInterval = 1 * time.Minute
+	}
+
+	if r.StaleAfter >= r.LostAfter || r.LostAfter >= r.RetireAfter {
+		return errors.New("Must specify stale_after < lost_after < retire_after!")
+	}
+	return nil
+}
+
+// The events that roving-srv can send to webhooks.
+const (
+	// A fuzzer found a crash that had not been archived before
+	WebhookCrashNew = "crash.new"
+	// The server received the first state from a fuzzer
+	WebhookNodeJoined = "node.joined"
+	// The Reaper removed a fuzzer that had stopped sending states
+	WebhookNodeReaped = "node.reaped"
+	// A scheduled archive of the workdir failed
+	WebhookArchiveFailed = "archive.failed"
+)
+
+var WebhookEvents = []string{WebhookCrashNew, WebhookNodeJoined, WebhookNodeReaped, WebhookArchiveFailed}
+
+// A WebhookConfig lists the URLs that roving-srv POSTs events to.
+// Failed deliveries are retried up to `MaxAttempts` times, waiting
+// `RetryInterval` after the first failure and twice as long after
+// each failure after that.
+type WebhookConfig struct {
+	URLs []string `yaml:"urls"`
+	// Events restricts the events that are sent to those listed. If
+	// it is empty then every event is sent.
+	Events        []string      `yaml:"events"`
+	MaxAttempts   int           `yaml:"max_attempts"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+func (r *WebhookConfig) validate() error {
+	for _, u := range r.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("Webhook URLs must be http or https: %s", u)
+		}
+	}
+
+	for _, event := range r.Events {
+		known := false
+		for _, e := range WebhookEvents {
+			if event == e {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("Unrecognized webhook event: %s", event)
+		}
+	}
+
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = 5
+	}
+	if r.RetryInterval <= 0 {
+		r.RetryInterval = 10 * time.Second
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = 10 * time.Second
+	}
+	return nil
 }
 
 func (r *ServerConfig) ValidateConfig() error {
@@ -59,29 +575,79 @@ func (r *ServerConfig) ValidateConfig() error {
 		return errors.New("Must specify workdir!")
 	}
 
+	if r.DatabasePath == "" {
+		r.DatabasePath = filepath.Join(r.Workdir, "roving.db")
+	}
+
 	if r.Fuzzer.UseBinary && len(r.Fuzzer.Command) > 0 {
 		return errors.New("Can only specify target_command if binary_path is not set")
 	}
 
-	switch r.Archive.Type {
-	case "disk":
-		archiveDst := r.Archive.Disk.DstRoot
-		if archiveDst == "" {
-			log.Fatal("Must specify dst_root if archiving to disk!")
-		}
-	case "s3":
-		if r.Archive.S3.RootKey == "" {
-			return errors.New("Must specify root_key if archiving to S3!")
-		}
-		if r.Archive.S3.BucketName == "" {
-			return errors.New("Must specify bucket_name if archiving to S3!")
+	if err = validateArchiveType(r.Archive.Type, &r.Archive.Disk, &r.Archive.S3); err != nil {
+		return err
+	}
+	names := map[string]bool{r.Archive.Type: r.Archive.Type != ""}
+	for i := range r.Archive.Destinations {
+		dst := &r.Archive.Destinations[i]
+		if err = dst.validate(); err != nil {
+			return err
 		}
-		if r.Archive.S3.AwsRegion == "" {
-			return errors.New("Must specify aws_region if archiving to S3!")
+		if names[dst.Name] {
+			return fmt.Errorf("Archive destination names must be unique: %s", dst.Name)
 		}
+		names[dst.Name] = true
+	}
+
+	switch r.Archive.Mode {
 	case "":
+		r.Archive.Mode = ArchiveModeSnapshot
+	case ArchiveModeSnapshot, ArchiveModeCopy, ArchiveModeTarball:
 	default:
-		log.Fatalf("Unrecognized archive type: %s", r.Archive.Type)
+		return fmt.Errorf("Unrecognized archive mode: %s", r.Archive.Mode)
+	}
+	if err = r.Archive.Retention.validate(); err != nil {
+		return err
+	}
+	if err = r.Archive.Encryption.validate(); err != nil {
+		return err
+	}
+	if r.Archive.Restore != "" {
+		if len(r.Archive.AllDestinations()) == 0 {
+			return errors.New("Must specify an archive type to restore from!")
+		}
+		if r.Archive.Restore != ArchiveRestoreLatest {
+			if _, err = strconv.ParseInt(r.Archive.Restore, 10, 64); err != nil {
+				return fmt.Errorf("Unrecognized snapshot to restore: %s", r.Archive.Restore)
+			}
+		}
+	}
+
+	if err = r.Metrics.validate(); err != nil {
+		return err
+	}
+
+	if err = r.Errors.validate(); err != nil {
+		return err
+	}
+
+	if err = r.Webhooks.validate(); err != nil {
+		return err
+	}
+
+	if err = r.Nodes.validate(); err != nil {
+		return err
+	}
+
+	if r.HangConfirm.Enabled {
+		if r.HangConfirm.Runs < 1 {
+			return errors.New("Must specify at least 1 run if confirming hangs!")
+		}
+		if r.HangConfirm.TimeoutMultiplier < 2 {
+			return errors.New("Must specify a timeout_multiplier of at least 2 if confirming hangs!")
+		}
+		if r.HangConfirm.Interval <= 0 {
+			return errors.New("Must specify interval if confirming hangs!")
+		}
 	}
 
 	return nil
@@ -90,6 +656,13 @@ func (r *ServerConfig) ValidateConfig() error {
 // makePathsAbsolute converts paths that were specified relative to the
 // current working directory to absolute paths.
 func (r *ServerConfig) makePathsAbsolute() error {
+	if r.Archive.Encryption.KeyFile != "" {
+		absKeyFile, err := filepath.Abs(r.Archive.Encryption.KeyFile)
+		if err != nil {
+			return err
+		}
+		r.Archive.Encryption.KeyFile = absKeyFile
+	}
 	if r.Archive.Type == "disk" {
 		absDst, err := filepath.Abs(r.Archive.Disk.DstRoot)
 		if err != nil {
@@ -97,6 +670,15 @@ func (r *ServerConfig) makePathsAbsolute() error {
 		}
 		r.Archive.Disk.DstRoot = absDst
 	}
+	for i, dst := range r.Archive.Destinations {
+		if dst.Type == "disk" && dst.Disk.DstRoot != "" {
+			absDst, err := filepath.Abs(dst.Disk.DstRoot)
+			if err != nil {
+				return err
+			}
+			r.Archive.Destinations[i].Disk.DstRoot = absDst
+		}
+	}
 
 	if r.Workdir != "" {
 		workdir, err := filepath.Abs(r.Workdir)
@@ -106,14 +688,24 @@ func (r *ServerConfig) makePathsAbsolute() error {
 		r.Workdir = workdir
 	}
 
+	if r.DatabasePath != "" {
+		databasePath, err := filepath.Abs(r.DatabasePath)
+		if err != nil {
+			return err
+		}
+		r.DatabasePath = databasePath
+	}
+
 	return nil
 }
 
 // A ClientConfig is loaded from a config file on the client itself,
 // unlike FuzzerConfig.
 type ClientConfig struct {
-	ServerAddress string `yaml:"server_address"`
-	Parallelism   int    `yaml:"parallelism"`
+	ServerAddress string        `yaml:"server_address"`
+	Parallelism   int           `yaml:"parallelism"`
+	Metrics       MetricsConfig `yaml:"metrics"`
+	Errors        ErrorsConfig  `yaml:"errors"`
 }
 
 func (r *ClientConfig) ValidateConfig() error {
@@ -124,7 +716,11 @@ func (r *ClientConfig) ValidateConfig() error {
 		return errors.New("Must specify server_address")
 	}
 
-	return nil
+	if err := r.Metrics.validate(); err != nil {
+		return err
+	}
+
+	return r.Errors.validate()
 }
 
 // canonicalizeServerAddress ensures that the server address has
@@ -0,0 +1,200 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookConfigValidation(t *testing.T) {
+	conf := WebhookConfig{URLs: []string{"https://example.com/hook"}}
+	assert.Nil(t, conf.validate())
+	assert.Equal(t, 5, conf.MaxAttempts)
+	assert.Equal(t, 10*time.Second, conf.RetryInterval)
+
+	conf = WebhookConfig{URLs: []string{"ftp://example.com/hook"}}
+	assert.NotNil(t, conf.validate())
+
+	conf = WebhookConfig{Events: []string{WebhookCrashNew, "crash.old"}}
+	assert.NotNil(t, conf.validate())
+}
+
+func TestNodesConfigValidation(t *testing.T) {
+	conf := NodesConfig{}
+	assert.Nil(t, conf.validate())
+	assert.Equal(t, 15*time.Minute, conf.StaleAfter)
+	assert.Equal(t, 1*time.Hour, conf.LostAfter)
+	assert.Equal(t, 24*time.Hour, conf.RetireAfter)
+	assert.Equal(t, 7*24*time.Hour, conf.QueueRetention)
+
+	conf = NodesConfig{StaleAfter: 2 * time.Hour}
+	assert.NotNil(t, conf.validate())
+}
+
+func TestArchiveModeValidation(t *testing.T) {
+	conf := ServerConfig{Workdir: "/tmp/roving"}
+	assert.Nil(t, conf.ValidateConfig())
+	assert.Equal(t, ArchiveModeSnapshot, conf.Archive.Mode)
+
+	conf = ServerConfig{Workdir: "/tmp/roving", Archive: ArchiveConfig{Mode: "zip"}}
+	assert.NotNil(t, conf.ValidateConfig())
+}
+
+func TestArchiveRetentionConfigValidation(t *testing.T) {
+	conf := ArchiveRetentionConfig{}
+	assert.Nil(t, conf.validate())
+	assert.False(t, conf.Enabled())
+
+	conf = ArchiveRetentionConfig{KeepDaily: 7}
+	assert.Nil(t, conf.validate())
+	assert.True(t, conf.Enabled())
+
+	conf = ArchiveRetentionConfig{KeepLast: -1}
+	assert.NotNil(t, conf.validate())
+}
+
+func TestArchiveRestoreValidation(t *testing.T) {
+	archiveConf := ArchiveConfig{Type: "disk", Disk: DiskArchiveConfig{DstRoot: "/tmp/archive"}}
+	for _, restore := range []string{"", ArchiveRestoreLatest, "1500000000"} {
+		archiveConf.Restore = restore
+		conf := ServerConfig{Workdir: "/tmp/roving", Archive: archiveConf}
+		assert.Nil(t, conf.ValidateConfig())
+	}
+
+	archiveConf.Restore = "yesterday"
+	conf := ServerConfig{Workdir: "/tmp/roving", Archive: archiveConf}
+	assert.NotNil(t, conf.ValidateConfig())
+
+	conf = ServerConfig{Workdir: "/tmp/roving", Archive: ArchiveConfig{Restore: ArchiveRestoreLatest}}
+	assert.NotNil(t, conf.ValidateConfig())
+}
+
+func TestArchiveEncryptionConfigValidation(t *testing.T) {
+	key := strings.Repeat("ab", ArchiveEncryptionKeySize)
+	conf := ArchiveEncryptionConfig{Key: key}
+	assert.Nil(t, conf.validate())
+	loaded, err := conf.LoadKey()
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveEncryptionKeySize, len(loaded))
+	assert.Equal(t, redactedValue, conf.Redacted().Key)
+
+	conf = ArchiveEncryptionConfig{Key: "abab"}
+	assert.NotNil(t, conf.validate())
+
+	keyFile, err := ioutil.TempFile("", "roving-archive-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString(key + "\n")
+	keyFile.Close()
+
+	conf = ArchiveEncryptionConfig{KeyFile: keyFile.Name()}
+	assert.Nil(t, conf.validate())
+	conf.Key = key
+	assert.NotNil(t, conf.validate())
+
+	conf = ArchiveEncryptionConfig{KeyFile: "/nonexistent/roving-archive-key"}
+	assert.NotNil(t, conf.validate())
+}
+
+func TestS3ArchiveConfigValidation(t *testing.T) {
+	conf := S3ArchiveConfig{RootKey: "roving", BucketName: "bucket", AwsRegion: "us-west-2"}
+	assert.Nil(t, conf.validate())
+
+	// S3-compatible stores don't need a region
+	conf = S3ArchiveConfig{RootKey: "roving", BucketName: "bucket", Endpoint: "http://localhost:9000", PathStyle: true}
+	assert.Nil(t, conf.validate())
+	assert.Equal(t, "us-east-1", conf.AwsRegion)
+
+	conf = S3ArchiveConfig{RootKey: "roving", BucketName: "bucket", Endpoint: "localhost:9000"}
+	assert.NotNil(t, conf.validate())
+
+	conf = S3ArchiveConfig{RootKey: "roving", BucketName: "bucket", AwsRegion: "us-west-2", AccessKeyId: "AKIA"}
+	assert.NotNil(t, conf.validate())
+	conf.SecretAccessKey = "secret"
+	assert.Nil(t, conf.validate())
+	conf.Profile = "roving"
+	assert.NotNil(t, conf.validate())
+
+	conf = S3ArchiveConfig{RootKey: "roving", BucketName: "bucket", AwsRegion: "us-west-2", SSE: S3SSEKMS, SSEKMSKeyId: "key"}
+	assert.Nil(t, conf.validate())
+	conf.SSE = S3SSEAES256
+	assert.NotNil(t, conf.validate())
+	conf.SSE = "rot13"
+	assert.NotNil(t, conf.validate())
+}
+
+func TestArchiveConfigRedacted(t *testing.T) {
+	conf := ArchiveConfig{S3: S3ArchiveConfig{AccessKeyId: "AKIA", SecretAccessKey: "secret"}}
+	redacted := conf.Redacted()
+	assert.Equal(t, "AKIA", redacted.S3.AccessKeyId)
+	assert.Equal(t, redactedValue, redacted.S3.SecretAccessKey)
+	// The original is untouched
+	assert.Equal(t, "secret", conf.S3.SecretAccessKey)
+}
+
+func TestParseArchiveDestination(t *testing.T) {
+	dst, err := ParseArchiveDestination("name=local,type=disk,disk-root=/mnt/roving,interval=10m,keep-last=24", S3ArchiveConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, ArchiveDestinationConfig{
+		Name:      "local",
+		Type:      "disk",
+		Interval:  10 * time.Minute,
+		Retention: ArchiveRetentionConfig{KeepLast: 24},
+		Disk:      DiskArchiveConfig{DstRoot: "/mnt/roving"},
+	}, dst)
+
+	// S3 destinations share the main destination's S3 settings
+	defaults := S3ArchiveConfig{AwsRegion: "us-west-2", Profile: "roving"}
+	dst, err = ParseArchiveDestination("name=offsite,type=s3,s3-bucket=backups,s3-root-key=roving,interval=1h", defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, "backups", dst.S3.BucketName)
+	assert.Equal(t, "us-west-2", dst.S3.AwsRegion)
+	assert.Equal(t, "roving", dst.S3.Profile)
+
+	_, err = ParseArchiveDestination("name=local,colour=blue", S3ArchiveConfig{})
+	assert.NotNil(t, err)
+	_, err = ParseArchiveDestination("name=local,interval=often", S3ArchiveConfig{})
+	assert.NotNil(t, err)
+}
+
+func TestArchiveDestinationsValidation(t *testing.T) {
+	local := ArchiveDestinationConfig{Name: "local", Type: "disk", Interval: time.Hour, Disk: DiskArchiveConfig{DstRoot: "/tmp/archive"}}
+	conf := ServerConfig{
+		Workdir: "/tmp/roving",
+		Archive: ArchiveConfig{
+			Type:         "disk",
+			Interval:     time.Hour,
+			Disk:         DiskArchiveConfig{DstRoot: "/tmp/main"},
+			Destinations: []ArchiveDestinationConfig{local},
+		},
+	}
+	assert.Nil(t, conf.ValidateConfig())
+	destinations := conf.Archive.AllDestinations()
+	assert.Equal(t, 2, len(destinations))
+	assert.Equal(t, "disk", destinations[0].Name)
+	assert.Equal(t, "local", destinations[1].Name)
+
+	// Names must be unique, including the main destination's
+	local.Name = "disk"
+	conf.Archive.Destinations = []ArchiveDestinationConfig{local}
+	assert.NotNil(t, conf.ValidateConfig())
+
+	local.Name = "local"
+	local.Interval = 0
+	conf.Archive.Destinations = []ArchiveDestinationConfig{local}
+	assert.NotNil(t, conf.ValidateConfig())
+
+	// Extra destinations are enough to restore from
+	local.Interval = time.Hour
+	conf = ServerConfig{
+		Workdir: "/tmp/roving",
+		Archive: ArchiveConfig{Restore: ArchiveRestoreLatest, Destinations: []ArchiveDestinationConfig{local}},
+	}
+	assert.Nil(t, conf.ValidateConfig())
+}
@@ -0,0 +1,136 @@
+package types
+
+import (
+	"fmt"
+	"log"
+
+	raven "github.com/getsentry/raven-go"
+)
+
+// ErrorReporter is somewhere that roving-srv and roving-client can
+// report errors to, along with tags describing where they happened.
+// Reporters must be safe for concurrent use.
+type ErrorReporter interface {
+	// Report reports `err` without waiting for it to be delivered.
+	Report(err error, tags map[string]string)
+	// ReportAndWait reports `err` and waits for it to be delivered.
+	// Use it before exiting.
+	ReportAndWait(err error, tags map[string]string)
+}
+
+// The reporter that ReportError and ReportErrorAndWait report errors
+// to. It defaults to Sentry, configured from the environment, for
+// backwards compatibility.
+var errorReporter ErrorReporter = SentryReporter{}
+
+// SetErrorReporter sets the reporter that all errors are reported to.
+// It should be called once at startup, before any errors are
+// reported.
+func SetErrorReporter(reporter ErrorReporter) {
+	errorReporter = reporter
+}
+
+func ReportError(err error, tags map[string]string) {
+	errorReporter.Report(err, tags)
+}
+
+func ReportErrorAndWait(err error, tags map[string]string) {
+	errorReporter.ReportAndWait(err, tags)
+}
+
+// NewErrorReporter builds the reporter described by `conf`. Every
+// error is tagged with `service`, eg. "roving-srv", and with the
+// campaign if there is one.
+func NewErrorReporter(conf ErrorsConfig, service string) (ErrorReporter, error) {
+	var reporter ErrorReporter
+	switch conf.Reporter {
+	case "sentry", "":
+		sentry, err := NewSentryReporter(conf.SentryDSN)
+		if err != nil {
+			return nil, err
+		}
+		reporter = sentry
+	case "log":
+		reporter = LogReporter{}
+	case "none":
+		return NoopReporter{}, nil
+	default:
+		return nil, fmt.Errorf("Unrecognized error reporter: %s", conf.Reporter)
+	}
+
+	tags := map[string]string{"service": service}
+	if conf.Campaign != "" {
+		tags["campaign"] = conf.Campaign
+	}
+	return taggedReporter{reporter: reporter, tags: tags}, nil
+}
+
+// SentryReporter reports errors to Sentry, using raven's default
+// client.
+type SentryReporter struct{}
+
+// NewSentryReporter builds a SentryReporter. raven's client is global,
+// so if `dsn` is set this configures it. Otherwise raven reads the DSN
+// from the SENTRY_DSN environment variable, and drops errors if that
+// isn't set either.
+func NewSentryReporter(dsn string) (SentryReporter, error) {
+	if dsn != "" {
+		if err := raven.SetDSN(dsn); err != nil {
+			return SentryReporter{}, err
+		}
+	}
+	return SentryReporter{}, nil
+}
+
+func (r SentryReporter) Report(err error, tags map[string]string) {
+	raven.CaptureError(err, tags)
+}
+
+func (r SentryReporter) ReportAndWait(err error, tags map[string]string) {
+	raven.CaptureErrorAndWait(err, tags)
+}
+
+// LogReporter writes errors to the log, as a single line of
+// `key=value` pairs.
+type LogReporter struct{}
+
+func (r LogReporter) Report(err error, tags map[string]string) {
+	log.Printf("error err=%q %s", err, formatTags(tags, "=", " "))
+}
+
+func (r LogReporter) ReportAndWait(err error, tags map[string]string) {
+	r.Report(err, tags)
+}
+
+// NoopReporter throws errors away.
+type NoopReporter struct{}
+
+func (r NoopReporter) Report(err error, tags map[string]string) {}
+
+func (r NoopReporter) ReportAndWait(err error, tags map[string]string) {}
+
+// taggedReporter adds `tags` to every error reported to `reporter`.
+// Tags given when the error is reported win.
+type taggedReporter struct {
+	reporter ErrorReporter
+	tags     map[string]string
+}
+
+func (r taggedReporter) merge(tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(r.tags)+len(tags))
+	for k, v := range r.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (r taggedReporter) Report(err error, tags map[string]string) {
+	r.reporter.Report(err, r.merge(tags))
+}
+
+func (r taggedReporter) ReportAndWait(err error, tags map[string]string) {
+	r.reporter.ReportAndWait(err, r.merge(tags))
+}
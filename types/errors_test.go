@@ -0,0 +1,71 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingReporter remembers the tags of the last error reported to
+// it.
+type recordingReporter struct {
+	tags map[string]string
+}
+
+func (r *recordingReporter) Report(err error, tags map[string]string) {
+	r.tags = tags
+}
+
+func (r *recordingReporter) ReportAndWait(err error, tags map[string]string) {
+	r.tags = tags
+}
+
+func TestTaggedReporter(t *testing.T) {
+	inner := &recordingReporter{}
+	reporter := taggedReporter{
+		reporter: inner,
+		tags:     map[string]string{"service": "roving-srv", "campaign": "libpng"},
+	}
+
+	reporter.Report(errors.New("oops"), map[string]string{"fuzzer_id": "host-1234"})
+	assert.Equal(t, map[string]string{"service": "roving-srv", "campaign": "libpng", "fuzzer_id": "host-1234"}, inner.tags)
+
+	reporter.ReportAndWait(errors.New("oops"), map[string]string{"campaign": "override"})
+	assert.Equal(t, map[string]string{"service": "roving-srv", "campaign": "override"}, inner.tags)
+
+	reporter.Report(errors.New("oops"), nil)
+	assert.Equal(t, map[string]string{"service": "roving-srv", "campaign": "libpng"}, inner.tags)
+}
+
+func TestLogReporter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	reporter, err := NewErrorReporter(ErrorsConfig{Reporter: "log", Campaign: "libpng"}, "roving-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.Report(errors.New("no such file"), map[string]string{"fuzzer_id": "host-1234"})
+
+	assert.Contains(t, buf.String(), `error err="no such file" campaign=libpng fuzzer_id=host-1234 service=roving-client`)
+}
+
+func TestErrorsConfigValidation(t *testing.T) {
+	conf := ErrorsConfig{}
+	assert.Nil(t, conf.validate())
+	assert.Equal(t, "sentry", conf.Reporter)
+
+	conf = ErrorsConfig{Reporter: "carrier-pigeon"}
+	assert.NotNil(t, conf.validate())
+	_, err := NewErrorReporter(conf, "roving-srv")
+	assert.NotNil(t, err)
+
+	reporter, err := NewErrorReporter(ErrorsConfig{Reporter: "none"}, "roving-srv")
+	assert.Nil(t, err)
+	assert.Equal(t, NoopReporter{}, reporter)
+}
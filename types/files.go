@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -167,7 +168,9 @@ func (m AflFileManager) InputPath(inputType, inputName string) (string, error) {
 		return "", err
 	}
 
-	err = validateInputName(inputName)
+	if err = validateInputName(inputName); err != nil {
+		return "", err
+	}
 	return filepath.Join(inputDir, inputName), nil
 }
 
@@ -180,6 +183,90 @@ func (m AflFileManager) ReadFuzzerStats() (*FuzzerStats, error) {
 	return ParseStats(string(buf))
 }
 
+// InputNames returns the names of all inputs of the given type,
+// without reading their bodies.
+func (m AflFileManager) InputNames(inputType string) ([]string, error) {
+	infos, err := m.ListInputs(inputType)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names, nil
+}
+
+// ListInputs returns metadata about all inputs of the given type,
+// without reading their bodies.
+func (m AflFileManager) ListInputs(inputType string) ([]InputInfo, error) {
+	dir, err := m.corpusDir(inputType)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []InputInfo{}, nil
+		}
+		return nil, err
+	}
+
+	infos := make([]InputInfo, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || fileInfo.Name() == readmeFilename {
+			continue
+		}
+		infos = append(infos, InputInfo{
+			FuzzerId: m.fuzzerId,
+			Type:     inputType,
+			Name:     fileInfo.Name(),
+			Size:     fileInfo.Size(),
+			ModTime:  fileInfo.ModTime(),
+		})
+	}
+	return infos, nil
+}
+
+// ReadHangTriage reads the server's triage results for this fuzzer's
+// hangs. It returns a map from hang name => HangTriage, which is empty
+// if no hangs have been triaged yet.
+func (m AflFileManager) ReadHangTriage() (map[string]HangTriage, error) {
+	triage := make(map[string]HangTriage)
+
+	buf, err := ioutil.ReadFile(m.HangTriagePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return triage, nil
+		}
+		return nil, err
+	}
+
+	if err = json.Unmarshal(buf, &triage); err != nil {
+		return nil, err
+	}
+	return triage, nil
+}
+
+// WriteHangTriage replaces the server's triage results for this
+// fuzzer's hangs.
+func (m AflFileManager) WriteHangTriage(triage map[string]HangTriage) error {
+	buf, err := json.Marshal(triage)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see
+	// a half-written file.
+	tmpPath := m.HangTriagePath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.HangTriagePath())
+}
+
 func (m AflFileManager) MkAllOutputDirs() error {
 	var err error
 	if err = m.MkQueueDir(); err != nil {
@@ -226,6 +313,12 @@ func (m AflFileManager) FuzzerStatsPath() string {
 	return filepath.Join(m.OutputDir(), "fuzzer_stats")
 }
 
+// HangTriagePath is written by roving-srv only. AFL itself knows
+// nothing about it.
+func (m AflFileManager) HangTriagePath() string {
+	return filepath.Join(m.OutputDir(), "hang_triage.json")
+}
+
 // AFL uses a different directory structure for fuzzers
 // that have an ID. The input directory stays the same, but
 // output is stored in `./output/$ID/[queue]`, instead of
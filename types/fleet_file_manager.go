@@ -1,6 +1,7 @@
 package types
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -28,7 +29,8 @@ import (
 // │   │    │    ├── queue1
 // │   │    │    ├── queue2
 // │   │    │    └── queue3
-// │   │    └── fuzzer_stats
+// │   │    ├── fuzzer_stats
+// │   │    └── hang_triage.json (server only)
 // │   └── FUZZER_ID_456
 // │        ├── crashes/
 // │        ├── hangs/
@@ -43,6 +45,11 @@ type FleetFileManager struct {
 	Basedir string
 }
 
+// RetiredCorpusId is the fuzzer ID that the server keeps the shared
+// corpus of retired fuzzers' queue entries under. It is reserved, so
+// no fuzzer can have it.
+var RetiredCorpusId string = "retired"
+
 // WriteOutput writes the given AflOutput for the given fuzzerId to the
 // appropriate location
 func (m FleetFileManager) WriteOutput(fuzzerId string, output *AflOutput) error {
@@ -73,6 +80,39 @@ func (m FleetFileManager) ReadOutputs() (map[string]*AflOutput, error) {
 	return outputs, nil
 }
 
+// ListOutputs returns metadata about every queue entry, crash and hang
+// of every fuzzer in the fleet, without reading their bodies.
+func (m FleetFileManager) ListOutputs() ([]InputInfo, error) {
+	fuzzerIds, err := m.FuzzerIds()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]InputInfo, 0)
+	for _, fuzzerId := range fuzzerIds {
+		fuzzerInfos, err := m.ListFuzzerOutputs(fuzzerId)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fuzzerInfos...)
+	}
+	return infos, nil
+}
+
+// ListFuzzerOutputs returns metadata about every queue entry, crash and
+// hang of the given fuzzer, without reading their bodies.
+func (m FleetFileManager) ListFuzzerOutputs(fuzzerId string) ([]InputInfo, error) {
+	infos := make([]InputInfo, 0)
+	for _, inputType := range []string{Queue, Crashes, Hangs} {
+		typeInfos, err := m.aflFileManager(fuzzerId).ListInputs(inputType)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, typeInfos...)
+	}
+	return infos, nil
+}
+
 // FuzzerIds returns the IDs of all of the fuzzers in the fleet
 // with output saved to disk.
 func (m FleetFileManager) FuzzerIds() ([]string, error) {
@@ -181,6 +221,21 @@ func (m FleetFileManager) ReadQueues() (map[string]*InputCorpus, error) {
 	return queues, nil
 }
 
+// OutputDir returns the path of the given fuzzer's output dir
+func (m FleetFileManager) OutputDir(fuzzerId string) string {
+	return m.aflFileManager(fuzzerId).OutputDir()
+}
+
+// RemoveOutput removes the given fuzzer's output dir, and everything
+// in it. If the dir doesn't exist, it is a no-op
+func (m FleetFileManager) RemoveOutput(fuzzerId string) error {
+	// Without a fuzzerId we would remove every fuzzer's output
+	if fuzzerId == "" {
+		return errors.New("Can't remove the output of a fuzzer without an ID")
+	}
+	return os.RemoveAll(m.OutputDir(fuzzerId))
+}
+
 // ReadInput reads the given input from the given fuzzer
 func (m FleetFileManager) ReadInput(fuzzerId, inputType, inputName string) (*Input, error) {
 	return m.aflFileManager(fuzzerId).ReadInput(inputType, inputName)
@@ -191,6 +246,47 @@ func (m FleetFileManager) InputPath(fuzzerId, inputType, inputName string) (stri
 	return m.aflFileManager(fuzzerId).InputPath(inputType, inputName)
 }
 
+// InputNames returns the names of the given fuzzer's inputs of the
+// given type, without reading their bodies
+func (m FleetFileManager) InputNames(fuzzerId, inputType string) ([]string, error) {
+	return m.aflFileManager(fuzzerId).InputNames(inputType)
+}
+
+// HangPath returns the path for the given hang from the given fuzzer
+func (m FleetFileManager) HangPath(fuzzerId, name string) (string, error) {
+	return m.InputPath(fuzzerId, Hangs, name)
+}
+
+// ReadHangTriage reads the triage results for the given fuzzer's hangs
+func (m FleetFileManager) ReadHangTriage(fuzzerId string) (map[string]HangTriage, error) {
+	return m.aflFileManager(fuzzerId).ReadHangTriage()
+}
+
+// ReadAllHangTriage reads the triage results for the hangs of every
+// fuzzer in the fleet. It returns a map from fuzzerId => hang name =>
+// HangTriage.
+func (m FleetFileManager) ReadAllHangTriage() (map[string]map[string]HangTriage, error) {
+	fuzzerIds, err := m.FuzzerIds()
+	if err != nil {
+		return nil, err
+	}
+
+	triage := make(map[string]map[string]HangTriage)
+	for _, fuzzerId := range fuzzerIds {
+		fuzzerTriage, err := m.ReadHangTriage(fuzzerId)
+		if err != nil {
+			return nil, err
+		}
+		triage[fuzzerId] = fuzzerTriage
+	}
+	return triage, nil
+}
+
+// WriteHangTriage writes the triage results for the given fuzzer's hangs
+func (m FleetFileManager) WriteHangTriage(fuzzerId string, triage map[string]HangTriage) error {
+	return m.aflFileManager(fuzzerId).WriteHangTriage(triage)
+}
+
 // CrashPath returns the path for the given crash from the given fuzzer
 func (m FleetFileManager) CrashPath(fuzzerId, name string) (string, error) {
 	return m.InputPath(fuzzerId, Crashes, name)
@@ -139,3 +139,52 @@ func TestReadAndWriteQueues(t *testing.T) {
 
 	assert.Equal(t, queues, actualQueues)
 }
+
+func TestListOutputs(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "roving-fleet-file-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm := FleetFileManager{
+		Basedir: basedir,
+	}
+
+	aflOutput := AflOutput{
+		Queue: &InputCorpus{
+			Inputs: []Input{
+				Input{
+					Name: "queue1-1",
+					Body: []byte("queue1-1-body"),
+				},
+			},
+		},
+		Hangs: &InputCorpus{
+			Inputs: []Input{},
+		},
+		Crashes: &InputCorpus{
+			Inputs: []Input{
+				Input{
+					Name: "crash1-1",
+					Body: []byte("crash1-1-longer-body"),
+				},
+			},
+		},
+	}
+	fm.MkAllOutputDirs("fuzzer1")
+	fm.WriteOutput("fuzzer1", &aflOutput)
+
+	infos, err := fm.ListOutputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, "fuzzer1", infos[0].FuzzerId)
+	assert.Equal(t, Queue, infos[0].Type)
+	assert.Equal(t, "queue1-1", infos[0].Name)
+	assert.Equal(t, int64(len("queue1-1-body")), infos[0].Size)
+	assert.Equal(t, Crashes, infos[1].Type)
+	assert.Equal(t, "crash1-1", infos[1].Name)
+	assert.Equal(t, int64(len("crash1-1-longer-body")), infos[1].Size)
+}
@@ -0,0 +1,34 @@
+package types
+
+import (
+	"time"
+)
+
+// HangClassification is the verdict that roving-srv reaches about
+// a hang after re-running it with an extended timeout.
+type HangClassification string
+
+const (
+	// HangConfirmed means that the input timed out on every re-run,
+	// even with the extended timeout.
+	HangConfirmed HangClassification = "confirmed"
+	// HangSlow means that the input never timed out with the extended
+	// timeout, but always took longer than the fuzzer's own timeout.
+	HangSlow HangClassification = "slow"
+	// HangFlaky means that the input behaved inconsistently across
+	// re-runs, or finished within the fuzzer's own timeout. It most
+	// likely only timed out because the client was busy.
+	HangFlaky HangClassification = "flaky"
+)
+
+// HangTriage records the result of re-running a single hang. The
+// server stores one HangTriage per hang, keyed by the hang's name,
+// alongside the fuzzer's output.
+type HangTriage struct {
+	Classification HangClassification
+	Runs           int
+	TimedOut       int
+	MaxDurationMs  int64
+	TimeoutMs      int64
+	TriagedAt      time.Time
+}
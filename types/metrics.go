@@ -2,27 +2,167 @@ package types
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
 
-	"github.com/getsentry/raven-go"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
 	"github.com/stripe/veneur/trace/metrics"
 )
 
+// MetricsSink is somewhere that roving-srv and roving-client can send
+// their metrics. Sinks must be safe for concurrent use, and should
+// never block for long or fail loudly; losing a metric is better than
+// slowing down a fuzzer.
+type MetricsSink interface {
+	Count(name string, value float32, tags map[string]string)
+	Gauge(name string, value float32, tags map[string]string)
+}
+
+// The sink that SubmitMetricCount and SubmitMetricGauge send metrics
+// to. It defaults to veneur for backwards compatibility.
+var metricsSink MetricsSink = VeneurSink{}
+
+// SetMetricsSink sets the sink that all metrics are sent to. It should
+// be called once at startup, before any metrics are submitted.
+func SetMetricsSink(sink MetricsSink) {
+	metricsSink = sink
+}
+
 func SubmitMetricCount(name string, value float32, tags map[string]string) {
-	submitMetric(ssf.Count(name, value, tags))
+	metricsSink.Count(name, value, tags)
 }
 
 func SubmitMetricGauge(name string, value float32, tags map[string]string) {
-	submitMetric(ssf.Gauge(name, value, tags))
+	metricsSink.Gauge(name, value, tags)
+}
+
+// NewMetricsSink builds the sink described by `conf`. Every metric's
+// name is prefixed with `service`, eg. "roving-srv".
+func NewMetricsSink(conf MetricsConfig, service string) (MetricsSink, error) {
+	switch conf.Sink {
+	case "veneur", "":
+		return NewVeneurSink(service), nil
+	case "statsd":
+		sink, err := NewStatsdSink(conf.StatsdAddr, service, conf.StatsdTags)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case "log":
+		return LogSink{prefix: service + "."}, nil
+	case "none":
+		return NoopSink{}, nil
+	default:
+		return nil, fmt.Errorf("Unrecognized metrics sink: %s", conf.Sink)
+	}
+}
+
+// VeneurSink sends metrics to veneur over SSF, using veneur's default
+// client.
+type VeneurSink struct{}
+
+// NewVeneurSink builds a VeneurSink. veneur's client is global, so this
+// also names the service that is sending metrics.
+func NewVeneurSink(service string) VeneurSink {
+	trace.Service = service
+	ssf.NamePrefix = service + "."
+	return VeneurSink{}
 }
 
-func submitMetric(metric *ssf.SSFSample) {
+func (s VeneurSink) Count(name string, value float32, tags map[string]string) {
+	s.report(ssf.Count(name, value, tags))
+}
+
+func (s VeneurSink) Gauge(name string, value float32, tags map[string]string) {
+	s.report(ssf.Gauge(name, value, tags))
+}
+
+func (s VeneurSink) report(metric *ssf.SSFSample) {
 	err := metrics.ReportOne(trace.DefaultClient, metric)
 	if err != nil {
-		ts := metric.Tags
-		ts["metric_name"] = metric.Name
-		ts["metric_value"] = fmt.Sprintf("%f", metric.Value)
-		raven.CaptureError(err, ts)
+		log.Printf("Couldn't report metric to veneur name=%s value=%f err=%v", metric.Name, metric.Value, err)
+	}
+}
+
+// StatsdSink sends metrics to a statsd server over UDP. Plain statsd
+// doesn't support tags, so they are dropped unless `tags` is set, in
+// which case they are sent using the DogStatsD extension.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+// NewStatsdSink builds a StatsdSink that sends metrics to the statsd
+// server at `addr`, eg. "127.0.0.1:8125".
+func NewStatsdSink(addr, service string, tags bool) (*StatsdSink, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("Must specify statsd_addr if sending metrics to statsd!")
+	}
+	// Dialing UDP doesn't send anything, so this only fails if `addr`
+	// is invalid.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSink{conn: conn, prefix: service + ".", tags: tags}, nil
+}
+
+func (s *StatsdSink) Count(name string, value float32, tags map[string]string) {
+	s.send(name, value, "c", tags)
+}
+
+func (s *StatsdSink) Gauge(name string, value float32, tags map[string]string) {
+	s.send(name, value, "g", tags)
+}
+
+func (s *StatsdSink) send(name string, value float32, metricType string, tags map[string]string) {
+	line := fmt.Sprintf("%s%s:%g|%s", s.prefix, name, value, metricType)
+	if s.tags && len(tags) > 0 {
+		line += "|#" + formatTags(tags, ":", ",")
+	}
+
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		log.Printf("Couldn't send metric to statsd name=%s err=%v", name, err)
+	}
+}
+
+// LogSink writes metrics to the log. It is useful for debugging, and
+// for running roving without any metrics infrastructure.
+type LogSink struct {
+	prefix string
+}
+
+func (s LogSink) Count(name string, value float32, tags map[string]string) {
+	log.Printf("metric type=count name=%s%s value=%g %s", s.prefix, name, value, formatTags(tags, "=", " "))
+}
+
+func (s LogSink) Gauge(name string, value float32, tags map[string]string) {
+	log.Printf("metric type=gauge name=%s%s value=%g %s", s.prefix, name, value, formatTags(tags, "=", " "))
+}
+
+// NoopSink throws metrics away.
+type NoopSink struct{}
+
+func (s NoopSink) Count(name string, value float32, tags map[string]string) {}
+
+func (s NoopSink) Gauge(name string, value float32, tags map[string]string) {}
+
+// formatTags formats `tags` as `k1<sep>v1<delim>k2<sep>v2`, sorted by
+// key.
+func formatTags(tags map[string]string, sep, delim string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+sep+tags[k])
 	}
+	return strings.Join(pairs, delim)
 }
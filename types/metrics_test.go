@@ -0,0 +1,80 @@
+package types
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	readPacket := func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	tags := map[string]string{"fuzzer_id": "host-1234", "a": "b"}
+
+	sink, err := NewMetricsSink(MetricsConfig{Sink: "statsd", StatsdAddr: conn.LocalAddr().String()}, "roving-srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Count("archive_one.success", 1, tags)
+	assert.Equal(t, "roving-srv.archive_one.success:1|c", readPacket())
+	sink.Gauge("fuzzer.execs_per_sec", 12.5, tags)
+	assert.Equal(t, "roving-srv.fuzzer.execs_per_sec:12.5|g", readPacket())
+
+	sink, err = NewMetricsSink(MetricsConfig{Sink: "statsd", StatsdAddr: conn.LocalAddr().String(), StatsdTags: true}, "roving-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Gauge("fuzzer.paths_total", 3, tags)
+	assert.Equal(t, "roving-client.fuzzer.paths_total:3|g|#a:b,fuzzer_id:host-1234", readPacket())
+}
+
+func TestLogSink(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	sink, err := NewMetricsSink(MetricsConfig{Sink: "log"}, "roving-srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Count("reaped", 1, map[string]string{"id": "host-1234"})
+
+	assert.Contains(t, buf.String(), "metric type=count name=roving-srv.reaped value=1 id=host-1234")
+}
+
+func TestMetricsConfigValidation(t *testing.T) {
+	conf := MetricsConfig{}
+	assert.Nil(t, conf.validate())
+	assert.Equal(t, "veneur", conf.Sink)
+
+	conf = MetricsConfig{Sink: "statsd"}
+	assert.NotNil(t, conf.validate())
+
+	conf = MetricsConfig{Sink: "carrier-pigeon"}
+	assert.NotNil(t, conf.validate())
+	_, err := NewMetricsSink(conf, "roving-srv")
+	assert.NotNil(t, err)
+
+	sink, err := NewMetricsSink(MetricsConfig{Sink: "none"}, "roving-srv")
+	assert.Nil(t, err)
+	assert.Equal(t, NoopSink{}, sink)
+}
@@ -201,3 +201,34 @@ func ParseStats(stats string) (*FuzzerStats, error) {
 		CommandLine:   command_line,
 	}, nil
 }
+
+// NumericStats returns the numeric fields of a FuzzerStats as a map
+// keyed by their names in AFL's fuzzer_stats file. This is useful for
+// code that treats every stat in the same way, such as recording
+// their history.
+func (s FuzzerStats) NumericStats() map[string]float64 {
+	return map[string]float64{
+		"start_time":     float64(s.StartTime),
+		"last_update":    float64(s.LastUpdate),
+		"fuzzer_pid":     float64(s.FuzzerPid),
+		"cycles_done":    float64(s.CyclesDone),
+		"execs_done":     float64(s.ExecsDone),
+		"execs_per_sec":  s.ExecsPerSec,
+		"paths_total":    float64(s.PathsTotal),
+		"paths_favored":  float64(s.PathsFavored),
+		"paths_found":    float64(s.PathsFound),
+		"paths_imported": float64(s.PathsImported),
+		"max_depth":      float64(s.MaxDepth),
+		"cur_path":       float64(s.CurPath),
+		"pending_favs":   float64(s.PendingFavs),
+		"pending_total":  float64(s.PendingTotal),
+		"variable_paths": float64(s.VariablePaths),
+		"bitmap_cvg":     s.BitmapCvg,
+		"unique_crashes": float64(s.UniqueCrashes),
+		"unique_hangs":   float64(s.UniqueHangs),
+		"last_path":      float64(s.LastPath),
+		"last_crash":     float64(s.LastCrash),
+		"last_hang":      float64(s.LastHang),
+		"exec_timeout":   float64(s.ExecTimeout),
+	}
+}
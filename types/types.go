@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // State is a struct representing the current state of a fuzzer
@@ -43,6 +44,17 @@ type Input struct {
 	Body []byte
 }
 
+// InputInfo is metadata about an Input that has been saved to disk.
+// It is much cheaper to get than the Input itself, since it doesn't
+// require reading the Input's body.
+type InputInfo struct {
+	FuzzerId string
+	Type     string
+	Name     string
+	Size     int64
+	ModTime  time.Time
+}
+
 // WriteInputCorpusToFile writes each Input in the given
 // InputCorpus to a separate file.
 func WriteInputCorpusToFile(inputCorpus *InputCorpus, dir string) error {